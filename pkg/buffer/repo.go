@@ -0,0 +1,280 @@
+package buffer
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	eh "github.com/looplab/eventhorizon"
+
+	"github.com/eendLabs/eh-pg/pkg/worker"
+)
+
+// BatchSaver is a repo saving several entities in one round trip, like
+// repo.Repo with SaveAll.
+type BatchSaver interface {
+	SaveAll(ctx context.Context, entities []eh.Entity) error
+}
+
+// Config is the configuration of a Repo.
+type Config struct {
+	// FlushInterval is how often the buffered entities are flushed, 100ms
+	// by default.
+	FlushInterval time.Duration
+	// MaxSize is the number of buffered entities triggering a flush, 1000
+	// by default.
+	MaxSize int
+	// OnError is optionally called with the error and the entities of a
+	// failed flush, which are dropped from the buffer. The errors of the
+	// background flushes are also sent on the Errors channel of the
+	// FlushWorker, and logged if nobody is receiving.
+	OnError func(err error, entities []eh.Entity)
+	// Context is the root context of the background flushes, they stop when
+	// it is cancelled. context.Background() by default.
+	Context context.Context
+}
+
+func (c *Config) provideDefaults() {
+	if c.FlushInterval <= 0 {
+		c.FlushInterval = 100 * time.Millisecond
+	}
+	if c.MaxSize <= 0 {
+		c.MaxSize = 1000
+	}
+	if c.Context == nil {
+		c.Context = context.Background()
+	}
+}
+
+// Repo is a write repository decorator buffering Saves in memory and flushing
+// them in bulk every FlushInterval or MaxSize entities, for high-throughput
+// projectors where a round trip per event dominates the latency. The entities
+// are flushed with SaveAll if the repo is a BatchSaver, per namespace.
+//
+// Save returns before the entity is written, see OnError for the errors of
+// the flushes. Find returns the buffered entities, also while they are being
+// flushed, FindAll flushes first. Saved entities must not be modified until
+// they are flushed. Close must be called to flush the last entities.
+type Repo struct {
+	eh.ReadWriteRepo
+	config *Config
+	flush  *worker.Worker
+
+	mu      sync.Mutex
+	pending map[string]*batch
+	size    int
+	// flushing are the entities being written by Flush, still returned by
+	// Find until they are written.
+	flushing map[string]*batch
+
+	// flushMu serializes the flushes, so that a newer batch is never written
+	// before an older one.
+	flushMu sync.Mutex
+}
+
+// batch are the buffered entities of a namespace, in save order.
+type batch struct {
+	ids      []uuid.UUID
+	entities map[uuid.UUID]eh.Entity
+}
+
+// NewRepo creates a new Repo buffering the Saves of repo.
+func NewRepo(repo eh.ReadWriteRepo, config *Config) *Repo {
+	config.provideDefaults()
+
+	r := &Repo{
+		ReadWriteRepo: repo,
+		config:        config,
+		pending:       map[string]*batch{},
+	}
+	r.flush = worker.Start(config.Context, "buffer flush", config.FlushInterval,
+		r.Flush)
+
+	return r
+}
+
+// Parent implements the Parent method of the eventhorizon.ReadRepo interface.
+func (r *Repo) Parent() eh.ReadRepo {
+	return r.ReadWriteRepo
+}
+
+// Find implements the Find method of the eventhorizon.ReadRepo interface.
+func (r *Repo) Find(ctx context.Context, id uuid.UUID) (eh.Entity, error) {
+	ns := eh.NamespaceFromContext(ctx)
+	r.mu.Lock()
+	for _, batches := range []map[string]*batch{r.pending, r.flushing} {
+		if b, ok := batches[ns]; ok {
+			if entity, ok := b.entities[id]; ok {
+				r.mu.Unlock()
+				return entity, nil
+			}
+		}
+	}
+	r.mu.Unlock()
+
+	return r.ReadWriteRepo.Find(ctx, id)
+}
+
+// FindAll implements the FindAll method of the eventhorizon.ReadRepo
+// interface.
+func (r *Repo) FindAll(ctx context.Context) ([]eh.Entity, error) {
+	if err := r.Flush(ctx); err != nil {
+		return nil, err
+	}
+
+	return r.ReadWriteRepo.FindAll(ctx)
+}
+
+// Save implements the Save method of the eventhorizon.WriteRepo interface.
+func (r *Repo) Save(ctx context.Context, entity eh.Entity) error {
+	if entity.EntityID() == uuid.Nil {
+		return eh.RepoError{
+			Err:       eh.ErrCouldNotSaveEntity,
+			BaseErr:   eh.ErrMissingEntityID,
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	}
+
+	ns := eh.NamespaceFromContext(ctx)
+	r.mu.Lock()
+	b, ok := r.pending[ns]
+	if !ok {
+		b = &batch{entities: map[uuid.UUID]eh.Entity{}}
+		r.pending[ns] = b
+	}
+	if _, ok := b.entities[entity.EntityID()]; !ok {
+		b.ids = append(b.ids, entity.EntityID())
+		r.size++
+	}
+	b.entities[entity.EntityID()] = entity
+	full := r.size >= r.config.MaxSize
+	r.mu.Unlock()
+
+	if full {
+		return r.Flush(ctx)
+	}
+
+	return nil
+}
+
+// Remove implements the Remove method of the eventhorizon.WriteRepo interface.
+// A buffered entity is dropped before it is written.
+func (r *Repo) Remove(ctx context.Context, id uuid.UUID) error {
+	// Wait for a running flush, which could write the entity after it is
+	// removed.
+	r.flushMu.Lock()
+	defer r.flushMu.Unlock()
+
+	var buffered bool
+	r.mu.Lock()
+	if b, ok := r.pending[eh.NamespaceFromContext(ctx)]; ok {
+		if _, buffered = b.entities[id]; buffered {
+			delete(b.entities, id)
+			for i, bid := range b.ids {
+				if bid == id {
+					b.ids = append(b.ids[:i], b.ids[i+1:]...)
+					break
+				}
+			}
+			r.size--
+		}
+	}
+	r.mu.Unlock()
+
+	err := r.ReadWriteRepo.Remove(ctx, id)
+	var rrErr eh.RepoError
+	if buffered && errors.As(err, &rrErr) && rrErr.Err == eh.ErrEntityNotFound {
+		// Never written.
+		return nil
+	}
+
+	return err
+}
+
+// Flush writes the buffered entities.
+func (r *Repo) Flush(ctx context.Context) error {
+	r.flushMu.Lock()
+	defer r.flushMu.Unlock()
+
+	r.mu.Lock()
+	pending := r.pending
+	r.pending = map[string]*batch{}
+	r.size = 0
+	r.flushing = pending
+	r.mu.Unlock()
+
+	defer func() {
+		r.mu.Lock()
+		r.flushing = nil
+		r.mu.Unlock()
+	}()
+
+	namespaces := make([]string, 0, len(pending))
+	for ns := range pending {
+		namespaces = append(namespaces, ns)
+	}
+	sort.Strings(namespaces)
+
+	var flushErr error
+	for _, ns := range namespaces {
+		b := pending[ns]
+		entities := make([]eh.Entity, 0, len(b.ids))
+		for _, id := range b.ids {
+			entities = append(entities, b.entities[id])
+		}
+		if len(entities) == 0 {
+			continue
+		}
+
+		if err := r.saveAll(eh.NewContextWithNamespace(ctx, ns), entities); err != nil {
+			if r.config.OnError != nil {
+				r.config.OnError(err, entities)
+			}
+			if flushErr == nil {
+				flushErr = err
+			}
+		}
+	}
+
+	return flushErr
+}
+
+func (r *Repo) saveAll(ctx context.Context, entities []eh.Entity) error {
+	if s, ok := r.ReadWriteRepo.(BatchSaver); ok {
+		return s.SaveAll(ctx, entities)
+	}
+
+	for _, entity := range entities {
+		if err := r.ReadWriteRepo.Save(ctx, entity); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close stops the background flushes and flushes the buffered entities.
+func (r *Repo) Close(ctx context.Context) error {
+	r.flush.Stop()
+	return r.Flush(ctx)
+}
+
+// FlushWorker returns the background worker flushing the entities.
+func (r *Repo) FlushWorker() *worker.Worker {
+	return r.flush
+}
+
+// Repository returns a parent ReadRepo if there is one.
+func Repository(repo eh.ReadRepo) *Repo {
+	if repo == nil {
+		return nil
+	}
+
+	if r, ok := repo.(*Repo); ok {
+		return r
+	}
+
+	return Repository(repo.Parent())
+}
@@ -0,0 +1,184 @@
+package buffer
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	eh "github.com/looplab/eventhorizon"
+
+	"github.com/eendLabs/eh-pg/pkg/memory"
+	"github.com/eendLabs/eh-pg/pkg/mocks"
+	"github.com/eendLabs/eh-pg/pkg/repo"
+)
+
+func TestRepo(t *testing.T) {
+	inner := memory.NewRepo(&memory.Config{})
+	inner.SetEntityFactory(func() eh.Entity { return &mocks.Model{} })
+	r := NewRepo(inner, &Config{FlushInterval: time.Hour})
+	defer r.Close(context.Background())
+	if r.Parent() != inner {
+		t.Error("the parent repo should be correct")
+	}
+	if Repository(r) != r {
+		t.Error("the repository should be found")
+	}
+
+	repo.AcceptanceTest(t, context.Background(), r)
+
+	ctx := context.Background()
+	m := &mocks.Model{ID: uuid.New(), Content: "a"}
+	if err := r.Save(ctx, m); err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	if _, err := inner.Find(ctx, m.ID); !errors.Is(err, eh.ErrEntityNotFound) {
+		t.Error("the entity should be buffered:", err)
+	}
+	if e, err := r.Find(ctx, m.ID); err != nil || e != m {
+		t.Error("the buffered entity should be found:", e, err)
+	}
+
+	// Removing drops the buffered entity.
+	if err := r.Remove(ctx, m.ID); err != nil {
+		t.Error("there should be no error:", err)
+	}
+	if err := r.Flush(ctx); err != nil {
+		t.Error("there should be no error:", err)
+	}
+	if _, err := inner.Find(ctx, m.ID); !errors.Is(err, eh.ErrEntityNotFound) {
+		t.Error("the entity should not be written:", err)
+	}
+
+	// Flushing writes the last save per entity.
+	if err := r.Save(ctx, m); err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	if err := r.Save(ctx, &mocks.Model{ID: m.ID, Content: "b"}); err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	if err := r.Flush(ctx); err != nil {
+		t.Error("there should be no error:", err)
+	}
+	if e, err := inner.Find(ctx, m.ID); err != nil || e.(*mocks.Model).Content != "b" {
+		t.Error("the entity should be written:", e, err)
+	}
+}
+
+func TestRepoMaxSize(t *testing.T) {
+	inner := memory.NewRepo(&memory.Config{})
+	inner.SetEntityFactory(func() eh.Entity { return &mocks.Model{} })
+	r := NewRepo(inner, &Config{FlushInterval: time.Hour, MaxSize: 2})
+	defer r.Close(context.Background())
+
+	ctx := context.Background()
+	m1 := &mocks.Model{ID: uuid.New()}
+	m2 := &mocks.Model{ID: uuid.New()}
+	for _, m := range []*mocks.Model{m1, m1, m2} {
+		if err := r.Save(ctx, m); err != nil {
+			t.Fatal("there should be no error:", err)
+		}
+	}
+	if all, _ := inner.FindAll(ctx); len(all) != 2 {
+		t.Error("the full buffer should be flushed:", len(all))
+	}
+}
+
+func TestRepoInterval(t *testing.T) {
+	inner := memory.NewRepo(&memory.Config{})
+	inner.SetEntityFactory(func() eh.Entity { return &mocks.Model{} })
+	r := NewRepo(inner, &Config{FlushInterval: 10 * time.Millisecond})
+
+	ctx := context.Background()
+	m := &mocks.Model{ID: uuid.New()}
+	if err := r.Save(ctx, m); err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if _, err := inner.Find(ctx, m.ID); err != nil {
+		t.Error("the entity should be flushed in the background:", err)
+	}
+
+	r.Close(ctx)
+	if r.FlushWorker().Err() == nil {
+		t.Error("the worker should be stopped")
+	}
+}
+
+type failingRepo struct {
+	eh.ReadWriteRepo
+}
+
+func (r failingRepo) SaveAll(ctx context.Context, entities []eh.Entity) error {
+	return errors.New("failed")
+}
+
+func TestRepoOnError(t *testing.T) {
+	var failed []eh.Entity
+	r := NewRepo(failingRepo{memory.NewRepo(&memory.Config{})}, &Config{
+		FlushInterval: time.Hour,
+		OnError: func(err error, entities []eh.Entity) {
+			failed = entities
+		},
+	})
+	defer r.FlushWorker().Stop()
+
+	ctx := context.Background()
+	m := &mocks.Model{ID: uuid.New()}
+	if err := r.Save(ctx, m); err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	if err := r.Flush(ctx); err == nil {
+		t.Error("there should be an error")
+	}
+	if len(failed) != 1 || failed[0] != m {
+		t.Error("the failed entities should be passed:", failed)
+	}
+}
+
+type slowRepo struct {
+	*memory.Repo
+	started, proceed chan struct{}
+}
+
+func (r slowRepo) SaveAll(ctx context.Context, entities []eh.Entity) error {
+	close(r.started)
+	<-r.proceed
+	for _, entity := range entities {
+		if err := r.Save(ctx, entity); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestRepoFindWhileFlushing(t *testing.T) {
+	inner := slowRepo{memory.NewRepo(&memory.Config{}), make(chan struct{}), make(chan struct{})}
+	inner.SetEntityFactory(func() eh.Entity { return &mocks.Model{} })
+	r := NewRepo(inner, &Config{FlushInterval: time.Hour})
+	defer r.FlushWorker().Stop()
+
+	ctx := context.Background()
+	m := &mocks.Model{ID: uuid.New()}
+	if err := r.Save(ctx, m); err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+
+	flushed := make(chan error)
+	go func() {
+		flushed <- r.Flush(ctx)
+	}()
+	<-inner.started
+	if e, err := r.Find(ctx, m.ID); err != nil || e != m {
+		t.Error("the entity being flushed should be found:", e, err)
+	}
+
+	close(inner.proceed)
+	if err := <-flushed; err != nil {
+		t.Error("there should be no error:", err)
+	}
+	if _, err := r.Find(ctx, m.ID); err != nil {
+		t.Error("the flushed entity should be found:", err)
+	}
+}
@@ -0,0 +1,49 @@
+package cache
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/eendLabs/eh-pg/pkg/mocks"
+)
+
+func TestLRU(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now()
+	c := NewLRU(2)
+	c.now = func() time.Time { return now }
+
+	m1 := &mocks.Model{ID: uuid.New()}
+	c.Set(ctx, "a", m1, 0)
+	c.Set(ctx, "b", &mocks.Model{ID: uuid.New()}, 0)
+	if _, ok := c.Get(ctx, "a"); !ok {
+		t.Error("a should be cached")
+	}
+
+	// b is the least recently used.
+	c.Set(ctx, "c", &mocks.Model{ID: uuid.New()}, 0)
+	if _, ok := c.Get(ctx, "b"); ok {
+		t.Error("b should be evicted")
+	}
+	if e, ok := c.Get(ctx, "a"); !ok || e != m1 {
+		t.Error("a should be cached:", e)
+	}
+	if c.Len() != 2 {
+		t.Error("the size should be limited:", c.Len())
+	}
+
+	// Expiry.
+	c.Set(ctx, "d", m1, time.Second)
+	now = now.Add(time.Second)
+	if _, ok := c.Get(ctx, "d"); ok {
+		t.Error("d should be expired")
+	}
+
+	c.Delete(ctx, "a")
+	if _, ok := c.Get(ctx, "a"); ok {
+		t.Error("a should be deleted")
+	}
+}
@@ -0,0 +1,126 @@
+package cache
+
+import (
+	"context"
+	"time"
+
+	"github.com/google/uuid"
+	eh "github.com/looplab/eventhorizon"
+)
+
+// Cache is a store for cached entities, like the in-memory LRU or a Redis
+// backed implementation encoding the entities.
+type Cache interface {
+	// Get returns a cached entity.
+	Get(ctx context.Context, key string) (eh.Entity, bool)
+	// Set caches an entity for ttl, forever if 0.
+	Set(ctx context.Context, key string, entity eh.Entity, ttl time.Duration)
+	// Delete removes a cached entity.
+	Delete(ctx context.Context, key string)
+}
+
+// Config is the configuration of a Repo.
+type Config struct {
+	// TTL is how long Find results are cached, 1 minute by default, or until
+	// they are invalidated or evicted if negative.
+	TTL time.Duration
+	// MaxSize is the max number of entities in the default LRU cache,
+	// 10000 by default.
+	MaxSize int
+	// Cache is the cache, an LRU of MaxSize entities by default.
+	Cache Cache
+}
+
+func (c *Config) provideDefaults() {
+	if c.TTL == 0 {
+		c.TTL = time.Minute
+	}
+	if c.MaxSize <= 0 {
+		c.MaxSize = 10000
+	}
+	if c.Cache == nil {
+		c.Cache = NewLRU(c.MaxSize)
+	}
+}
+
+// Repo is a read repository decorator caching the results of Find, per
+// namespace. The cached entity is invalidated when it is saved or removed
+// through the Repo. Cached entities are shared between callers and must not be
+// modified without saving them.
+type Repo struct {
+	eh.ReadWriteRepo
+	config *Config
+}
+
+// NewRepo creates a new Repo caching the Finds of repo.
+func NewRepo(repo eh.ReadWriteRepo, config *Config) *Repo {
+	config.provideDefaults()
+
+	return &Repo{
+		ReadWriteRepo: repo,
+		config:        config,
+	}
+}
+
+// Parent implements the Parent method of the eventhorizon.ReadRepo interface.
+func (r *Repo) Parent() eh.ReadRepo {
+	return r.ReadWriteRepo
+}
+
+// Find implements the Find method of the eventhorizon.ReadRepo interface.
+func (r *Repo) Find(ctx context.Context, id uuid.UUID) (eh.Entity, error) {
+	key := cacheKey(ctx, id)
+	if entity, ok := r.config.Cache.Get(ctx, key); ok {
+		return entity, nil
+	}
+
+	entity, err := r.ReadWriteRepo.Find(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	ttl := r.config.TTL
+	if ttl < 0 {
+		ttl = 0
+	}
+	r.config.Cache.Set(ctx, key, entity, ttl)
+
+	return entity, nil
+}
+
+// Save implements the Save method of the eventhorizon.WriteRepo interface.
+func (r *Repo) Save(ctx context.Context, entity eh.Entity) error {
+	key := cacheKey(ctx, entity.EntityID())
+	err := r.ReadWriteRepo.Save(ctx, entity)
+	// Invalidate after the write, so that the Finds after it load the new
+	// entity. A Find that loaded the old entity before the write may still
+	// cache it after the invalidation, until the TTL expires.
+	r.config.Cache.Delete(ctx, key)
+
+	return err
+}
+
+// Remove implements the Remove method of the eventhorizon.WriteRepo interface.
+func (r *Repo) Remove(ctx context.Context, id uuid.UUID) error {
+	key := cacheKey(ctx, id)
+	err := r.ReadWriteRepo.Remove(ctx, id)
+	r.config.Cache.Delete(ctx, key)
+
+	return err
+}
+
+func cacheKey(ctx context.Context, id uuid.UUID) string {
+	return eh.NamespaceFromContext(ctx) + "/" + id.String()
+}
+
+// Repository returns a parent ReadRepo if there is one.
+func Repository(repo eh.ReadRepo) *Repo {
+	if repo == nil {
+		return nil
+	}
+
+	if r, ok := repo.(*Repo); ok {
+		return r
+	}
+
+	return Repository(repo.Parent())
+}
@@ -0,0 +1,88 @@
+package cache
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	eh "github.com/looplab/eventhorizon"
+
+	"github.com/eendLabs/eh-pg/pkg/memory"
+	"github.com/eendLabs/eh-pg/pkg/mocks"
+	"github.com/eendLabs/eh-pg/pkg/repo"
+)
+
+func TestRepo(t *testing.T) {
+	inner := memory.NewRepo(&memory.Config{})
+	inner.SetEntityFactory(func() eh.Entity { return &mocks.Model{} })
+	r := NewRepo(inner, &Config{})
+	if r.Parent() != inner {
+		t.Error("the parent repo should be correct")
+	}
+	if Repository(r) != r {
+		t.Error("the repository should be found")
+	}
+
+	repo.AcceptanceTest(t, context.Background(), r)
+
+	ctx := context.Background()
+	m := &mocks.Model{ID: uuid.New(), Content: "a"}
+	if err := r.Save(ctx, m); err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	e1, err := r.Find(ctx, m.ID)
+	if err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	e2, _ := r.Find(ctx, m.ID)
+	if e1 != e2 {
+		t.Error("the second Find should be cached")
+	}
+
+	// Other namespaces are cached separately.
+	nsCtx := eh.NewContextWithNamespace(ctx, "other")
+	if cacheKey(nsCtx, m.ID) == cacheKey(ctx, m.ID) {
+		t.Error("the cache keys should differ by namespace")
+	}
+
+	// Saving invalidates.
+	if err := r.Save(ctx, &mocks.Model{ID: m.ID, Content: "b"}); err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	e3, _ := r.Find(ctx, m.ID)
+	if e3.(*mocks.Model).Content != "b" {
+		t.Error("the entity should be updated:", e3)
+	}
+
+	// Removing invalidates.
+	if err := r.Remove(ctx, m.ID); err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	if _, err := r.Find(ctx, m.ID); err == nil {
+		t.Error("there should be an error")
+	}
+}
+
+func TestRepoNoTTL(t *testing.T) {
+	inner := memory.NewRepo(&memory.Config{})
+	inner.SetEntityFactory(func() eh.Entity { return &mocks.Model{} })
+	now := time.Now()
+	lru := NewLRU(10)
+	lru.now = func() time.Time { return now }
+	r := NewRepo(inner, &Config{TTL: -1, Cache: lru})
+
+	ctx := context.Background()
+	m := &mocks.Model{ID: uuid.New(), Content: "a"}
+	if err := r.Save(ctx, m); err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	e1, err := r.Find(ctx, m.ID)
+	if err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	now = now.Add(24 * time.Hour)
+	if e2, _ := r.Find(ctx, m.ID); e1 != e2 {
+		t.Error("the entity should still be cached")
+	}
+}
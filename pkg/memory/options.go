@@ -0,0 +1,67 @@
+package memory
+
+import (
+	"sort"
+
+	eh "github.com/looplab/eventhorizon"
+)
+
+// QueryOption is an option for FindMatching, the in-memory counterpart of the
+// query options of repo.Repo.
+type QueryOption func(*queryOptions)
+
+type queryOptions struct {
+	limit  int
+	offset int
+	less   []func(a, b eh.Entity) bool
+}
+
+// WithOrderBy sorts the result with less, which reports whether a sorts
+// before b. It can be given several times to sort on multiple keys, in the
+// order given. Equal entities keep the insertion order.
+func WithOrderBy(less func(a, b eh.Entity) bool) QueryOption {
+	return func(o *queryOptions) {
+		o.less = append(o.less, less)
+	}
+}
+
+// WithLimit limits the number of returned entities.
+func WithLimit(n int) QueryOption {
+	return func(o *queryOptions) {
+		o.limit = n
+	}
+}
+
+// WithOffset skips the first n entities.
+func WithOffset(n int) QueryOption {
+	return func(o *queryOptions) {
+		o.offset = n
+	}
+}
+
+// apply sorts the entities and returns the window of the offset and limit.
+func (o queryOptions) apply(entities []eh.Entity) []eh.Entity {
+	if len(o.less) > 0 {
+		sort.SliceStable(entities, func(i, j int) bool {
+			for _, less := range o.less {
+				if less(entities[i], entities[j]) {
+					return true
+				}
+				if less(entities[j], entities[i]) {
+					return false
+				}
+			}
+			return false
+		})
+	}
+	if o.offset > 0 {
+		if o.offset >= len(entities) {
+			return nil
+		}
+		entities = entities[o.offset:]
+	}
+	if o.limit > 0 && o.limit < len(entities) {
+		entities = entities[:o.limit]
+	}
+	return entities
+}
@@ -0,0 +1,311 @@
+package memory
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sync"
+
+	"github.com/google/uuid"
+	eh "github.com/looplab/eventhorizon"
+
+	"github.com/eendLabs/eh-pg/pkg/repo"
+)
+
+// table is the table name of the NotFoundError and VersionConflictError
+// errors of the repo.
+const table = "memory"
+
+// Config is the configuration of a Repo.
+type Config struct {
+	// Middleware optionally intercepts Find, FindAll, Save and Remove like the
+	// middleware of repo.Repo, the first one being the outermost.
+	Middleware []repo.Middleware
+	// NamespaceSchemas keeps the namespaces apart, like the NamespaceSchemas
+	// config of repo.Repo. Without it all namespaces share the entities, like
+	// the single table of repo.Repo.
+	NamespaceSchemas bool
+}
+
+// Repo is an in-memory eh.ReadWriteRepo with the semantics of repo.Repo, useful
+// for unit testing application services without a database: it returns the
+// same errors, with the same NotFoundError and VersionConflictError base
+// errors, runs the operations through the same middleware and stores copies of
+// the saved entities, so mutating an entity after Save does not change the
+// stored row, just like with Postgres.
+//
+// Of the extended API of repo.Repo it implements the filters, as predicates
+// with FindMatching, the limit, offset and order of the query options, the
+// middleware and, with WithTx, the transactions. The SQL of FindWithFilter and
+// the other features backed by Postgres can't be evaluated in memory, code
+// using them must be tested against Postgres.
+type Repo struct {
+	factoryFn func() eh.Entity
+	config    *Config
+	exec      repo.QueryFunc
+
+	mu         sync.RWMutex
+	namespaces map[string]*namespace
+}
+
+// namespace are the entities of a namespace, in insertion order.
+type namespace struct {
+	entities map[uuid.UUID]eh.Entity
+	order    []uuid.UUID
+}
+
+// NewRepo creates a new Repo.
+func NewRepo(config *Config) *Repo {
+	r := &Repo{
+		config:     config,
+		namespaces: map[string]*namespace{},
+	}
+	r.exec = r.do
+	for i := len(config.Middleware) - 1; i >= 0; i-- {
+		r.exec = config.Middleware[i](r.exec)
+	}
+
+	return r
+}
+
+// WithTx runs f like repo.WithTx, for application services that take the
+// transaction function as a dependency. The Repo has no transactions, f runs
+// without isolation and its writes are kept if it fails.
+func WithTx(ctx context.Context, f func(context.Context) error) error {
+	return f(ctx)
+}
+
+// namespace returns the entities of the namespace of the context, creating
+// them if create is set and nil otherwise. The lock must be held.
+func (r *Repo) namespace(ctx context.Context, create bool) *namespace {
+	name := r.namespaceName(ctx)
+	ns, ok := r.namespaces[name]
+	if !ok && create {
+		ns = &namespace{entities: map[uuid.UUID]eh.Entity{}}
+		r.namespaces[name] = ns
+	}
+	return ns
+}
+
+// namespaceName returns the key of the entities of the context, the same for
+// all namespaces without NamespaceSchemas.
+func (r *Repo) namespaceName(ctx context.Context) string {
+	if !r.config.NamespaceSchemas {
+		return ""
+	}
+	return eh.NamespaceFromContext(ctx)
+}
+
+// do runs an operation.
+func (r *Repo) do(ctx context.Context, op *repo.Operation) error {
+	var err error
+	switch op.Kind {
+	case repo.OpFind:
+		op.Entity, err = r.find(ctx, op.ID)
+	case repo.OpFindAll:
+		op.Entities, err = r.FindMatching(ctx, nil)
+	case repo.OpSave:
+		err = r.save(ctx, op.Entity)
+	case repo.OpRemove:
+		err = r.remove(ctx, op.ID)
+	default:
+		err = fmt.Errorf("unknown operation %q", op.Kind)
+	}
+	return err
+}
+
+// Parent implements the Parent method of the eventhorizon.ReadRepo interface.
+func (r *Repo) Parent() eh.ReadRepo {
+	return nil
+}
+
+// Find implements the Find method of the eventhorizon.ReadRepo interface.
+func (r *Repo) Find(ctx context.Context, id uuid.UUID) (eh.Entity, error) {
+	op := &repo.Operation{Kind: repo.OpFind, Table: table, ID: id}
+	if err := r.exec(ctx, op); err != nil {
+		return nil, err
+	}
+	return op.Entity, nil
+}
+
+func (r *Repo) find(ctx context.Context, id uuid.UUID) (eh.Entity, error) {
+	if r.factoryFn == nil {
+		return nil, eh.RepoError{
+			Err:       repo.ErrModelNotSet,
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	var entity eh.Entity
+	if ns := r.namespace(ctx, false); ns != nil {
+		entity = ns.entities[id]
+	}
+	if entity == nil {
+		return nil, eh.RepoError{
+			Err:       eh.ErrEntityNotFound,
+			BaseErr:   &repo.NotFoundError{ID: id, Table: table},
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	}
+
+	return copyEntity(entity), nil
+}
+
+// FindAll implements the FindAll method of the eventhorizon.ReadRepo interface.
+func (r *Repo) FindAll(ctx context.Context) ([]eh.Entity, error) {
+	op := &repo.Operation{Kind: repo.OpFindAll, Table: table}
+	if err := r.exec(ctx, op); err != nil {
+		return nil, err
+	}
+	return op.Entities, nil
+}
+
+// FindMatching returns all entities matching the predicate, or all entities
+// if the predicate is nil, in insertion order unless sorted with WithOrderBy.
+// It stands in for the filters of repo.Repo, like FindWhere:
+//
+//	r.FindMatching(ctx, func(e eh.Entity) bool {
+//		return e.(*Order).Status == "open"
+//	}, WithOrderBy(func(a, b eh.Entity) bool {
+//		return a.(*Order).Total > b.(*Order).Total
+//	}), WithLimit(10))
+func (r *Repo) FindMatching(ctx context.Context,
+	match func(eh.Entity) bool, options ...QueryOption) ([]eh.Entity, error) {
+	if r.factoryFn == nil {
+		return nil, eh.RepoError{
+			Err:       repo.ErrModelNotSet,
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	ns := r.namespace(ctx, false)
+	if ns == nil {
+		return nil, nil
+	}
+	var result []eh.Entity
+	for _, id := range ns.order {
+		entity := ns.entities[id]
+		if match == nil || match(entity) {
+			result = append(result, copyEntity(entity))
+		}
+	}
+
+	var o queryOptions
+	for _, option := range options {
+		option(&o)
+	}
+	return o.apply(result), nil
+}
+
+// Save implements the Save method of the eventhorizon.WriteRepo interface.
+// Like repo.Repo, it doesn't overwrite a versioned entity with an older
+// version.
+func (r *Repo) Save(ctx context.Context, entity eh.Entity) error {
+	return r.exec(ctx, &repo.Operation{
+		Kind:   repo.OpSave,
+		Table:  table,
+		ID:     entity.EntityID(),
+		Entity: entity,
+	})
+}
+
+func (r *Repo) save(ctx context.Context, entity eh.Entity) error {
+	id := entity.EntityID()
+	if id == uuid.Nil {
+		return eh.RepoError{
+			Err:       eh.ErrCouldNotSaveEntity,
+			BaseErr:   eh.ErrMissingEntityID,
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	ns := r.namespace(ctx, true)
+	stored, ok := ns.entities[id]
+	if v, isVersioned := entity.(eh.Versionable); isVersioned && ok {
+		if s, ok := stored.(eh.Versionable); ok && s.AggregateVersion() > v.AggregateVersion() {
+			return eh.RepoError{
+				Err: eh.ErrIncorrectEntityVersion,
+				BaseErr: &repo.VersionConflictError{
+					ID:      id,
+					Version: v.AggregateVersion(),
+					Table:   table,
+				},
+				Namespace: eh.NamespaceFromContext(ctx),
+			}
+		}
+	}
+	if !ok {
+		ns.order = append(ns.order, id)
+	}
+	ns.entities[id] = copyEntity(entity)
+
+	return nil
+}
+
+// Remove implements the Remove method of the eventhorizon.WriteRepo interface.
+func (r *Repo) Remove(ctx context.Context, id uuid.UUID) error {
+	return r.exec(ctx, &repo.Operation{Kind: repo.OpRemove, Table: table, ID: id})
+}
+
+func (r *Repo) remove(ctx context.Context, id uuid.UUID) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	ns := r.namespace(ctx, false)
+	if ns == nil || ns.entities[id] == nil {
+		return eh.RepoError{
+			Err:       eh.ErrEntityNotFound,
+			BaseErr:   &repo.NotFoundError{ID: id, Table: table},
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	}
+	delete(ns.entities, id)
+	for i, v := range ns.order {
+		if v == id {
+			ns.order = append(ns.order[:i], ns.order[i+1:]...)
+			break
+		}
+	}
+
+	return nil
+}
+
+// SetEntityFactory sets a factory function that creates concrete entity types.
+func (r *Repo) SetEntityFactory(f func() eh.Entity) {
+	r.factoryFn = f
+}
+
+// Clear clears the namespace of the context, or all entities without
+// NamespaceSchemas. The options are accepted for compatibility with repo.Repo
+// and are ignored.
+func (r *Repo) Clear(ctx context.Context, _ ...repo.ClearOption) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	delete(r.namespaces, r.namespaceName(ctx))
+
+	return nil
+}
+
+// Close implements the Close method of repo.Repo, it is a no-op.
+func (r *Repo) Close(_ context.Context) {}
+
+// copyEntity makes a shallow copy of the struct an entity pointer points to.
+func copyEntity(entity eh.Entity) eh.Entity {
+	v := reflect.ValueOf(entity)
+	if v.Kind() != reflect.Ptr {
+		return entity
+	}
+	c := reflect.New(v.Elem().Type())
+	c.Elem().Set(v.Elem())
+	return c.Interface().(eh.Entity)
+}
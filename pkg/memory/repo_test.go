@@ -0,0 +1,210 @@
+package memory
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/google/uuid"
+	eh "github.com/looplab/eventhorizon"
+	ehmocks "github.com/looplab/eventhorizon/mocks"
+
+	"github.com/eendLabs/eh-pg/pkg/mocks"
+	"github.com/eendLabs/eh-pg/pkg/repo"
+)
+
+func TestReadRepo(t *testing.T) {
+	r := NewRepo(&Config{NamespaceSchemas: true})
+	if r.Parent() != nil {
+		t.Error("the parent repo should be nil")
+	}
+
+	ctx := context.Background()
+	if _, err := r.Find(ctx, uuid.New()); !errors.Is(err, repo.ErrModelNotSet) {
+		t.Error("there should be a ErrModelNotSet error:", err)
+	}
+
+	r.SetEntityFactory(func() eh.Entity {
+		return &mocks.Model{}
+	})
+
+	repo.AcceptanceTest(t, ctx, r)
+
+	// Stored entities should not be affected by later changes.
+	model := &mocks.Model{ID: uuid.New(), Content: "model"}
+	if err := r.Save(ctx, model); err != nil {
+		t.Error("there should be no error:", err)
+	}
+	model.Content = "changed"
+	entity, err := r.Find(ctx, model.ID)
+	if err != nil {
+		t.Error("there should be no error:", err)
+	}
+	if m, ok := entity.(*mocks.Model); !ok || m.Content != "model" {
+		t.Error("the stored entity should not change:", entity)
+	}
+
+	result, err := r.FindMatching(ctx, func(e eh.Entity) bool {
+		return e.(*mocks.Model).Content == "model"
+	})
+	if err != nil {
+		t.Error("there should be no error:", err)
+	}
+	if len(result) != 1 {
+		t.Error("there should be one item:", len(result))
+	}
+
+	// Namespaces should be kept apart.
+	nsCtx := eh.NewContextWithNamespace(ctx, "other")
+	if _, err := r.Find(nsCtx, model.ID); !errors.Is(err, eh.ErrEntityNotFound) {
+		t.Error("there should be a ErrEntityNotFound error:", err)
+	}
+	if result, _ := r.FindAll(nsCtx); len(result) != 0 {
+		t.Error("there should be no items:", len(result))
+	}
+
+	// Errors should have the base errors of repo.Repo.
+	_, err = r.Find(ctx, uuid.Nil)
+	if rrErr, ok := err.(eh.RepoError); !ok || !errors.As(rrErr.BaseErr, new(*repo.NotFoundError)) {
+		t.Error("there should be a NotFoundError error:", err)
+	}
+	err = r.Remove(ctx, uuid.New())
+	if rrErr, ok := err.(eh.RepoError); !ok || !errors.As(rrErr.BaseErr, new(*repo.NotFoundError)) {
+		t.Error("there should be a NotFoundError error:", err)
+	}
+
+	if err := r.Clear(ctx); err != nil {
+		t.Error("there should be no error:", err)
+	}
+	if result, _ := r.FindAll(ctx); len(result) != 0 {
+		t.Error("there should be no items:", len(result))
+	}
+}
+
+func TestReadRepoVersion(t *testing.T) {
+	r := NewRepo(&Config{})
+	r.SetEntityFactory(func() eh.Entity {
+		return &ehmocks.Model{}
+	})
+
+	ctx := context.Background()
+	model := &ehmocks.Model{ID: uuid.New(), Version: 2, Content: "model"}
+	if err := r.Save(ctx, model); err != nil {
+		t.Error("there should be no error:", err)
+	}
+	if err := r.Save(ctx, &ehmocks.Model{ID: model.ID, Version: 2, Content: "same"}); err != nil {
+		t.Error("there should be no error:", err)
+	}
+
+	err := r.Save(ctx, &ehmocks.Model{ID: model.ID, Version: 1, Content: "older"})
+	var conflict *repo.VersionConflictError
+	if rrErr, ok := err.(eh.RepoError); !ok || !errors.Is(rrErr.Err, eh.ErrIncorrectEntityVersion) ||
+		!errors.As(rrErr.BaseErr, &conflict) || conflict.Version != 1 {
+		t.Error("there should be a VersionConflictError error:", err)
+	}
+	entity, err := r.Find(ctx, model.ID)
+	if err != nil {
+		t.Error("there should be no error:", err)
+	}
+	if m, ok := entity.(*ehmocks.Model); !ok || m.Content != "same" {
+		t.Error("the newer version should be kept:", entity)
+	}
+}
+
+func TestReadRepoSharedNamespaces(t *testing.T) {
+	r := NewRepo(&Config{})
+	r.SetEntityFactory(func() eh.Entity {
+		return &mocks.Model{}
+	})
+
+	ctx := context.Background()
+	model := &mocks.Model{ID: uuid.New(), Content: "model"}
+	if err := r.Save(ctx, model); err != nil {
+		t.Error("there should be no error:", err)
+	}
+
+	// Like a repo.Repo without NamespaceSchemas, the namespaces share the
+	// entities.
+	nsCtx := eh.NewContextWithNamespace(ctx, "other")
+	if _, err := r.Find(nsCtx, model.ID); err != nil {
+		t.Error("there should be no error:", err)
+	}
+	if err := r.Clear(nsCtx); err != nil {
+		t.Error("there should be no error:", err)
+	}
+	if result, _ := r.FindAll(ctx); len(result) != 0 {
+		t.Error("there should be no items:", len(result))
+	}
+}
+
+func TestReadRepoQueryOptions(t *testing.T) {
+	r := NewRepo(&Config{})
+	r.SetEntityFactory(func() eh.Entity {
+		return &mocks.Model{}
+	})
+
+	ctx := context.Background()
+	for _, content := range []string{"c", "a", "d", "b", "e"} {
+		if err := r.Save(ctx, &mocks.Model{ID: uuid.New(), Content: content}); err != nil {
+			t.Error("there should be no error:", err)
+		}
+	}
+
+	result, err := r.FindMatching(ctx, func(e eh.Entity) bool {
+		return e.(*mocks.Model).Content != "e"
+	}, WithOrderBy(func(a, b eh.Entity) bool {
+		return a.(*mocks.Model).Content < b.(*mocks.Model).Content
+	}), WithOffset(1), WithLimit(2))
+	if err != nil {
+		t.Error("there should be no error:", err)
+	}
+	var contents []string
+	for _, e := range result {
+		contents = append(contents, e.(*mocks.Model).Content)
+	}
+	if !reflect.DeepEqual(contents, []string{"b", "c"}) {
+		t.Error("the entities should be correct:", contents)
+	}
+
+	if result, _ := r.FindMatching(ctx, nil, WithOffset(5)); len(result) != 0 {
+		t.Error("there should be no items:", len(result))
+	}
+}
+
+func TestReadRepoMiddleware(t *testing.T) {
+	var ops []repo.OpKind
+	r := NewRepo(&Config{
+		Middleware: []repo.Middleware{func(next repo.QueryFunc) repo.QueryFunc {
+			return func(ctx context.Context, op *repo.Operation) error {
+				ops = append(ops, op.Kind)
+				return next(ctx, op)
+			}
+		}},
+	})
+	r.SetEntityFactory(func() eh.Entity {
+		return &mocks.Model{}
+	})
+
+	ctx := context.Background()
+	model := &mocks.Model{ID: uuid.New(), Content: "model"}
+	err := WithTx(ctx, func(ctx context.Context) error {
+		if err := r.Save(ctx, model); err != nil {
+			return err
+		}
+		if _, err := r.Find(ctx, model.ID); err != nil {
+			return err
+		}
+		if _, err := r.FindAll(ctx); err != nil {
+			return err
+		}
+		return r.Remove(ctx, model.ID)
+	})
+	if err != nil {
+		t.Error("there should be no error:", err)
+	}
+	expected := []repo.OpKind{repo.OpSave, repo.OpFind, repo.OpFindAll, repo.OpRemove}
+	if !reflect.DeepEqual(ops, expected) {
+		t.Error("the operations should be correct:", ops)
+	}
+}
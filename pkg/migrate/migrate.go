@@ -0,0 +1,253 @@
+// Package migrate applies versioned SQL migrations, like the ones of the read
+// model tables of an application, tracking the applied versions in a table.
+//
+// The migrations use the file layout of golang-migrate, so teams already
+// using it can let it own the schema instead, including the meta tables of
+// the repo package:
+//
+//	src, err := iofs.New(migrate.Migrations, "migrations")
+//	m, err := gomigrate.NewWithSourceInstance("iofs", src, dbURL)
+package migrate
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// ErrInvalidMigration is when a migration file is not valid.
+var ErrInvalidMigration = errors.New("invalid migration")
+
+// Migrations are the migrations of the meta tables of the repo package with
+// their default names, like eh_last_writes and eh_idempotency_keys, in the
+// migrations directory.
+//
+//go:embed migrations/*.sql
+var Migrations embed.FS
+
+// migrationRe matches the migration file names, e.g. 0001_create_models.sql
+// or 0001_create_models.up.sql.
+var migrationRe = regexp.MustCompile(`^(\d+)_(\w+?)(\.up)?\.sql$`)
+
+// Migration is a versioned SQL migration.
+type Migration struct {
+	Version int64
+	Name    string
+	SQL     string
+}
+
+// Load returns the migrations in the directory of the file system, ordered
+// by version. The files must be named <version>_<name>.sql or, like for
+// golang-migrate, <version>_<name>.up.sql. Other files, like the .down.sql
+// files of golang-migrate, are ignored.
+func Load(fsys fs.FS, dir string) ([]Migration, error) {
+	entries, err := fs.ReadDir(fsys, dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var migrations []Migration
+	versions := map[int64]string{}
+	for _, e := range entries {
+		m := migrationRe.FindStringSubmatch(e.Name())
+		if e.IsDir() || m == nil {
+			continue
+		}
+		version, err := strconv.ParseInt(m[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s: %v", ErrInvalidMigration, e.Name(), err)
+		}
+		if other, ok := versions[version]; ok {
+			return nil, fmt.Errorf("%w: %s: version of %s", ErrInvalidMigration,
+				e.Name(), other)
+		}
+		versions[version] = e.Name()
+
+		b, err := fs.ReadFile(fsys, path.Join(dir, e.Name()))
+		if err != nil {
+			return nil, err
+		}
+		migrations = append(migrations, Migration{
+			Version: version,
+			Name:    m[2],
+			SQL:     string(b),
+		})
+	}
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+
+	return migrations, nil
+}
+
+// Config is the configuration of a Migrator.
+type Config struct {
+	// TableName is the table of the applied versions,
+	// "eh_schema_migrations" by default, not to share the schema_migrations
+	// table of golang-migrate.
+	TableName string
+	// FS is the file system of the migrations, the Migrations of the
+	// package by default.
+	FS fs.FS
+	// Dir is the directory of the migrations in FS, "migrations" by
+	// default.
+	Dir string
+}
+
+func (c *Config) provideDefaults() {
+	if c.TableName == "" {
+		c.TableName = "eh_schema_migrations"
+	}
+	if c.FS == nil {
+		c.FS = Migrations
+	}
+	if c.Dir == "" {
+		c.Dir = "migrations"
+	}
+}
+
+// Migrator applies the migrations of a file system.
+type Migrator struct {
+	db         *sqlx.DB
+	config     *Config
+	migrations []Migration
+}
+
+// New creates a new Migrator, loading the migrations.
+func New(db *sqlx.DB, config *Config) (*Migrator, error) {
+	config.provideDefaults()
+
+	migrations, err := Load(config.FS, config.Dir)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Migrator{
+		db:         db,
+		config:     config,
+		migrations: migrations,
+	}, nil
+}
+
+// Migrations returns the loaded migrations, ordered by version.
+func (m *Migrator) Migrations() []Migration {
+	return m.migrations
+}
+
+// Migrate applies the migrations not applied yet, in version order, each in
+// a transaction with the record of its version. It is safe to call from
+// several instances starting at the same time, like on rolling deploys: it
+// holds a session advisory lock keyed by the tracking table while migrating,
+// so only one instance applies the DDL and the others wait for it, then find
+// the migrations applied. The wait is bounded by the context.
+func (m *Migrator) Migrate(ctx context.Context) error {
+	conn, err := m.db.Connx(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if _, err := conn.ExecContext(ctx,
+		"SELECT pg_advisory_lock(hashtext($1))", m.config.TableName); err != nil {
+		return fmt.Errorf("could not lock migrations: %w", err)
+	}
+	defer func() {
+		// Unlock even if the context is done, the connection returns to the
+		// pool still holding the session lock otherwise. If that fails,
+		// discard the connection, closing the session releases the lock.
+		if _, err := conn.ExecContext(context.Background(),
+			"SELECT pg_advisory_unlock(hashtext($1))", m.config.TableName); err != nil {
+			conn.Raw(func(interface{}) error {
+				return driver.ErrBadConn
+			})
+		}
+	}()
+
+	if _, err := conn.ExecContext(ctx, fmt.Sprintf(`
+	CREATE TABLE IF NOT EXISTS %s (
+	    version    bigint PRIMARY KEY,
+	    name       text NOT NULL,
+	    applied_at timestamptz NOT NULL DEFAULT now()
+	)`, m.config.TableName)); err != nil {
+		return err
+	}
+
+	applied, err := m.applied(ctx, conn)
+	if err != nil {
+		return err
+	}
+	done := make(map[int64]bool, len(applied))
+	for _, v := range applied {
+		done[v] = true
+	}
+
+	for _, migration := range m.migrations {
+		if done[migration.Version] {
+			continue
+		}
+		if err := m.apply(ctx, conn, migration); err != nil {
+			return fmt.Errorf("migration %d %s: %w", migration.Version, migration.Name, err)
+		}
+	}
+
+	return nil
+}
+
+func (m *Migrator) apply(ctx context.Context, conn *sqlx.Conn, migration Migration) error {
+	tx, err := conn.BeginTxx(ctx, &sql.TxOptions{})
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Instances of previous versions don't take the advisory lock, and may
+	// have applied it while waiting for the table lock.
+	if _, err := tx.ExecContext(ctx, fmt.Sprintf(
+		"LOCK TABLE %s IN EXCLUSIVE MODE", m.config.TableName)); err != nil {
+		return err
+	}
+	var applied bool
+	if err := tx.GetContext(ctx, &applied, fmt.Sprintf(
+		"SELECT EXISTS (SELECT 1 FROM %s WHERE version = $1)", m.config.TableName),
+		migration.Version); err != nil {
+		return err
+	}
+	if applied {
+		return nil
+	}
+
+	if _, err := tx.ExecContext(ctx, migration.SQL); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, fmt.Sprintf(
+		"INSERT INTO %s (version, name) VALUES ($1, $2)", m.config.TableName),
+		migration.Version, migration.Name); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Applied returns the applied versions in order.
+func (m *Migrator) Applied(ctx context.Context) ([]int64, error) {
+	return m.applied(ctx, m.db)
+}
+
+func (m *Migrator) applied(ctx context.Context, q sqlx.QueryerContext) ([]int64, error) {
+	var versions []int64
+	if err := sqlx.SelectContext(ctx, q, &versions, fmt.Sprintf(
+		"SELECT version FROM %s ORDER BY version", m.config.TableName)); err != nil {
+		return nil, err
+	}
+	return versions, nil
+}
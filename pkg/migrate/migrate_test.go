@@ -0,0 +1,158 @@
+package migrate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"testing"
+	"testing/fstest"
+
+	"github.com/jmoiron/sqlx"
+	_ "github.com/lib/pq"
+)
+
+func TestLoad(t *testing.T) {
+	migrations, err := Load(fstest.MapFS{
+		"sql/0010_add_index.up.sql":   {Data: []byte("CREATE INDEX")},
+		"sql/0010_add_index.down.sql": {Data: []byte("DROP INDEX")},
+		"sql/0002_create_models.sql":  {Data: []byte("CREATE TABLE")},
+		"sql/README.md":               {Data: []byte("docs")},
+	}, "sql")
+	if err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	if len(migrations) != 2 {
+		t.Fatal("there should be two migrations:", migrations)
+	}
+	if m := migrations[0]; m.Version != 2 || m.Name != "create_models" || m.SQL != "CREATE TABLE" {
+		t.Error("the first migration should be correct:", m)
+	}
+	if m := migrations[1]; m.Version != 10 || m.Name != "add_index" {
+		t.Error("the second migration should be correct:", m)
+	}
+
+	if _, err := Load(fstest.MapFS{
+		"sql/1_a.sql":  {},
+		"sql/01_b.sql": {},
+	}, "sql"); !errors.Is(err, ErrInvalidMigration) {
+		t.Error("there should be a ErrInvalidMigration error:", err)
+	}
+}
+
+func TestPackageMigrations(t *testing.T) {
+	config := &Config{}
+	m, err := New(nil, config)
+	if err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	if config.TableName != "eh_schema_migrations" {
+		t.Error("the table should not be the one of golang-migrate:", config.TableName)
+	}
+	if len(m.Migrations()) == 0 {
+		t.Error("the package migrations should be embedded")
+	}
+
+	// Every migration can be reverted by golang-migrate.
+	for _, migration := range m.Migrations() {
+		name := fmt.Sprintf("migrations/%04d_%s.down.sql", migration.Version, migration.Name)
+		if _, err := fs.Stat(Migrations, name); err != nil {
+			t.Error("there should be a down migration:", err)
+		}
+	}
+}
+
+func TestMigrateIntegration(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integration test")
+	}
+
+	host := os.Getenv("POSTGRES_HOST")
+	if host == "" {
+		host = "localhost"
+	}
+	db, err := sqlx.Connect("postgres", "host="+host+
+		" port=5432 user=postgres password=postgres sslmode=disable")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	ctx := context.Background()
+	db.MustExecContext(ctx, "DROP TABLE IF EXISTS schema_migrations_test, migrated")
+	defer db.MustExecContext(ctx, "DROP TABLE schema_migrations_test, migrated")
+
+	m, err := New(db, &Config{
+		TableName: "schema_migrations_test",
+		FS: fstest.MapFS{
+			"sql/0001_create.sql": {Data: []byte("CREATE TABLE migrated (id int)")},
+			"sql/0002_alter.sql":  {Data: []byte("ALTER TABLE migrated ADD COLUMN name text")},
+		},
+		Dir: "sql",
+	})
+	if err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := m.Migrate(ctx); err != nil {
+			t.Fatal("there should be no error:", err)
+		}
+	}
+	if applied, err := m.Applied(ctx); err != nil || len(applied) != 2 {
+		t.Error("the migrations should be applied:", applied, err)
+	}
+}
+
+func TestMigrateConcurrentIntegration(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integration test")
+	}
+
+	host := os.Getenv("POSTGRES_HOST")
+	if host == "" {
+		host = "localhost"
+	}
+	db, err := sqlx.Connect("postgres", "host="+host+
+		" port=5432 user=postgres password=postgres sslmode=disable")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	ctx := context.Background()
+	db.MustExecContext(ctx, "DROP TABLE IF EXISTS schema_migrations_concurrent, migrated_concurrent")
+	defer db.MustExecContext(ctx, "DROP TABLE schema_migrations_concurrent, migrated_concurrent")
+
+	// Instances starting at the same time, the first one holds the lock
+	// while creating the table.
+	errs := make(chan error, 4)
+	for i := 0; i < cap(errs); i++ {
+		go func() {
+			m, err := New(db, &Config{
+				TableName: "schema_migrations_concurrent",
+				FS: fstest.MapFS{
+					"sql/0001_create.sql": {Data: []byte(
+						"SELECT pg_sleep(0.2); CREATE TABLE migrated_concurrent (id int)")},
+				},
+				Dir: "sql",
+			})
+			if err != nil {
+				errs <- err
+				return
+			}
+			errs <- m.Migrate(ctx)
+		}()
+	}
+	for i := 0; i < cap(errs); i++ {
+		if err := <-errs; err != nil {
+			t.Error("there should be no error:", err)
+		}
+	}
+
+	var locks int
+	if err := db.GetContext(ctx, &locks,
+		"SELECT count(*) FROM pg_locks WHERE locktype = 'advisory'"); err != nil || locks != 0 {
+		t.Error("the lock should be released:", locks, err)
+	}
+}
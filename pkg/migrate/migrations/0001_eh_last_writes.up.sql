@@ -0,0 +1,7 @@
+CREATE TABLE IF NOT EXISTS eh_last_writes (
+    table_name text NOT NULL,
+    namespace  text NOT NULL,
+    written_at timestamptz NOT NULL,
+    version    integer NOT NULL,
+    PRIMARY KEY (table_name, namespace)
+);
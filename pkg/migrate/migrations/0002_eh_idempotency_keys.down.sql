@@ -0,0 +1 @@
+DROP TABLE IF EXISTS eh_idempotency_keys;
@@ -0,0 +1,7 @@
+CREATE TABLE IF NOT EXISTS eh_idempotency_keys (
+    table_name text NOT NULL,
+    namespace  text NOT NULL,
+    key        text NOT NULL,
+    created_at timestamptz NOT NULL DEFAULT now(),
+    PRIMARY KEY (table_name, namespace, key)
+);
@@ -0,0 +1,246 @@
+package reconcile
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/eendLabs/eh-pg/pkg/repo"
+	"github.com/eendLabs/eh-pg/pkg/worker"
+)
+
+// ErrDuplicateCheck is when a check with the same name is already registered.
+var ErrDuplicateCheck = errors.New("duplicate check")
+
+// Finding is a discrepancy reported by a check.
+type Finding struct {
+	// Check is the name of the check reporting the finding.
+	Check string
+	// Message describes the discrepancy.
+	Message string
+	// Time is when the finding was made.
+	Time time.Time
+}
+
+func (f Finding) String() string {
+	return fmt.Sprintf("%s: %s", f.Check, f.Message)
+}
+
+// Check compares a read model to its source of truth and returns messages
+// describing the discrepancies, if any.
+type Check func(context.Context) ([]string, error)
+
+// Config is the configuration of a Reconciler.
+type Config struct {
+	// Interval is the time between two runs of the checks, 1 hour by default.
+	Interval time.Duration
+	// OnFinding is called for each finding, for example to update a metric.
+	// Findings are logged by default.
+	OnFinding func(Finding)
+}
+
+func (c *Config) provideDefaults() {
+	if c.Interval <= 0 {
+		c.Interval = time.Hour
+	}
+	if c.OnFinding == nil {
+		c.OnFinding = func(f Finding) {
+			log.Printf("eh-pg: reconciliation: %s", f)
+		}
+	}
+}
+
+// Stats are the counters of a check.
+type Stats struct {
+	// Runs is the number of times the check has run.
+	Runs int64
+	// Failures is the number of runs returning an error.
+	Failures int64
+	// Findings is the total number of findings.
+	Findings int64
+	// LastRun is when the check last ran.
+	LastRun time.Time
+	// LastFindings is the number of findings of the last run.
+	LastFindings int
+}
+
+// Reconciler periodically runs registered reconciliation checks, like row
+// counts against event counts, orphan detection or checksum comparisons, and
+// reports the findings, keeping long-lived projections trustworthy.
+type Reconciler struct {
+	config *Config
+	worker *worker.Worker
+
+	mu     sync.Mutex
+	checks map[string]Check
+	stats  map[string]*Stats
+}
+
+// NewReconciler creates a new Reconciler.
+func NewReconciler(config *Config) *Reconciler {
+	config.provideDefaults()
+
+	return &Reconciler{
+		config: config,
+		checks: map[string]Check{},
+		stats:  map[string]*Stats{},
+	}
+}
+
+// Register registers a check by name.
+func (r *Reconciler) Register(name string, check Check) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.checks[name]; ok {
+		return fmt.Errorf("%w: %s", ErrDuplicateCheck, name)
+	}
+	r.checks[name] = check
+	r.stats[name] = &Stats{}
+
+	return nil
+}
+
+// Run runs all checks once, in name order, and returns the findings. All
+// checks are run even if some fail, the errors are joined in the returned
+// error.
+func (r *Reconciler) Run(ctx context.Context) ([]Finding, error) {
+	r.mu.Lock()
+	names := make([]string, 0, len(r.checks))
+	for name := range r.checks {
+		names = append(names, name)
+	}
+	r.mu.Unlock()
+	sort.Strings(names)
+
+	var findings []Finding
+	var errs []error
+	for _, name := range names {
+		r.mu.Lock()
+		check := r.checks[name]
+		r.mu.Unlock()
+
+		messages, err := check(ctx)
+		now := time.Now()
+
+		r.mu.Lock()
+		s := r.stats[name]
+		s.Runs++
+		s.LastRun = now
+		if err != nil {
+			s.Failures++
+		} else {
+			s.Findings += int64(len(messages))
+			s.LastFindings = len(messages)
+		}
+		r.mu.Unlock()
+
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", name, err))
+			continue
+		}
+		for _, m := range messages {
+			f := Finding{Check: name, Message: m, Time: now}
+			r.config.OnFinding(f)
+			findings = append(findings, f)
+		}
+	}
+
+	switch len(errs) {
+	case 0:
+		return findings, nil
+	case 1:
+		return findings, errs[0]
+	default:
+		return findings, fmt.Errorf("%w (and %d more failed checks)", errs[0], len(errs)-1)
+	}
+}
+
+// Stats returns the counters of the checks by name.
+func (r *Reconciler) Stats() map[string]Stats {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	stats := make(map[string]Stats, len(r.stats))
+	for name, s := range r.stats {
+		stats[name] = *s
+	}
+	return stats
+}
+
+// Start starts running the checks in the background until the context is
+// cancelled or Close is called.
+func (r *Reconciler) Start(ctx context.Context) {
+	r.worker = worker.Start(ctx, "reconciliation", r.config.Interval,
+		func(ctx context.Context) error {
+			_, err := r.Run(ctx)
+			return err
+		})
+}
+
+// Done returns a channel that is closed when the background runs have
+// stopped. It is nil if the reconciler is not started.
+func (r *Reconciler) Done() <-chan struct{} {
+	if r.worker == nil {
+		return nil
+	}
+	return r.worker.Done()
+}
+
+// Errors returns a channel where check errors are sent. It is nil if the
+// reconciler is not started.
+func (r *Reconciler) Errors() <-chan error {
+	if r.worker == nil {
+		return nil
+	}
+	return r.worker.Errors()
+}
+
+// Close stops the background runs started with Start.
+func (r *Reconciler) Close() {
+	if r.worker != nil {
+		r.worker.Stop()
+	}
+}
+
+// RowCount returns a check comparing the number of rows in the repo with the
+// expected count, for example the number of creation events in the event
+// store. A difference larger than tolerance is reported.
+func RowCount(r *repo.Repo, expected func(context.Context) (int64, error),
+	tolerance int64) Check {
+	return func(ctx context.Context) ([]string, error) {
+		want, err := expected(ctx)
+		if err != nil {
+			return nil, err
+		}
+		got, err := r.Count(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if diff := got - want; diff > tolerance || -diff > tolerance {
+			return []string{fmt.Sprintf("%d rows, expected %d", got, want)}, nil
+		}
+		return nil, nil
+	}
+}
+
+// Orphans returns a check reporting rows matching the filter, like rows
+// referencing a parent that does not exist:
+//
+//	Orphans(r, "NOT EXISTS (SELECT 1 FROM orders o WHERE o.id = order_id)")
+func Orphans(r *repo.Repo, expr string, args ...interface{}) Check {
+	return func(ctx context.Context) ([]string, error) {
+		n, err := r.CountWithFilter(ctx, expr, args...)
+		if err != nil {
+			return nil, err
+		}
+		if n > 0 {
+			return []string{fmt.Sprintf("%d orphaned rows", n)}, nil
+		}
+		return nil, nil
+	}
+}
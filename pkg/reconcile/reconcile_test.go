@@ -0,0 +1,68 @@
+package reconcile
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestReconciler(t *testing.T) {
+	var reported []Finding
+	r := NewReconciler(&Config{
+		Interval:  time.Millisecond,
+		OnFinding: func(f Finding) { reported = append(reported, f) },
+	})
+
+	checkErr := errors.New("check error")
+	if err := r.Register("counts", func(ctx context.Context) ([]string, error) {
+		return []string{"10 rows, expected 12"}, nil
+	}); err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	if err := r.Register("broken", func(ctx context.Context) ([]string, error) {
+		return nil, checkErr
+	}); err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	if err := r.Register("counts", nil); !errors.Is(err, ErrDuplicateCheck) {
+		t.Error("there should be a ErrDuplicateCheck error:", err)
+	}
+
+	findings, err := r.Run(context.Background())
+	if !errors.Is(err, checkErr) {
+		t.Error("the check error should be returned:", err)
+	}
+	if len(findings) != 1 || findings[0].Check != "counts" ||
+		findings[0].Message != "10 rows, expected 12" {
+		t.Error("the findings should be correct:", findings)
+	}
+	if len(reported) != 1 {
+		t.Error("the findings should be reported:", reported)
+	}
+
+	stats := r.Stats()
+	if s := stats["counts"]; s.Runs != 1 || s.Findings != 1 || s.LastFindings != 1 {
+		t.Error("the stats should be correct:", s)
+	}
+	if s := stats["broken"]; s.Runs != 1 || s.Failures != 1 {
+		t.Error("the stats should be correct:", s)
+	}
+
+	// Run in the background.
+	r.Start(context.Background())
+	select {
+	case err := <-r.Errors():
+		if !errors.Is(err, checkErr) {
+			t.Error("the check error should be sent:", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("there should be an error")
+	}
+	r.Close()
+	select {
+	case <-r.Done():
+	default:
+		t.Error("the reconciler should be stopped")
+	}
+}
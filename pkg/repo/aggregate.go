@@ -0,0 +1,183 @@
+package repo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/jmoiron/sqlx/reflectx"
+	eh "github.com/looplab/eventhorizon"
+)
+
+// ErrCouldNotAggregate is when an aggregate query could not be run.
+var ErrCouldNotAggregate = errors.New("could not aggregate entities")
+
+// AggregateFunc is an SQL aggregate function.
+type AggregateFunc string
+
+// The supported aggregate functions.
+const (
+	Count AggregateFunc = "count"
+	Sum   AggregateFunc = "sum"
+	Avg   AggregateFunc = "avg"
+	Min   AggregateFunc = "min"
+	Max   AggregateFunc = "max"
+)
+
+// Aggregation is an aggregate function applied to a column.
+type Aggregation struct {
+	Func AggregateFunc
+	// Column is the aggregated column, or "*" to count all rows.
+	Column string
+	// As is the key of the value in the result rows. It defaults to the
+	// function and column joined by "_", like "sum_amount", or "count" when
+	// counting all rows.
+	As string
+}
+
+// AggregateQuery is a GROUP BY query over the table of the repo.
+type AggregateQuery struct {
+	// GroupBy are the grouping columns, which are included in the result rows.
+	// With no columns a single row aggregating the whole table is returned.
+	GroupBy []string
+	// Aggregates are the computed aggregations.
+	Aggregates []Aggregation
+	// Where optionally filters the rows before grouping.
+	Where Filter
+	// Limit is the max number of result rows, 0 for no limit.
+	Limit int
+}
+
+// Aggregate runs a GROUP BY query over the table and returns the result rows
+// as maps keyed by column, for dashboard style queries that do not map onto
+// entities. The rows are ordered by the grouping columns. Numeric values are
+// returned as they are decoded by the driver, so sums and averages of NUMERIC
+// columns are strings to keep their precision.
+func (r *Repo) Aggregate(ctx context.Context,
+	q AggregateQuery) ([]map[string]interface{}, error) {
+	if r.factoryFn == nil {
+		return nil, eh.RepoError{
+			Err:       ErrModelNotSet,
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	}
+
+	query, args, err := q.query(r.mapper, r.readTable(), r.factoryFn())
+	if err != nil {
+		return nil, eh.RepoError{
+			Err:       ErrCouldNotAggregate,
+			BaseErr:   err,
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	}
+
+	ex, release, err := r.conn(ctx, false)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	rows, err := ex.QueryxContext(ctx, query, args...)
+	if err != nil {
+		return nil, eh.RepoError{
+			Err:       ErrCouldNotAggregate,
+			BaseErr:   err,
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	}
+	defer rows.Close()
+
+	var result []map[string]interface{}
+	for rows.Next() {
+		row := map[string]interface{}{}
+		if err := rows.MapScan(row); err != nil {
+			return nil, eh.RepoError{
+				Err:       ErrCouldNotAggregate,
+				BaseErr:   err,
+				Namespace: eh.NamespaceFromContext(ctx),
+			}
+		}
+		for k, v := range row {
+			if b, ok := v.([]byte); ok {
+				row[k] = string(b)
+			}
+		}
+		result = append(result, row)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, eh.RepoError{
+			Err:       ErrCouldNotAggregate,
+			BaseErr:   err,
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	}
+
+	return result, nil
+}
+
+// query builds the aggregate query, validating the columns against the entity.
+func (q AggregateQuery) query(m *reflectx.Mapper, table string,
+	entity interface{}) (string, []interface{}, error) {
+	if len(q.Aggregates) == 0 {
+		return "", nil, errors.New("no aggregates")
+	}
+
+	selects := make([]string, 0, len(q.GroupBy)+len(q.Aggregates))
+	for _, column := range q.GroupBy {
+		if !hasColumn(m, entity, column) {
+			return "", nil, fmt.Errorf("%w: %q is not mapped", ErrInvalidColumn, column)
+		}
+		selects = append(selects, quoteColumn(column))
+	}
+	for _, a := range q.Aggregates {
+		switch a.Func {
+		case Count, Sum, Avg, Min, Max:
+		default:
+			return "", nil, fmt.Errorf("unknown aggregate function: %q", a.Func)
+		}
+		as := a.As
+		arg := a.Column
+		if a.Column == "*" {
+			if a.Func != Count {
+				return "", nil, fmt.Errorf("%s(*) is not supported", a.Func)
+			}
+			if as == "" {
+				as = string(Count)
+			}
+		} else {
+			if !hasColumn(m, entity, a.Column) {
+				return "", nil, fmt.Errorf("%w: %q is not mapped", ErrInvalidColumn, a.Column)
+			}
+			if as == "" {
+				as = string(a.Func) + "_" + a.Column
+			}
+			arg = quoteColumn(a.Column)
+		}
+		if !validIdentifier(as) {
+			return "", nil, fmt.Errorf("invalid alias: %q", as)
+		}
+		selects = append(selects, fmt.Sprintf("%s(%s) AS %s", a.Func, arg, as))
+	}
+
+	query := fmt.Sprintf("SELECT %s FROM %s", strings.Join(selects, ", "), table)
+	var args []interface{}
+	if q.Where != nil {
+		expr, whereArgs, err := q.Where.compile(m, entity, nil)
+		if err != nil {
+			return "", nil, err
+		}
+		query += " WHERE " + expr
+		args = whereArgs
+	}
+	if len(q.GroupBy) > 0 {
+		groupBy := strings.Join(quoteColumns(q.GroupBy), ", ")
+		query += " GROUP BY " + groupBy + " ORDER BY " + groupBy
+	}
+	if q.Limit > 0 {
+		args = append(args, q.Limit)
+		query += fmt.Sprintf(" LIMIT $%d", len(args))
+	}
+
+	return query, args, nil
+}
@@ -0,0 +1,52 @@
+package repo
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/eendLabs/eh-pg/pkg/mocks"
+)
+
+func TestAggregateQuery(t *testing.T) {
+	query, args, err := AggregateQuery{
+		GroupBy: []string{"content"},
+		Aggregates: []Aggregation{
+			{Func: Count, Column: "*"},
+			{Func: Sum, Column: "version"},
+			{Func: Max, Column: "created_at", As: "latest"},
+		},
+		Where: Gt("version", 1),
+		Limit: 10,
+	}.query(defaultMapper, "models", &mocks.Model{})
+	if err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	expected := "SELECT content, count(*) AS count, sum(version) AS sum_version, " +
+		"max(created_at) AS latest FROM models WHERE version > $1 " +
+		"GROUP BY content ORDER BY content LIMIT $2"
+	if query != expected {
+		t.Error("the query should be correct:", query)
+	}
+	if len(args) != 2 || args[0] != 1 || args[1] != 10 {
+		t.Error("the args should be correct:", args)
+	}
+
+	for _, q := range []AggregateQuery{
+		{},
+		{Aggregates: []Aggregation{{Func: "drop", Column: "version"}}},
+		{Aggregates: []Aggregation{{Func: Sum, Column: "*"}}},
+		{Aggregates: []Aggregation{{Func: Count, Column: "*", As: "n; --"}}},
+	} {
+		if _, _, err := q.query(defaultMapper, "models", &mocks.Model{}); err == nil {
+			t.Error("there should be an error:", q)
+		}
+	}
+	for _, q := range []AggregateQuery{
+		{GroupBy: []string{"password"}, Aggregates: []Aggregation{{Func: Count, Column: "*"}}},
+		{Aggregates: []Aggregation{{Func: Sum, Column: "password"}}},
+	} {
+		if _, _, err := q.query(defaultMapper, "models", &mocks.Model{}); !errors.Is(err, ErrInvalidColumn) {
+			t.Error("there should be a ErrInvalidColumn error:", err)
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package repo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+
+	eh "github.com/looplab/eventhorizon"
+)
+
+// ErrCouldNotAnalyze is when the table could not be analyzed.
+var ErrCouldNotAnalyze = errors.New("could not analyze table")
+
+// Analyze runs ANALYZE on the table, so the planner has fresh statistics.
+func (r *Repo) Analyze(ctx context.Context) error {
+	if err := r.analyze(ctx, r.config.TableName); err != nil {
+		return eh.RepoError{
+			Err:       ErrCouldNotAnalyze,
+			BaseErr:   err,
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	}
+	return nil
+}
+
+// autoAnalyze analyzes the tables after a bulk operation when AutoAnalyze is
+// configured. Errors are only logged, the bulk operation itself succeeded.
+func (r *Repo) autoAnalyze(ctx context.Context, tables ...string) {
+	if !r.config.AutoAnalyze {
+		return
+	}
+	for _, table := range tables {
+		if err := r.analyze(ctx, table); err != nil {
+			log.Printf("eh-pg: could not analyze %s: %v", table, err)
+		}
+	}
+}
+
+// analyze runs ANALYZE in the transaction of the context, if any, as the
+// tables may be locked by it.
+func (r *Repo) analyze(ctx context.Context, table string) error {
+	return r.inSettings(ctx, func(ctx context.Context) error {
+		ex, release, err := r.conn(ctx, true)
+		if err != nil {
+			return err
+		}
+		defer release()
+
+		_, err = ex.ExecContext(ctx, fmt.Sprintf("ANALYZE %s", table))
+		return err
+	})
+}
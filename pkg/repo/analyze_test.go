@@ -0,0 +1,29 @@
+package repo
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/jmoiron/sqlx"
+	eh "github.com/looplab/eventhorizon"
+)
+
+func TestAnalyze(t *testing.T) {
+	db, err := sqlx.Open("postgres", "host=localhost port=1 connect_timeout=1")
+	if err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+
+	r, err := NewRepoWithClient(&Config{TableName: "models"}, db)
+	if err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	ctx := eh.NewContextWithNamespace(context.Background(), "ns")
+	err = r.Analyze(ctx)
+	var rrErr eh.RepoError
+	if !errors.As(err, &rrErr) || !errors.Is(rrErr.Err, ErrCouldNotAnalyze) ||
+		rrErr.BaseErr == nil || rrErr.Namespace != "ns" {
+		t.Error("there should be a ErrCouldNotAnalyze error:", err)
+	}
+}
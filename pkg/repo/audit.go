@@ -0,0 +1,47 @@
+package repo
+
+import (
+	"fmt"
+)
+
+// AuditConfig sets audit timestamps with the database time on Save, so that
+// all read models get consistent timestamps regardless of the clocks of the
+// projectors. The created column is only written when the entity is inserted,
+// the updated column on every write. The columns must exist in the table. If
+// they are also mapped by the entity the database time replaces the value of
+// the entity, see Config.Returning to read it back.
+type AuditConfig struct {
+	// CreatedColumn is the column of the insert time. Both columns are
+	// "created_at" and "updated_at" by default, if only one is set the other
+	// is not written.
+	CreatedColumn string
+	// UpdatedColumn is the column of the last write time.
+	UpdatedColumn string
+}
+
+func (c *AuditConfig) provideDefaults() {
+	if c.CreatedColumn == "" && c.UpdatedColumn == "" {
+		c.CreatedColumn = "created_at"
+		c.UpdatedColumn = "updated_at"
+	}
+}
+
+func (c *AuditConfig) validate() error {
+	for _, column := range []string{c.CreatedColumn, c.UpdatedColumn} {
+		if column != "" && !validIdentifier(column) {
+			return fmt.Errorf("%w: audit column %q", ErrInvalidColumn, column)
+		}
+	}
+	return nil
+}
+
+// columns returns the audit columns as computed columns written on Save.
+func (c *AuditConfig) columns() []ComputedColumn {
+	var columns []ComputedColumn
+	for _, column := range []string{c.CreatedColumn, c.UpdatedColumn} {
+		if column != "" {
+			columns = append(columns, ComputedColumn{Name: column, Expr: "now()"})
+		}
+	}
+	return columns
+}
@@ -0,0 +1,52 @@
+package repo
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jmoiron/sqlx"
+	eh "github.com/looplab/eventhorizon"
+
+	"github.com/eendLabs/eh-pg/pkg/mocks"
+)
+
+func TestAudit(t *testing.T) {
+	db, err := sqlx.Open("postgres", "")
+	if err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	config := &Config{TableName: "models", Audit: &AuditConfig{}}
+	r, err := NewRepoWithClient(config, db)
+	if err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	if config.Audit.CreatedColumn != "created_at" || config.Audit.UpdatedColumn != "updated_at" {
+		t.Error("the columns should be the defaults:", config.Audit)
+	}
+
+	m := &mocks.Model{ID: uuid.New(), Content: "m", CreatedAt: time.Now()}
+	query, args, err := r.upsertSpec().query(entityColumns(defaultMapper, m), []eh.Entity{m})
+	if err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	expected := "INSERT INTO models (content, id, version, created_at, updated_at) " +
+		"VALUES ($1, $2, $3, (now()), (now())) " +
+		"ON CONFLICT (id) DO UPDATE SET content = EXCLUDED.content, " +
+		"id = EXCLUDED.id, version = EXCLUDED.version, " +
+		"updated_at = EXCLUDED.updated_at"
+	if query != expected {
+		t.Error("the query should be correct:", query)
+	}
+	if len(args) != 3 {
+		t.Error("the created time of the entity should not be used:", args)
+	}
+
+	if _, err := NewRepoWithClient(&Config{
+		TableName: "models",
+		Audit:     &AuditConfig{UpdatedColumn: "updated at"},
+	}, db); !errors.Is(err, ErrInvalidColumn) {
+		t.Error("there should be a ErrInvalidColumn error:", err)
+	}
+}
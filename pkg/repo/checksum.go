@@ -0,0 +1,79 @@
+package repo
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+
+	"github.com/google/uuid"
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+	eh "github.com/looplab/eventhorizon"
+)
+
+// Checksum returns the checksum of an entity, the hex encoded SHA-256 of its
+// JSON encoding. It is the value stored in the checksum column on Save.
+func Checksum(entity eh.Entity) (string, error) {
+	b, err := json.Marshal(entity)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// checksumColumn returns the checksum column as a computed column.
+func checksumColumn(name string) ComputedColumn {
+	return ComputedColumn{Name: name, Func: func(entity eh.Entity) (interface{}, error) {
+		return Checksum(entity)
+	}}
+}
+
+// Checksums returns the stored checksums of the entities with the given IDs,
+// so that sync tooling can cheaply find the entities that differ between two
+// databases before transferring them. Missing IDs are skipped. It requires
+// Config.ChecksumColumn.
+func (r *Repo) Checksums(ctx context.Context, ids []uuid.UUID) (map[uuid.UUID]string, error) {
+	column := r.config.ChecksumColumn
+	if column == "" {
+		return nil, eh.RepoError{
+			Err:       eh.ErrCouldNotLoadEntity,
+			BaseErr:   fmt.Errorf("%w: no checksum column", ErrInvalidColumn),
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	}
+
+	strs := make([]string, len(ids))
+	for i, id := range ids {
+		strs[i] = id.String()
+	}
+
+	q, release, err := r.conn(ctx, false)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	var rows []struct {
+		ID       uuid.UUID `db:"id"`
+		Checksum string    `db:"checksum"`
+	}
+	if err := sqlx.SelectContext(ctx, q, &rows, fmt.Sprintf(
+		"SELECT id, %s AS checksum FROM %s WHERE id = ANY($1::uuid[])",
+		column, r.config.TableName), pq.Array(strs)); err != nil {
+		return nil, eh.RepoError{
+			Err:       eh.ErrCouldNotLoadEntity,
+			BaseErr:   err,
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	}
+
+	checksums := make(map[uuid.UUID]string, len(rows))
+	for _, row := range rows {
+		checksums[row.ID] = row.Checksum
+	}
+
+	return checksums, nil
+}
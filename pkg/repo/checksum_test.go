@@ -0,0 +1,81 @@
+package repo
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/jmoiron/sqlx"
+	eh "github.com/looplab/eventhorizon"
+
+	"github.com/eendLabs/eh-pg/pkg/mocks"
+)
+
+func TestChecksum(t *testing.T) {
+	m := &mocks.Model{ID: uuid.New(), Content: "a"}
+	sum1, err := Checksum(m)
+	if err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	if sum2, _ := Checksum(&mocks.Model{ID: m.ID, Content: "a"}); sum2 != sum1 {
+		t.Error("the checksum should be stable:", sum1, sum2)
+	}
+	if sum3, _ := Checksum(&mocks.Model{ID: m.ID, Content: "b"}); sum3 == sum1 {
+		t.Error("the checksum should change with the content")
+	}
+
+	db, err := sqlx.Open("postgres", "")
+	if err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	r, err := NewRepoWithClient(&Config{
+		TableName:      "models",
+		ChecksumColumn: "checksum",
+	}, db)
+	if err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	_, args, err := r.upsertSpec().query(entityColumns(defaultMapper, m), []eh.Entity{m})
+	if err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	if len(args) != 5 || args[4] != sum1 {
+		t.Error("the checksum should be saved:", args)
+	}
+
+	_, err = NewRepoWithClient(&Config{TableName: "models", ChecksumColumn: "a b"}, db)
+	if !errors.Is(err, ErrInvalidColumn) {
+		t.Error("there should be a ErrInvalidColumn error:", err)
+	}
+}
+
+func TestSkipUnchanged(t *testing.T) {
+	db, err := sqlx.Open("postgres", "")
+	if err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	r, err := NewRepoWithClient(&Config{
+		TableName:      "models",
+		ChecksumColumn: "checksum",
+		SkipUnchanged:  true,
+	}, db)
+	if err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+
+	m := &versionedModel{mocks.Model{ID: uuid.New(), Version: 1}}
+	query, _, err := r.upsertSpec().query(entityColumns(defaultMapper, m), []eh.Entity{m})
+	if err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	if !strings.HasSuffix(query, " WHERE models.version <= EXCLUDED.version "+
+		"AND models.checksum IS DISTINCT FROM EXCLUDED.checksum") {
+		t.Error("the query should skip unchanged rows:", query)
+	}
+
+	_, err = NewRepoWithClient(&Config{TableName: "models", SkipUnchanged: true}, db)
+	if !errors.Is(err, ErrInvalidColumn) {
+		t.Error("there should be a ErrInvalidColumn error:", err)
+	}
+}
@@ -0,0 +1,55 @@
+package repo
+
+import (
+	"errors"
+	"fmt"
+
+	eh "github.com/looplab/eventhorizon"
+)
+
+// ErrInvalidComputedColumn is when a computed column is not valid.
+var ErrInvalidComputedColumn = errors.New("invalid computed column")
+
+// ComputedColumn is a derived column written on every Save, like a search
+// text or a total amount, so denormalization logic lives in one place instead
+// of in every projector. The value is computed either by a Go function from
+// the entity or by a SQL expression where the mapped columns of the entity
+// are referenced as named placeholders, e.g:
+//
+//	ComputedColumn{Name: "search_text", Expr: "lower({content})"}
+//	ComputedColumn{Name: "total_amount", Func: func(e eh.Entity) (interface{}, error) {
+//	    return e.(*Order).Total(), nil
+//	}}
+//
+// The column must exist in the table. If it is also mapped by the entity the
+// computed value replaces the value of the entity.
+type ComputedColumn struct {
+	// Name is the name of the column.
+	Name string
+	// Func computes the value from the entity.
+	Func func(eh.Entity) (interface{}, error)
+	// Expr is a SQL expression computing the value.
+	Expr string
+}
+
+func (c ComputedColumn) validate() error {
+	if !validIdentifier(c.Name) {
+		return fmt.Errorf("%w: invalid name %q", ErrInvalidComputedColumn, c.Name)
+	}
+	if (c.Func == nil) == (c.Expr == "") {
+		return fmt.Errorf("%w: %s: exactly one of Func and Expr must be set",
+			ErrInvalidComputedColumn, c.Name)
+	}
+	return nil
+}
+
+// render renders the expression with the parameters of the mapped columns.
+func (c ComputedColumn) render(params map[string]string) (string, error) {
+	for _, m := range placeholderRe.FindAllStringSubmatch(c.Expr, -1) {
+		if _, ok := params[m[1]]; !ok {
+			return "", fmt.Errorf("%w: %s: unknown column {%s}",
+				ErrInvalidComputedColumn, c.Name, m[1])
+		}
+	}
+	return "(" + render(c.Expr, params) + ")", nil
+}
@@ -0,0 +1,113 @@
+package repo
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"github.com/jmoiron/sqlx"
+	eh "github.com/looplab/eventhorizon"
+)
+
+// ErrEntityExists is when an entity already exists with ConflictError.
+var ErrEntityExists = errors.New("entity already exists")
+
+// ErrInvalidConflictStrategy is when the conflict strategy is unknown.
+var ErrInvalidConflictStrategy = errors.New("invalid conflict strategy")
+
+// ConflictStrategy is how Save handles entities that already exist.
+type ConflictStrategy int
+
+const (
+	// ConflictUpsert updates existing rows, the default.
+	ConflictUpsert ConflictStrategy = iota
+	// ConflictError returns an eh.ErrCouldNotSaveEntity error with
+	// ErrEntityExists for existing rows.
+	ConflictError
+	// ConflictIgnore keeps existing rows as they are, like ON CONFLICT DO
+	// NOTHING.
+	ConflictIgnore
+	// ConflictUpdateOnly only updates existing rows, and returns an
+	// eh.ErrEntityNotFound error for missing ones.
+	ConflictUpdateOnly
+)
+
+func (s ConflictStrategy) validate() error {
+	if s < ConflictUpsert || s > ConflictUpdateOnly {
+		return fmt.Errorf("%w: %d", ErrInvalidConflictStrategy, s)
+	}
+	return nil
+}
+
+// writeTx runs f in the repo-managed transaction of the context, or in a new
+// transaction committed when f succeeds, with the settings of the context,
+// see inSettings.
+func (r *Repo) writeTx(ctx context.Context, f func(*sqlx.Tx) error) error {
+	if settings, err := r.settings(ctx); err != nil {
+		return err
+	} else if len(settings) > 0 && !r.settingsApplied(ctx, settings) {
+		return r.withSettings(ctx, settings, func(ctx context.Context) error {
+			return f(r.txFromContext(ctx))
+		})
+	}
+
+	if tx := r.txFromContext(ctx); tx != nil {
+		return f(tx)
+	}
+
+	release, err := r.acquireWrite(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	tx, err := r.client.BeginTxx(ctx, &sql.TxOptions{})
+	if err != nil {
+		return eh.RepoError{
+			Err:       eh.ErrCouldNotSaveEntity,
+			BaseErr:   err,
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	}
+	defer tx.Rollback()
+
+	if err := f(tx); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return eh.RepoError{
+			Err:       eh.ErrCouldNotSaveEntity,
+			BaseErr:   err,
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	}
+
+	return nil
+}
+
+// updateOnly locks the stored row of the entity and updates it, for
+// ConflictUpdateOnly.
+func (r *Repo) updateOnly(ctx context.Context, spec upsertSpec, entity eh.Entity) error {
+	return r.writeTx(ctx, func(tx *sqlx.Tx) error {
+		var exists bool
+		err := tx.GetContext(ctx, &exists, fmt.Sprintf(
+			"SELECT true FROM %s WHERE id = $1 FOR UPDATE",
+			r.config.TableName), entity.EntityID())
+		if errors.Is(err, sql.ErrNoRows) {
+			return eh.RepoError{
+				Err:       eh.ErrEntityNotFound,
+				BaseErr:   &NotFoundError{ID: entity.EntityID(), Table: r.config.TableName},
+				Namespace: eh.NamespaceFromContext(ctx),
+			}
+		} else if err != nil {
+			return eh.RepoError{
+				Err:       eh.ErrCouldNotSaveEntity,
+				BaseErr:   err,
+				Namespace: eh.NamespaceFromContext(ctx),
+			}
+		}
+
+		return r.saveIn(ctx, tx, spec, entity)
+	})
+}
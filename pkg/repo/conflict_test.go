@@ -0,0 +1,39 @@
+package repo
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/jmoiron/sqlx"
+	eh "github.com/looplab/eventhorizon"
+
+	"github.com/eendLabs/eh-pg/pkg/mocks"
+)
+
+func TestConflictStrategy(t *testing.T) {
+	db, err := sqlx.Open("postgres", "")
+	if err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+
+	if _, err := NewRepoWithClient(&Config{
+		TableName:  "models",
+		OnConflict: ConflictUpdateOnly + 1,
+	}, db); !errors.Is(err, ErrInvalidConflictStrategy) {
+		t.Error("there should be a ErrInvalidConflictStrategy error:", err)
+	}
+
+	r, err := NewRepoWithClient(&Config{
+		TableName:  "models",
+		OnConflict: ConflictError,
+	}, db)
+	if err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	err = r.SaveAll(context.Background(), []eh.Entity{&mocks.Model{ID: uuid.New()}})
+	if rrErr, ok := err.(eh.RepoError); !ok || !errors.Is(rrErr.BaseErr, ErrInvalidConflictStrategy) {
+		t.Error("there should be a ErrInvalidConflictStrategy error:", err)
+	}
+}
@@ -0,0 +1,111 @@
+package repo
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/jmoiron/sqlx"
+	eh "github.com/looplab/eventhorizon"
+)
+
+// ErrCouldNotCount is when the entities could not be counted.
+var ErrCouldNotCount = errors.New("could not count entities")
+
+// Count returns the exact number of entities in the table.
+func (r *Repo) Count(ctx context.Context) (int64, error) {
+	return r.CountWithFilter(ctx, "")
+}
+
+// CountWithFilter returns the number of entities matching the filter, using
+// the same expression and positional args as FindWithFilter. An empty
+// expression counts all entities.
+func (r *Repo) CountWithFilter(ctx context.Context, expr string,
+	args ...interface{}) (int64, error) {
+	query := fmt.Sprintf("SELECT count(*) FROM %s", r.readTable())
+	if expr != "" {
+		query += " WHERE " + expr
+	}
+
+	q, release, err := r.conn(ctx, false)
+	if err != nil {
+		return 0, err
+	}
+	defer release()
+
+	var n int64
+	if err := sqlx.GetContext(ctx, q, &n, query, args...); err != nil {
+		return 0, eh.RepoError{
+			Err:       ErrCouldNotCount,
+			BaseErr:   err,
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	}
+
+	return n, nil
+}
+
+// EstimateCount returns an approximate number of rows in the table, read from
+// the planner statistics in pg_class. If the table has not been analyzed yet
+// the row estimate of the query plan is used instead. It is much cheaper than
+// an exact COUNT(*) on large tables and suitable for displaying totals.
+func (r *Repo) EstimateCount(ctx context.Context) (int64, error) {
+	q, release, err := r.conn(ctx, false)
+	if err != nil {
+		return 0, err
+	}
+	defer release()
+
+	var reltuples float64
+	if err := sqlx.GetContext(ctx, q, &reltuples,
+		"SELECT reltuples FROM pg_class WHERE oid = to_regclass($1)",
+		r.config.TableName); err != nil {
+		return 0, eh.RepoError{
+			Err:       ErrCouldNotCount,
+			BaseErr:   err,
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	}
+	if reltuples >= 0 {
+		return int64(reltuples), nil
+	}
+
+	// Never vacuumed or analyzed, fall back to the planner estimate.
+	var plan []byte
+	if err := sqlx.GetContext(ctx, q, &plan, fmt.Sprintf(
+		"EXPLAIN (FORMAT JSON) SELECT 1 FROM %s", r.config.TableName)); err != nil {
+		return 0, eh.RepoError{
+			Err:       ErrCouldNotCount,
+			BaseErr:   err,
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	}
+	n, err := planRows(plan)
+	if err != nil {
+		return 0, eh.RepoError{
+			Err:       ErrCouldNotCount,
+			BaseErr:   err,
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	}
+
+	return n, nil
+}
+
+// planRows returns the estimated rows of the top node of a JSON query plan.
+func planRows(plan []byte) (int64, error) {
+	var explain []struct {
+		Plan struct {
+			Rows float64 `json:"Plan Rows"`
+		} `json:"Plan"`
+	}
+	if err := json.Unmarshal(plan, &explain); err != nil {
+		return 0, err
+	}
+	if len(explain) == 0 {
+		return 0, errors.New("empty query plan")
+	}
+
+	return int64(explain[0].Plan.Rows), nil
+}
@@ -0,0 +1,20 @@
+package repo
+
+import (
+	"testing"
+)
+
+func TestPlanRows(t *testing.T) {
+	plan := []byte(`[{"Plan": {"Node Type": "Seq Scan", "Plan Rows": 2550}}]`)
+	n, err := planRows(plan)
+	if err != nil {
+		t.Error("there should be no error:", err)
+	}
+	if n != 2550 {
+		t.Error("the estimate should be correct:", n)
+	}
+
+	if _, err := planRows([]byte(`[]`)); err == nil {
+		t.Error("there should be an error")
+	}
+}
@@ -0,0 +1,121 @@
+package repo
+
+import (
+	"context"
+	"errors"
+
+	"github.com/jmoiron/sqlx"
+	eh "github.com/looplab/eventhorizon"
+)
+
+// ErrInvalidQuery is when a query was not returned from the callback to FindCustom.
+var ErrInvalidQuery = errors.New("invalid query")
+
+// FindCustom uses a callback to run a custom SELECT (with joins, CTEs etc.) on
+// the database and returns the rows as entities created by the factory. It
+// can also be used to do queries that does not map to the model by executing
+// the query in the callback and returning nil to block scanning in FindCustom.
+// Expect a ErrInvalidQuery if returning nil rows from the callback.
+//
+// The callback gets the client, outside of the search_path of the namespace
+// schema, so a ErrNotInNamespaceSchema is returned for the namespaces of
+// Config.NamespaceSchemas other than the default one, use FindRaw instead.
+func (r *Repo) FindCustom(ctx context.Context,
+	f func(context.Context, *sqlx.DB) (*sqlx.Rows, error)) ([]eh.Entity, error) {
+	if r.factoryFn == nil {
+		return nil, eh.RepoError{
+			Err:       ErrModelNotSet,
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	}
+	if ns := eh.NamespaceFromContext(ctx); r.config.NamespaceSchemas != nil &&
+		ns != eh.DefaultNamespace {
+		return nil, eh.RepoError{
+			Err:       ErrNotInNamespaceSchema,
+			Namespace: ns,
+		}
+	}
+
+	release, err := r.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	rows, err := f(ctx, r.client)
+	if err != nil {
+		return nil, eh.RepoError{
+			Err:       ErrInvalidQuery,
+			BaseErr:   err,
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	}
+	if rows == nil {
+		return nil, eh.RepoError{
+			Err:       ErrInvalidQuery,
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	}
+
+	return r.scan(ctx, rows)
+}
+
+// FindRaw runs an arbitrary SELECT, like a complex join, and returns the rows
+// as entities created by the factory. The rows must have the columns of the
+// entity.
+//
+// The caller owns the safety of the SQL: it is run as is, so values must be
+// passed as positional parameters ($1, $2, ...) bound to args and never be
+// concatenated into the query.
+func (r *Repo) FindRaw(ctx context.Context, query string,
+	args ...interface{}) ([]eh.Entity, error) {
+	if r.factoryFn == nil {
+		return nil, eh.RepoError{
+			Err:       ErrModelNotSet,
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	}
+
+	return r.query(ctx, query, args...)
+}
+
+// Sqlizer is a query builder, like squirrel.SelectBuilder.
+type Sqlizer interface {
+	ToSql() (string, []interface{}, error)
+}
+
+// FindWithBuilder runs the SELECT built by a query builder, like a
+// squirrel.SelectBuilder, and returns the rows as entities created by the
+// factory. Both the "?" and "$1" placeholder formats are accepted.
+func (r *Repo) FindWithBuilder(ctx context.Context, b Sqlizer) ([]eh.Entity, error) {
+	if r.factoryFn == nil {
+		return nil, eh.RepoError{
+			Err:       ErrModelNotSet,
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	}
+
+	query, args, err := builderQuery(b)
+	if err != nil {
+		return nil, eh.RepoError{
+			Err:       ErrInvalidQuery,
+			BaseErr:   err,
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	}
+
+	return r.query(ctx, query, args...)
+}
+
+// builderQuery returns the query of the builder using dollar placeholders.
+func builderQuery(b Sqlizer) (string, []interface{}, error) {
+	if b == nil {
+		return "", nil, errors.New("no query builder")
+	}
+	query, args, err := b.ToSql()
+	if err != nil {
+		return "", nil, err
+	}
+
+	return sqlx.Rebind(sqlx.DOLLAR, query), args, nil
+}
@@ -0,0 +1,77 @@
+package repo
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/jmoiron/sqlx"
+	eh "github.com/looplab/eventhorizon"
+
+	"github.com/eendLabs/eh-pg/pkg/mocks"
+)
+
+type builder struct {
+	query string
+	args  []interface{}
+	err   error
+}
+
+func (b builder) ToSql() (string, []interface{}, error) {
+	return b.query, b.args, b.err
+}
+
+func TestFindWithBuilder(t *testing.T) {
+	query, args, err := builderQuery(builder{
+		query: "SELECT * FROM models WHERE content = ? AND version > ?",
+		args:  []interface{}{"foo", 1},
+	})
+	if err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	if query != "SELECT * FROM models WHERE content = $1 AND version > $2" {
+		t.Error("the query should use dollar placeholders:", query)
+	}
+	if len(args) != 2 {
+		t.Error("the args should be correct:", args)
+	}
+
+	query, _, _ = builderQuery(builder{query: "SELECT * FROM models WHERE id = $1"})
+	if query != "SELECT * FROM models WHERE id = $1" {
+		t.Error("the query should be unchanged:", query)
+	}
+
+	db, err := sqlx.Open("postgres", "")
+	if err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	r, err := NewRepoWithClient(&Config{TableName: "models"}, db)
+	if err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	r.SetEntityFactory(func() eh.Entity { return &mocks.Model{} })
+
+	buildErr := errors.New("build error")
+	_, err = r.FindWithBuilder(context.Background(), builder{err: buildErr})
+	if rrErr, ok := err.(eh.RepoError); !ok || rrErr.Err != ErrInvalidQuery ||
+		rrErr.BaseErr != buildErr {
+		t.Error("there should be a ErrInvalidQuery error:", err)
+	}
+	if _, err := r.FindWithBuilder(context.Background(), nil); !errors.Is(err, ErrInvalidQuery) {
+		t.Error("there should be a ErrInvalidQuery error:", err)
+	}
+}
+
+func TestFindRawModelNotSet(t *testing.T) {
+	db, err := sqlx.Open("postgres", "")
+	if err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	r, err := NewRepoWithClient(&Config{TableName: "models"}, db)
+	if err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	if _, err := r.FindRaw(context.Background(), "SELECT 1"); !errors.Is(err, ErrModelNotSet) {
+		t.Error("there should be a ErrModelNotSet error:", err)
+	}
+}
@@ -0,0 +1,141 @@
+package repo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/google/uuid"
+	eh "github.com/looplab/eventhorizon"
+)
+
+// ErrCouldNotDiff is when two namespaces could not be compared.
+var ErrCouldNotDiff = errors.New("could not diff namespaces")
+
+// DiffReport is the difference between the entities of two namespaces.
+type DiffReport struct {
+	// OnlyInA are the IDs of the entities only in the first namespace.
+	OnlyInA []uuid.UUID
+	// OnlyInB are the IDs of the entities only in the second namespace.
+	OnlyInB []uuid.UUID
+	// Changed are the IDs of the entities in both namespaces that differ.
+	Changed []uuid.UUID
+}
+
+// Equal reports if the namespaces hold the same entities.
+func (d DiffReport) Equal() bool {
+	return len(d.OnlyInA) == 0 && len(d.OnlyInB) == 0 && len(d.Changed) == 0
+}
+
+// DiffOption is an option for DiffNamespaces.
+type DiffOption func(*diffOptions)
+
+type diffOptions struct {
+	columns []string
+}
+
+// WithDiffColumns compares only the given columns, to ignore columns that
+// legitimately differ between environments, like write timestamps.
+func WithDiffColumns(columns ...string) DiffOption {
+	return func(o *diffOptions) {
+		o.columns = append(o.columns, columns...)
+	}
+}
+
+// namespaceTable returns the table of a namespace, the table in the schema of
+// the namespace with Config.NamespaceSchemas.
+func (r *Repo) namespaceTable(ns string) (string, error) {
+	c := r.config.NamespaceSchemas
+	if c == nil {
+		return "", ErrNoNamespaceSchemas
+	}
+	schema, err := c.schema(ns)
+	if err != nil {
+		return "", err
+	}
+	return schema + "." + r.config.TableName, nil
+}
+
+// DiffNamespaces compares the rows of two namespaces (tenants or
+// environments), by ID and by a checksum of the row or of the columns given
+// with WithDiffColumns, for migration validation and drift checks. The
+// comparison runs in the database, only the differing IDs are returned. It
+// requires Config.NamespaceSchemas, otherwise the namespaces share the table.
+func (r *Repo) DiffNamespaces(ctx context.Context, nsA, nsB string,
+	opts ...DiffOption) (DiffReport, error) {
+	var o diffOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	query, err := r.diffQuery(nsA, nsB, o)
+	if err != nil {
+		return DiffReport{}, eh.RepoError{
+			Err:       ErrCouldNotDiff,
+			BaseErr:   err,
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	}
+
+	release, err := r.acquire(ctx)
+	if err != nil {
+		return DiffReport{}, err
+	}
+	defer release()
+
+	var rows []struct {
+		ID       uuid.UUID `db:"id"`
+		MissingA bool      `db:"missing_a"`
+		MissingB bool      `db:"missing_b"`
+	}
+	if err := r.client.SelectContext(ctx, &rows, query); err != nil {
+		return DiffReport{}, eh.RepoError{
+			Err:       ErrCouldNotDiff,
+			BaseErr:   err,
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	}
+
+	var report DiffReport
+	for _, row := range rows {
+		switch {
+		case row.MissingA:
+			report.OnlyInB = append(report.OnlyInB, row.ID)
+		case row.MissingB:
+			report.OnlyInA = append(report.OnlyInA, row.ID)
+		default:
+			report.Changed = append(report.Changed, row.ID)
+		}
+	}
+
+	return report, nil
+}
+
+func (r *Repo) diffQuery(nsA, nsB string, o diffOptions) (string, error) {
+	tableA, err := r.namespaceTable(nsA)
+	if err != nil {
+		return "", err
+	}
+	tableB, err := r.namespaceTable(nsB)
+	if err != nil {
+		return "", err
+	}
+
+	row := "t"
+	if len(o.columns) > 0 {
+		for _, c := range o.columns {
+			if !validIdentifier(c) {
+				return "", fmt.Errorf("%w: %q", ErrInvalidColumn, c)
+			}
+		}
+		row = "ROW(" + strings.Join(o.columns, ", ") + ")"
+	}
+
+	return fmt.Sprintf(
+		"SELECT coalesce(a.id, b.id) AS id, a.id IS NULL AS missing_a, b.id IS NULL AS missing_b "+
+			"FROM (SELECT id, md5(%[3]s::text) AS sum FROM %[1]s t) a "+
+			"FULL JOIN (SELECT id, md5(%[3]s::text) AS sum FROM %[2]s t) b ON a.id = b.id "+
+			"WHERE a.id IS NULL OR b.id IS NULL OR a.sum <> b.sum ORDER BY 1",
+		tableA, tableB, row), nil
+}
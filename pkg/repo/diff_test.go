@@ -0,0 +1,55 @@
+package repo
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/jmoiron/sqlx"
+	eh "github.com/looplab/eventhorizon"
+)
+
+func TestDiffQuery(t *testing.T) {
+	db, err := sqlx.Open("postgres", "")
+	if err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	r, err := NewRepoWithClient(&Config{
+		TableName:        "models",
+		NamespaceSchemas: &NamespaceSchemaConfig{Prefix: "tenant_"},
+	}, db)
+	if err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+
+	query, err := r.diffQuery(eh.DefaultNamespace, "staging",
+		diffOptions{columns: []string{"content", "version"}})
+	if err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	expected := "SELECT coalesce(a.id, b.id) AS id, a.id IS NULL AS missing_a, b.id IS NULL AS missing_b " +
+		"FROM (SELECT id, md5(ROW(content, version)::text) AS sum FROM public.models t) a " +
+		"FULL JOIN (SELECT id, md5(ROW(content, version)::text) AS sum FROM tenant_staging.models t) b ON a.id = b.id " +
+		"WHERE a.id IS NULL OR b.id IS NULL OR a.sum <> b.sum ORDER BY 1"
+	if query != expected {
+		t.Error("the query should be correct:", query)
+	}
+
+	if _, err := r.diffQuery("a; DROP TABLE models", "b", diffOptions{}); err == nil {
+		t.Error("there should be an error")
+	}
+	if _, err := r.diffQuery("a", "b", diffOptions{columns: []string{"1"}}); !errors.Is(err, ErrInvalidColumn) {
+		t.Error("there should be a ErrInvalidColumn error:", err)
+	}
+
+	r, err = NewRepoWithClient(&Config{TableName: "models"}, db)
+	if err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	if _, err := r.diffQuery(eh.DefaultNamespace, "staging", diffOptions{}); !errors.Is(err, ErrNoNamespaceSchemas) {
+		t.Error("there should be a ErrNoNamespaceSchemas error:", err)
+	}
+
+	if !(DiffReport{}).Equal() {
+		t.Error("an empty report should be equal")
+	}
+}
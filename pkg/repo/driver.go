@@ -0,0 +1,44 @@
+package repo
+
+import (
+	"errors"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	// Registers the pgx driver of database/sql.
+	_ "github.com/jackc/pgx/v5/stdlib"
+	"github.com/lib/pq"
+)
+
+// Driver is the database/sql driver NewRepo connects with.
+type Driver string
+
+const (
+	// DriverPQ is the lib/pq driver, the default.
+	DriverPQ Driver = "postgres"
+	// DriverPgx is the stdlib adapter of jackc/pgx/v5. It is the maintained
+	// driver, with better error details. Repos created with NewRepoWithClient
+	// use the driver of the client, which can be opened with it as "pgx":
+	//
+	//	client, err := sqlx.Connect("pgx", connString)
+	DriverPgx Driver = "pgx"
+)
+
+// Error codes of Postgres used by the repo, see
+// https://www.postgresql.org/docs/current/errcodes-appendix.html.
+const (
+	codeInsufficientPrivilege = "42501"
+)
+
+// errorCode returns the SQLSTATE code of the Postgres error of both drivers,
+// or "" if err is not one.
+func errorCode(err error) string {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		return string(pqErr.Code)
+	}
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		return pgErr.Code
+	}
+	return ""
+}
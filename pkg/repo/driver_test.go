@@ -0,0 +1,47 @@
+package repo
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+)
+
+func TestErrorCode(t *testing.T) {
+	for _, c := range []struct {
+		err      error
+		expected string
+	}{
+		{&pq.Error{Code: "42501"}, codeInsufficientPrivilege},
+		{fmt.Errorf("truncate: %w", &pgconn.PgError{Code: "42501"}), codeInsufficientPrivilege},
+		{&pgconn.PgError{Code: "23505"}, "23505"},
+		{errors.New("connection refused"), ""},
+		{nil, ""},
+	} {
+		if code := errorCode(c.err); code != c.expected {
+			t.Error("the code should be correct:", c.err, code)
+		}
+	}
+}
+
+func TestDriver(t *testing.T) {
+	config := &Config{}
+	config.provideDefaults()
+	if config.Driver != DriverPQ {
+		t.Error("the driver should be lib/pq by default:", config.Driver)
+	}
+
+	db, err := sqlx.Open(string(DriverPgx), "")
+	if err != nil {
+		t.Fatal("the pgx driver should be registered:", err)
+	}
+	if db.Rebind("id = ?") != "id = $1" {
+		t.Error("the pgx client should use dollar placeholders")
+	}
+	if _, err := NewRepoWithClient(&Config{TableName: "models"}, db); err != nil {
+		t.Error("there should be no error:", err)
+	}
+}
@@ -0,0 +1,64 @@
+package repo
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"github.com/google/uuid"
+	eh "github.com/looplab/eventhorizon"
+)
+
+// NotFoundError is the BaseErr of the eh.ErrEntityNotFound errors returned by
+// Find and Remove, carrying the missing ID and the table. The Err of the
+// eh.RepoError stays eh.ErrEntityNotFound, as projectors and other repos
+// compare it directly. Use AsNotFoundError or errors.As on the BaseErr to get
+// it:
+//
+//	if nf, ok := repo.AsNotFoundError(err); ok {
+//	    log.Printf("%s not found in %s", nf.ID, nf.Table)
+//	}
+type NotFoundError struct {
+	ID    uuid.UUID
+	Table string
+}
+
+// Error implements the Error method of the errors.Error interface.
+func (e *NotFoundError) Error() string {
+	return fmt.Sprintf("no entity with ID %s in %s", e.ID, e.Table)
+}
+
+// Unwrap returns sql.ErrNoRows.
+func (e *NotFoundError) Unwrap() error {
+	return sql.ErrNoRows
+}
+
+// VersionConflictError is the BaseErr of the eh.ErrIncorrectEntityVersion
+// errors returned by Save when the stored entity has a newer version, and by
+// SaveIfVersion when the stored entity has another version.
+type VersionConflictError struct {
+	ID uuid.UUID
+	// Version is the version that was not saved, or the expected version
+	// for SaveIfVersion.
+	Version int
+	Table   string
+}
+
+// Error implements the Error method of the errors.Error interface.
+func (e *VersionConflictError) Error() string {
+	return fmt.Sprintf("version conflict of entity %s in %s at version %d",
+		e.ID, e.Table, e.Version)
+}
+
+// AsNotFoundError returns the NotFoundError of an error returned by the repo.
+func AsNotFoundError(err error) (*NotFoundError, bool) {
+	var rrErr eh.RepoError
+	if errors.As(err, &rrErr) {
+		err = rrErr.BaseErr
+	}
+	var nf *NotFoundError
+	if errors.As(err, &nf) {
+		return nf, true
+	}
+	return nil, false
+}
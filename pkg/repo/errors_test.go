@@ -0,0 +1,37 @@
+package repo
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/google/uuid"
+	eh "github.com/looplab/eventhorizon"
+)
+
+func TestNotFoundError(t *testing.T) {
+	id := uuid.New()
+	err := error(eh.RepoError{
+		Err:     eh.ErrEntityNotFound,
+		BaseErr: &NotFoundError{ID: id, Table: "models"},
+	})
+
+	nf, ok := AsNotFoundError(fmt.Errorf("wrapped: %w", err))
+	if !ok {
+		t.Fatal("there should be a NotFoundError")
+	}
+	if nf.ID != id || nf.Table != "models" {
+		t.Error("the error should be correct:", nf)
+	}
+	if !errors.Is(nf, sql.ErrNoRows) {
+		t.Error("the error should wrap sql.ErrNoRows")
+	}
+
+	if _, ok := AsNotFoundError(eh.RepoError{Err: eh.ErrCouldNotLoadEntity}); ok {
+		t.Error("there should be no NotFoundError")
+	}
+	if _, ok := AsNotFoundError(nil); ok {
+		t.Error("there should be no NotFoundError")
+	}
+}
@@ -0,0 +1,101 @@
+package repo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/eendLabs/eh-pg/pkg/worker"
+)
+
+// ErrInvalidExpiration is when an expiration config is not valid.
+var ErrInvalidExpiration = errors.New("invalid expiration config")
+
+// ExpirationConfig makes entities expire at the time in a column, like
+// sessions and tokens. Expired entities are excluded from all finds and are
+// deleted by a background janitor. The expiration time is either mapped by
+// the entity, or set to the time of the Save plus TTL, in which case the
+// column must not be mapped by the entity.
+type ExpirationConfig struct {
+	// Column is the timestamp column of the expiration time, "expires_at" by
+	// default. Rows where it is NULL never expire.
+	Column string
+	// TTL is optionally the time to live of the entities from their last
+	// Save.
+	TTL time.Duration
+	// Interval is optionally the time between two janitor runs, the expired
+	// rows are not deleted if not set.
+	Interval time.Duration
+	// BatchSize is the max number of rows deleted per statement by the
+	// janitor, 1000 by default.
+	BatchSize int
+}
+
+func (c *ExpirationConfig) provideDefaults() {
+	if c.Column == "" {
+		c.Column = "expires_at"
+	}
+	if c.BatchSize <= 0 {
+		c.BatchSize = 1000
+	}
+}
+
+func (c *ExpirationConfig) validate() error {
+	if !validIdentifier(c.Column) {
+		return fmt.Errorf("%w: invalid column %q", ErrInvalidExpiration, c.Column)
+	}
+	if c.TTL < 0 || c.Interval < 0 {
+		return fmt.Errorf("%w: negative duration", ErrInvalidExpiration)
+	}
+	return nil
+}
+
+// columns returns the expiration column as a computed column written on
+// Save when a TTL is set.
+func (c *ExpirationConfig) columns() []ComputedColumn {
+	if c.TTL == 0 {
+		return nil
+	}
+	return []ComputedColumn{{
+		Name: c.Column,
+		Expr: fmt.Sprintf("now() + interval '%d milliseconds'", c.TTL.Milliseconds()),
+	}}
+}
+
+// DeleteExpired deletes the expired rows in batches, skipping the rows locked
+// by other sessions, and returns the number of deleted rows. It is called
+// periodically by the janitor but can also be called manually.
+func (r *Repo) DeleteExpired(ctx context.Context) (int64, error) {
+	c := r.config.Expiration
+	if c == nil {
+		return 0, nil
+	}
+
+	query := fmt.Sprintf("DELETE FROM %[1]s WHERE id IN ("+
+		"SELECT id FROM %[1]s WHERE %[2]s <= now() "+
+		"LIMIT $1 FOR UPDATE SKIP LOCKED)",
+		r.config.TableName, c.Column)
+
+	var total int64
+	for {
+		affected, err := r.execAffected(ctx, nil, query, c.BatchSize)
+		if err != nil {
+			return total, err
+		}
+		total += affected
+
+		if affected < int64(c.BatchSize) {
+			return total, nil
+		}
+		if err := ctx.Err(); err != nil {
+			return total, err
+		}
+	}
+}
+
+// ExpirationWorker returns the background janitor deleting the expired rows,
+// or nil if not configured.
+func (r *Repo) ExpirationWorker() *worker.Worker {
+	return r.janitor
+}
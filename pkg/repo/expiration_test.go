@@ -0,0 +1,68 @@
+package repo
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jmoiron/sqlx"
+	eh "github.com/looplab/eventhorizon"
+
+	"github.com/eendLabs/eh-pg/pkg/mocks"
+)
+
+func TestExpiration(t *testing.T) {
+	c := &ExpirationConfig{TTL: -time.Hour}
+	c.provideDefaults()
+	if c.Column != "expires_at" || c.BatchSize != 1000 {
+		t.Error("the defaults should be correct:", c)
+	}
+	if err := c.validate(); !errors.Is(err, ErrInvalidExpiration) {
+		t.Error("there should be a ErrInvalidExpiration error:", err)
+	}
+
+	db, err := sqlx.Open("postgres", "host=127.0.0.1 port=1 connect_timeout=1")
+	if err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	r, err := NewRepoWithClient(&Config{
+		TableName:  "sessions",
+		Context:    ctx,
+		SoftDelete: &SoftDeleteConfig{},
+		Expiration: &ExpirationConfig{TTL: 90 * time.Second, Interval: time.Hour},
+	}, db)
+	if err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+
+	if table := r.readTable(); table != "(SELECT * FROM sessions WHERE deleted_at IS NULL AND "+
+		"(expires_at IS NULL OR expires_at > now())) AS sessions" {
+		t.Error("the expired rows should be excluded:", table)
+	}
+
+	m := &mocks.Model{ID: uuid.New()}
+	query, _, err := r.upsertSpec().query(entityColumns(defaultMapper, m), []eh.Entity{m})
+	if err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	if !strings.Contains(query, "(now() + interval '90000 milliseconds')") ||
+		!strings.Contains(query, "expires_at = EXCLUDED.expires_at") {
+		t.Error("the query should set the expiration:", query)
+	}
+
+	// The janitor runs immediately and fails without a database.
+	select {
+	case err := <-r.ExpirationWorker().Errors():
+		if err == nil {
+			t.Error("there should be an error")
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("the janitor should run")
+	}
+	cancel()
+	<-r.ExpirationWorker().Done()
+}
@@ -0,0 +1,49 @@
+package repo
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// PlanFunc receives the query plan of a query, as returned by
+// EXPLAIN (ANALYZE, FORMAT JSON).
+type PlanFunc func(ctx context.Context, query string, plan json.RawMessage)
+
+// WithExplain returns a context making the find queries run with it (like
+// FindAll, FindWithFilter, FindWhere, Search and FindRaw) hand their query
+// plan to f, to diagnose slow queries in production without code changes.
+// The query is executed twice, once by EXPLAIN ANALYZE and once for the
+// result, so it is meant for diagnostics only.
+func WithExplain(ctx context.Context, f PlanFunc) context.Context {
+	return context.WithValue(ctx, explainKey, f)
+}
+
+// explainFunc returns the plan func for the context, or the configured one.
+func (r *Repo) explainFunc(ctx context.Context) PlanFunc {
+	if f, ok := ctx.Value(explainKey).(PlanFunc); ok && f != nil {
+		return f
+	}
+	return r.config.Explain
+}
+
+// explain runs EXPLAIN ANALYZE on the query with q, the connection or the
+// transaction running the query, and hands the plan to the plan func, if any.
+// Errors are logged, they never fail the query.
+func (r *Repo) explain(ctx context.Context, q sqlx.QueryerContext, query string,
+	args ...interface{}) {
+	f := r.explainFunc(ctx)
+	if f == nil {
+		return
+	}
+
+	var plan []byte
+	if err := sqlx.GetContext(ctx, q, &plan,
+		"EXPLAIN (ANALYZE, FORMAT JSON) "+query, args...); err != nil {
+		log.Printf("eh-pg: could not explain query: %v", err)
+		return
+	}
+	f(ctx, query, plan)
+}
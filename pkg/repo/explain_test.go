@@ -0,0 +1,46 @@
+package repo
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/jmoiron/sqlx"
+)
+
+func TestExplainFunc(t *testing.T) {
+	client, err := sqlx.Open("postgres", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var configured, perCall int
+	r, err := NewRepoWithClient(&Config{
+		TableName: "models",
+		Explain: func(context.Context, string, json.RawMessage) {
+			configured++
+		},
+	}, client)
+	if err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+
+	ctx := context.Background()
+	r.explainFunc(ctx)(ctx, "", nil)
+	if configured != 1 {
+		t.Error("the configured plan func should be used")
+	}
+
+	ctx = WithExplain(ctx, func(context.Context, string, json.RawMessage) {
+		perCall++
+	})
+	r.explainFunc(ctx)(ctx, "", nil)
+	if configured != 1 || perCall != 1 {
+		t.Error("the per call plan func should be used:", configured, perCall)
+	}
+
+	r.config.Explain = nil
+	if f := r.explainFunc(context.Background()); f != nil {
+		t.Error("there should be no plan func")
+	}
+}
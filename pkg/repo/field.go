@@ -0,0 +1,94 @@
+package repo
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"github.com/jmoiron/sqlx/reflectx"
+	eh "github.com/looplab/eventhorizon"
+)
+
+// ErrNotUnique is when a lookup by a natural key matches several entities.
+var ErrNotUnique = errors.New("not unique")
+
+// EqFold matches entities where the text column equals the value, ignoring
+// case. An index on lower(column) is used if it exists.
+func EqFold(column, value string) Filter {
+	return filterFunc(func(m *reflectx.Mapper, entity interface{},
+		args []interface{}) (string, []interface{}, error) {
+		if !hasColumn(m, entity, column) {
+			return "", nil, fmt.Errorf("%w: %q is not mapped", ErrInvalidColumn, column)
+		}
+		args = append(args, value)
+		return fmt.Sprintf("lower(%s) = lower($%d)", quoteColumn(column), len(args)), args, nil
+	})
+}
+
+// FindByField returns the entity with the value in the column, for lookups
+// by a natural key like an email, a slug or an external ID. It returns an
+// eh.ErrEntityNotFound error if there is no such entity and a ErrNotUnique
+// error if there are several.
+func (r *Repo) FindByField(ctx context.Context, column string,
+	value interface{}) (eh.Entity, error) {
+	return r.findOne(ctx, Eq(column, value))
+}
+
+// FindByFieldFold is FindByField comparing the text column ignoring case.
+func (r *Repo) FindByFieldFold(ctx context.Context, column,
+	value string) (eh.Entity, error) {
+	return r.findOne(ctx, EqFold(column, value))
+}
+
+// FindByKey returns the entity with the values of the key columns, see
+// Config.KeyColumns, for entities identified by a composite key:
+//
+//	r.FindByKey(ctx, map[string]interface{}{"tenant_id": tenant, "sku": "A-1"})
+//
+// The key must have a value for each key column and no other.
+func (r *Repo) FindByKey(ctx context.Context,
+	key map[string]interface{}) (eh.Entity, error) {
+	columns := r.upsertSpec().keyColumns()
+	filters := make([]Filter, 0, len(columns))
+	for _, column := range columns {
+		if v, ok := key[column]; ok {
+			filters = append(filters, Eq(column, v))
+		}
+	}
+	if len(filters) != len(columns) || len(key) != len(columns) {
+		return nil, eh.RepoError{
+			Err: eh.ErrCouldNotLoadEntity,
+			BaseErr: fmt.Errorf("%w: the key must have the columns %v",
+				ErrInvalidColumn, columns),
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	}
+
+	return r.findOne(ctx, And(filters...))
+}
+
+// findOne returns the single entity matching the filter.
+func (r *Repo) findOne(ctx context.Context, filter Filter) (eh.Entity, error) {
+	result, err := r.FindWhere(ctx, filter, WithLimit(2))
+	if err != nil {
+		return nil, err
+	}
+
+	switch len(result) {
+	case 0:
+		return nil, eh.RepoError{
+			Err:       eh.ErrEntityNotFound,
+			BaseErr:   fmt.Errorf("no entity in %s: %w", r.config.TableName, sql.ErrNoRows),
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	case 1:
+		return result[0], nil
+	default:
+		return nil, eh.RepoError{
+			Err:       eh.ErrCouldNotLoadEntity,
+			BaseErr:   ErrNotUnique,
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	}
+}
@@ -0,0 +1,46 @@
+package repo
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/jmoiron/sqlx"
+	eh "github.com/looplab/eventhorizon"
+
+	"github.com/eendLabs/eh-pg/pkg/mocks"
+)
+
+func TestFindByKeyInvalid(t *testing.T) {
+	db, err := sqlx.Open("postgres", "")
+	if err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	r, err := NewRepoWithClient(&Config{
+		TableName:  "models",
+		KeyColumns: []string{"content", "version"},
+	}, db)
+	if err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	r.SetEntityFactory(func() eh.Entity { return &mocks.Model{} })
+
+	ctx := context.Background()
+	for _, key := range []map[string]interface{}{
+		{"content": "m"},
+		{"content": "m", "id": 1},
+		{"content": "m", "version": 1, "id": 1},
+	} {
+		_, err := r.FindByKey(ctx, key)
+		if rrErr, ok := err.(eh.RepoError); !ok || !errors.Is(rrErr.BaseErr, ErrInvalidColumn) {
+			t.Error("there should be a ErrInvalidColumn error:", key, err)
+		}
+	}
+
+	if _, err := NewRepoWithClient(&Config{
+		TableName:  "models",
+		KeyColumns: []string{"id); DROP TABLE models; --"},
+	}, db); !errors.Is(err, ErrInvalidColumn) {
+		t.Error("there should be a ErrInvalidColumn error:", err)
+	}
+}
@@ -0,0 +1,350 @@
+package repo
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx/reflectx"
+	"github.com/lib/pq"
+	eh "github.com/looplab/eventhorizon"
+)
+
+// Filter is a condition on the entities, built with Eq, In, Gt, Between, And,
+// Or etc. Filters compile to parameterized SQL, with the columns validated
+// against the db tags of the entity, so no SQL has to be written by hand:
+//
+//	r.FindWhere(ctx, And(Eq("content", "foo"), Gt("version", 2)))
+type Filter interface {
+	// compile returns the SQL condition for the filter, with the parameters
+	// appended to args and numbered accordingly.
+	compile(m *reflectx.Mapper, entity interface{}, args []interface{}) (string, []interface{}, error)
+}
+
+// filterFunc adapts a function to the Filter interface.
+type filterFunc func(m *reflectx.Mapper, entity interface{}, args []interface{}) (string, []interface{}, error)
+
+func (f filterFunc) compile(m *reflectx.Mapper, entity interface{},
+	args []interface{}) (string, []interface{}, error) {
+	return f(m, entity, args)
+}
+
+// compare is a filter comparing a column to a value with an operator.
+func compare(column, op string, value interface{}) Filter {
+	return filterFunc(func(m *reflectx.Mapper, entity interface{},
+		args []interface{}) (string, []interface{}, error) {
+		if !hasColumn(m, entity, column) {
+			return "", nil, fmt.Errorf("%w: %q is not mapped", ErrInvalidColumn, column)
+		}
+		args = append(args, value)
+		return fmt.Sprintf("%s %s $%d", quoteColumn(column), op, len(args)), args, nil
+	})
+}
+
+// Eq matches entities where the column equals the value.
+func Eq(column string, value interface{}) Filter {
+	return compare(column, "=", value)
+}
+
+// Ne matches entities where the column does not equal the value.
+func Ne(column string, value interface{}) Filter {
+	return compare(column, "<>", value)
+}
+
+// Gt matches entities where the column is greater than the value.
+func Gt(column string, value interface{}) Filter {
+	return compare(column, ">", value)
+}
+
+// Gte matches entities where the column is greater than or equal to the value.
+func Gte(column string, value interface{}) Filter {
+	return compare(column, ">=", value)
+}
+
+// Lt matches entities where the column is less than the value.
+func Lt(column string, value interface{}) Filter {
+	return compare(column, "<", value)
+}
+
+// Lte matches entities where the column is less than or equal to the value.
+func Lte(column string, value interface{}) Filter {
+	return compare(column, "<=", value)
+}
+
+// In matches entities where the column equals one of the values. With no
+// values it matches nothing.
+func In(column string, values ...interface{}) Filter {
+	return filterFunc(func(m *reflectx.Mapper, entity interface{},
+		args []interface{}) (string, []interface{}, error) {
+		if !hasColumn(m, entity, column) {
+			return "", nil, fmt.Errorf("%w: %q is not mapped", ErrInvalidColumn, column)
+		}
+		if len(values) == 0 {
+			return "FALSE", args, nil
+		}
+		params := make([]string, len(values))
+		for i, v := range values {
+			args = append(args, v)
+			params[i] = fmt.Sprintf("$%d", len(args))
+		}
+		return fmt.Sprintf("%s IN (%s)", quoteColumn(column), strings.Join(params, ", ")), args, nil
+	})
+}
+
+// Between matches entities where the column is between from and to, inclusive.
+func Between(column string, from, to interface{}) Filter {
+	return And(Gte(column, from), Lte(column, to))
+}
+
+// Since matches entities where the timestamp column is at or after t. Times
+// are compared in UTC, so timestamp columns without time zone must hold UTC
+// times, like the ones written by the repo.
+func Since(column string, t time.Time) Filter {
+	return compare(column, ">=", t.UTC())
+}
+
+// Until matches entities where the timestamp column is before t. Times are
+// compared in UTC, see Since.
+func Until(column string, t time.Time) Filter {
+	return compare(column, "<", t.UTC())
+}
+
+// TimeRange matches entities where the timestamp column is in the half-open
+// range [from, to), so that consecutive ranges don't overlap.
+func TimeRange(column string, from, to time.Time) Filter {
+	return And(Since(column, from), Until(column, to))
+}
+
+// Within matches entities where the timestamp column is within the last d,
+// like the orders created in the last 24 hours:
+//
+//	Within("created_at", 24*time.Hour)
+func Within(column string, d time.Duration) Filter {
+	return Since(column, time.Now().Add(-d))
+}
+
+// IsNull matches entities where the column is NULL.
+func IsNull(column string) Filter {
+	return filterFunc(func(m *reflectx.Mapper, entity interface{},
+		args []interface{}) (string, []interface{}, error) {
+		if !hasColumn(m, entity, column) {
+			return "", nil, fmt.Errorf("%w: %q is not mapped", ErrInvalidColumn, column)
+		}
+		return quoteColumn(column) + " IS NULL", args, nil
+	})
+}
+
+// ContainsFold matches entities where the text column contains s, ignoring
+// case. Wildcards in s are matched literally.
+func ContainsFold(column, s string) Filter {
+	return ilike(column, "%"+escapeLike(s)+"%")
+}
+
+// HasPrefixFold matches entities where the text column starts with s,
+// ignoring case. Wildcards in s are matched literally.
+func HasPrefixFold(column, s string) Filter {
+	return ilike(column, escapeLike(s)+"%")
+}
+
+func ilike(column, pattern string) Filter {
+	return filterFunc(func(m *reflectx.Mapper, entity interface{},
+		args []interface{}) (string, []interface{}, error) {
+		if !hasColumn(m, entity, column) {
+			return "", nil, fmt.Errorf("%w: %q is not mapped", ErrInvalidColumn, column)
+		}
+		args = append(args, pattern)
+		return fmt.Sprintf(`%s ILIKE $%d ESCAPE '\'`, quoteColumn(column), len(args)), args, nil
+	})
+}
+
+// likeEscaper escapes the LIKE wildcards and the escape character itself.
+var likeEscaper = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+
+func escapeLike(s string) string {
+	return likeEscaper.Replace(s)
+}
+
+// JSONContains matches entities where the JSONB column contains the value,
+// marshaled to JSON unless it is a json.RawMessage, using the @> operator:
+//
+//	JSONContains("attrs", map[string]interface{}{"status": "open"})
+func JSONContains(column string, value interface{}) Filter {
+	return filterFunc(func(m *reflectx.Mapper, entity interface{},
+		args []interface{}) (string, []interface{}, error) {
+		if !hasColumn(m, entity, column) {
+			return "", nil, fmt.Errorf("%w: %q is not mapped", ErrInvalidColumn, column)
+		}
+		doc, err := jsonArg(value)
+		if err != nil {
+			return "", nil, err
+		}
+		args = append(args, doc)
+		return fmt.Sprintf("%s @> $%d::jsonb", quoteColumn(column), len(args)), args, nil
+	})
+}
+
+// JSONPathExists matches entities where the SQL/JSON path returns any item
+// for the JSONB column. Variables referenced in the path as $name are taken
+// from vars, which may be nil:
+//
+//	JSONPathExists("attrs", "$.items[*] ? (@.price > $min)", map[string]interface{}{"min": 10})
+func JSONPathExists(column, path string, vars map[string]interface{}) Filter {
+	return filterFunc(func(m *reflectx.Mapper, entity interface{},
+		args []interface{}) (string, []interface{}, error) {
+		if !hasColumn(m, entity, column) {
+			return "", nil, fmt.Errorf("%w: %q is not mapped", ErrInvalidColumn, column)
+		}
+		if vars == nil {
+			vars = map[string]interface{}{}
+		}
+		doc, err := jsonArg(vars)
+		if err != nil {
+			return "", nil, err
+		}
+		args = append(args, path, doc)
+		return fmt.Sprintf("jsonb_path_exists(%s, $%d::jsonpath, $%d::jsonb)",
+			quoteColumn(column), len(args)-1, len(args)), args, nil
+	})
+}
+
+// jsonArg marshals the value to a JSON parameter.
+func jsonArg(value interface{}) (string, error) {
+	if raw, ok := value.(json.RawMessage); ok {
+		return string(raw), nil
+	}
+	b, err := json.Marshal(value)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// ArrayContains matches entities where the array column contains the value,
+// using = ANY, like the entities tagged "urgent":
+//
+//	ArrayContains("tags", "urgent")
+func ArrayContains(column string, value interface{}) Filter {
+	return filterFunc(func(m *reflectx.Mapper, entity interface{},
+		args []interface{}) (string, []interface{}, error) {
+		if !hasColumn(m, entity, column) {
+			return "", nil, fmt.Errorf("%w: %q is not mapped", ErrInvalidColumn, column)
+		}
+		args = append(args, value)
+		return fmt.Sprintf("$%d = ANY(%s)", len(args), quoteColumn(column)), args, nil
+	})
+}
+
+// ArrayOverlaps matches entities where the array column has any element in
+// common with values, a slice like []string or []uuid.UUID, using &&.
+func ArrayOverlaps(column string, values interface{}) Filter {
+	return arrayCompare(column, "&&", values)
+}
+
+// ArrayContainsAll matches entities where the array column contains all of
+// values, a slice like []string or []uuid.UUID, using @>.
+func ArrayContainsAll(column string, values interface{}) Filter {
+	return arrayCompare(column, "@>", values)
+}
+
+// arrayCompare is a filter comparing an array column to an array parameter.
+func arrayCompare(column, op string, values interface{}) Filter {
+	return compare(column, op, pq.Array(values))
+}
+
+// And matches entities matching all the filters. With no filters it matches
+// everything.
+func And(filters ...Filter) Filter {
+	return join("AND", "TRUE", filters)
+}
+
+// Or matches entities matching any of the filters. With no filters it matches
+// nothing.
+func Or(filters ...Filter) Filter {
+	return join("OR", "FALSE", filters)
+}
+
+// Not matches entities not matching the filter.
+func Not(filter Filter) Filter {
+	return filterFunc(func(m *reflectx.Mapper, entity interface{},
+		args []interface{}) (string, []interface{}, error) {
+		cond, args, err := filter.compile(m, entity, args)
+		if err != nil {
+			return "", nil, err
+		}
+		return "NOT (" + cond + ")", args, nil
+	})
+}
+
+func join(op, empty string, filters []Filter) Filter {
+	return filterFunc(func(m *reflectx.Mapper, entity interface{},
+		args []interface{}) (string, []interface{}, error) {
+		if len(filters) == 0 {
+			return empty, args, nil
+		}
+		conds := make([]string, len(filters))
+		for i, f := range filters {
+			var err error
+			if conds[i], args, err = f.compile(m, entity, args); err != nil {
+				return "", nil, err
+			}
+			conds[i] = "(" + conds[i] + ")"
+		}
+		return strings.Join(conds, " "+op+" "), args, nil
+	})
+}
+
+// FindWhere returns the entities matching the filter. A nil filter matches
+// all entities, like And().
+func (r *Repo) FindWhere(ctx context.Context, filter Filter,
+	opts ...QueryOption) ([]eh.Entity, error) {
+	if r.factoryFn == nil {
+		return nil, eh.RepoError{
+			Err:       ErrModelNotSet,
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	}
+
+	if filter == nil {
+		filter = And()
+	}
+	expr, args, err := filter.compile(r.mapper, r.factoryFn(), nil)
+	if err != nil {
+		return nil, eh.RepoError{
+			Err:       eh.ErrCouldNotLoadEntity,
+			BaseErr:   err,
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	}
+	for _, opt := range opts {
+		args = append(args, opt)
+	}
+
+	return r.FindWithFilter(ctx, expr, args...)
+}
+
+// CountWhere returns the number of entities matching the filter. A nil filter
+// matches all entities, like And().
+func (r *Repo) CountWhere(ctx context.Context, filter Filter) (int64, error) {
+	if r.factoryFn == nil {
+		return 0, eh.RepoError{
+			Err:       ErrModelNotSet,
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	}
+
+	if filter == nil {
+		filter = And()
+	}
+	expr, args, err := filter.compile(r.mapper, r.factoryFn(), nil)
+	if err != nil {
+		return 0, eh.RepoError{
+			Err:       ErrCouldNotCount,
+			BaseErr:   err,
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	}
+
+	return r.CountWithFilter(ctx, expr, args...)
+}
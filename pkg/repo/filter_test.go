@@ -0,0 +1,170 @@
+package repo
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/lib/pq"
+
+	"github.com/eendLabs/eh-pg/pkg/mocks"
+)
+
+func TestFilter(t *testing.T) {
+	f := And(
+		Eq("content", "foo"),
+		Or(Gt("version", 2), Between("version", -2, -1)),
+		In("id", "a", "b"),
+		Not(IsNull("created_at")),
+	)
+	expr, args, err := f.compile(defaultMapper, &mocks.Model{}, nil)
+	if err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	expected := "(content = $1) AND " +
+		"((version > $2) OR ((version >= $3) AND (version <= $4))) AND " +
+		"(id IN ($5, $6)) AND " +
+		"(NOT (created_at IS NULL))"
+	if expr != expected {
+		t.Error("the expression should be correct:", expr)
+	}
+	if len(args) != 6 || args[0] != "foo" || args[3] != -1 || args[5] != "b" {
+		t.Error("the args should be correct:", args)
+	}
+
+	// Parameters are numbered after existing args.
+	expr, args, _ = Eq("content", "foo").compile(defaultMapper, &mocks.Model{}, []interface{}{1})
+	if expr != "content = $2" || len(args) != 2 {
+		t.Error("the expression should be correct:", expr, args)
+	}
+
+	for _, f := range []Filter{And(), Or(), In("id")} {
+		if expr, _, _ := f.compile(defaultMapper, &mocks.Model{}, nil); expr != "TRUE" && expr != "FALSE" {
+			t.Error("the expression should be constant:", expr)
+		}
+	}
+
+	if _, _, err := Eq("password", "x").compile(defaultMapper, &mocks.Model{}, nil); !errors.Is(err, ErrInvalidColumn) {
+		t.Error("there should be a ErrInvalidColumn error:", err)
+	}
+	if _, _, err := Or(Eq("content", "x"), Gt("1=1; --", 1)).compile(defaultMapper, &mocks.Model{}, nil); !errors.Is(err, ErrInvalidColumn) {
+		t.Error("there should be a ErrInvalidColumn error:", err)
+	}
+}
+
+type documentModel struct {
+	mocks.Model
+	Attrs json.RawMessage `db:"attrs"`
+}
+
+func TestJSONFilter(t *testing.T) {
+	expr, args, err := And(
+		JSONContains("attrs", map[string]interface{}{"status": "open"}),
+		JSONPathExists("attrs", "$.items[*] ? (@.price > $min)",
+			map[string]interface{}{"min": 10}),
+		JSONContains("attrs", json.RawMessage(`{"tags":["a"]}`)),
+	).compile(defaultMapper, &documentModel{}, nil)
+	if err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	expected := "(attrs @> $1::jsonb) AND " +
+		"(jsonb_path_exists(attrs, $2::jsonpath, $3::jsonb)) AND " +
+		"(attrs @> $4::jsonb)"
+	if expr != expected {
+		t.Error("the expression should be correct:", expr)
+	}
+	if len(args) != 4 || args[0] != `{"status":"open"}` ||
+		args[1] != "$.items[*] ? (@.price > $min)" || args[2] != `{"min":10}` ||
+		args[3] != `{"tags":["a"]}` {
+		t.Error("the args should be correct:", args)
+	}
+
+	if _, _, err := JSONContains("attrs", func() {}).compile(defaultMapper, &documentModel{}, nil); err == nil {
+		t.Error("there should be an error")
+	}
+}
+
+func TestFoldFilter(t *testing.T) {
+	expr, args, err := Or(
+		ContainsFold("content", `50%_off\\`),
+		HasPrefixFold("content", "Foo"),
+	).compile(defaultMapper, &mocks.Model{}, nil)
+	if err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	if expr != `(content ILIKE $1 ESCAPE '\') OR (content ILIKE $2 ESCAPE '\')` {
+		t.Error("the expression should be correct:", expr)
+	}
+	if len(args) != 2 || args[0] != `%50\%\_off\\\\%` || args[1] != "Foo%" {
+		t.Error("the args should be escaped:", args)
+	}
+}
+
+func TestTimeFilter(t *testing.T) {
+	loc := time.FixedZone("UTC+2", 2*60*60)
+	from := time.Date(2021, time.March, 1, 2, 0, 0, 0, loc)
+	to := from.Add(24 * time.Hour)
+
+	expr, args, err := TimeRange("created_at", from, to).compile(defaultMapper, &mocks.Model{}, nil)
+	if err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	if expr != "(created_at >= $1) AND (created_at < $2)" {
+		t.Error("the expression should be correct:", expr)
+	}
+	if len(args) != 2 ||
+		args[0] != time.Date(2021, time.March, 1, 0, 0, 0, 0, time.UTC) ||
+		args[1] != time.Date(2021, time.March, 2, 0, 0, 0, 0, time.UTC) {
+		t.Error("the args should be in UTC:", args)
+	}
+
+	_, args, _ = Within("created_at", time.Hour).compile(defaultMapper, &mocks.Model{}, nil)
+	if since := args[0].(time.Time); time.Since(since) < time.Hour ||
+		time.Since(since) > time.Hour+time.Minute || since.Location() != time.UTC {
+		t.Error("the arg should be an hour ago in UTC:", since)
+	}
+}
+
+type taggedModel struct {
+	mocks.Model
+	Tags pq.StringArray `db:"tags"`
+}
+
+func TestArrayFilter(t *testing.T) {
+	expr, args, err := And(
+		ArrayContains("tags", "urgent"),
+		ArrayOverlaps("tags", []string{"a", "b"}),
+		ArrayContainsAll("tags", []string{"c"}),
+	).compile(defaultMapper, &taggedModel{}, nil)
+	if err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	if expr != "($1 = ANY(tags)) AND (tags && $2) AND (tags @> $3)" {
+		t.Error("the expression should be correct:", expr)
+	}
+	if len(args) != 3 || args[0] != "urgent" {
+		t.Error("the args should be correct:", args)
+	}
+	if v, err := args[1].(driver.Valuer).Value(); err != nil || v != "{\"a\",\"b\"}" {
+		t.Error("the values should be an array:", v, err)
+	}
+
+	if _, _, err := ArrayContains("labels", "x").compile(defaultMapper, &taggedModel{}, nil); !errors.Is(err, ErrInvalidColumn) {
+		t.Error("there should be a ErrInvalidColumn error:", err)
+	}
+}
+
+func TestEqFold(t *testing.T) {
+	expr, args, err := EqFold("content", "Foo").compile(defaultMapper, &mocks.Model{}, nil)
+	if err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	if expr != "lower(content) = lower($1)" || len(args) != 1 || args[0] != "Foo" {
+		t.Error("the expression should be correct:", expr, args)
+	}
+	if _, _, err := EqFold("email", "x").compile(defaultMapper, &mocks.Model{}, nil); !errors.Is(err, ErrInvalidColumn) {
+		t.Error("there should be a ErrInvalidColumn error:", err)
+	}
+}
@@ -0,0 +1,237 @@
+package repo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+	eh "github.com/looplab/eventhorizon"
+)
+
+// ErrInvalidForeignKey is when a foreign key of Config.ForeignKeys is not
+// valid.
+var ErrInvalidForeignKey = errors.New("invalid foreign key")
+
+// ReferentialAction is what happens to the referencing rows when a referenced
+// row is deleted.
+type ReferentialAction string
+
+const (
+	// NoAction fails the delete if rows still reference the row, at the end
+	// of the statement. It is the default.
+	NoAction ReferentialAction = "NO ACTION"
+	// Restrict fails the delete if rows reference the row, immediately.
+	Restrict ReferentialAction = "RESTRICT"
+	// Cascade deletes the referencing rows.
+	Cascade ReferentialAction = "CASCADE"
+	// SetNull sets the referencing columns to NULL.
+	SetNull ReferentialAction = "SET NULL"
+	// SetDefault sets the referencing columns to their default.
+	SetDefault ReferentialAction = "SET DEFAULT"
+)
+
+// ForeignKey is a reference from the table to the table of another read
+// model, declared in Config.ForeignKeys, so that normalized projections keep
+// their referential integrity:
+//
+//	ForeignKeys: []ForeignKey{
+//		{Columns: []string{"customer_id"}, References: "customers", OnDelete: Cascade},
+//	}
+//
+// The foreign keys are created by EnsureTable and EnsureForeignKeys, and
+// Ready checks that they exist. The referenced table must exist first, with
+// a primary key or a unique constraint on the referenced columns. Note that
+// the projections must then save the referenced entities first.
+type ForeignKey struct {
+	// Name is the name of the constraint, <table>_<columns>_fkey by default.
+	Name string
+	// Columns are the referencing columns.
+	Columns []string
+	// References is the referenced table.
+	References string
+	// ReferencedColumns are the referenced columns, "id" by default.
+	ReferencedColumns []string
+	// OnDelete is NoAction by default.
+	OnDelete ReferentialAction
+}
+
+func (c ForeignKey) validate(table string) error {
+	if len(c.Columns) == 0 {
+		return fmt.Errorf("%w: no columns", ErrInvalidForeignKey)
+	}
+	for _, column := range append(append([]string{}, c.Columns...), c.ReferencedColumns...) {
+		if !validIdentifier(column) {
+			return fmt.Errorf("%w: invalid column %q", ErrInvalidForeignKey, column)
+		}
+	}
+	if !validIdentifier(c.name(table)) {
+		return fmt.Errorf("%w: invalid name %q", ErrInvalidForeignKey, c.name(table))
+	}
+	if !validTableName(c.References) {
+		return fmt.Errorf("%w: %s: invalid table %q",
+			ErrInvalidForeignKey, c.name(table), c.References)
+	}
+	if len(c.referencedColumns()) != len(c.Columns) {
+		return fmt.Errorf("%w: %s: %d columns reference %d columns", ErrInvalidForeignKey,
+			c.name(table), len(c.Columns), len(c.referencedColumns()))
+	}
+	switch c.OnDelete {
+	case "", NoAction, Restrict, Cascade, SetNull, SetDefault:
+	default:
+		return fmt.Errorf("%w: %s: unknown action %q",
+			ErrInvalidForeignKey, c.name(table), c.OnDelete)
+	}
+	return nil
+}
+
+// name returns the constraint name, derived from the table without its
+// schema and the columns when the Name is not set, like the ones Postgres
+// derives.
+func (c ForeignKey) name(table string) string {
+	if c.Name != "" {
+		return c.Name
+	}
+	return table[strings.LastIndex(table, ".")+1:] + "_" +
+		strings.Join(c.Columns, "_") + "_fkey"
+}
+
+// referencedColumns returns the referenced columns, id by default.
+func (c ForeignKey) referencedColumns() []string {
+	if len(c.ReferencedColumns) == 0 {
+		return []string{"id"}
+	}
+	return c.ReferencedColumns
+}
+
+// constraint returns the table constraint of the foreign key, which must be
+// valid.
+func (c ForeignKey) constraint(table string) string {
+	s := fmt.Sprintf("CONSTRAINT %s FOREIGN KEY (%s) REFERENCES %s (%s)",
+		c.name(table), strings.Join(quoteColumns(c.Columns), ", "), c.References,
+		strings.Join(quoteColumns(c.referencedColumns()), ", "))
+	if c.OnDelete != "" && c.OnDelete != NoAction {
+		s += " ON DELETE " + string(c.OnDelete)
+	}
+	return s
+}
+
+// EnsureForeignKeys adds the foreign keys of Config.ForeignKeys missing from
+// the table. EnsureTable creates them with the table, this is for existing
+// tables. The foreign keys are added NOT VALID and then validated, so that the
+// table is only locked against writes while adding them, and the existing rows
+// must reference existing rows. Note that an existing constraint with the
+// same name is kept as is, even if it is defined differently.
+func (r *Repo) EnsureForeignKeys(ctx context.Context) error {
+	if len(r.config.ForeignKeys) == 0 {
+		return nil
+	}
+
+	return r.writeTx(ctx, func(tx *sqlx.Tx) error {
+		if err := lockSchema(ctx, tx, r.config.TableName); err != nil {
+			return err
+		}
+		existing, err := r.foreignKeys(ctx, tx)
+		if err != nil {
+			return eh.RepoError{
+				Err:       err,
+				Namespace: eh.NamespaceFromContext(ctx),
+			}
+		}
+		exists := make(map[string]bool, len(existing))
+		for _, name := range existing {
+			exists[name] = true
+		}
+
+		for _, fk := range r.config.ForeignKeys {
+			name := fk.name(r.config.TableName)
+			if exists[name] {
+				continue
+			}
+			for _, query := range []string{
+				fmt.Sprintf("ALTER TABLE %s ADD %s NOT VALID",
+					r.config.TableName, fk.constraint(r.config.TableName)),
+				fmt.Sprintf("ALTER TABLE %s VALIDATE CONSTRAINT %s",
+					r.config.TableName, name),
+			} {
+				if _, err := tx.ExecContext(ctx, query); err != nil {
+					return eh.RepoError{
+						Err:       err,
+						Namespace: eh.NamespaceFromContext(ctx),
+					}
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// foreignKeys returns the names of the foreign keys of the table.
+func (r *Repo) foreignKeys(ctx context.Context, q sqlx.QueryerContext) ([]string, error) {
+	var names []string
+	err := sqlx.SelectContext(ctx, q, &names,
+		"SELECT conname FROM pg_constraint WHERE conrelid = to_regclass($1) AND contype = 'f'",
+		r.config.TableName)
+	return names, err
+}
+
+// requiredForeignKeys returns the names of the foreign keys of
+// Config.ForeignKeys.
+func (r *Repo) requiredForeignKeys() []string {
+	names := make([]string, len(r.config.ForeignKeys))
+	for i, fk := range r.config.ForeignKeys {
+		names[i] = fk.name(r.config.TableName)
+	}
+	return names
+}
+
+// FindWithJoin returns the entities referencing, with a foreign key of
+// Config.ForeignKeys, the rows of the referenced table matching the
+// expression. The foreign key is given by its name or its referenced table.
+// The expression is the WHERE clause of the referenced rows, like for
+// FindWithFilter, with positional parameters bound to args, which may also
+// contain QueryOptions for the entities. Like the orders of the customers of
+// a country:
+//
+//	orders.FindWithJoin(ctx, "customers", "country = $1", "SE", WithLimit(10))
+//
+// It is a semi-join, so each entity is returned once.
+func (r *Repo) FindWithJoin(ctx context.Context, foreignKey string, expr string,
+	args ...interface{}) ([]eh.Entity, error) {
+	fk, ok := r.foreignKey(foreignKey)
+	if !ok {
+		return nil, eh.RepoError{
+			Err:       eh.ErrCouldNotLoadEntity,
+			BaseErr:   fmt.Errorf("%w: %q is not declared", ErrInvalidForeignKey, foreignKey),
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	}
+
+	return r.FindWithFilter(ctx, joinExpr(fk, expr), args...)
+}
+
+// foreignKey returns the foreign key with the name or referencing the table.
+func (r *Repo) foreignKey(nameOrTable string) (ForeignKey, bool) {
+	for _, fk := range r.config.ForeignKeys {
+		if fk.name(r.config.TableName) == nameOrTable || fk.References == nameOrTable {
+			return fk, true
+		}
+	}
+	return ForeignKey{}, false
+}
+
+// joinExpr returns the condition of the entities referencing the rows
+// matching the expression.
+func joinExpr(fk ForeignKey, expr string) string {
+	columns := strings.Join(quoteColumns(fk.Columns), ", ")
+	referenced := strings.Join(quoteColumns(fk.referencedColumns()), ", ")
+	if len(fk.Columns) > 1 {
+		columns = "(" + columns + ")"
+	}
+	query := fmt.Sprintf("SELECT %s FROM %s", referenced, fk.References)
+	if expr != "" {
+		query += " WHERE " + expr
+	}
+	return fmt.Sprintf("%s IN (%s)", columns, query)
+}
@@ -0,0 +1,123 @@
+package repo
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/jmoiron/sqlx"
+	eh "github.com/looplab/eventhorizon"
+	"github.com/looplab/eventhorizon/mocks"
+)
+
+type orderLine struct {
+	ID      uuid.UUID `db:"id"`
+	OrderID uuid.UUID `db:"order_id"`
+	SKU     string    `db:"sku"`
+}
+
+func (m *orderLine) EntityID() uuid.UUID {
+	return m.ID
+}
+
+func TestForeignKey(t *testing.T) {
+	for _, c := range []struct {
+		fk       ForeignKey
+		expected string
+	}{
+		{
+			ForeignKey{Columns: []string{"customer_id"}, References: "customers"},
+			"CONSTRAINT orders_customer_id_fkey FOREIGN KEY (customer_id) REFERENCES customers (id)",
+		},
+		{
+			ForeignKey{Columns: []string{"customer_id"}, References: "app.customers", OnDelete: Cascade},
+			"CONSTRAINT orders_customer_id_fkey FOREIGN KEY (customer_id) REFERENCES app.customers (id) ON DELETE CASCADE",
+		},
+		{
+			ForeignKey{Name: "by_item", Columns: []string{"shopId", "sku"}, References: "items",
+				ReferencedColumns: []string{"shop_id", "sku"}, OnDelete: SetNull},
+			`CONSTRAINT by_item FOREIGN KEY ("shopId", sku) REFERENCES items (shop_id, sku) ON DELETE SET NULL`,
+		},
+	} {
+		if err := c.fk.validate("app.orders"); err != nil {
+			t.Fatal("there should be no error:", err)
+		}
+		if constraint := c.fk.constraint("app.orders"); constraint != c.expected {
+			t.Errorf("the constraint should be correct: %s", constraint)
+		}
+	}
+
+	for _, fk := range []ForeignKey{
+		{References: "customers"},
+		{Columns: []string{"customer id"}, References: "customers"},
+		{Columns: []string{"customer_id"}},
+		{Columns: []string{"customer_id"}, References: "customers; DROP TABLE orders"},
+		{Columns: []string{"customer_id"}, References: "customers", ReferencedColumns: []string{"id", "version"}},
+		{Columns: []string{"customer_id"}, References: "customers", OnDelete: "DROP"},
+		{Name: "by customer", Columns: []string{"customer_id"}, References: "customers"},
+	} {
+		if err := fk.validate("orders"); !errors.Is(err, ErrInvalidForeignKey) {
+			t.Error("the foreign key should be invalid:", fk, err)
+		}
+	}
+}
+
+func TestForeignKeyTable(t *testing.T) {
+	db, err := sqlx.Open("postgres", "")
+	if err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+
+	r, err := NewRepoWithClient(&Config{
+		TableName: "models",
+		ForeignKeys: []ForeignKey{
+			{Columns: []string{"content"}, References: "contents", ReferencedColumns: []string{"name"}},
+		},
+	}, db)
+	if err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	query, err := r.createTableQuery(&mocks.Model{})
+	if err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	if !strings.Contains(query, ",\n    CONSTRAINT models_content_fkey FOREIGN KEY (content) REFERENCES contents (name)\n)") {
+		t.Error("the table should have the foreign key:", query)
+	}
+	if names := r.requiredForeignKeys(); len(names) != 1 || names[0] != "models_content_fkey" {
+		t.Error("the foreign keys should be required:", names)
+	}
+
+	if _, err := NewRepoWithClient(&Config{
+		TableName:   "models",
+		ForeignKeys: []ForeignKey{{Columns: []string{"content"}}},
+	}, db); !errors.Is(err, ErrInvalidForeignKey) {
+		t.Error("there should be a ErrInvalidForeignKey error:", err)
+	}
+
+	r.SetEntityFactory(func() eh.Entity {
+		return &mocks.Model{}
+	})
+	_, err = r.FindWithJoin(context.Background(), "customers", "")
+	if rrErr, ok := err.(eh.RepoError); !ok || !errors.Is(rrErr.BaseErr, ErrInvalidForeignKey) {
+		t.Error("there should be a ErrInvalidForeignKey error:", err)
+	}
+}
+
+func TestJoinExpr(t *testing.T) {
+	fk := ForeignKey{Columns: []string{"customer_id"}, References: "customers"}
+	if expr := joinExpr(fk, "country = $1"); expr != "customer_id IN (SELECT id FROM customers WHERE country = $1)" {
+		t.Error("the expression should be correct:", expr)
+	}
+	if expr := joinExpr(fk, ""); expr != "customer_id IN (SELECT id FROM customers)" {
+		t.Error("the expression should be correct:", expr)
+	}
+
+	fk = ForeignKey{Columns: []string{"shop_id", "sku"}, References: "items",
+		ReferencedColumns: []string{"shop", "sku"}}
+	if expr := joinExpr(fk, "stock > 0"); expr != "(shop_id, sku) IN (SELECT shop, sku FROM items WHERE stock > 0)" {
+		t.Error("the expression should be correct:", expr)
+	}
+}
@@ -0,0 +1,81 @@
+package repo
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+)
+
+// ErrInvalidGeneratedColumn is when a generated column is not valid.
+var ErrInvalidGeneratedColumn = errors.New("invalid generated column")
+
+// typeNameRe matches a type name, like "numeric(12,2)", "double precision"
+// or "text[]".
+var typeNameRe = regexp.MustCompile(
+	`^[A-Za-z_][A-Za-z0-9_]*( [A-Za-z_][A-Za-z0-9_]*)*(\(\d+(, ?\d+)?\))?(\[\])?$`)
+
+// GeneratedColumn is a column Postgres extracts from a field of a JSONB column
+// and stores on every write, so that the document keeps its flexibility while
+// the field can be filtered, sorted and indexed like any column:
+//
+//	GeneratedColumn{Name: "status", Field: JSONField{Column: "data", Keys: []string{"status"}}, Index: true}
+//	GeneratedColumn{Name: "total", Field: JSONField{Column: "data", Keys: []string{"total"}}, Type: "numeric"}
+//
+// The column is created by EnsureTable. Save never writes it, map it with a
+// field of the entity to read it and to use it in the filters, like Eq.
+type GeneratedColumn struct {
+	// Name is the name of the column.
+	Name string
+	// Field is the field of the JSONB column the column is generated from.
+	Field JSONField
+	// Type is the type the field is cast to, "text" by default, with an
+	// optional precision or array suffix, like "numeric(12,2)". The cast
+	// must be immutable, which casts to timestamptz are not.
+	Type string
+	// Index creates a btree index on the column named like the ones of
+	// Config.Indexes, <table>_<name>_idx.
+	Index bool
+}
+
+func (c GeneratedColumn) validate() error {
+	if !validIdentifier(c.Name) {
+		return fmt.Errorf("%w: invalid name %q", ErrInvalidGeneratedColumn, c.Name)
+	}
+	if err := c.Field.validate(); err != nil {
+		return fmt.Errorf("%w: %s: %v", ErrInvalidGeneratedColumn, c.Name, err)
+	}
+	if c.Type != "" && !typeNameRe.MatchString(c.Type) {
+		return fmt.Errorf("%w: %s: invalid type %q", ErrInvalidGeneratedColumn, c.Name, c.Type)
+	}
+	return nil
+}
+
+// definition returns the type and the generation expression of the column.
+func (c GeneratedColumn) definition() string {
+	if c.Type == "" || c.Type == "text" {
+		return fmt.Sprintf("text GENERATED ALWAYS AS %s STORED", c.Field.expr())
+	}
+	return fmt.Sprintf("%s GENERATED ALWAYS AS (%s::%s) STORED",
+		c.Type, c.Field.expr(), c.Type)
+}
+
+// generatedColumns returns the names of the generated columns.
+func (r *Repo) generatedColumns() []string {
+	names := make([]string, len(r.config.GeneratedColumns))
+	for i, c := range r.config.GeneratedColumns {
+		names[i] = c.Name
+	}
+	return names
+}
+
+// indexes returns the indexes of Config.Indexes and of the indexed generated
+// columns.
+func (r *Repo) indexes() []IndexConfig {
+	indexes := append([]IndexConfig{}, r.config.Indexes...)
+	for _, c := range r.config.GeneratedColumns {
+		if c.Index {
+			indexes = append(indexes, IndexConfig{Columns: []string{c.Name}})
+		}
+	}
+	return indexes
+}
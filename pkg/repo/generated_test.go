@@ -0,0 +1,89 @@
+package repo
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/jmoiron/sqlx"
+	eh "github.com/looplab/eventhorizon"
+)
+
+type orderDocument struct {
+	ID     uuid.UUID       `db:"id"`
+	Data   json.RawMessage `db:"data"`
+	Status string          `db:"status"`
+}
+
+func (m *orderDocument) EntityID() uuid.UUID {
+	return m.ID
+}
+
+func TestGeneratedColumns(t *testing.T) {
+	db, err := sqlx.Open("postgres", "")
+	if err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	r, err := NewRepoWithClient(&Config{
+		TableName: "orders",
+		GeneratedColumns: []GeneratedColumn{
+			{Name: "status", Field: JSONField{Column: "data", Keys: []string{"status"}}, Index: true},
+			{Name: "total", Field: JSONField{Column: "data", Keys: []string{"amount", "total"}}, Type: "numeric(12,2)"},
+		},
+	}, db)
+	if err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+
+	expected := `CREATE TABLE IF NOT EXISTS orders (
+    data jsonb,
+    id uuid PRIMARY KEY,
+    status text GENERATED ALWAYS AS (data->>'status') STORED,
+    total numeric(12,2) GENERATED ALWAYS AS ((data#>>'{amount,total}')::numeric(12,2)) STORED
+)`
+	if query, err := r.createTableQuery(&orderDocument{}); err != nil || query != expected {
+		t.Error("the query should be correct:", query, err)
+	}
+
+	m := &orderDocument{ID: uuid.New(), Data: json.RawMessage(`{"status":"open"}`), Status: "open"}
+	query, args, err := r.upsertSpec().query(entityColumns(r.mapper, m), []eh.Entity{m})
+	if err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	if strings.Contains(query, "status") || len(args) != 2 {
+		t.Error("the generated columns should not be written:", query, args)
+	}
+
+	if indexes := r.requiredIndexes(); len(indexes) != 1 || indexes[0] != "orders_status_idx" {
+		t.Error("the generated column should be indexed:", indexes)
+	}
+	if columns := r.requiredColumns(); len(columns) != 2 || columns[0] != "status" || columns[1] != "total" {
+		t.Error("the generated columns should be required:", columns)
+	}
+
+	for _, c := range []GeneratedColumn{
+		{Name: "status; DROP", Field: JSONField{Column: "data", Keys: []string{"status"}}},
+		{Name: "status", Field: JSONField{Column: "data"}},
+		{Name: "total", Field: JSONField{Column: "data", Keys: []string{"total"}}, Type: "int; DROP TABLE orders"},
+		{Name: "total", Field: JSONField{Column: "data", Keys: []string{"total"}}, Type: "int) STORED, x int GENERATED ALWAYS AS (1"},
+		{Name: "total", Field: JSONField{Column: "data", Keys: []string{"total"}}, Type: "numeric(12,"},
+		{Name: "total", Field: JSONField{Column: "data", Keys: []string{"total"}}, Type: "int -- comment"},
+	} {
+		if _, err := NewRepoWithClient(&Config{
+			TableName:        "orders",
+			GeneratedColumns: []GeneratedColumn{c},
+		}, db); !errors.Is(err, ErrInvalidGeneratedColumn) {
+			t.Error("there should be a ErrInvalidGeneratedColumn error:", c, err)
+		}
+	}
+
+	for _, typ := range []string{"", "int", "numeric(12,2)", "numeric(12, 2)", "varchar(64)",
+		"double precision", "text[]"} {
+		c := GeneratedColumn{Name: "total", Field: JSONField{Column: "data", Keys: []string{"total"}}, Type: typ}
+		if err := c.validate(); err != nil {
+			t.Error("there should be no error:", typ, err)
+		}
+	}
+}
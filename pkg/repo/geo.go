@@ -0,0 +1,116 @@
+package repo
+
+import (
+	"database/sql/driver"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+
+	"github.com/jmoiron/sqlx/reflectx"
+)
+
+// ErrInvalidGeometry is when a geometry can not be scanned into a Point.
+var ErrInvalidGeometry = errors.New("invalid geometry")
+
+// srid is the spatial reference system of the points, WGS 84 as used by GPS.
+const srid = 4326
+
+// Point is a WGS 84 longitude/latitude point stored in a PostGIS geometry or
+// geography column, like a store location. It can be used as the field of an
+// entity and with the geo filters:
+//
+//	type Store struct {
+//		ID       uuid.UUID `db:"id"`
+//		Location Point     `db:"location"`
+//	}
+type Point struct {
+	Lng float64
+	Lat float64
+}
+
+// Value implements the driver.Valuer interface, writing the point as EWKT.
+func (p Point) Value() (driver.Value, error) {
+	return fmt.Sprintf("SRID=%d;POINT(%v %v)", srid, p.Lng, p.Lat), nil
+}
+
+// Scan implements the sql.Scanner interface, reading the point from the hex
+// encoded (E)WKB returned by PostGIS.
+func (p *Point) Scan(src interface{}) error {
+	var b []byte
+	switch src := src.(type) {
+	case []byte:
+		b = src
+	case string:
+		b = []byte(src)
+	case nil:
+		*p = Point{}
+		return nil
+	default:
+		return fmt.Errorf("%w: unsupported type %T", ErrInvalidGeometry, src)
+	}
+
+	wkb := make([]byte, hex.DecodedLen(len(b)))
+	if _, err := hex.Decode(wkb, b); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidGeometry, err)
+	}
+	if len(wkb) < 5 {
+		return fmt.Errorf("%w: too short", ErrInvalidGeometry)
+	}
+
+	var order binary.ByteOrder = binary.BigEndian
+	if wkb[0] == 1 {
+		order = binary.LittleEndian
+	}
+	typ := order.Uint32(wkb[1:5])
+	wkb = wkb[5:]
+	if typ&0x20000000 != 0 {
+		// EWKB with a SRID.
+		if len(wkb) < 4 {
+			return fmt.Errorf("%w: too short", ErrInvalidGeometry)
+		}
+		wkb = wkb[4:]
+	}
+	if typ&0xffff != 1 {
+		return fmt.Errorf("%w: not a point", ErrInvalidGeometry)
+	}
+	if len(wkb) < 16 {
+		return fmt.Errorf("%w: too short", ErrInvalidGeometry)
+	}
+
+	p.Lng = math.Float64frombits(order.Uint64(wkb[0:8]))
+	p.Lat = math.Float64frombits(order.Uint64(wkb[8:16]))
+	return nil
+}
+
+// WithinRadius matches entities where the geometry or geography column is
+// within meters of the point, measured on the spheroid. A GiST index on
+// the column cast to geography is used if it exists:
+//
+//	WithinRadius("location", Point{Lng: 4.89, Lat: 52.37}, 500)
+func WithinRadius(column string, p Point, meters float64) Filter {
+	return filterFunc(func(m *reflectx.Mapper, entity interface{},
+		args []interface{}) (string, []interface{}, error) {
+		if !hasColumn(m, entity, column) {
+			return "", nil, fmt.Errorf("%w: %q is not mapped", ErrInvalidColumn, column)
+		}
+		args = append(args, p, meters)
+		return fmt.Sprintf("ST_DWithin(%s::geography, $%d::geography, $%d)",
+			quoteColumn(column), len(args)-1, len(args)), args, nil
+	})
+}
+
+// WithinArea matches entities where the geometry column is inside the area,
+// a GeoJSON polygon in WGS 84 like a delivery zone.
+func WithinArea(column, geoJSON string) Filter {
+	return filterFunc(func(m *reflectx.Mapper, entity interface{},
+		args []interface{}) (string, []interface{}, error) {
+		if !hasColumn(m, entity, column) {
+			return "", nil, fmt.Errorf("%w: %q is not mapped", ErrInvalidColumn, column)
+		}
+		args = append(args, geoJSON)
+		return fmt.Sprintf("ST_Within(%s::geometry, ST_SetSRID(ST_GeomFromGeoJSON($%d), %d))",
+			quoteColumn(column), len(args), srid), args, nil
+	})
+}
@@ -0,0 +1,78 @@
+package repo
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+type storeModel struct {
+	ID       uuid.UUID `db:"id"`
+	Location Point     `db:"location"`
+}
+
+func (m *storeModel) EntityID() uuid.UUID {
+	return m.ID
+}
+
+func TestPoint(t *testing.T) {
+	v, err := Point{Lng: 4.89, Lat: 52.37}.Value()
+	if err != nil {
+		t.Error("there should be no error:", err)
+	}
+	if v != "SRID=4326;POINT(4.89 52.37)" {
+		t.Error("the value should be correct:", v)
+	}
+
+	// As returned by SELECT 'SRID=4326;POINT(4.89 52.37)'::geometry.
+	var p Point
+	if err := p.Scan([]byte("0101000020E61000008FC2F5285C8F13408FC2F5285C2F4A40")); err != nil {
+		t.Error("there should be no error:", err)
+	}
+	if p.Lng != 4.89 || p.Lat != 52.37 {
+		t.Error("the point should be correct:", p)
+	}
+
+	// Plain WKB without a SRID.
+	if err := p.Scan("0101000000000000000000F03F0000000000000040"); err != nil {
+		t.Error("there should be no error:", err)
+	}
+	if p.Lng != 1 || p.Lat != 2 {
+		t.Error("the point should be correct:", p)
+	}
+
+	// A linestring.
+	if err := p.Scan("010200000000000000"); !errors.Is(err, ErrInvalidGeometry) {
+		t.Error("there should be a ErrInvalidGeometry error:", err)
+	}
+	if err := p.Scan("zz"); !errors.Is(err, ErrInvalidGeometry) {
+		t.Error("there should be a ErrInvalidGeometry error:", err)
+	}
+}
+
+func TestGeoFilter(t *testing.T) {
+	p := Point{Lng: 4.89, Lat: 52.37}
+	expr, args, err := And(
+		WithinRadius("location", p, 500),
+		WithinArea("location", `{"type":"Polygon"}`),
+	).compile(defaultMapper, &storeModel{}, nil)
+	if err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	expected := "(ST_DWithin(location::geography, $1::geography, $2)) AND " +
+		"(ST_Within(location::geometry, ST_SetSRID(ST_GeomFromGeoJSON($3), 4326)))"
+	if expr != expected {
+		t.Error("the expression should be correct:", expr)
+	}
+	if len(args) != 3 || args[0] != p || args[1] != 500.0 {
+		t.Error("the args should be correct:", args)
+	}
+
+	if !hasColumn(defaultMapper, &storeModel{}, "location") || hasColumn(defaultMapper, &storeModel{}, "location.Lat") {
+		t.Error("the point should map to a single column")
+	}
+	if _, _, err := WithinRadius("position", p, 1).compile(defaultMapper, &storeModel{}, nil); !errors.Is(err, ErrInvalidColumn) {
+		t.Error("there should be a ErrInvalidColumn error:", err)
+	}
+}
@@ -0,0 +1,129 @@
+package repo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jmoiron/sqlx"
+	eh "github.com/looplab/eventhorizon"
+)
+
+// ErrInvalidHeartbeat is when the heartbeat config is not valid.
+var ErrInvalidHeartbeat = errors.New("invalid heartbeat config")
+
+// HeartbeatConfig stamps every saved row with the ID of the writing projector
+// and the time of the write, so that entities no longer updated by a stuck
+// projector can be found with FindStale. The columns must exist in the table
+// but not be mapped by the entity.
+type HeartbeatConfig struct {
+	// ProjectorID identifies the projector writing with the repo.
+	ProjectorID string
+	// ProjectorColumn is the column holding the projector ID, "written_by"
+	// by default.
+	ProjectorColumn string
+	// TimeColumn is the column holding the write time, "written_at" by
+	// default.
+	TimeColumn string
+}
+
+func (c *HeartbeatConfig) provideDefaults() {
+	if c.ProjectorColumn == "" {
+		c.ProjectorColumn = "written_by"
+	}
+	if c.TimeColumn == "" {
+		c.TimeColumn = "written_at"
+	}
+}
+
+func (c *HeartbeatConfig) validate() error {
+	if c.ProjectorID == "" {
+		return fmt.Errorf("%w: no projector ID", ErrInvalidHeartbeat)
+	}
+	if !validIdentifier(c.ProjectorColumn) {
+		return fmt.Errorf("%w: invalid column %q", ErrInvalidHeartbeat, c.ProjectorColumn)
+	}
+	if !validIdentifier(c.TimeColumn) {
+		return fmt.Errorf("%w: invalid column %q", ErrInvalidHeartbeat, c.TimeColumn)
+	}
+	return nil
+}
+
+// columns returns the heartbeat columns as computed columns written on Save.
+func (c *HeartbeatConfig) columns() []ComputedColumn {
+	id := c.ProjectorID
+	return []ComputedColumn{
+		{Name: c.ProjectorColumn, Func: func(eh.Entity) (interface{}, error) {
+			return id, nil
+		}},
+		{Name: c.TimeColumn, Expr: "now()"},
+	}
+}
+
+// StaleEntity is an entity that has not been written for a while.
+type StaleEntity struct {
+	ID uuid.UUID `db:"id"`
+	// WrittenBy is the ID of the projector that last wrote the entity.
+	WrittenBy string `db:"written_by"`
+	// WrittenAt is when the entity was last written.
+	WrittenAt time.Time `db:"written_at"`
+}
+
+// FindStale returns the entities (up to limit, oldest first) that have not
+// been written within the threshold although newer events exist for them, as
+// reported by hasNewerEvents, typically by querying the event store. This
+// catches projectors that silently stopped. With a nil hasNewerEvents all
+// entities not written within the threshold are returned.
+func (r *Repo) FindStale(ctx context.Context, threshold time.Duration, limit int,
+	hasNewerEvents func(ctx context.Context, id uuid.UUID, since time.Time) (bool, error),
+) ([]StaleEntity, error) {
+	c := r.config.Heartbeat
+	if c == nil {
+		return nil, eh.RepoError{
+			Err:       eh.ErrCouldNotLoadEntity,
+			BaseErr:   fmt.Errorf("%w: heartbeat not configured", ErrInvalidHeartbeat),
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	}
+
+	q, release, err := r.conn(ctx, false)
+	if err != nil {
+		return nil, err
+	}
+	var candidates []StaleEntity
+	err = sqlx.SelectContext(ctx, q, &candidates, fmt.Sprintf(
+		"SELECT id, %[2]s AS written_by, %[3]s AS written_at FROM %[1]s "+
+			"WHERE %[3]s < $1 ORDER BY %[3]s LIMIT $2",
+		r.config.TableName, c.ProjectorColumn, c.TimeColumn),
+		time.Now().Add(-threshold), limit)
+	release()
+	if err != nil {
+		return nil, eh.RepoError{
+			Err:       eh.ErrCouldNotLoadEntity,
+			BaseErr:   err,
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	}
+	if hasNewerEvents == nil {
+		return candidates, nil
+	}
+
+	var stale []StaleEntity
+	for _, e := range candidates {
+		newer, err := hasNewerEvents(ctx, e.ID, e.WrittenAt)
+		if err != nil {
+			return nil, eh.RepoError{
+				Err:       eh.ErrCouldNotLoadEntity,
+				BaseErr:   err,
+				Namespace: eh.NamespaceFromContext(ctx),
+			}
+		}
+		if newer {
+			stale = append(stale, e)
+		}
+	}
+
+	return stale, nil
+}
@@ -0,0 +1,51 @@
+package repo
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/jmoiron/sqlx"
+	eh "github.com/looplab/eventhorizon"
+
+	"github.com/eendLabs/eh-pg/pkg/mocks"
+)
+
+func TestHeartbeat(t *testing.T) {
+	db, err := sqlx.Open("postgres", "")
+	if err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	r, err := NewRepoWithClient(&Config{
+		TableName: "models",
+		Heartbeat: &HeartbeatConfig{ProjectorID: "projector-1"},
+	}, db)
+	if err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+
+	m := &mocks.Model{ID: uuid.New()}
+	query, args, err := r.upsertSpec().query(entityColumns(defaultMapper, m), []eh.Entity{m})
+	if err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	if !strings.Contains(query, "VALUES ($1, $2, $3, $4, $5, (now()))") ||
+		!strings.Contains(query, "written_by = EXCLUDED.written_by") ||
+		!strings.Contains(query, "written_at = EXCLUDED.written_at") {
+		t.Error("the query should stamp the rows:", query)
+	}
+	if len(args) != 5 || args[4] != "projector-1" {
+		t.Error("the args should be correct:", args)
+	}
+
+	for _, c := range []*HeartbeatConfig{
+		{},
+		{ProjectorID: "p", TimeColumn: "at; --"},
+	} {
+		_, err := NewRepoWithClient(&Config{TableName: "models", Heartbeat: c}, db)
+		if !errors.Is(err, ErrInvalidHeartbeat) {
+			t.Error("there should be a ErrInvalidHeartbeat error:", err)
+		}
+	}
+}
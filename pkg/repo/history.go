@@ -0,0 +1,155 @@
+package repo
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jmoiron/sqlx"
+	eh "github.com/looplab/eventhorizon"
+)
+
+// ErrInvalidHistory is when the history config is not valid.
+var ErrInvalidHistory = errors.New("invalid history config")
+
+// HistoryConfig keeps every version of the entities in a history table, with
+// the time range each version was valid, so that past states can be read
+// with FindAsOf. The history table and the trigger maintaining it are created
+// with EnsureHistory. The history is written by the trigger for all writes to
+// the table, but not while the triggers are disabled by WithTriggersDisabled.
+type HistoryConfig struct {
+	// TableName is the history table, "<table>_history" by default.
+	TableName string
+	// ValidFromColumn is the column of the time a version was written,
+	// "valid_from" by default.
+	ValidFromColumn string
+	// ValidToColumn is the column of the time a version was replaced or
+	// removed, "valid_to" by default. It is NULL for the current version.
+	ValidToColumn string
+}
+
+func (c *HistoryConfig) provideDefaults(table string) {
+	if c.TableName == "" {
+		c.TableName = table + "_history"
+	}
+	if c.ValidFromColumn == "" {
+		c.ValidFromColumn = "valid_from"
+	}
+	if c.ValidToColumn == "" {
+		c.ValidToColumn = "valid_to"
+	}
+}
+
+func (c *HistoryConfig) validate() error {
+	if !validTableName(c.TableName) {
+		return fmt.Errorf("%w: invalid table name %q", ErrInvalidHistory, c.TableName)
+	}
+	for _, column := range []string{c.ValidFromColumn, c.ValidToColumn} {
+		if !validIdentifier(column) {
+			return fmt.Errorf("%w: invalid column %q", ErrInvalidHistory, column)
+		}
+	}
+	return nil
+}
+
+// EnsureHistory creates the history table and the trigger recording the
+// versions of the entities if needed.
+func (r *Repo) EnsureHistory(ctx context.Context) error {
+	c := r.config.History
+	if c == nil {
+		return nil
+	}
+
+	name := c.TableName[strings.LastIndex(c.TableName, ".")+1:]
+	query := render(`
+	CREATE TABLE IF NOT EXISTS {history} (
+	    LIKE {table},
+	    {from} timestamptz NOT NULL,
+	    {to}   timestamptz
+	);
+	CREATE INDEX IF NOT EXISTS {name}_id_idx ON {history} (id, {from});
+	CREATE OR REPLACE FUNCTION {history}_record() RETURNS trigger AS $$
+	BEGIN
+	    IF TG_OP IN ('UPDATE', 'DELETE') THEN
+	        UPDATE {history} SET {to} = now() WHERE id = OLD.id AND {to} IS NULL;
+	    END IF;
+	    IF TG_OP IN ('INSERT', 'UPDATE') THEN
+	        INSERT INTO {history} SELECT NEW.*, now(), NULL;
+	    END IF;
+	    RETURN NULL;
+	END $$ LANGUAGE plpgsql;
+	DROP TRIGGER IF EXISTS {name}_record ON {table};
+	CREATE TRIGGER {name}_record AFTER INSERT OR UPDATE OR DELETE ON {table}
+	    FOR EACH ROW EXECUTE PROCEDURE {history}_record()`,
+		map[string]string{
+			"table":   r.config.TableName,
+			"history": c.TableName,
+			"name":    name,
+			"from":    c.ValidFromColumn,
+			"to":      c.ValidToColumn,
+		})
+
+	return r.writeTx(ctx, func(tx *sqlx.Tx) error {
+		if err := lockSchema(ctx, tx, r.config.TableName); err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, query); err != nil {
+			return eh.RepoError{
+				Err:       err,
+				Namespace: eh.NamespaceFromContext(ctx),
+			}
+		}
+		return nil
+	})
+}
+
+// FindAsOf returns the version of the entity that was valid at the time t. It
+// returns an eh.ErrEntityNotFound error if the entity did not exist then. It
+// requires Config.History.
+func (r *Repo) FindAsOf(ctx context.Context, id uuid.UUID, t time.Time) (eh.Entity, error) {
+	c := r.config.History
+	if c == nil || r.factoryFn == nil {
+		err := ErrModelNotSet
+		if c == nil {
+			err = fmt.Errorf("%w: not configured", ErrInvalidHistory)
+		}
+		return nil, eh.RepoError{
+			Err:       eh.ErrCouldNotLoadEntity,
+			BaseErr:   err,
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	}
+
+	query := fmt.Sprintf("SELECT * FROM %[1]s WHERE id = $1 AND %[2]s <= $2 "+
+		"AND (%[3]s IS NULL OR %[3]s > $2)", c.TableName, c.ValidFromColumn, c.ValidToColumn)
+	if sd := r.config.SoftDelete; sd != nil {
+		query += fmt.Sprintf(" AND %s IS NULL", sd.Column)
+	}
+
+	q, release, err := r.conn(ctx, false)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	entity, err := r.get(ctx, q, query, id, t)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, eh.RepoError{
+			Err:       eh.ErrEntityNotFound,
+			BaseErr:   &NotFoundError{ID: id, Table: c.TableName},
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	} else if err != nil {
+		return nil, eh.RepoError{
+			Err:       eh.ErrCouldNotLoadEntity,
+			BaseErr:   err,
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	}
+
+	return entity, nil
+}
@@ -0,0 +1,49 @@
+package repo
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jmoiron/sqlx"
+	eh "github.com/looplab/eventhorizon"
+
+	"github.com/eendLabs/eh-pg/pkg/mocks"
+)
+
+func TestHistory(t *testing.T) {
+	db, err := sqlx.Open("postgres", "")
+	if err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+
+	config := &Config{TableName: "public.models", History: &HistoryConfig{}}
+	if _, err := NewRepoWithClient(config, db); err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	if c := config.History; c.TableName != "public.models_history" ||
+		c.ValidFromColumn != "valid_from" || c.ValidToColumn != "valid_to" {
+		t.Error("the config should have the defaults:", c)
+	}
+
+	if _, err := NewRepoWithClient(&Config{
+		TableName: "models",
+		History:   &HistoryConfig{ValidToColumn: "valid to"},
+	}, db); !errors.Is(err, ErrInvalidHistory) {
+		t.Error("there should be a ErrInvalidHistory error:", err)
+	}
+
+	r, err := NewRepoWithClient(&Config{TableName: "models"}, db)
+	if err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	r.SetEntityFactory(func() eh.Entity {
+		return &mocks.Model{}
+	})
+	_, err = r.FindAsOf(context.Background(), uuid.New(), time.Now())
+	if rrErr, ok := err.(eh.RepoError); !ok || !errors.Is(rrErr.BaseErr, ErrInvalidHistory) {
+		t.Error("there should be a ErrInvalidHistory error:", err)
+	}
+}
@@ -0,0 +1,144 @@
+package repo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	eh "github.com/looplab/eventhorizon"
+)
+
+// ErrInvalidIdempotency is when the idempotency config is not valid.
+var ErrInvalidIdempotency = errors.New("invalid idempotency config")
+
+// IdempotencyConfig records the idempotency keys of Saves, see
+// WithIdempotencyKey, in a meta table in the same transaction as the Save, so
+// that reprocessing an event after a crash is a no-op. The meta table is
+// created with EnsureIdempotency and can be shared by several repos, the keys
+// are scoped by table and namespace.
+type IdempotencyConfig struct {
+	// TableName is the meta table, "eh_idempotency_keys" by default.
+	TableName string
+}
+
+func (c *IdempotencyConfig) provideDefaults() {
+	if c.TableName == "" {
+		c.TableName = "eh_idempotency_keys"
+	}
+}
+
+func (c *IdempotencyConfig) validate() error {
+	if !validTableName(c.TableName) {
+		return fmt.Errorf("%w: invalid table name %q", ErrInvalidIdempotency, c.TableName)
+	}
+	return nil
+}
+
+// WithIdempotencyKey returns a context making Save a no-op if a Save with the
+// same key, like the event ID and the handler name, was already committed to
+// the table. The key is ignored by repos without Config.Idempotency.
+func WithIdempotencyKey(ctx context.Context, key string) context.Context {
+	return context.WithValue(ctx, idempotencyKey, key)
+}
+
+func idempotencyKeyFromContext(ctx context.Context) string {
+	key, _ := ctx.Value(idempotencyKey).(string)
+	return key
+}
+
+// EnsureIdempotency creates the meta table of the idempotency keys if needed.
+func (r *Repo) EnsureIdempotency(ctx context.Context) error {
+	c := r.config.Idempotency
+	if c == nil {
+		return nil
+	}
+
+	return r.writeTx(ctx, func(tx *sqlx.Tx) error {
+		if err := lockSchema(ctx, tx, c.TableName); err != nil {
+			return err
+		}
+		_, err := tx.ExecContext(ctx, fmt.Sprintf(`
+		CREATE TABLE IF NOT EXISTS %s (
+		    table_name text NOT NULL,
+		    namespace  text NOT NULL,
+		    key        text NOT NULL,
+		    created_at timestamptz NOT NULL DEFAULT now(),
+		    PRIMARY KEY (table_name, namespace, key)
+		)`, c.TableName))
+		if err != nil {
+			return eh.RepoError{
+				Err:       ErrCouldNotEnsureSchema,
+				BaseErr:   err,
+				Namespace: eh.NamespaceFromContext(ctx),
+			}
+		}
+		return nil
+	})
+}
+
+// saveOnce saves the entity and records the idempotency key in a
+// transaction, unless the key is already recorded.
+func (r *Repo) saveOnce(ctx context.Context, key string, entity eh.Entity) error {
+	return r.writeTx(ctx, func(tx *sqlx.Tx) error {
+		res, err := tx.ExecContext(ctx, fmt.Sprintf(
+			"INSERT INTO %s (table_name, namespace, key) VALUES ($1, $2, $3) "+
+				"ON CONFLICT DO NOTHING", r.config.Idempotency.TableName),
+			r.config.TableName, eh.NamespaceFromContext(ctx), key)
+		if err != nil {
+			return eh.RepoError{
+				Err:       eh.ErrCouldNotSaveEntity,
+				BaseErr:   err,
+				Namespace: eh.NamespaceFromContext(ctx),
+			}
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return eh.RepoError{
+				Err:       eh.ErrCouldNotSaveEntity,
+				BaseErr:   err,
+				Namespace: eh.NamespaceFromContext(ctx),
+			}
+		}
+		if n == 0 {
+			// Already saved.
+			return nil
+		}
+
+		return r.saveEntity(contextWithTx(ctx, r.client.DB, tx), entity)
+	})
+}
+
+// DeleteIdempotencyKeys deletes the idempotency keys of the table recorded
+// longer than olderThan ago, once events can't be reprocessed anymore, and
+// returns the number of deleted keys.
+func (r *Repo) DeleteIdempotencyKeys(ctx context.Context, olderThan time.Duration) (int64, error) {
+	c := r.config.Idempotency
+	if c == nil {
+		return 0, fmt.Errorf("%w: not configured", ErrInvalidIdempotency)
+	}
+
+	var affected int64
+	err := r.inSettings(ctx, func(ctx context.Context) error {
+		ex, release, err := r.conn(ctx, true)
+		if err != nil {
+			return err
+		}
+		defer release()
+
+		res, err := ex.ExecContext(ctx, fmt.Sprintf(
+			"DELETE FROM %s WHERE table_name = $1 "+
+				"AND created_at < now() - $2 * interval '1 millisecond'", c.TableName),
+			r.config.TableName, olderThan.Milliseconds())
+		if err != nil {
+			return eh.RepoError{
+				Err:       err,
+				Namespace: eh.NamespaceFromContext(ctx),
+			}
+		}
+		affected, err = res.RowsAffected()
+		return err
+	})
+	return affected, err
+}
@@ -0,0 +1,39 @@
+package repo
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/jmoiron/sqlx"
+)
+
+func TestIdempotency(t *testing.T) {
+	db, err := sqlx.Open("postgres", "")
+	if err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+
+	config := &Config{TableName: "models", Idempotency: &IdempotencyConfig{}}
+	if _, err := NewRepoWithClient(config, db); err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	if config.Idempotency.TableName != "eh_idempotency_keys" {
+		t.Error("the table should be the default:", config.Idempotency.TableName)
+	}
+
+	if _, err := NewRepoWithClient(&Config{
+		TableName:   "models",
+		Idempotency: &IdempotencyConfig{TableName: "a b"},
+	}, db); !errors.Is(err, ErrInvalidIdempotency) {
+		t.Error("there should be a ErrInvalidIdempotency error:", err)
+	}
+
+	ctx := context.Background()
+	if key := idempotencyKeyFromContext(WithIdempotencyKey(ctx, "event/handler")); key != "event/handler" {
+		t.Error("the key should be in the context:", key)
+	}
+	if key := idempotencyKeyFromContext(ctx); key != "" {
+		t.Error("there should be no key:", key)
+	}
+}
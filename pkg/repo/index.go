@@ -0,0 +1,276 @@
+package repo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+	eh "github.com/looplab/eventhorizon"
+)
+
+// ErrInvalidIndex is when an index of Config.Indexes is not valid.
+var ErrInvalidIndex = errors.New("invalid index")
+
+// IndexOption is an option for EnsureIndex.
+type IndexOption func(*indexOptions)
+
+type indexOptions struct {
+	concurrently bool
+}
+
+// Concurrently creates the index without locking the table against writes,
+// for tables in use. It is slower and can't run in a transaction, it runs on
+// its own connection even with the WithTx transaction of the context.
+func Concurrently() IndexOption {
+	return func(o *indexOptions) {
+		o.concurrently = true
+	}
+}
+
+// name returns the index name, derived from the table without its schema
+// and the keys when the IndexName is not set.
+func (i IndexInput) name(table string) string {
+	if i.IndexName != "" {
+		return i.IndexName
+	}
+	name := table[strings.LastIndex(table, ".")+1:] + "_" + i.PartitionKey
+	if i.SortKey != "" {
+		name += "_" + i.SortKey
+	}
+	return name + "_idx"
+}
+
+// createIndexQuery returns the CREATE INDEX statement backing
+// FindWithFilterUsingIndex with the index.
+func (i IndexInput) createIndexQuery(table string, o indexOptions) (string, error) {
+	if !validIdentifier(i.PartitionKey) {
+		return "", fmt.Errorf("%w: partition key %q",
+			ErrInvalidColumn, i.PartitionKey)
+	}
+	if i.SortKey != "" && !validIdentifier(i.SortKey) {
+		return "", fmt.Errorf("%w: sort key %q",
+			ErrInvalidColumn, i.SortKey)
+	}
+	if name := i.name(table); !validIdentifier(name) {
+		return "", fmt.Errorf("%w: index name %q",
+			ErrInvalidColumn, name)
+	}
+
+	columns := i.PartitionKey
+	if i.SortKey != "" {
+		columns += ", " + i.SortKey
+	}
+	concurrently := ""
+	if o.concurrently {
+		concurrently = "CONCURRENTLY "
+	}
+
+	return fmt.Sprintf("CREATE INDEX %sIF NOT EXISTS %s ON %s (%s)",
+		concurrently, i.name(table), table, columns), nil
+}
+
+// EnsureIndex creates the btree index on the partition and sort key columns
+// used by FindWithFilterUsingIndex if it doesn't exist. The index is named
+// <table>_<PartitionKey>_<SortKey>_idx when IndexName is not set. Like
+// EnsureTable it waits for the DDL of other instances on the table. Note that
+// a failed Concurrently build leaves an invalid index behind, which must be
+// dropped before retrying.
+func (r *Repo) EnsureIndex(ctx context.Context, index IndexInput,
+	opts ...IndexOption) error {
+	return r.EnsureIndexes(ctx, []IndexInput{index}, opts...)
+}
+
+// EnsureIndexes creates the indexes like EnsureIndex, in order.
+func (r *Repo) EnsureIndexes(ctx context.Context, indexes []IndexInput,
+	opts ...IndexOption) error {
+	var o indexOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	return r.ensureSchema(ctx, o.concurrently, func(ex sqlx.ExecerContext, table string) error {
+		for _, index := range indexes {
+			query, err := index.createIndexQuery(table, o)
+			if err != nil {
+				return eh.RepoError{
+					Err:       err,
+					Namespace: eh.NamespaceFromContext(ctx),
+				}
+			}
+			if _, err := ex.ExecContext(ctx, query); err != nil {
+				return eh.RepoError{
+					Err:       ErrCouldNotEnsureSchema,
+					BaseErr:   err,
+					Namespace: eh.NamespaceFromContext(ctx),
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// IndexMethod is the access method of an index.
+type IndexMethod string
+
+const (
+	// IndexBtree is the default index method, for equality, range and sort.
+	IndexBtree IndexMethod = "btree"
+	// IndexGIN indexes the keys and values of jsonb and the elements of
+	// array columns, for the containment filters like JSONContains and
+	// ArrayContains.
+	IndexGIN IndexMethod = "gin"
+)
+
+// IndexConfig is an index required by the queries of a projection, declared
+// in Config.Indexes. The indexes are created by EnsureTable and
+// EnsureConfigIndexes, and Ready checks that they exist.
+//
+//	Indexes: []IndexConfig{
+//		{Columns: []string{"tenant_id", "created_at"}},
+//		{Columns: []string{"email"}, Unique: true, Where: "deleted_at IS NULL"},
+//		{Columns: []string{"data"}, Method: IndexGIN},
+//	}
+type IndexConfig struct {
+	// Name is the name of the index, <table>_<columns>_idx by default, or
+	// <table>_<columns>_key for unique indexes. Index names are unique per
+	// schema, so the versions of the table, see Versioned, need the default.
+	Name string
+	// Columns are the indexed columns, in order.
+	Columns []string
+	// Unique makes the index a unique constraint on the columns.
+	Unique bool
+	// Where is optionally the predicate of a partial index, like
+	// "deleted_at IS NULL". Only queries with the predicate can use it.
+	Where string
+	// Method is IndexBtree by default.
+	Method IndexMethod
+	// OpClass is optionally the operator class of the columns, like
+	// jsonb_path_ops for smaller GIN indexes only supporting containment.
+	OpClass string
+}
+
+func (c IndexConfig) validate(table string) error {
+	if len(c.Columns) == 0 {
+		return fmt.Errorf("%w: no columns", ErrInvalidIndex)
+	}
+	for _, column := range c.Columns {
+		if !validIdentifier(column) {
+			return fmt.Errorf("%w: invalid column %q", ErrInvalidIndex, column)
+		}
+	}
+	if !validIdentifier(c.name(table)) {
+		return fmt.Errorf("%w: invalid name %q", ErrInvalidIndex, c.name(table))
+	}
+	switch c.Method {
+	case "", IndexBtree:
+	case IndexGIN:
+		if c.Unique {
+			return fmt.Errorf("%w: %s: GIN indexes can't be unique",
+				ErrInvalidIndex, c.name(table))
+		}
+	default:
+		return fmt.Errorf("%w: %s: unknown method %q",
+			ErrInvalidIndex, c.name(table), c.Method)
+	}
+	if c.OpClass != "" && !validIdentifier(c.OpClass) {
+		return fmt.Errorf("%w: %s: invalid operator class %q",
+			ErrInvalidIndex, c.name(table), c.OpClass)
+	}
+	if strings.Contains(c.Where, ";") {
+		return fmt.Errorf("%w: %s: invalid predicate %q",
+			ErrInvalidIndex, c.name(table), c.Where)
+	}
+	return nil
+}
+
+// name returns the index name, derived from the table without its schema and
+// the columns when the Name is not set.
+func (c IndexConfig) name(table string) string {
+	if c.Name != "" {
+		return c.Name
+	}
+	suffix := "_idx"
+	if c.Unique {
+		suffix = "_key"
+	}
+	return table[strings.LastIndex(table, ".")+1:] + "_" +
+		strings.Join(c.Columns, "_") + suffix
+}
+
+// createIndexQuery returns the CREATE INDEX statement of the index, which
+// must be valid.
+func (c IndexConfig) createIndexQuery(table string, o indexOptions) string {
+	var b strings.Builder
+	b.WriteString("CREATE ")
+	if c.Unique {
+		b.WriteString("UNIQUE ")
+	}
+	b.WriteString("INDEX ")
+	if o.concurrently {
+		b.WriteString("CONCURRENTLY ")
+	}
+	fmt.Fprintf(&b, "IF NOT EXISTS %s ON %s ", c.name(table), table)
+	if c.Method != "" && c.Method != IndexBtree {
+		fmt.Fprintf(&b, "USING %s ", c.Method)
+	}
+
+	columns := quoteColumns(c.Columns)
+	if c.OpClass != "" {
+		for i := range columns {
+			columns[i] += " " + c.OpClass
+		}
+	}
+	fmt.Fprintf(&b, "(%s)", strings.Join(columns, ", "))
+	if c.Where != "" {
+		fmt.Fprintf(&b, " WHERE %s", c.Where)
+	}
+	return b.String()
+}
+
+// EnsureConfigIndexes creates the indexes of Config.Indexes if they don't
+// exist, in order. EnsureTable creates them with the table, this is for
+// existing tables, typically with Concurrently. Note that an existing index
+// with the same name is kept as is, even if it is defined differently.
+func (r *Repo) EnsureConfigIndexes(ctx context.Context, opts ...IndexOption) error {
+	if len(r.indexes()) == 0 {
+		return nil
+	}
+
+	var o indexOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	return r.ensureSchema(ctx, o.concurrently, func(ex sqlx.ExecerContext, table string) error {
+		return r.ensureConfigIndexes(ctx, ex, table, o)
+	})
+}
+
+func (r *Repo) ensureConfigIndexes(ctx context.Context, ex sqlx.ExecerContext,
+	table string, o indexOptions) error {
+	for _, index := range r.indexes() {
+		if _, err := ex.ExecContext(ctx,
+			index.createIndexQuery(table, o)); err != nil {
+			return eh.RepoError{
+				Err:       ErrCouldNotEnsureSchema,
+				BaseErr:   err,
+				Namespace: eh.NamespaceFromContext(ctx),
+			}
+		}
+	}
+
+	return nil
+}
+
+// requiredIndexes returns the names of the indexes of Config.Indexes and of
+// the indexed generated columns.
+func (r *Repo) requiredIndexes() []string {
+	indexes := r.indexes()
+	names := make([]string, len(indexes))
+	for i, index := range indexes {
+		names[i] = index.name(r.config.TableName)
+	}
+	return names
+}
@@ -0,0 +1,115 @@
+package repo
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestCreateIndexQuery(t *testing.T) {
+	for _, c := range []struct {
+		index    IndexInput
+		opts     indexOptions
+		expected string
+	}{
+		{
+			IndexInput{IndexName: "by_content", PartitionKey: "content", SortKey: "created_at"},
+			indexOptions{},
+			"CREATE INDEX IF NOT EXISTS by_content ON models (content, created_at)",
+		},
+		{
+			IndexInput{PartitionKey: "content"},
+			indexOptions{},
+			"CREATE INDEX IF NOT EXISTS models_content_idx ON models (content)",
+		},
+		{
+			IndexInput{PartitionKey: "content", SortKey: "version"},
+			indexOptions{concurrently: true},
+			"CREATE INDEX CONCURRENTLY IF NOT EXISTS models_content_version_idx ON models (content, version)",
+		},
+	} {
+		query, err := c.index.createIndexQuery("models", c.opts)
+		if err != nil {
+			t.Fatal("there should be no error:", err)
+		}
+		if query != c.expected {
+			t.Errorf("the query should be correct: %s", query)
+		}
+	}
+
+	query, err := IndexInput{PartitionKey: "content"}.createIndexQuery("app.models", indexOptions{})
+	if err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	if query != "CREATE INDEX IF NOT EXISTS models_content_idx ON app.models (content)" {
+		t.Errorf("the index name should not have the schema: %s", query)
+	}
+
+	for _, index := range []IndexInput{
+		{PartitionKey: "content; DROP TABLE models"},
+		{PartitionKey: "content", SortKey: "1"},
+		{IndexName: "by content", PartitionKey: "content"},
+	} {
+		if _, err := index.createIndexQuery("models", indexOptions{}); !errors.Is(err, ErrInvalidColumn) {
+			t.Error("the index should be invalid:", index, err)
+		}
+	}
+	_, err = IndexInput{PartitionKey: "content"}.createIndexQuery("my-models", indexOptions{})
+	if !errors.Is(err, ErrInvalidColumn) || !strings.Contains(err.Error(), "my-models_content_idx") {
+		t.Error("the error should have the computed name:", err)
+	}
+}
+
+func TestIndexConfig(t *testing.T) {
+	for _, c := range []struct {
+		index    IndexConfig
+		opts     indexOptions
+		expected string
+	}{
+		{
+			IndexConfig{Columns: []string{"content", "created_at"}},
+			indexOptions{},
+			"CREATE INDEX IF NOT EXISTS models_content_created_at_idx ON models (content, created_at)",
+		},
+		{
+			IndexConfig{Columns: []string{"email"}, Unique: true, Where: "deleted_at IS NULL"},
+			indexOptions{concurrently: true},
+			"CREATE UNIQUE INDEX CONCURRENTLY IF NOT EXISTS models_email_key ON models (email) WHERE deleted_at IS NULL",
+		},
+		{
+			IndexConfig{Name: "by_data", Columns: []string{"data"}, Method: IndexGIN, OpClass: "jsonb_path_ops"},
+			indexOptions{},
+			"CREATE INDEX IF NOT EXISTS by_data ON models USING gin (data jsonb_path_ops)",
+		},
+		{
+			IndexConfig{Columns: []string{"createdAt"}, Method: IndexBtree},
+			indexOptions{},
+			`CREATE INDEX IF NOT EXISTS models_createdAt_idx ON models ("createdAt")`,
+		},
+	} {
+		if err := c.index.validate("models"); err != nil {
+			t.Fatal("there should be no error:", err)
+		}
+		if query := c.index.createIndexQuery("models", c.opts); query != c.expected {
+			t.Errorf("the query should be correct: %s", query)
+		}
+	}
+
+	if name := (IndexConfig{Columns: []string{"content"}}).name("app.models"); name != "models_content_idx" {
+		t.Error("the name should not include the schema:", name)
+	}
+
+	for _, index := range []IndexConfig{
+		{},
+		{Columns: []string{"content; DROP TABLE models"}},
+		{Name: "by content", Columns: []string{"content"}},
+		{Columns: []string{"data"}, Method: IndexGIN, Unique: true},
+		{Columns: []string{"data"}, Method: "hash"},
+		{Columns: []string{"data"}, OpClass: "jsonb_path_ops)"},
+		{Columns: []string{"content"}, Where: "true; DROP TABLE models"},
+	} {
+		if err := index.validate("models"); !errors.Is(err, ErrInvalidIndex) {
+			t.Error("the index should be invalid:", index, err)
+		}
+	}
+}
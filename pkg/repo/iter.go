@@ -0,0 +1,148 @@
+package repo
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/jmoiron/sqlx"
+	eh "github.com/looplab/eventhorizon"
+)
+
+// defaultFetchSize is the number of rows fetched at a time by the iterators.
+const defaultFetchSize = 1000
+
+// iterCursor is the name of the server-side cursor of the iterators, it is
+// scoped to the transaction of the iterator.
+const iterCursor = "eh_iter"
+
+// The iterator reads the rows from a server-side cursor, a batch of fetchSize
+// rows at a time, so that only one batch is buffered by the driver.
+// The iterator is not thread safe.
+type iter struct {
+	tx        *sqlx.Tx
+	fetchSize int
+	rows      *sqlx.Rows
+	fetched   int
+	done      bool
+	release   func()
+	data      eh.Entity
+	scanRow   func(*sqlx.Rows) (eh.Entity, error)
+	err       error
+	decodeErr error
+}
+
+func (i *iter) Next(ctx context.Context) bool {
+	for i.err == nil && i.decodeErr == nil && !i.done {
+		if i.rows != nil && i.rows.Next() {
+			i.fetched++
+			i.data, i.decodeErr = i.scanRow(i.rows)
+			return i.decodeErr == nil
+		}
+
+		if i.rows != nil {
+			if i.err = i.rows.Err(); i.err != nil {
+				return false
+			}
+			i.rows.Close()
+			i.rows = nil
+			if i.fetched < i.fetchSize {
+				i.done = true
+				return false
+			}
+		}
+
+		i.fetched = 0
+		i.rows, i.err = i.tx.QueryxContext(ctx,
+			fmt.Sprintf("FETCH %d FROM %s", i.fetchSize, iterCursor))
+	}
+	return false
+}
+
+func (i *iter) Value() interface{} {
+	return i.data
+}
+
+func (i *iter) Close(_ context.Context) error {
+	defer i.release()
+
+	if i.rows != nil {
+		if err := i.rows.Close(); err != nil {
+			i.tx.Rollback()
+			return err
+		}
+	}
+	// Only read, rolling back closes the cursor.
+	if err := i.tx.Rollback(); err != nil {
+		return err
+	}
+	if i.decodeErr != nil {
+		return i.decodeErr
+	}
+	return i.err
+}
+
+// FindAllIter returns an iterator over all entities, which can be used to
+// stream very large tables without loading all entities in memory. The rows
+// are read from a server-side cursor in batches of Config.IterFetchSize,
+// within a read-only transaction that is held open until the iterator is
+// closed. The iterator must be closed.
+func (r *Repo) FindAllIter(ctx context.Context) (eh.Iter, error) {
+	if r.factoryFn == nil {
+		return nil, eh.RepoError{
+			Err:       ErrModelNotSet,
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	}
+
+	return r.queryIter(ctx,
+		fmt.Sprintf("SELECT * FROM %s", r.readTable()))
+}
+
+// queryIter declares a cursor for the query, in a transaction with the
+// settings of the context, and returns an iterator over the rows.
+func (r *Repo) queryIter(ctx context.Context, query string,
+	args ...interface{}) (eh.Iter, error) {
+	settings, err := r.settings(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	release, err := r.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := r.client.BeginTxx(ctx, &sql.TxOptions{ReadOnly: true})
+	if err == nil {
+		if err := setConfig(ctx, tx, settings); err != nil {
+			tx.Rollback()
+			release()
+			return nil, err
+		}
+		if _, err = tx.ExecContext(ctx, fmt.Sprintf(
+			"DECLARE %s NO SCROLL CURSOR FOR %s", iterCursor, query), args...); err != nil {
+			tx.Rollback()
+		}
+	}
+	if err != nil {
+		release()
+		return nil, eh.RepoError{
+			Err:       eh.ErrCouldNotLoadEntity,
+			BaseErr:   err,
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	}
+
+	fetchSize := r.config.IterFetchSize
+	if fetchSize <= 0 {
+		fetchSize = defaultFetchSize
+	}
+
+	return &iter{
+		tx:        tx,
+		fetchSize: fetchSize,
+		release:   release,
+		scanRow:   r.scanRow,
+	}, nil
+}
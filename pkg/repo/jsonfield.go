@@ -0,0 +1,120 @@
+package repo
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/jmoiron/sqlx/reflectx"
+)
+
+// JSONField is a text field in a JSONB column, like the status in
+// data->>'status', that can be filtered on with JSONFieldEq and JSONFieldIn.
+// Fields declared in Config.JSONFields get a matching expression index with
+// EnsureJSONIndexes, so the filters don't scan the table:
+//
+//	status := JSONField{Column: "data", Keys: []string{"status"}}
+//	r.FindWhere(ctx, JSONFieldEq(status, "open"))
+type JSONField struct {
+	// Column is the JSONB column.
+	Column string
+	// Keys is the path to the field, one key per level of nesting.
+	Keys []string
+}
+
+func (f JSONField) validate() error {
+	if !validIdentifier(f.Column) {
+		return fmt.Errorf("%w: %q", ErrInvalidColumn, f.Column)
+	}
+	if len(f.Keys) == 0 {
+		return fmt.Errorf("%w: %s: no keys", ErrInvalidColumn, f.Column)
+	}
+	for _, k := range f.Keys {
+		if !validIdentifier(k) {
+			return fmt.Errorf("%w: %s: invalid key %q", ErrInvalidColumn, f.Column, k)
+		}
+	}
+	return nil
+}
+
+// expr returns the expression of the field, which must be valid. The same
+// expression is used by the filters and the index, so that the index matches.
+func (f JSONField) expr() string {
+	if len(f.Keys) == 1 {
+		return fmt.Sprintf("(%s->>'%s')", f.Column, f.Keys[0])
+	}
+	return fmt.Sprintf("(%s#>>'{%s}')", f.Column, strings.Join(f.Keys, ","))
+}
+
+// indexName returns the name of the expression index of the field.
+func (f JSONField) indexName(table string) string {
+	return strings.ReplaceAll(table, ".", "_") + "_" + f.Column + "_" +
+		strings.Join(f.Keys, "_") + "_idx"
+}
+
+// JSONFieldEq matches entities where the JSON field equals the value, compared
+// as text.
+func JSONFieldEq(f JSONField, value string) Filter {
+	return filterFunc(func(m *reflectx.Mapper, entity interface{},
+		args []interface{}) (string, []interface{}, error) {
+		if err := f.checkColumn(m, entity); err != nil {
+			return "", nil, err
+		}
+		args = append(args, value)
+		return fmt.Sprintf("%s = $%d", f.expr(), len(args)), args, nil
+	})
+}
+
+// JSONFieldIn matches entities where the JSON field equals one of the values,
+// compared as text. With no values it matches nothing.
+func JSONFieldIn(f JSONField, values ...string) Filter {
+	return filterFunc(func(m *reflectx.Mapper, entity interface{},
+		args []interface{}) (string, []interface{}, error) {
+		if err := f.checkColumn(m, entity); err != nil {
+			return "", nil, err
+		}
+		if len(values) == 0 {
+			return "FALSE", args, nil
+		}
+		params := make([]string, len(values))
+		for i, v := range values {
+			args = append(args, v)
+			params[i] = fmt.Sprintf("$%d", len(args))
+		}
+		return fmt.Sprintf("%s IN (%s)", f.expr(), strings.Join(params, ", ")), args, nil
+	})
+}
+
+// checkColumn validates the field and checks that its column is mapped.
+func (f JSONField) checkColumn(m *reflectx.Mapper, entity interface{}) error {
+	if err := f.validate(); err != nil {
+		return err
+	}
+	if !hasColumn(m, entity, f.Column) {
+		return fmt.Errorf("%w: %q is not mapped", ErrInvalidColumn, f.Column)
+	}
+	return nil
+}
+
+// EnsureJSONIndexes creates the expression indexes of the JSON fields in
+// Config.JSONFields if they don't exist.
+func (r *Repo) EnsureJSONIndexes(ctx context.Context) error {
+	if len(r.config.JSONFields) == 0 {
+		return nil
+	}
+
+	return r.writeTx(ctx, func(tx *sqlx.Tx) error {
+		if err := lockSchema(ctx, tx, r.config.TableName); err != nil {
+			return err
+		}
+		for _, f := range r.config.JSONFields {
+			if _, err := tx.ExecContext(ctx, fmt.Sprintf(
+				"CREATE INDEX IF NOT EXISTS %s ON %s (%s)",
+				f.indexName(r.config.TableName), r.config.TableName, f.expr())); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,52 @@
+package repo
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/jmoiron/sqlx"
+)
+
+func TestJSONField(t *testing.T) {
+	status := JSONField{Column: "attrs", Keys: []string{"status"}}
+	city := JSONField{Column: "attrs", Keys: []string{"address", "city"}}
+	expr, args, err := And(
+		JSONFieldEq(status, "open"),
+		JSONFieldIn(city, "Amsterdam", "Utrecht"),
+	).compile(defaultMapper, &documentModel{}, nil)
+	if err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	expected := "((attrs->>'status') = $1) AND " +
+		"((attrs#>>'{address,city}') IN ($2, $3))"
+	if expr != expected {
+		t.Error("the expression should be correct:", expr)
+	}
+	if len(args) != 3 || args[0] != "open" || args[2] != "Utrecht" {
+		t.Error("the args should be correct:", args)
+	}
+	if name := city.indexName("public.documents"); name != "public_documents_attrs_address_city_idx" {
+		t.Error("the index name should be correct:", name)
+	}
+
+	for _, f := range []JSONField{
+		{Column: "data", Keys: []string{"status"}},
+		{Column: "attrs", Keys: []string{"status'); DROP TABLE documents; --"}},
+		{Column: "attrs"},
+	} {
+		if _, _, err := JSONFieldEq(f, "x").compile(defaultMapper, &documentModel{}, nil); !errors.Is(err, ErrInvalidColumn) {
+			t.Error("there should be a ErrInvalidColumn error:", f, err)
+		}
+	}
+
+	db, err := sqlx.Open("postgres", "")
+	if err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	if _, err := NewRepoWithClient(&Config{
+		TableName:  "documents",
+		JSONFields: []JSONField{{Column: "attrs", Keys: []string{"a-b"}}},
+	}, db); !errors.Is(err, ErrInvalidColumn) {
+		t.Error("there should be a ErrInvalidColumn error:", err)
+	}
+}
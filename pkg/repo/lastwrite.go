@@ -0,0 +1,159 @@
+package repo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	eh "github.com/looplab/eventhorizon"
+)
+
+// ErrInvalidLastWrite is when the last write config is not valid.
+var ErrInvalidLastWrite = errors.New("invalid last write config")
+
+// LastWriteConfig records the time and event position of the last successful
+// Save per table and namespace in a meta table, as a freshness signal for
+// dashboards and alerts. The meta table is created with EnsureLastWrite and
+// can be shared by several repos.
+type LastWriteConfig struct {
+	// TableName is the meta table, "eh_last_writes" by default.
+	TableName string
+}
+
+func (c *LastWriteConfig) provideDefaults() {
+	if c.TableName == "" {
+		c.TableName = "eh_last_writes"
+	}
+}
+
+func (c *LastWriteConfig) validate() error {
+	if !validTableName(c.TableName) {
+		return fmt.Errorf("%w: invalid table name %q", ErrInvalidLastWrite, c.TableName)
+	}
+	return nil
+}
+
+// LastWrite is the last successful Save to a table and namespace.
+type LastWrite struct {
+	Table     string `db:"table_name"`
+	Namespace string `db:"namespace"`
+	// Time is when the write was committed.
+	Time time.Time `db:"written_at"`
+	// Version is the version of the written entity, the position in its
+	// event stream, or 0 if the entity is not versioned.
+	Version int `db:"version"`
+}
+
+// EnsureLastWrite creates the meta table of the last writes if needed.
+func (r *Repo) EnsureLastWrite(ctx context.Context) error {
+	c := r.config.LastWrite
+	if c == nil {
+		return nil
+	}
+
+	return r.writeTx(ctx, func(tx *sqlx.Tx) error {
+		if err := lockSchema(ctx, tx, c.TableName); err != nil {
+			return err
+		}
+		_, err := tx.ExecContext(ctx, fmt.Sprintf(`
+		CREATE TABLE IF NOT EXISTS %s (
+		    table_name text NOT NULL,
+		    namespace  text NOT NULL,
+		    written_at timestamptz NOT NULL,
+		    version    integer NOT NULL,
+		    PRIMARY KEY (table_name, namespace)
+		)`, c.TableName))
+		if err != nil {
+			return eh.RepoError{
+				Err:       ErrCouldNotEnsureSchema,
+				BaseErr:   err,
+				Namespace: eh.NamespaceFromContext(ctx),
+			}
+		}
+		return nil
+	})
+}
+
+// recordLastWrite upserts the last write of the entity, after the write is
+// committed or, in a repo-managed transaction, in that transaction so it is
+// only recorded on commit. Failures are logged and don't fail the Save, the
+// entity is already written.
+func (r *Repo) recordLastWrite(ctx context.Context, entity eh.Entity) {
+	c := r.config.LastWrite
+	if c == nil {
+		return
+	}
+
+	var version int
+	if v, ok := entity.(eh.Versionable); ok {
+		version = v.AggregateVersion()
+	}
+	query := fmt.Sprintf(`
+	INSERT INTO %s (table_name, namespace, written_at, version)
+	VALUES ($1, $2, now(), $3)
+	ON CONFLICT (table_name, namespace) DO UPDATE
+	SET written_at = EXCLUDED.written_at, version = EXCLUDED.version`, c.TableName)
+	args := []interface{}{r.config.TableName, eh.NamespaceFromContext(ctx), version}
+
+	ex, release, err := r.conn(ctx, true)
+	if err != nil {
+		log.Printf("eh-pg: could not record last write to %s: %v", r.config.TableName, err)
+		return
+	}
+	defer release()
+
+	tx, ok := ex.(*sqlx.Tx)
+	if !ok {
+		if _, err := ex.ExecContext(ctx, query, args...); err != nil {
+			log.Printf("eh-pg: could not record last write to %s: %v", r.config.TableName, err)
+		}
+		return
+	}
+
+	// A failed statement would abort the transaction of the caller.
+	if _, err := tx.ExecContext(ctx, "SAVEPOINT eh_last_write"); err != nil {
+		log.Printf("eh-pg: could not record last write to %s: %v", r.config.TableName, err)
+		return
+	}
+	if _, err := tx.ExecContext(ctx, query, args...); err != nil {
+		log.Printf("eh-pg: could not record last write to %s: %v", r.config.TableName, err)
+		if _, err := tx.ExecContext(ctx, "ROLLBACK TO SAVEPOINT eh_last_write"); err != nil {
+			log.Printf("eh-pg: could not roll back last write to %s: %v", r.config.TableName, err)
+		}
+		return
+	}
+	if _, err := tx.ExecContext(ctx, "RELEASE SAVEPOINT eh_last_write"); err != nil {
+		log.Printf("eh-pg: could not record last write to %s: %v", r.config.TableName, err)
+	}
+}
+
+// LastWrites returns the last writes to the table of the repo, one per
+// namespace, for exporting as metrics.
+func (r *Repo) LastWrites(ctx context.Context) ([]LastWrite, error) {
+	c := r.config.LastWrite
+	if c == nil {
+		return nil, fmt.Errorf("%w: not configured", ErrInvalidLastWrite)
+	}
+
+	q, release, err := r.conn(ctx, false)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	var writes []LastWrite
+	if err := sqlx.SelectContext(ctx, q, &writes, fmt.Sprintf(`
+	SELECT table_name, namespace, written_at, version FROM %s
+	WHERE table_name = $1 ORDER BY namespace`, c.TableName),
+		r.config.TableName); err != nil {
+		return nil, eh.RepoError{
+			Err:       eh.ErrCouldNotLoadEntity,
+			BaseErr:   err,
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	}
+	return writes, nil
+}
@@ -0,0 +1,30 @@
+package repo
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/jmoiron/sqlx"
+)
+
+func TestLastWriteConfig(t *testing.T) {
+	db, err := sqlx.Open("postgres", "")
+	if err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+
+	config := &Config{TableName: "models", LastWrite: &LastWriteConfig{}}
+	if _, err := NewRepoWithClient(config, db); err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	if config.LastWrite.TableName != "eh_last_writes" {
+		t.Error("the table name should be the default:", config.LastWrite.TableName)
+	}
+
+	if _, err := NewRepoWithClient(&Config{
+		TableName: "models",
+		LastWrite: &LastWriteConfig{TableName: "meta; DROP TABLE models"},
+	}, db); !errors.Is(err, ErrInvalidLastWrite) {
+		t.Error("there should be a ErrInvalidLastWrite error:", err)
+	}
+}
@@ -0,0 +1,67 @@
+package repo
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/jmoiron/sqlx/reflectx"
+	eh "github.com/looplab/eventhorizon"
+)
+
+// FindLatest returns the newest entity per distinct value of the key columns,
+// newest by the by column, among the entities matching the filter (all if
+// nil). Like the latest status row per order:
+//
+//	r.FindLatest(ctx, []string{"order_id"}, "created_at", nil)
+//
+// It compiles to SELECT DISTINCT ON (key) ... ORDER BY key, by DESC, which is
+// fast with an index on (key, by).
+func (r *Repo) FindLatest(ctx context.Context, key []string, by string,
+	where Filter) ([]eh.Entity, error) {
+	if r.factoryFn == nil {
+		return nil, eh.RepoError{
+			Err:       ErrModelNotSet,
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	}
+
+	query, args, err := latestQuery(r.mapper, r.readTable(), r.factoryFn(), key, by, where)
+	if err != nil {
+		return nil, eh.RepoError{
+			Err:       eh.ErrCouldNotLoadEntity,
+			BaseErr:   err,
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	}
+
+	return r.query(ctx, query, args...)
+}
+
+// latestQuery returns the query of FindLatest.
+func latestQuery(m *reflectx.Mapper, table string, entity interface{}, key []string, by string,
+	where Filter) (string, []interface{}, error) {
+	if len(key) == 0 {
+		return "", nil, fmt.Errorf("%w: no key columns", ErrInvalidColumn)
+	}
+	for _, column := range append([]string{by}, key...) {
+		if !hasColumn(m, entity, column) {
+			return "", nil, fmt.Errorf("%w: %q is not mapped", ErrInvalidColumn, column)
+		}
+	}
+
+	keys := strings.Join(quoteColumns(key), ", ")
+	query := fmt.Sprintf("SELECT DISTINCT ON (%s) * FROM %s", keys, table)
+	var args []interface{}
+	if where != nil {
+		var expr string
+		var err error
+		if expr, args, err = where.compile(m, entity, nil); err != nil {
+			return "", nil, err
+		}
+		query += " WHERE " + expr
+	}
+	query += fmt.Sprintf(" ORDER BY %s, %s DESC, id DESC", keys, quoteColumn(by))
+
+	return query, args, nil
+}
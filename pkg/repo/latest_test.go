@@ -0,0 +1,43 @@
+package repo
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/eendLabs/eh-pg/pkg/mocks"
+)
+
+func TestLatestQuery(t *testing.T) {
+	query, args, err := latestQuery(defaultMapper, "models", &mocks.Model{},
+		[]string{"content"}, "created_at", Gt("version", 1))
+	if err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	if query != "SELECT DISTINCT ON (content) * FROM models WHERE version > $1 "+
+		"ORDER BY content, created_at DESC, id DESC" {
+		t.Error("the query should be correct:", query)
+	}
+	if len(args) != 1 || args[0] != 1 {
+		t.Error("the args should be correct:", args)
+	}
+
+	query, _, _ = latestQuery(defaultMapper, "models", &mocks.Model{},
+		[]string{"content", "version"}, "created_at", nil)
+	if query != "SELECT DISTINCT ON (content, version) * FROM models "+
+		"ORDER BY content, version, created_at DESC, id DESC" {
+		t.Error("the query should be correct:", query)
+	}
+
+	for _, tc := range []struct {
+		key []string
+		by  string
+	}{
+		{nil, "created_at"},
+		{[]string{"order_id"}, "created_at"},
+		{[]string{"content"}, "1; DROP TABLE models"},
+	} {
+		if _, _, err := latestQuery(defaultMapper, "models", &mocks.Model{}, tc.key, tc.by, nil); !errors.Is(err, ErrInvalidColumn) {
+			t.Error("there should be a ErrInvalidColumn error:", tc, err)
+		}
+	}
+}
@@ -0,0 +1,165 @@
+package repo
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+
+	"github.com/jmoiron/sqlx"
+	eh "github.com/looplab/eventhorizon"
+)
+
+// LockMode is a row lock taken by Find.
+type LockMode string
+
+const (
+	// LockForUpdate locks the row against updates, deletes and other locks.
+	LockForUpdate LockMode = "FOR UPDATE"
+	// LockNoKeyUpdate is a weaker LockForUpdate that does not block inserts
+	// of rows referencing the locked row by a foreign key.
+	LockNoKeyUpdate LockMode = "FOR NO KEY UPDATE"
+)
+
+type contextKey int
+
+const (
+	lockKey contextKey = iota
+	txKey
+	explainKey
+	hardDeleteKey
+	idempotencyKey
+	settingsKey
+)
+
+// WithLock returns a context making Find lock the found row until the end of
+// the repo-managed transaction it runs in (like the one of
+// WithTriggersDisabled), for read-modify-write flows without races. Find
+// returns a ErrNoTransaction error when not run in a transaction, as the lock
+// would be released immediately.
+func WithLock(ctx context.Context, mode LockMode) context.Context {
+	return context.WithValue(ctx, lockKey, mode)
+}
+
+func lockFromContext(ctx context.Context) LockMode {
+	mode, _ := ctx.Value(lockKey).(LockMode)
+	return mode
+}
+
+// ctxTx is a repo-managed transaction and the database it runs on.
+type ctxTx struct {
+	tx *sqlx.Tx
+	db *sql.DB
+}
+
+// contextWithTx returns a context carrying a repo-managed transaction on the
+// database.
+func contextWithTx(ctx context.Context, db *sql.DB, tx *sqlx.Tx) context.Context {
+	return context.WithValue(ctx, txKey, ctxTx{tx: tx, db: db})
+}
+
+// txFromContext returns the repo-managed transaction of the context if it
+// runs on the database, so that repos on other databases don't use it.
+func txFromContext(ctx context.Context, db *sql.DB) *sqlx.Tx {
+	t, ok := ctx.Value(txKey).(ctxTx)
+	if !ok || t.db != db {
+		return nil
+	}
+	return t.tx
+}
+
+// txFromContext returns the repo-managed transaction of the context. It may
+// have been begun with WithTx on a client not ignoring the columns unmapped by
+// the entity, so it ignores them if the client of the repo does.
+func (r *Repo) txFromContext(ctx context.Context) *sqlx.Tx {
+	tx := txFromContext(ctx, r.client.DB)
+	if tx != nil && r.unsafe {
+		return tx.Unsafe()
+	}
+	return tx
+}
+
+// conn returns the repo-managed transaction of the context, so that the
+// statements of a read-modify-write see their own uncommitted changes, or
+// else the client with a slot of the read or write lane of the pool. The
+// release func must be called when done. Reads run with the settings of the
+// context, see inSettings, in a read-only transaction if needed. Writes must
+// be run in inSettings, they fail for the namespaces of
+// Config.NamespaceSchemas otherwise.
+func (r *Repo) conn(ctx context.Context, write bool) (sqlx.ExtContext, func(), error) {
+	settings, err := r.settings(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(settings) > 0 && !r.settingsApplied(ctx, settings) {
+		if !write {
+			return r.readConn(ctx, settings)
+		}
+		if err := r.checkNamespaceSchema(ctx); err != nil {
+			return nil, nil, err
+		}
+	}
+	if tx := r.txFromContext(ctx); tx != nil {
+		return tx, func() {}, nil
+	}
+
+	acquire := r.acquire
+	if write {
+		acquire = r.acquireWrite
+	}
+	release, err := acquire(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	return r.client, release, nil
+}
+
+// readConn returns the repo-managed transaction of the context with the
+// settings set until the release, or else a read-only transaction with the
+// settings and a slot of the read lane of the pool.
+func (r *Repo) readConn(ctx context.Context, settings []setting) (sqlx.ExtContext, func(), error) {
+	if tx := r.txFromContext(ctx); tx != nil {
+		restore, err := setLocal(ctx, tx, settings)
+		if err != nil {
+			return nil, nil, err
+		}
+		return tx, func() {
+			if err := restore(); err != nil {
+				log.Printf("eh-pg: could not restore the settings: %v", err)
+			}
+		}, nil
+	}
+
+	release, err := r.acquire(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	tx, err := r.client.BeginTxx(ctx, &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		release()
+		return nil, nil, eh.RepoError{
+			Err:       ErrCouldNotApplySettings,
+			BaseErr:   err,
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	}
+	if err := setConfig(ctx, tx, settings); err != nil {
+		tx.Rollback()
+		release()
+		return nil, nil, err
+	}
+	return tx, func() {
+		tx.Rollback()
+		release()
+	}, nil
+}
+
+// lockQuery appends the locking clause to a SELECT.
+func lockQuery(query string, mode LockMode) (string, error) {
+	switch mode {
+	case LockForUpdate, LockNoKeyUpdate:
+		return query + " " + string(mode), nil
+	default:
+		return "", fmt.Errorf("unknown lock mode: %q", mode)
+	}
+}
@@ -0,0 +1,41 @@
+package repo
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/jmoiron/sqlx"
+	eh "github.com/looplab/eventhorizon"
+
+	"github.com/eendLabs/eh-pg/pkg/mocks"
+)
+
+func TestLock(t *testing.T) {
+	query, err := lockQuery("SELECT * FROM models WHERE id = $1", LockNoKeyUpdate)
+	if err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	if query != "SELECT * FROM models WHERE id = $1 FOR NO KEY UPDATE" {
+		t.Error("the query should be correct:", query)
+	}
+	if _, err := lockQuery("SELECT 1", "FOR SHARE; DROP"); err == nil {
+		t.Error("there should be an error")
+	}
+
+	// A lock outside of a transaction is an error.
+	db, err := sqlx.Open("postgres", "")
+	if err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	r, err := NewRepoWithClient(&Config{TableName: "models"}, db)
+	if err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	r.SetEntityFactory(func() eh.Entity { return &mocks.Model{} })
+	ctx := WithLock(context.Background(), LockForUpdate)
+	if _, err := r.Find(ctx, uuid.New()); !errors.Is(err, ErrNoTransaction) {
+		t.Error("there should be a ErrNoTransaction error:", err)
+	}
+}
@@ -0,0 +1,130 @@
+package repo
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"reflect"
+	"strings"
+	"unicode"
+
+	"github.com/jmoiron/sqlx/reflectx"
+)
+
+// NameMapper maps the name of a struct field without a db tag to its column,
+// see Config.NameMapper.
+type NameMapper func(field string) string
+
+// SnakeCase maps CreatedAt to created_at and UserID to user_id. It is the
+// default NameMapper.
+func SnakeCase(field string) string {
+	runes := []rune(field)
+	var b strings.Builder
+	for i, r := range runes {
+		if unicode.IsUpper(r) {
+			// A new word after a lower case letter or digit, or the last
+			// letter of an acronym followed by a word, like in HTTPServer.
+			if i > 0 && (unicode.IsLower(runes[i-1]) || unicode.IsDigit(runes[i-1]) ||
+				i+1 < len(runes) && unicode.IsLower(runes[i+1])) {
+				b.WriteByte('_')
+			}
+			r = unicode.ToLower(r)
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// CamelCase maps CreatedAt to createdAt and ID to id. As Postgres folds
+// unquoted names to lower case, the repo quotes such columns.
+func CamelCase(field string) string {
+	runes := []rune(field)
+	n := 0
+	for n < len(runes) && unicode.IsUpper(runes[n]) {
+		n++
+	}
+	// Keep the first letter of the next word of an acronym, like in
+	// HTTPServer.
+	if n > 1 && n < len(runes) && unicode.IsLower(runes[n]) {
+		n--
+	}
+	for i := 0; i < n; i++ {
+		runes[i] = unicode.ToLower(runes[i])
+	}
+	return string(runes)
+}
+
+// LowerCase maps CreatedAt to createdat, like sqlx does by default.
+func LowerCase(field string) string {
+	return strings.ToLower(field)
+}
+
+// newMapper returns a mapper of the entity struct fields to columns using the
+// db tags, and the name mapper for the fields without one. It caches the
+// mapping of each type.
+func newMapper(f NameMapper) *reflectx.Mapper {
+	return reflectx.NewMapperFunc("db", f)
+}
+
+// defaultMapper is the mapper of the default NameMapper.
+var defaultMapper = newMapper(SnakeCase)
+
+// quoteColumn quotes the column if Postgres would fold it to lower case, so
+// that the columns of NameMappers like CamelCase are written as they are.
+func quoteColumn(column string) string {
+	if strings.ToLower(column) == column {
+		return column
+	}
+	return `"` + column + `"`
+}
+
+// quoteColumns quotes the columns like quoteColumn.
+func quoteColumns(columns []string) []string {
+	quoted := make([]string, len(columns))
+	for i, column := range columns {
+		quoted[i] = quoteColumn(column)
+	}
+	return quoted
+}
+
+var (
+	valuerType  = reflect.TypeOf((*driver.Valuer)(nil)).Elem()
+	scannerType = reflect.TypeOf((*sql.Scanner)(nil)).Elem()
+)
+
+// isValueType reports if the type converts itself to and from a column, like
+// decimal.Decimal, pgtype.Numeric or sql.NullString. Such types are stored in
+// a single column even if they are structs with exported fields.
+func isValueType(t reflect.Type) bool {
+	return t.Implements(valuerType) || t.Implements(scannerType) ||
+		reflect.PtrTo(t).Implements(scannerType)
+}
+
+// isColumn reports if the field maps to a column, that is if it is not nested
+// in a field of a value type.
+func isColumn(fi *reflectx.FieldInfo) bool {
+	for p := fi.Parent; p != nil && p.Parent != nil; p = p.Parent {
+		if isValueType(p.Field.Type) {
+			return false
+		}
+	}
+	return true
+}
+
+// columnFields returns the fields of the entity by column.
+func columnFields(m *reflectx.Mapper, v reflect.Value) map[string]reflect.Value {
+	v = reflect.Indirect(v)
+	fields := map[string]reflect.Value{}
+	for column, fi := range m.TypeMap(v.Type()).Names {
+		if isColumn(fi) {
+			fields[column] = reflectx.FieldByIndexes(v, fi.Index)
+		}
+	}
+	return fields
+}
+
+// hasColumn reports if the column is mapped by a field of the entity.
+func hasColumn(m *reflectx.Mapper, entity interface{}, column string) bool {
+	t := reflectx.Deref(reflect.TypeOf(entity))
+	fi := m.TypeMap(t).GetByPath(column)
+	return fi != nil && isColumn(fi)
+}
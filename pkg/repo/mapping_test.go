@@ -0,0 +1,164 @@
+package repo
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/jmoiron/sqlx"
+	eh "github.com/looplab/eventhorizon"
+	"github.com/shopspring/decimal"
+)
+
+type moneyModel struct {
+	ID     uuid.UUID       `db:"id"`
+	Amount decimal.Decimal `db:"amount"`
+	Note   sql.NullString  `db:"note"`
+}
+
+func (m moneyModel) EntityID() uuid.UUID {
+	return m.ID
+}
+
+func TestValueTypeColumns(t *testing.T) {
+	m := &moneyModel{
+		ID:     uuid.New(),
+		Amount: decimal.RequireFromString("1234567890.123456789"),
+		Note:   sql.NullString{String: "note", Valid: true},
+	}
+
+	columns := entityColumns(defaultMapper, m)
+	if len(columns) != 3 || columns[0] != "amount" || columns[1] != "id" ||
+		columns[2] != "note" {
+		t.Error("the columns should be correct:", columns)
+	}
+	if hasColumn(defaultMapper, m, "note.string") {
+		t.Error("fields of value types should not be columns")
+	}
+	if !hasColumn(defaultMapper, m, "amount") {
+		t.Error("value types should be columns")
+	}
+
+	_, args, err := upsertSpec{
+		mapper:   defaultMapper,
+		template: DefaultTemplates.Save,
+		table:    "money",
+	}.query(columns, []eh.Entity{m})
+	if err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+
+	// The decimal is sent as exact text and scanned back from the bytes the
+	// driver returns for NUMERIC columns.
+	v, err := args[0].(driver.Valuer).Value()
+	if err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	if v != "1234567890.123456789" {
+		t.Error("the value should be exact:", v)
+	}
+	var amount decimal.Decimal
+	if err := amount.Scan([]byte(v.(string))); err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	if !amount.Equal(m.Amount) {
+		t.Error("the amount should round-trip:", amount)
+	}
+}
+
+func TestNameMappers(t *testing.T) {
+	for _, tc := range []struct {
+		field, snake, camel string
+	}{
+		{"ID", "id", "id"},
+		{"CreatedAt", "created_at", "createdAt"},
+		{"UserID", "user_id", "userID"},
+		{"HTTPServer", "http_server", "httpServer"},
+		{"Line2Text", "line2_text", "line2Text"},
+		{"name", "name", "name"},
+	} {
+		if c := SnakeCase(tc.field); c != tc.snake {
+			t.Errorf("%s should be mapped to %s: %s", tc.field, tc.snake, c)
+		}
+		if c := CamelCase(tc.field); c != tc.camel {
+			t.Errorf("%s should be mapped to %s: %s", tc.field, tc.camel, c)
+		}
+	}
+	if c := LowerCase("CreatedAt"); c != "createdat" {
+		t.Error("the field should be mapped to lower case:", c)
+	}
+}
+
+type untaggedModel struct {
+	ID        uuid.UUID
+	CreatedAt string
+	Note      string `db:"the_note"`
+}
+
+func (m *untaggedModel) EntityID() uuid.UUID {
+	return m.ID
+}
+
+func TestNameMapperQueries(t *testing.T) {
+	db, err := sqlx.Open("postgres", "")
+	if err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+
+	r, err := NewRepoWithClient(&Config{TableName: "models"}, db)
+	if err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	m := &untaggedModel{ID: uuid.New()}
+	columns := entityColumns(r.mapper, m)
+	if len(columns) != 3 || columns[0] != "created_at" || columns[1] != "id" ||
+		columns[2] != "the_note" {
+		t.Error("the columns should be snake case by default:", columns)
+	}
+
+	r, err = NewRepoWithClient(&Config{TableName: "models", NameMapper: CamelCase}, db)
+	if err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	columns = entityColumns(r.mapper, m)
+	if len(columns) != 3 || columns[0] != "createdAt" || columns[1] != "id" ||
+		columns[2] != "the_note" {
+		t.Error("the columns should be camel case:", columns)
+	}
+
+	query, _, err := r.upsertSpec().query(columns, []eh.Entity{m})
+	if err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	if !strings.Contains(query, `("createdAt", id, the_note)`) ||
+		!strings.Contains(query, `"createdAt" = EXCLUDED."createdAt"`) {
+		t.Error("the camel case column should be quoted:", query)
+	}
+
+	expected := `CREATE TABLE IF NOT EXISTS models (
+    "createdAt" text,
+    id uuid PRIMARY KEY,
+    the_note text
+)`
+	if query, err := r.createTableQuery(m); err != nil || query != expected {
+		t.Error("the query should be correct:", query, err)
+	}
+
+	where, _, err := Eq("createdAt", "x").compile(r.mapper, m, nil)
+	if err != nil || where != `"createdAt" = $1` {
+		t.Error("the filter should quote the column:", where, err)
+	}
+}
+
+func TestQuoteColumn(t *testing.T) {
+	for column, expected := range map[string]string{
+		"created_at": "created_at",
+		"createdAt":  `"createdAt"`,
+	} {
+		if c := quoteColumn(column); c != expected {
+			t.Errorf("%s should be quoted as %s: %s", column, expected, c)
+		}
+	}
+}
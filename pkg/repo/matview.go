@@ -0,0 +1,76 @@
+package repo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	eh "github.com/looplab/eventhorizon"
+
+	"github.com/eendLabs/eh-pg/pkg/worker"
+)
+
+// ErrInvalidMaterializedView is when a materialized view config is not valid.
+var ErrInvalidMaterializedView = errors.New("invalid materialized view")
+
+// ErrCouldNotRefresh is when a materialized view could not be refreshed.
+var ErrCouldNotRefresh = errors.New("could not refresh materialized view")
+
+// MaterializedView makes the repo front a materialized view: Save and Remove
+// write to the table, and the finds read from the view, which is refreshed
+// with Refresh or periodically in the background. Reads don't see the writes
+// until the next refresh.
+type MaterializedView struct {
+	// Name is the name of the materialized view.
+	Name string
+	// RefreshInterval is optionally the time between two background
+	// refreshes.
+	RefreshInterval time.Duration
+	// Concurrently makes the background refreshes not block the reads, which
+	// requires a unique index on the view.
+	Concurrently bool
+}
+
+func (v *MaterializedView) validate() error {
+	if !validTableName(v.Name) {
+		return fmt.Errorf("%w: invalid name %q", ErrInvalidMaterializedView, v.Name)
+	}
+	if v.RefreshInterval < 0 {
+		return fmt.Errorf("%w: negative refresh interval", ErrInvalidMaterializedView)
+	}
+	return nil
+}
+
+// Refresh refreshes the materialized view. A concurrent refresh does not
+// block the reads but requires a unique index on the view.
+func (r *Repo) Refresh(ctx context.Context, concurrently bool) error {
+	v := r.config.MaterializedView
+	if v == nil {
+		return eh.RepoError{
+			Err:       ErrCouldNotRefresh,
+			BaseErr:   fmt.Errorf("%w: not configured", ErrInvalidMaterializedView),
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	}
+
+	query := "REFRESH MATERIALIZED VIEW " + v.Name
+	if concurrently {
+		query = "REFRESH MATERIALIZED VIEW CONCURRENTLY " + v.Name
+	}
+	if _, err := r.client.ExecContext(ctx, query); err != nil {
+		return eh.RepoError{
+			Err:       ErrCouldNotRefresh,
+			BaseErr:   err,
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	}
+
+	return nil
+}
+
+// RefreshWorker returns the background refresh worker, or nil if no refresh
+// interval is configured.
+func (r *Repo) RefreshWorker() *worker.Worker {
+	return r.refresh
+}
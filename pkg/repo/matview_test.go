@@ -0,0 +1,64 @@
+package repo
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	eh "github.com/looplab/eventhorizon"
+)
+
+func TestMaterializedView(t *testing.T) {
+	db, err := sqlx.Open("postgres", "host=127.0.0.1 port=1 connect_timeout=1")
+	if err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	r, err := NewRepoWithClient(&Config{
+		TableName: "models",
+		Context:   ctx,
+		MaterializedView: &MaterializedView{
+			Name:            "models_summary",
+			RefreshInterval: time.Hour,
+		},
+	}, db)
+	if err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	if table := r.readTable(); table != "models_summary" {
+		t.Error("the entities should be read from the view:", table)
+	}
+
+	// The first refresh runs immediately and fails without a database.
+	select {
+	case err := <-r.RefreshWorker().Errors():
+		if !errors.Is(err, ErrCouldNotRefresh) {
+			t.Error("there should be a ErrCouldNotRefresh error:", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("the view should be refreshed")
+	}
+	cancel()
+	<-r.RefreshWorker().Done()
+
+	for _, config := range []*Config{
+		{TableName: "models", MaterializedView: &MaterializedView{Name: "a b"}},
+		{TableName: "models", ReadFrom: "models_view", MaterializedView: &MaterializedView{Name: "models_summary"}},
+	} {
+		if _, err := NewRepoWithClient(config, db); !errors.Is(err, ErrInvalidMaterializedView) {
+			t.Error("there should be a ErrInvalidMaterializedView error:", err)
+		}
+	}
+
+	r, err = NewRepoWithClient(&Config{TableName: "models"}, db)
+	if err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	err = r.Refresh(context.Background(), false)
+	if rrErr, ok := err.(eh.RepoError); !ok || !errors.Is(rrErr.BaseErr, ErrInvalidMaterializedView) {
+		t.Error("there should be a ErrInvalidMaterializedView error:", err)
+	}
+}
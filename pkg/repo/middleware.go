@@ -0,0 +1,98 @@
+package repo
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/google/uuid"
+	eh "github.com/looplab/eventhorizon"
+)
+
+// OpKind is the kind of an operation passed through the middleware.
+type OpKind string
+
+const (
+	// OpFind is a Find.
+	OpFind OpKind = "find"
+	// OpFindAll is a FindAll.
+	OpFindAll OpKind = "find_all"
+	// OpSave is a Save.
+	OpSave OpKind = "save"
+	// OpRemove is a Remove.
+	OpRemove OpKind = "remove"
+	// OpSaveAll is a SaveAll.
+	OpSaveAll OpKind = "save_all"
+	// OpClear is a Clear.
+	OpClear OpKind = "clear"
+)
+
+// Operation is an operation passed through the middleware: a Find, FindAll,
+// Save, Remove, SaveAll or Clear, SaveIfVersion being passed as a Save. The
+// results are set on it by the repo.
+type Operation struct {
+	Kind  OpKind
+	Table string
+	// ID is the ID of the found, saved or removed entity.
+	ID uuid.UUID
+	// Entity is the entity to save, or the found entity after a Find.
+	Entity eh.Entity
+	// Entities are the entities to save by a SaveAll, or the found entities
+	// after a FindAll.
+	Entities []eh.Entity
+}
+
+// QueryFunc runs an operation.
+type QueryFunc func(ctx context.Context, op *Operation) error
+
+// Middleware intercepts the operations of the repo, for logging, metrics,
+// retries or multi-tenancy guards, by wrapping the next QueryFunc:
+//
+//	func Logging(next QueryFunc) QueryFunc {
+//		return func(ctx context.Context, op *Operation) error {
+//			t := time.Now()
+//			err := next(ctx, op)
+//			log.Printf("%s %s %s: %v (%s)", op.Kind, op.Table, op.ID, err, time.Since(t))
+//			return err
+//		}
+//	}
+type Middleware func(next QueryFunc) QueryFunc
+
+// chain wraps f in the middleware, the first one being the outermost.
+func chain(middleware []Middleware, f QueryFunc) QueryFunc {
+	for i := len(middleware) - 1; i >= 0; i-- {
+		f = middleware[i](f)
+	}
+	return f
+}
+
+// run runs f for an operation through the middleware, for the operations
+// with arguments that don't fit in an Operation, like the ClearOptions.
+func (r *Repo) run(ctx context.Context, op *Operation, f func(context.Context) error) error {
+	return chain(r.config.Middleware, func(ctx context.Context, _ *Operation) error {
+		return r.inSettings(ctx, f)
+	})(ctx, op)
+}
+
+// do runs an operation.
+func (r *Repo) do(ctx context.Context, op *Operation) error {
+	return r.inSettings(ctx, func(ctx context.Context) error {
+		return r.doOp(ctx, op)
+	})
+}
+
+func (r *Repo) doOp(ctx context.Context, op *Operation) error {
+	var err error
+	switch op.Kind {
+	case OpFind:
+		op.Entity, err = r.find(ctx, op.ID)
+	case OpFindAll:
+		op.Entities, err = r.findAll(ctx)
+	case OpSave:
+		err = r.save(ctx, op.Entity)
+	case OpRemove:
+		err = r.remove(ctx, op.ID)
+	default:
+		err = fmt.Errorf("unknown operation %q", op.Kind)
+	}
+	return err
+}
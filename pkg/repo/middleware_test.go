@@ -0,0 +1,82 @@
+package repo
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/jmoiron/sqlx"
+	eh "github.com/looplab/eventhorizon"
+
+	"github.com/eendLabs/eh-pg/pkg/mocks"
+)
+
+func TestMiddleware(t *testing.T) {
+	db, err := sqlx.Open("postgres", "")
+	if err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+
+	var calls []string
+	trace := func(name string) Middleware {
+		return func(next QueryFunc) QueryFunc {
+			return func(ctx context.Context, op *Operation) error {
+				calls = append(calls, name+" "+string(op.Kind))
+				return next(ctx, op)
+			}
+		}
+	}
+	errForbidden := errors.New("forbidden")
+	cached := &mocks.Model{ID: uuid.New()}
+	stub := func(next QueryFunc) QueryFunc {
+		return func(ctx context.Context, op *Operation) error {
+			switch op.Kind {
+			case OpFind:
+				op.Entity = cached
+				return nil
+			case OpSave, OpSaveAll, OpClear:
+				return errForbidden
+			}
+			return next(ctx, op)
+		}
+	}
+
+	r, err := NewRepoWithClient(&Config{
+		TableName:  "models",
+		Middleware: []Middleware{trace("outer"), trace("inner"), stub},
+	}, db)
+	if err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	r.SetEntityFactory(func() eh.Entity { return &mocks.Model{} })
+
+	ctx := context.Background()
+	entity, err := r.Find(ctx, cached.ID)
+	if err != nil {
+		t.Error("there should be no error:", err)
+	}
+	if entity != cached {
+		t.Error("the entity should be set by the middleware:", entity)
+	}
+	if err := r.Save(ctx, cached); !errors.Is(err, errForbidden) {
+		t.Error("there should be a forbidden error:", err)
+	}
+	if err := r.SaveIfVersion(ctx, cached, 1); !errors.Is(err, errForbidden) {
+		t.Error("there should be a forbidden error:", err)
+	}
+	if err := r.SaveAll(ctx, []eh.Entity{cached}); !errors.Is(err, errForbidden) {
+		t.Error("there should be a forbidden error:", err)
+	}
+	if err := r.Clear(ctx); !errors.Is(err, errForbidden) {
+		t.Error("there should be a forbidden error:", err)
+	}
+	if !reflect.DeepEqual(calls, []string{
+		"outer find", "inner find", "outer save", "inner save",
+		"outer save", "inner save", "outer save_all", "inner save_all",
+		"outer clear", "inner clear",
+	}) {
+		t.Error("the middleware should be called in order:", calls)
+	}
+}
@@ -0,0 +1,114 @@
+package repo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+
+	"github.com/jmoiron/sqlx"
+	eh "github.com/looplab/eventhorizon"
+)
+
+// ErrQueryNotRegistered is when a named query is not registered.
+var ErrQueryNotRegistered = errors.New("query not registered")
+
+// ErrQueryAlreadyRegistered is when a named query is registered twice.
+var ErrQueryAlreadyRegistered = errors.New("query already registered")
+
+// namedQueries are the prepared statements of the named queries.
+type namedQueries struct {
+	sync.RWMutex
+	stmts map[string]*sqlx.Stmt
+}
+
+// RegisterQuery registers a query by name, typically at startup, so that
+// commonly used filters are centralized and validated at boot. The query is
+// prepared immediately, which fails on syntax errors and unknown columns, and
+// then once per connection by database/sql. The {table} placeholder is
+// replaced by the table of the repo:
+//
+//	r.RegisterQuery("by_content", "SELECT * FROM {table} WHERE content = $1")
+func (r *Repo) RegisterQuery(name, query string) error {
+	if err := validateTemplate("query "+name, query, []string{"table"}, nil); err != nil {
+		return err
+	}
+
+	r.named.Lock()
+	defer r.named.Unlock()
+
+	if _, ok := r.named.stmts[name]; ok {
+		return fmt.Errorf("%w: %s", ErrQueryAlreadyRegistered, name)
+	}
+	stmt, err := r.client.Preparex(render(query, map[string]string{
+		"table": r.readTable(),
+	}))
+	if err != nil {
+		return fmt.Errorf("%w: %s: %v", ErrInvalidQuery, name, err)
+	}
+	if r.named.stmts == nil {
+		r.named.stmts = map[string]*sqlx.Stmt{}
+	}
+	r.named.stmts[name] = stmt
+
+	return nil
+}
+
+// FindNamed runs a registered query and returns the rows as entities created
+// by the factory.
+func (r *Repo) FindNamed(ctx context.Context, name string,
+	args ...interface{}) ([]eh.Entity, error) {
+	if r.factoryFn == nil {
+		return nil, eh.RepoError{
+			Err:       ErrModelNotSet,
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	}
+
+	r.named.RLock()
+	stmt, ok := r.named.stmts[name]
+	r.named.RUnlock()
+	if !ok {
+		return nil, eh.RepoError{
+			Err:       ErrQueryNotRegistered,
+			BaseErr:   fmt.Errorf("query %q", name),
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	}
+
+	q, release, err := r.conn(ctx, false)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	// The statement runs in the transaction with the settings of the context,
+	// if any, the table is resolved again for its search_path.
+	if tx, ok := q.(*sqlx.Tx); ok {
+		stmt = tx.StmtxContext(ctx, stmt)
+	}
+	rows, err := stmt.QueryxContext(ctx, args...)
+	if err != nil {
+		return nil, eh.RepoError{
+			Err:       eh.ErrCouldNotLoadEntity,
+			BaseErr:   err,
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	}
+
+	return r.scan(ctx, rows)
+}
+
+// closeNamed closes the prepared statements of the named queries.
+func (r *Repo) closeNamed() {
+	r.named.Lock()
+	defer r.named.Unlock()
+
+	for name, stmt := range r.named.stmts {
+		if err := stmt.Close(); err != nil {
+			log.Printf("eh-pg: could not close query %s: %v", name, err)
+		}
+	}
+	r.named.stmts = nil
+}
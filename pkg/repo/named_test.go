@@ -0,0 +1,31 @@
+package repo
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/jmoiron/sqlx"
+	eh "github.com/looplab/eventhorizon"
+
+	"github.com/eendLabs/eh-pg/pkg/mocks"
+)
+
+func TestNamedQueries(t *testing.T) {
+	db, err := sqlx.Open("postgres", "")
+	if err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	r, err := NewRepoWithClient(&Config{TableName: "models"}, db)
+	if err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	r.SetEntityFactory(func() eh.Entity { return &mocks.Model{} })
+
+	if err := r.RegisterQuery("bad", "SELECT * FROM {tables}"); !errors.Is(err, ErrInvalidTemplate) {
+		t.Error("there should be a ErrInvalidTemplate error:", err)
+	}
+	if _, err := r.FindNamed(context.Background(), "missing"); !errors.Is(err, ErrQueryNotRegistered) {
+		t.Error("there should be a ErrQueryNotRegistered error:", err)
+	}
+}
@@ -0,0 +1,374 @@
+package repo
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+	eh "github.com/looplab/eventhorizon"
+)
+
+// ErrInvalidNamespaceSchema is when the namespace schema config or the schema
+// of a namespace is not valid.
+var ErrInvalidNamespaceSchema = errors.New("invalid namespace schema")
+
+// ErrNoNamespaceSchemas is when an operation on the table of a namespace is
+// used without Config.NamespaceSchemas, as all the namespaces share the table
+// then.
+var ErrNoNamespaceSchemas = errors.New("no namespace schemas")
+
+// ErrNotInNamespaceSchema is when an operation on the table of a namespace
+// is run without the search_path set to its schema, see InNamespaceSchema.
+var ErrNotInNamespaceSchema = errors.New("not in namespace schema")
+
+// ErrCouldNotDropNamespace is when a namespace could not be dropped.
+var ErrCouldNotDropNamespace = errors.New("could not drop namespace")
+
+// ErrCouldNotApplySettings is when the search_path of the namespace schema or
+// the row security setting could not be set.
+var ErrCouldNotApplySettings = errors.New("could not apply settings")
+
+// NamespaceSchemaConfig maps each eventhorizon namespace to a Postgres schema
+// holding the table of the namespace, instead of a table per namespace, for
+// tenant isolation with schema privileges. The operations run in a
+// transaction with the search_path set to the schema of the namespace of the
+// context, see InNamespaceSchema, so TableName must not be schema qualified.
+//
+// As the search_path only holds the schema, the tables shared by the
+// namespaces, like the idempotency keys, must be schema qualified.
+type NamespaceSchemaConfig struct {
+	// Prefix is prepended to the namespace to get the schema, like
+	// "tenant_".
+	Prefix string
+	// DefaultSchema is the schema of the default namespace, "public" by
+	// default.
+	DefaultSchema string
+}
+
+func (c *NamespaceSchemaConfig) provideDefaults() {
+	if c.DefaultSchema == "" {
+		c.DefaultSchema = "public"
+	}
+}
+
+func (c *NamespaceSchemaConfig) validate(table string) error {
+	if !validIdentifier(c.DefaultSchema) {
+		return fmt.Errorf("%w: default schema %q", ErrInvalidNamespaceSchema, c.DefaultSchema)
+	}
+	if c.Prefix != "" && !validIdentifier(c.Prefix) {
+		return fmt.Errorf("%w: prefix %q", ErrInvalidNamespaceSchema, c.Prefix)
+	}
+	if strings.Contains(table, ".") {
+		return fmt.Errorf("%w: table %s is schema qualified", ErrInvalidNamespaceSchema, table)
+	}
+	return nil
+}
+
+// schema returns the schema of the namespace.
+func (c *NamespaceSchemaConfig) schema(ns string) (string, error) {
+	if ns == eh.DefaultNamespace {
+		return c.DefaultSchema, nil
+	}
+	schema := c.Prefix + ns
+	if !validIdentifier(schema) {
+		return "", fmt.Errorf("%w: namespace %q", ErrInvalidNamespaceSchema, ns)
+	}
+	return schema, nil
+}
+
+// InNamespaceSchema runs f with the search_path set to the schema of the
+// namespace of the context, see Config.NamespaceSchemas, so that the methods
+// called with the context passed to f use the table of the namespace. f runs
+// in the repo-managed transaction of the context, or in a new one committed
+// when f succeeds. The methods on the table do so by themselves, the ones
+// that can't, like FindCustom, fail with a ErrNotInNamespaceSchema for the
+// namespaces other than the default one. Without NamespaceSchemas f is called
+// with the context as is.
+func (r *Repo) InNamespaceSchema(ctx context.Context, f func(context.Context) error) error {
+	c := r.config.NamespaceSchemas
+	if c == nil {
+		return f(ctx)
+	}
+
+	schema, err := c.schema(eh.NamespaceFromContext(ctx))
+	if err != nil {
+		return eh.RepoError{
+			Err:       err,
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	}
+
+	return r.withSettings(ctx, []setting{{"search_path", pq.QuoteIdentifier(schema)}}, f)
+}
+
+// setting is a run-time parameter and its value.
+type setting [2]string
+
+// appliedSettings are the settings set by withSettings in a transaction.
+type appliedSettings struct {
+	tx       *sqlx.Tx
+	settings []setting
+}
+
+// contextWithSettings returns a context recording that the settings are set
+// in the transaction, in addition to the ones set before in it.
+func contextWithSettings(ctx context.Context, tx *sqlx.Tx, settings []setting) context.Context {
+	applied := append([]setting(nil), settings...)
+	if a, ok := ctx.Value(settingsKey).(appliedSettings); ok && a.tx == tx {
+		for _, s := range a.settings {
+			if !hasSetting(applied, s[0]) {
+				applied = append(applied, s)
+			}
+		}
+	}
+	return context.WithValue(ctx, settingsKey, appliedSettings{tx: tx, settings: applied})
+}
+
+// hasSetting reports if the run-time parameter is among the settings.
+func hasSetting(settings []setting, name string) bool {
+	for _, s := range settings {
+		if s[0] == name {
+			return true
+		}
+	}
+	return false
+}
+
+// settingsApplied reports if the settings are set in the repo-managed
+// transaction of the context.
+func (r *Repo) settingsApplied(ctx context.Context, settings []setting) bool {
+	a, ok := ctx.Value(settingsKey).(appliedSettings)
+	if !ok || a.tx != txFromContext(ctx, r.client.DB) {
+		return false
+	}
+	for _, s := range settings {
+		found := false
+		for _, applied := range a.settings {
+			if applied == s {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// inSettings runs f with the settings of the context, see settings, unless
+// they are already set in its repo-managed transaction. The operations on the
+// table run in it, so that they see the table of the namespace schema and the
+// rows of the tenant.
+func (r *Repo) inSettings(ctx context.Context, f func(context.Context) error) error {
+	settings, err := r.settings(ctx)
+	if err != nil {
+		return err
+	}
+	if len(settings) == 0 || r.settingsApplied(ctx, settings) {
+		return f(ctx)
+	}
+	return r.withSettings(ctx, settings, f)
+}
+
+// checkNamespaceSchema returns a ErrNotInNamespaceSchema error if the search
+// path is not set to the schema of the namespace of the context, so that the
+// operations run without inSettings fail instead of using the table of the
+// default schema.
+func (r *Repo) checkNamespaceSchema(ctx context.Context) error {
+	c := r.config.NamespaceSchemas
+	ns := eh.NamespaceFromContext(ctx)
+	if c == nil || ns == eh.DefaultNamespace {
+		return nil
+	}
+
+	schema, err := c.schema(ns)
+	if err != nil {
+		return eh.RepoError{
+			Err:       err,
+			Namespace: ns,
+		}
+	}
+	if !r.settingsApplied(ctx, []setting{{"search_path", pq.QuoteIdentifier(schema)}}) {
+		return eh.RepoError{
+			Err:       ErrNotInNamespaceSchema,
+			Namespace: ns,
+		}
+	}
+	return nil
+}
+
+// withSettings runs f with the settings set like SET LOCAL, in the
+// repo-managed transaction of the context, restoring them for the other
+// statements of the transaction after f, or in a new transaction committed
+// when f succeeds.
+func (r *Repo) withSettings(ctx context.Context, settings []setting,
+	f func(context.Context) error) error {
+	if tx := r.txFromContext(ctx); tx != nil {
+		restore, err := setLocal(ctx, tx, settings)
+		if err != nil {
+			return err
+		}
+		if err := f(contextWithSettings(ctx, txFromContext(ctx, r.client.DB), settings)); err != nil {
+			return err
+		}
+		return restore()
+	}
+
+	release, err := r.acquireWrite(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	tx, err := r.client.BeginTxx(ctx, &sql.TxOptions{})
+	if err != nil {
+		return eh.RepoError{
+			Err:       ErrCouldNotApplySettings,
+			BaseErr:   err,
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	}
+	defer tx.Rollback()
+
+	if err := setConfig(ctx, tx, settings); err != nil {
+		return err
+	}
+	if err := f(contextWithSettings(contextWithTx(ctx, r.client.DB, tx), tx, settings)); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return eh.RepoError{
+			Err:       ErrCouldNotApplySettings,
+			BaseErr:   err,
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	}
+
+	return nil
+}
+
+// setLocal sets the settings like SET LOCAL and returns a func restoring the
+// previous values, for the other statements of the transaction.
+func setLocal(ctx context.Context, tx *sqlx.Tx, settings []setting) (func() error, error) {
+	previous := make([]setting, len(settings))
+	for i, s := range settings {
+		var value sql.NullString
+		if err := tx.GetContext(ctx, &value,
+			"SELECT current_setting($1, true)", s[0]); err != nil {
+			return nil, eh.RepoError{
+				Err:       ErrCouldNotApplySettings,
+				BaseErr:   err,
+				Namespace: eh.NamespaceFromContext(ctx),
+			}
+		}
+		previous[i] = setting{s[0], value.String}
+	}
+	if err := setConfig(ctx, tx, settings); err != nil {
+		return nil, err
+	}
+	return func() error {
+		return setConfig(ctx, tx, previous)
+	}, nil
+}
+
+// setConfig sets the settings like SET LOCAL, until the end of the
+// transaction.
+func setConfig(ctx context.Context, tx *sqlx.Tx, settings []setting) error {
+	for _, s := range settings {
+		if _, err := tx.ExecContext(ctx,
+			"SELECT set_config($1, $2, true)", s[0], s[1]); err != nil {
+			return eh.RepoError{
+				Err:       ErrCouldNotApplySettings,
+				BaseErr:   err,
+				Namespace: eh.NamespaceFromContext(ctx),
+			}
+		}
+	}
+	return nil
+}
+
+// EnsureNamespaceSchema creates the schema of the namespace of the context
+// and the table in it, see EnsureTable, if they don't exist.
+func (r *Repo) EnsureNamespaceSchema(ctx context.Context) error {
+	c := r.config.NamespaceSchemas
+	if c == nil {
+		return nil
+	}
+
+	schema, err := c.schema(eh.NamespaceFromContext(ctx))
+	if err != nil {
+		return eh.RepoError{
+			Err:       err,
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	}
+
+	return r.InNamespaceSchema(ctx, func(ctx context.Context) error {
+		return r.writeTx(ctx, func(tx *sqlx.Tx) error {
+			if err := lockSchema(ctx, tx, r.config.TableName); err != nil {
+				return err
+			}
+			if _, err := tx.ExecContext(ctx,
+				"CREATE SCHEMA IF NOT EXISTS "+schema); err != nil {
+				return eh.RepoError{
+					Err:       ErrCouldNotEnsureSchema,
+					BaseErr:   err,
+					Namespace: eh.NamespaceFromContext(ctx),
+				}
+			}
+			return r.EnsureTable(ctx)
+		})
+	})
+}
+
+// DropNamespace drops the schema of the namespace with everything in it, for
+// tenant offboarding and test teardown. It does nothing if it doesn't exist.
+// It requires Config.NamespaceSchemas, otherwise the namespaces share the
+// table, and the default namespace can't be dropped, use Clear instead.
+func (r *Repo) DropNamespace(ctx context.Context, ns string) error {
+	var schema string
+	var err error
+	switch c := r.config.NamespaceSchemas; {
+	case c == nil:
+		err = ErrNoNamespaceSchemas
+	case ns == eh.DefaultNamespace:
+		err = fmt.Errorf("%s is the default namespace", ns)
+	default:
+		schema, err = c.schema(ns)
+	}
+	if err != nil {
+		return eh.RepoError{
+			Err:       ErrCouldNotDropNamespace,
+			BaseErr:   err,
+			Namespace: ns,
+		}
+	}
+	query := "DROP SCHEMA IF EXISTS " + schema + " CASCADE"
+
+	// The schema is named, the search_path of the context doesn't matter.
+	var ex sqlx.ExecerContext = r.client
+	if tx := r.txFromContext(ctx); tx != nil {
+		ex = tx
+	} else {
+		release, err := r.acquireWrite(ctx)
+		if err != nil {
+			return err
+		}
+		defer release()
+	}
+
+	if _, err := ex.ExecContext(ctx, query); err != nil {
+		return eh.RepoError{
+			Err:       ErrCouldNotDropNamespace,
+			BaseErr:   err,
+			Namespace: ns,
+		}
+	}
+
+	return nil
+}
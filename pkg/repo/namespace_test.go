@@ -0,0 +1,123 @@
+package repo
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/jmoiron/sqlx"
+	eh "github.com/looplab/eventhorizon"
+
+	"github.com/eendLabs/eh-pg/pkg/mocks"
+)
+
+func TestNamespaceSchemaConfig(t *testing.T) {
+	db, err := sqlx.Open("postgres", "")
+	if err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+
+	config := &Config{
+		TableName:        "models",
+		NamespaceSchemas: &NamespaceSchemaConfig{Prefix: "tenant_"},
+	}
+	r, err := NewRepoWithClient(config, db)
+	if err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	if c := config.NamespaceSchemas; c.DefaultSchema != "public" {
+		t.Error("the config should have the defaults:", c)
+	}
+
+	for ns, expected := range map[string]string{
+		eh.DefaultNamespace: "public.models",
+		"acme":              "tenant_acme.models",
+	} {
+		if table, err := r.namespaceTable(ns); err != nil || table != expected {
+			t.Error("the table of the namespace should be correct:", ns, table, err)
+		}
+	}
+	if _, err := r.namespaceTable("acme; DROP"); !errors.Is(err, ErrInvalidNamespaceSchema) {
+		t.Error("there should be a ErrInvalidNamespaceSchema error:", err)
+	}
+
+	for _, c := range []*Config{
+		{TableName: "public.models", NamespaceSchemas: &NamespaceSchemaConfig{}},
+		{TableName: "models", NamespaceSchemas: &NamespaceSchemaConfig{Prefix: "tenant-"}},
+		{TableName: "models", NamespaceSchemas: &NamespaceSchemaConfig{DefaultSchema: "a b"}},
+	} {
+		if _, err := NewRepoWithClient(c, db); !errors.Is(err, ErrInvalidNamespaceSchema) {
+			t.Error("there should be a ErrInvalidNamespaceSchema error:", c.NamespaceSchemas, err)
+		}
+	}
+}
+
+func TestDropNamespace(t *testing.T) {
+	db, err := sqlx.Open("postgres", "")
+	if err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	r, err := NewRepoWithClient(&Config{TableName: "models"}, db)
+	if err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+
+	ctx := context.Background()
+	err = r.DropNamespace(ctx, "acme")
+	if rrErr, ok := err.(eh.RepoError); !ok || !errors.Is(rrErr.Err, ErrCouldNotDropNamespace) ||
+		!errors.Is(rrErr.BaseErr, ErrNoNamespaceSchemas) {
+		t.Error("there should be a ErrNoNamespaceSchemas error:", err)
+	}
+
+	r, err = NewRepoWithClient(&Config{
+		TableName:        "models",
+		NamespaceSchemas: &NamespaceSchemaConfig{},
+	}, db)
+	if err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	for _, ns := range []string{eh.DefaultNamespace, "acme; DROP"} {
+		if err := r.DropNamespace(ctx, ns); !errors.Is(err, ErrCouldNotDropNamespace) {
+			t.Error("there should be a ErrCouldNotDropNamespace error:", ns, err)
+		}
+	}
+}
+
+func TestNotInNamespaceSchema(t *testing.T) {
+	db, err := sqlx.Open("postgres", "")
+	if err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	r, err := NewRepoWithClient(&Config{
+		TableName:        "models",
+		NamespaceSchemas: &NamespaceSchemaConfig{},
+	}, db)
+	if err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	r.SetEntityFactory(func() eh.Entity {
+		return &mocks.Model{}
+	})
+
+	ctx := context.Background()
+	_, release, err := r.conn(ctx, true)
+	if err != nil {
+		t.Error("there should be no error:", err)
+	} else {
+		release()
+	}
+
+	// Writes outside of the search_path of the namespace would use the table
+	// of the default schema.
+	nsCtx := eh.NewContextWithNamespace(ctx, "acme")
+	if _, _, err := r.conn(nsCtx, true); !errors.Is(err, ErrNotInNamespaceSchema) {
+		t.Error("there should be a ErrNotInNamespaceSchema error:", err)
+	}
+	_, err = r.FindCustom(nsCtx, func(ctx context.Context, db *sqlx.DB) (*sqlx.Rows, error) {
+		t.Error("the query should not be run")
+		return nil, nil
+	})
+	if !errors.Is(err, ErrNotInNamespaceSchema) {
+		t.Error("there should be a ErrNotInNamespaceSchema error:", err)
+	}
+}
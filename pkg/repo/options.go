@@ -0,0 +1,198 @@
+package repo
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/jmoiron/sqlx/reflectx"
+	"github.com/lib/pq"
+)
+
+// QueryOption is an option for the find queries. Query options can be passed
+// among the arguments of FindWithFilter and FindWithFilterUsingIndex, they
+// are not bound as query parameters:
+//
+//	r.FindWithFilter(ctx, "content = $1", "foo", WithLimit(10), WithOffset(20))
+type QueryOption func(*queryOptions)
+
+type queryOptions struct {
+	limit   int
+	offset  int
+	keyset  string
+	orderBy []orderBy
+	columns []string
+	hints   []string
+	// extra are selected in addition to the columns, like window functions.
+	extra []string
+}
+
+// Direction is a sort direction.
+type Direction string
+
+const (
+	// Asc sorts in ascending order.
+	Asc Direction = "ASC"
+	// Desc sorts in descending order.
+	Desc Direction = "DESC"
+)
+
+type orderBy struct {
+	column    string
+	direction Direction
+	collation string
+}
+
+// WithOrderBy sorts the result on a column. It can be given several times to
+// sort on multiple columns, in the order given. The column must be mapped by a
+// db tag on the entity. The ID is always added as the last sort column, in the
+// direction of the last given column, to make the order stable.
+func WithOrderBy(column string, direction Direction) QueryOption {
+	return func(o *queryOptions) {
+		o.orderBy = append(o.orderBy, orderBy{column: column, direction: direction})
+	}
+}
+
+// WithOrderByCollate sorts the result on a text column like WithOrderBy, with
+// the collation instead of the one of the column, like a collation of the
+// language of the user:
+//
+//	r.FindWhere(ctx, Eq("country", "SE"), WithOrderByCollate("name", Asc, "sv-x-icu"))
+//
+// Note that an index on the column is only used for its own collation.
+func WithOrderByCollate(column string, direction Direction, collation string) QueryOption {
+	return func(o *queryOptions) {
+		o.orderBy = append(o.orderBy, orderBy{column, direction, collation})
+	}
+}
+
+// collate returns the COLLATE clause of the collation, if any.
+func collate(collation string) string {
+	if collation == "" {
+		return ""
+	}
+	return " COLLATE " + pq.QuoteIdentifier(collation)
+}
+
+// WithLimit limits the number of returned entities.
+func WithLimit(n int) QueryOption {
+	return func(o *queryOptions) {
+		o.limit = n
+	}
+}
+
+// WithOffset skips the first n entities.
+func WithOffset(n int) QueryOption {
+	return func(o *queryOptions) {
+		o.offset = n
+	}
+}
+
+// splitQueryOptions separates the query options from the query arguments.
+func splitQueryOptions(args []interface{}) ([]interface{}, queryOptions) {
+	var o queryOptions
+	queryArgs := make([]interface{}, 0, len(args))
+	for _, arg := range args {
+		if opt, ok := arg.(QueryOption); ok {
+			opt(&o)
+			continue
+		}
+		queryArgs = append(queryArgs, arg)
+	}
+
+	return queryArgs, o
+}
+
+// WithColumns selects only the given columns, leaving the other fields of the
+// returned entities zero valued. Useful for wide read models with large text
+// or jsonb columns. The columns must be mapped by db tags on the entity.
+func WithColumns(columns ...string) QueryOption {
+	return func(o *queryOptions) {
+		o.columns = append(o.columns, columns...)
+	}
+}
+
+// WithHint attaches planner hints to the query, as read by the pg_hint_plan
+// extension, as an escape hatch for pathological plans on large tables:
+//
+//	r.FindWithFilter(ctx, "content = $1", "foo",
+//		WithHint("IndexScan(models models_content_idx)"))
+//
+// Without the extension the hints are ignored.
+func WithHint(hints ...string) QueryOption {
+	return func(o *queryOptions) {
+		o.hints = append(o.hints, hints...)
+	}
+}
+
+// selectFrom returns the SELECT clause for the table, preceded by the hints.
+func (o queryOptions) selectFrom(table string) string {
+	columns := "*"
+	if len(o.columns) > 0 {
+		columns = strings.Join(quoteColumns(o.columns), ", ")
+	}
+	if len(o.extra) > 0 {
+		columns += ", " + strings.Join(o.extra, ", ")
+	}
+	query := fmt.Sprintf("SELECT %s FROM %s", columns, table)
+	if len(o.hints) > 0 {
+		query = "/*+ " + strings.Join(o.hints, " ") + " */ " + query
+	}
+	return query
+}
+
+// validate checks the columns of the options against the columns mapped by
+// the entity.
+func (o queryOptions) validate(m *reflectx.Mapper, entity interface{}) error {
+	for _, column := range o.columns {
+		if !hasColumn(m, entity, column) {
+			return fmt.Errorf("%w: %q is not mapped", ErrInvalidColumn, column)
+		}
+	}
+	for _, ob := range o.orderBy {
+		if !hasColumn(m, entity, ob.column) {
+			return fmt.Errorf("%w: %q is not mapped", ErrInvalidColumn, ob.column)
+		}
+		if ob.direction != Asc && ob.direction != Desc {
+			return fmt.Errorf("invalid sort direction: %q", ob.direction)
+		}
+	}
+	for _, h := range o.hints {
+		if strings.Contains(h, "/*") || strings.Contains(h, "*/") {
+			return fmt.Errorf("invalid hint: %q", h)
+		}
+	}
+	return nil
+}
+
+// apply appends the clauses for the options to the query, with parameters
+// numbered after the existing arguments. The options must be validated.
+func (o queryOptions) apply(query string,
+	args []interface{}) (string, []interface{}) {
+	if len(o.orderBy) > 0 {
+		terms := make([]string, 0, len(o.orderBy)+1)
+		hasID := false
+		for _, ob := range o.orderBy {
+			terms = append(terms, quoteColumn(ob.column)+collate(ob.collation)+
+				" "+string(ob.direction))
+			hasID = hasID || ob.column == "id"
+		}
+		// Break ties on the primary key, so that rows with equal sort values
+		// have a stable order and are never duplicated or skipped between
+		// pages.
+		if !hasID {
+			last := o.orderBy[len(o.orderBy)-1]
+			terms = append(terms, "id "+string(last.direction))
+		}
+		query += " ORDER BY " + strings.Join(terms, ", ")
+	}
+	if o.limit > 0 {
+		args = append(args, o.limit)
+		query += fmt.Sprintf(" LIMIT $%d", len(args))
+	}
+	if o.offset > 0 {
+		args = append(args, o.offset)
+		query += fmt.Sprintf(" OFFSET $%d", len(args))
+	}
+
+	return query, args
+}
@@ -0,0 +1,105 @@
+package repo
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/eendLabs/eh-pg/pkg/mocks"
+)
+
+func TestQueryOptions(t *testing.T) {
+	args, opts := splitQueryOptions([]interface{}{
+		"foo", WithLimit(10), 2, WithOffset(20),
+	})
+	if len(args) != 2 || args[0] != "foo" || args[1] != 2 {
+		t.Error("the args should be correct:", args)
+	}
+
+	query, args := opts.apply("SELECT * FROM models WHERE content = $1 AND version > $2", args)
+	if query != "SELECT * FROM models WHERE content = $1 AND version > $2 LIMIT $3 OFFSET $4" {
+		t.Error("the query should be correct:", query)
+	}
+	if len(args) != 4 || args[2] != 10 || args[3] != 20 {
+		t.Error("the args should be correct:", args)
+	}
+
+	_, opts = splitQueryOptions(nil)
+	if query, args := opts.apply("SELECT * FROM models", nil); query != "SELECT * FROM models" || len(args) != 0 {
+		t.Error("the query should be unchanged:", query, args)
+	}
+}
+
+func TestQueryOptionsOrderBy(t *testing.T) {
+	_, opts := splitQueryOptions([]interface{}{
+		WithOrderBy("created_at", Desc), WithOrderBy("id", Asc), WithLimit(5),
+	})
+	if err := opts.validate(defaultMapper, &mocks.Model{}); err != nil {
+		t.Error("there should be no error:", err)
+	}
+	query, args := opts.apply("SELECT * FROM models", nil)
+	if query != "SELECT * FROM models ORDER BY created_at DESC, id ASC LIMIT $1" {
+		t.Error("the query should be correct:", query)
+	}
+	if len(args) != 1 || args[0] != 5 {
+		t.Error("the args should be correct:", args)
+	}
+
+	// The ID is added as a tiebreaker.
+	_, opts = splitQueryOptions([]interface{}{
+		WithOrderBy("content", Asc), WithOrderBy("version", Desc),
+	})
+	query, _ = opts.apply("SELECT * FROM models", nil)
+	if query != "SELECT * FROM models ORDER BY content ASC, version DESC, id DESC" {
+		t.Error("the query should be correct:", query)
+	}
+
+	_, opts = splitQueryOptions([]interface{}{
+		WithOrderByCollate("content", Asc, "sv-x-icu"),
+	})
+	query, _ = opts.apply("SELECT * FROM models", nil)
+	if query != `SELECT * FROM models ORDER BY content COLLATE "sv-x-icu" ASC, id ASC` {
+		t.Error("the query should be correct:", query)
+	}
+
+	_, opts = splitQueryOptions([]interface{}{WithOrderBy("id; DROP TABLE models", Asc)})
+	if err := opts.validate(defaultMapper, &mocks.Model{}); !errors.Is(err, ErrInvalidColumn) {
+		t.Error("there should be a ErrInvalidColumn error:", err)
+	}
+	_, opts = splitQueryOptions([]interface{}{WithOrderBy("id", "sideways")})
+	if err := opts.validate(defaultMapper, &mocks.Model{}); err == nil {
+		t.Error("there should be an error")
+	}
+}
+
+func TestQueryOptionsColumns(t *testing.T) {
+	_, opts := splitQueryOptions([]interface{}{WithColumns("id", "content")})
+	if err := opts.validate(defaultMapper, &mocks.Model{}); err != nil {
+		t.Error("there should be no error:", err)
+	}
+	if query := opts.selectFrom("models"); query != "SELECT id, content FROM models" {
+		t.Error("the query should be correct:", query)
+	}
+
+	_, opts = splitQueryOptions([]interface{}{WithColumns("id", "password")})
+	if err := opts.validate(defaultMapper, &mocks.Model{}); !errors.Is(err, ErrInvalidColumn) {
+		t.Error("there should be a ErrInvalidColumn error:", err)
+	}
+}
+
+func TestQueryOptionsHint(t *testing.T) {
+	_, opts := splitQueryOptions([]interface{}{
+		WithHint("IndexScan(models models_content_idx)", "Set(work_mem 64MB)"),
+	})
+	if err := opts.validate(defaultMapper, &mocks.Model{}); err != nil {
+		t.Error("there should be no error:", err)
+	}
+	if query := opts.selectFrom("models"); query != "/*+ IndexScan(models models_content_idx) "+
+		"Set(work_mem 64MB) */ SELECT * FROM models" {
+		t.Error("the query should be correct:", query)
+	}
+
+	_, opts = splitQueryOptions([]interface{}{WithHint("SeqScan(models) */ DROP TABLE models; /*")})
+	if err := opts.validate(defaultMapper, &mocks.Model{}); err == nil {
+		t.Error("there should be an error")
+	}
+}
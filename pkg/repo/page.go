@@ -0,0 +1,368 @@
+package repo
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"time"
+
+	"github.com/jmoiron/sqlx/reflectx"
+	eh "github.com/looplab/eventhorizon"
+)
+
+// ErrInvalidCursor is when a page cursor can not be decoded.
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// Cursor is an opaque position in a paginated result. The empty cursor is the
+// first page.
+type Cursor string
+
+type cursorData struct {
+	Column string `json:"c"`
+	Value  string `json:"v,omitempty"`
+	ID     string `json:"id"`
+}
+
+// WithKeyset sets the column to paginate on in FindPage, "id" by default.
+// The id is always used as a tiebreaker for non-unique columns.
+func WithKeyset(column string) QueryOption {
+	return func(o *queryOptions) {
+		o.keyset = column
+	}
+}
+
+// FindPage returns a page of entities after the cursor, ordered by the keyset
+// column, and the cursor of the next page. The next cursor is empty when there
+// are no more entities. Keyset pagination uses the index on the column and
+// does not slow down on later pages as OFFSET does.
+func (r *Repo) FindPage(ctx context.Context, cursor Cursor, pageSize int,
+	opts ...QueryOption) ([]eh.Entity, Cursor, error) {
+	if r.factoryFn == nil {
+		return nil, "", eh.RepoError{
+			Err:       ErrModelNotSet,
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	}
+
+	o := queryOptions{keyset: "id"}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if len(o.columns) > 0 {
+		// The cursor is built from the keyset column and the id.
+		o.columns = appendMissing(o.columns, "id", o.keyset)
+	}
+	err := o.validate(r.mapper, r.factoryFn())
+	if err == nil && !hasColumn(r.mapper, r.factoryFn(), o.keyset) {
+		err = fmt.Errorf("%w: %q is not mapped", ErrInvalidColumn, o.keyset)
+	}
+	if err != nil {
+		return nil, "", eh.RepoError{
+			Err:       eh.ErrCouldNotLoadEntity,
+			BaseErr:   err,
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	}
+
+	c, err := cursor.decode(o.keyset)
+	if err != nil {
+		return nil, "", eh.RepoError{
+			Err:       eh.ErrCouldNotLoadEntity,
+			BaseErr:   err,
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	}
+
+	query, args := o.pageQuery(r.readTable(), c, pageSize)
+	result, err := r.query(ctx, query, args...)
+	if err != nil {
+		return nil, "", err
+	}
+	if len(result) < pageSize || len(result) == 0 {
+		return result, "", nil
+	}
+
+	next, err := newCursor(r.mapper, o.keyset, result[len(result)-1])
+	if err != nil {
+		return nil, "", eh.RepoError{
+			Err:       eh.ErrCouldNotLoadEntity,
+			BaseErr:   err,
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	}
+
+	return result, next, nil
+}
+
+// pageQuery returns the query of the page after the cursor, nil for the first
+// page, and its args.
+func (o queryOptions) pageQuery(table string, c *cursorData,
+	pageSize int) (string, []interface{}) {
+	query := o.selectFrom(table)
+	var args []interface{}
+	keyset := quoteColumn(o.keyset)
+	order := "id"
+	if o.keyset != "id" {
+		order = keyset + ", id"
+	}
+	if c != nil {
+		if o.keyset == "id" {
+			query += " WHERE id > $1"
+			args = append(args, c.ID)
+		} else {
+			query += fmt.Sprintf(" WHERE (%s, id) > ($1, $2)", keyset)
+			args = append(args, c.Value, c.ID)
+		}
+	}
+	args = append(args, pageSize)
+	query += fmt.Sprintf(" ORDER BY %s LIMIT $%d", order, len(args))
+	return query, args
+}
+
+// ErrInvalidPage is when a page number or size is not valid.
+var ErrInvalidPage = errors.New("invalid page")
+
+// totalColumn is the column holding the total count in FindPageWithTotal.
+const totalColumn = "eh_total"
+
+// FindPageWithTotal returns a page of the entities matching the filter, with
+// pages numbered from 1, and the total number of matching entities, as needed
+// by paginated APIs. The total is computed by a count(*) OVER () window in the
+// same query, so only past the last page a separate count is run. The result
+// is ordered by id unless ordered with WithOrderBy. A nil filter matches all
+// entities, like And().
+func (r *Repo) FindPageWithTotal(ctx context.Context, filter Filter,
+	page, size int, opts ...QueryOption) ([]eh.Entity, int64, error) {
+	if r.factoryFn == nil {
+		return nil, 0, eh.RepoError{
+			Err:       ErrModelNotSet,
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	}
+	if filter == nil {
+		filter = And()
+	}
+
+	var o queryOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if len(o.orderBy) == 0 {
+		o.orderBy = []orderBy{{column: "id", direction: Asc}}
+	}
+	o.limit, o.offset = size, (page-1)*size
+	o.extra = []string{"count(*) OVER () AS " + totalColumn}
+
+	err := o.validate(r.mapper, r.factoryFn())
+	if err == nil && (page < 1 || size < 1) {
+		err = fmt.Errorf("%w: page %d of size %d", ErrInvalidPage, page, size)
+	}
+	var expr string
+	var args []interface{}
+	if err == nil {
+		expr, args, err = filter.compile(r.mapper, r.factoryFn(), nil)
+	}
+	if err != nil {
+		return nil, 0, eh.RepoError{
+			Err:       eh.ErrCouldNotLoadEntity,
+			BaseErr:   err,
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	}
+
+	query, args := o.apply(o.selectFrom(r.readTable())+" WHERE "+expr, args)
+
+	result, total, err := r.queryWithTotal(ctx, query, args...)
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(result) == 0 && page > 1 {
+		// Past the last page there are no rows to carry the total.
+		if total, err = r.CountWhere(ctx, filter); err != nil {
+			return nil, 0, err
+		}
+	}
+
+	return result, total, nil
+}
+
+// queryWithTotal runs a query selecting the entities and the total column.
+func (r *Repo) queryWithTotal(ctx context.Context, query string,
+	args ...interface{}) ([]eh.Entity, int64, error) {
+	q, release, err := r.conn(ctx, false)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer release()
+
+	r.explain(ctx, q, query, args...)
+	rows, err := q.QueryxContext(ctx, query, args...)
+	if err != nil {
+		return nil, 0, eh.RepoError{
+			Err:       eh.ErrCouldNotLoadEntity,
+			BaseErr:   err,
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	}
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, 0, eh.RepoError{
+			Err:       eh.ErrCouldNotLoadEntity,
+			BaseErr:   err,
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	}
+
+	var result []eh.Entity
+	var total int64
+	for rows.Next() {
+		entity := r.factoryFn()
+		if err := rows.Scan(scanTargets(r.mapper, entity, columns, &total)...); err != nil {
+			return nil, 0, eh.RepoError{
+				Err:       eh.ErrCouldNotLoadEntity,
+				BaseErr:   err,
+				Namespace: eh.NamespaceFromContext(ctx),
+			}
+		}
+		result = append(result, entity)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, 0, eh.RepoError{
+			Err:       eh.ErrCouldNotLoadEntity,
+			BaseErr:   err,
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	}
+
+	return result, total, nil
+}
+
+// scanTargets returns the scan destinations for the columns: the fields of
+// the entity, total for the total column, and a discarded value for the
+// columns not mapped by the entity.
+func scanTargets(m *reflectx.Mapper, entity interface{}, columns []string,
+	total *int64) []interface{} {
+	v := reflect.Indirect(reflect.ValueOf(entity))
+	traversals := m.TraversalsByName(v.Type(), columns)
+
+	targets := make([]interface{}, len(columns))
+	for i, column := range columns {
+		switch {
+		case column == totalColumn:
+			targets[i] = total
+		case len(traversals[i]) == 0:
+			targets[i] = new(interface{})
+		default:
+			targets[i] = reflectx.FieldByIndexes(v, traversals[i]).Addr().Interface()
+		}
+	}
+	return targets
+}
+
+// FindAllInBatches calls fn with all entities in batches of batchSize,
+// ordered by id, for batch jobs processing huge tables with bounded memory.
+// It paginates with FindPage, so each batch is a short query and the rows
+// written during the iteration are seen if they sort after the current
+// batch. The iteration stops at the first error returned by fn.
+func (r *Repo) FindAllInBatches(ctx context.Context, batchSize int,
+	fn func([]eh.Entity) error) error {
+	if batchSize < 1 {
+		return eh.RepoError{
+			Err:       eh.ErrCouldNotLoadEntity,
+			BaseErr:   fmt.Errorf("%w: batch size %d", ErrInvalidPage, batchSize),
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	}
+
+	var cursor Cursor
+	for {
+		batch, next, err := r.FindPage(ctx, cursor, batchSize)
+		if err != nil {
+			return err
+		}
+		if len(batch) > 0 {
+			if err := fn(batch); err != nil {
+				return err
+			}
+		}
+		if next == "" {
+			return nil
+		}
+		cursor = next
+	}
+}
+
+// appendMissing appends the columns that are not already in the list.
+func appendMissing(list []string, columns ...string) []string {
+	for _, column := range columns {
+		found := false
+		for _, c := range list {
+			if c == column {
+				found = true
+				break
+			}
+		}
+		if !found {
+			list = append(list, column)
+		}
+	}
+	return list
+}
+
+// newCursor creates a cursor pointing after the entity.
+func newCursor(m *reflectx.Mapper, column string, entity eh.Entity) (Cursor, error) {
+	c := cursorData{
+		Column: column,
+		ID:     entity.EntityID().String(),
+	}
+
+	if column != "id" {
+		v := reflect.Indirect(reflect.ValueOf(entity))
+		fi := m.TypeMap(v.Type()).GetByPath(column)
+		if fi == nil {
+			return "", fmt.Errorf("%w: %q is not mapped", ErrInvalidColumn, column)
+		}
+		f := reflectx.FieldByIndexesReadOnly(v, fi.Index)
+		switch x := f.Interface().(type) {
+		case time.Time:
+			c.Value = x.Format(time.RFC3339Nano)
+		default:
+			c.Value = fmt.Sprint(x)
+		}
+	}
+
+	b, err := json.Marshal(c)
+	if err != nil {
+		return "", err
+	}
+
+	return Cursor(base64.RawURLEncoding.EncodeToString(b)), nil
+}
+
+// decode decodes a cursor, which must be for the column. The empty cursor
+// decodes to nil.
+func (c Cursor) decode(column string) (*cursorData, error) {
+	if c == "" {
+		return nil, nil
+	}
+
+	b, err := base64.RawURLEncoding.DecodeString(string(c))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidCursor, err)
+	}
+	var d cursorData
+	if err := json.Unmarshal(b, &d); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidCursor, err)
+	}
+	if d.Column != column {
+		return nil, fmt.Errorf("%w: cursor is for column %q",
+			ErrInvalidCursor, d.Column)
+	}
+
+	return &d, nil
+}
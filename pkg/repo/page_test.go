@@ -0,0 +1,125 @@
+package repo
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jmoiron/sqlx"
+	eh "github.com/looplab/eventhorizon"
+
+	"github.com/eendLabs/eh-pg/pkg/mocks"
+)
+
+func TestCursor(t *testing.T) {
+	model := &mocks.Model{
+		ID:        uuid.New(),
+		CreatedAt: time.Date(2009, time.November, 10, 23, 0, 0, 0, time.UTC),
+	}
+
+	c, err := newCursor(defaultMapper, "created_at", model)
+	if err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	d, err := c.decode("created_at")
+	if err != nil {
+		t.Error("there should be no error:", err)
+	}
+	if d.ID != model.ID.String() || d.Value != "2009-11-10T23:00:00Z" {
+		t.Error("the cursor should be correct:", d)
+	}
+
+	if _, err := c.decode("id"); !errors.Is(err, ErrInvalidCursor) {
+		t.Error("there should be a ErrInvalidCursor error:", err)
+	}
+	if _, err := Cursor("not a cursor").decode("id"); !errors.Is(err, ErrInvalidCursor) {
+		t.Error("there should be a ErrInvalidCursor error:", err)
+	}
+	if d, err := Cursor("").decode("id"); d != nil || err != nil {
+		t.Error("the empty cursor should be the first page:", d, err)
+	}
+
+	if _, err := newCursor(defaultMapper, "not_mapped", model); !errors.Is(err, ErrInvalidColumn) {
+		t.Error("there should be a ErrInvalidColumn error:", err)
+	}
+}
+
+func TestPageQuery(t *testing.T) {
+	o := queryOptions{keyset: "createdAt"}
+	query, args := o.pageQuery("models", nil, 10)
+	if query != `SELECT * FROM models ORDER BY "createdAt", id LIMIT $1` ||
+		len(args) != 1 || args[0] != 10 {
+		t.Error("the query of the first page should be correct:", query, args)
+	}
+
+	c := &cursorData{Column: "createdAt", Value: "now", ID: uuid.New().String()}
+	query, args = o.pageQuery("models", c, 10)
+	if query != `SELECT * FROM models WHERE ("createdAt", id) > ($1, $2) `+
+		`ORDER BY "createdAt", id LIMIT $3` || len(args) != 3 {
+		t.Error("the camel case keyset should be quoted:", query, args)
+	}
+
+	o = queryOptions{keyset: "id"}
+	if query, _ := o.pageQuery("models", c, 10); query !=
+		"SELECT * FROM models WHERE id > $1 ORDER BY id LIMIT $2" {
+		t.Error("the query should be correct:", query)
+	}
+}
+
+func TestScanTargets(t *testing.T) {
+	model := &mocks.Model{}
+	var total int64
+	targets := scanTargets(defaultMapper, model, []string{"id", "content", "not_mapped", totalColumn}, &total)
+	if len(targets) != 4 {
+		t.Fatal("there should be a target per column:", len(targets))
+	}
+	if targets[0] != &model.ID || targets[1] != &model.Content || targets[3] != &total {
+		t.Error("the targets should be correct:", targets)
+	}
+	if _, ok := targets[2].(*interface{}); !ok {
+		t.Error("unmapped columns should be discarded:", targets[2])
+	}
+}
+
+func TestFindPageWithTotalInvalid(t *testing.T) {
+	db, err := sqlx.Open("postgres", "")
+	if err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	r, err := NewRepoWithClient(&Config{TableName: "models"}, db)
+	if err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	r.SetEntityFactory(func() eh.Entity { return &mocks.Model{} })
+
+	ctx := context.Background()
+	_, _, err = r.FindPageWithTotal(ctx, And(), 0, 10)
+	if rrErr, ok := err.(eh.RepoError); !ok || !errors.Is(rrErr.BaseErr, ErrInvalidPage) {
+		t.Error("there should be a ErrInvalidPage error:", err)
+	}
+	_, _, err = r.FindPageWithTotal(ctx, Eq("not_mapped", 1), 1, 10)
+	if rrErr, ok := err.(eh.RepoError); !ok || !errors.Is(rrErr.BaseErr, ErrInvalidColumn) {
+		t.Error("there should be a ErrInvalidColumn error:", err)
+	}
+}
+
+func TestFindAllInBatchesInvalid(t *testing.T) {
+	db, err := sqlx.Open("postgres", "")
+	if err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	r, err := NewRepoWithClient(&Config{TableName: "models"}, db)
+	if err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+
+	err = r.FindAllInBatches(context.Background(), 0, func([]eh.Entity) error {
+		t.Error("the callback should not be called")
+		return nil
+	})
+	if rrErr, ok := err.(eh.RepoError); !ok || !errors.Is(rrErr.BaseErr, ErrInvalidPage) {
+		t.Error("there should be a ErrInvalidPage error:", err)
+	}
+}
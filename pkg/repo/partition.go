@@ -0,0 +1,246 @@
+package repo
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/jmoiron/sqlx/reflectx"
+	eh "github.com/looplab/eventhorizon"
+)
+
+// ErrInvalidPartition is when the partition config or the partition key of an
+// entity is not valid.
+var ErrInvalidPartition = errors.New("invalid partition")
+
+// PartitionStrategy is how the rows are distributed over the partitions.
+type PartitionStrategy string
+
+const (
+	// PartitionHash distributes the rows evenly by the hash of the column,
+	// like a tenant ID.
+	PartitionHash PartitionStrategy = "HASH"
+	// PartitionRange puts the rows in a partition per interval of a time
+	// column, like created_at, so that old partitions can be detached.
+	PartitionRange PartitionStrategy = "RANGE"
+)
+
+// PartitionConfig partitions the table by a column, for tables too large for
+// a single heap and its indexes. Postgres routes the writes to the partition
+// of the row. The table and the hash partitions are created by EnsureTable,
+// the range partitions are created by Save and SaveAll before the first row of
+// their interval is written, or ahead of time with EnsurePartitions.
+//
+// A unique constraint on a partitioned table must include the column, so Save
+// upserts on (id, Column) unless KeyColumns are given, which must include the
+// column. The column must therefore never change for an entity.
+type PartitionConfig struct {
+	// Column is the partition key, mapped by the entity.
+	Column string
+	// Strategy is PartitionHash by default.
+	Strategy PartitionStrategy
+	// Partitions is the number of hash partitions, 16 by default.
+	Partitions int
+	// Interval is the time span of the range partitions, 30 days by default.
+	// The partitions start at multiples of the interval since the zero time,
+	// in UTC.
+	Interval time.Duration
+}
+
+func (c *PartitionConfig) provideDefaults() {
+	if c.Strategy == "" {
+		c.Strategy = PartitionHash
+	}
+	if c.Partitions <= 0 {
+		c.Partitions = 16
+	}
+	if c.Interval <= 0 {
+		c.Interval = 30 * 24 * time.Hour
+	}
+}
+
+func (c *PartitionConfig) validate(keyColumns []string) error {
+	if !validIdentifier(c.Column) {
+		return fmt.Errorf("%w: invalid column %q", ErrInvalidPartition, c.Column)
+	}
+	if c.Strategy != PartitionHash && c.Strategy != PartitionRange {
+		return fmt.Errorf("%w: unknown strategy %q", ErrInvalidPartition, c.Strategy)
+	}
+	if len(keyColumns) > 0 {
+		for _, k := range keyColumns {
+			if k == c.Column {
+				return nil
+			}
+		}
+		return fmt.Errorf("%w: key columns %v don't include %s",
+			ErrInvalidPartition, keyColumns, c.Column)
+	}
+	return nil
+}
+
+// key returns the conflict target of Save.
+func (c *PartitionConfig) key() []string {
+	return []string{"id", c.Column}
+}
+
+// partitionedBy returns the PARTITION BY clause of the table.
+func (c *PartitionConfig) partitionedBy() string {
+	return fmt.Sprintf("PARTITION BY %s (%s)", c.Strategy, c.Column)
+}
+
+// hashPartitionsQuery returns the statements creating the hash partitions.
+func (c *PartitionConfig) hashPartitionsQuery(table string) string {
+	stmts := make([]string, c.Partitions)
+	for i := range stmts {
+		stmts[i] = fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s_p%d PARTITION OF %s "+
+			"FOR VALUES WITH (MODULUS %d, REMAINDER %d)",
+			table, i, table, c.Partitions, i)
+	}
+	return strings.Join(stmts, ";\n")
+}
+
+// rangeStart returns the start of the range partition of t.
+func (c *PartitionConfig) rangeStart(t time.Time) time.Time {
+	return t.UTC().Truncate(c.Interval)
+}
+
+// rangePartitionQuery returns the name of the range partition starting at
+// start and the statement creating it.
+func (c *PartitionConfig) rangePartitionQuery(table string, start time.Time) (string, string) {
+	layout := "20060102"
+	if c.Interval%(24*time.Hour) != 0 {
+		layout += "_150405"
+	}
+	name := table + "_" + start.Format(layout)
+	return name, fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s PARTITION OF %s "+
+		"FOR VALUES FROM ('%s') TO ('%s')", name, table,
+		start.Format(time.RFC3339), start.Add(c.Interval).Format(time.RFC3339))
+}
+
+// partitionTime returns the value of the range partition key of the entity.
+func (c *PartitionConfig) partitionTime(m *reflectx.Mapper,
+	entity eh.Entity) (time.Time, error) {
+	v, ok := columnFields(m, reflect.ValueOf(entity))[c.Column]
+	if !ok {
+		return time.Time{}, fmt.Errorf("%w: entity %s does not map %s",
+			ErrInvalidPartition, entity.EntityID(), c.Column)
+	}
+	switch t := v.Interface().(type) {
+	case time.Time:
+		return t, nil
+	case *time.Time:
+		if t != nil {
+			return *t, nil
+		}
+	case sql.NullTime:
+		if t.Valid {
+			return t.Time, nil
+		}
+	default:
+		return time.Time{}, fmt.Errorf("%w: %s is a %T, not a time",
+			ErrInvalidPartition, c.Column, t)
+	}
+	return time.Time{}, fmt.Errorf("%w: entity %s has no %s",
+		ErrInvalidPartition, entity.EntityID(), c.Column)
+}
+
+// EnsurePartitions creates the hash partitions, or the range partitions
+// covering the times from and to, if they don't exist. Creating a partition
+// locks the table for a moment, creating the range partitions ahead of time
+// avoids doing so on Save.
+func (r *Repo) EnsurePartitions(ctx context.Context, from, to time.Time) error {
+	c := r.config.Partition
+	if c == nil {
+		return nil
+	}
+
+	return r.writeTx(ctx, func(tx *sqlx.Tx) error {
+		if err := lockSchema(ctx, tx, r.config.TableName); err != nil {
+			return err
+		}
+		if c.Strategy == PartitionHash {
+			if _, err := tx.ExecContext(ctx,
+				c.hashPartitionsQuery(r.config.TableName)); err != nil {
+				return eh.RepoError{
+					Err:       err,
+					Namespace: eh.NamespaceFromContext(ctx),
+				}
+			}
+			return nil
+		}
+
+		ctx := contextWithTx(ctx, r.client.DB, tx)
+		for start := c.rangeStart(from); !start.After(to); start = start.Add(c.Interval) {
+			if err := r.ensureRangePartition(ctx, start); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// ensureRangePartitions creates the missing range partitions of the entities.
+func (r *Repo) ensureRangePartitions(ctx context.Context, entities ...eh.Entity) error {
+	c := r.config.Partition
+	if c == nil || c.Strategy != PartitionRange {
+		return nil
+	}
+
+	for _, entity := range entities {
+		t, err := c.partitionTime(r.mapper, entity)
+		if err != nil {
+			return eh.RepoError{
+				Err:       eh.ErrCouldNotSaveEntity,
+				BaseErr:   err,
+				Namespace: eh.NamespaceFromContext(ctx),
+			}
+		}
+		if err := r.ensureRangePartition(ctx, c.rangeStart(t)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ensureRangePartition creates the range partition starting at start, unless
+// it is known to exist. In a repo-managed transaction the partition is
+// created in the transaction, which already locks the table.
+func (r *Repo) ensureRangePartition(ctx context.Context, start time.Time) error {
+	name, query := r.config.Partition.rangePartitionQuery(r.config.TableName, start)
+	if _, ok := r.partitions.Load(name); ok {
+		return nil
+	}
+
+	tx := r.txFromContext(ctx)
+	var err error
+	if tx != nil {
+		_, err = tx.ExecContext(ctx, query)
+	} else {
+		_, err = r.client.ExecContext(ctx, query)
+		if err != nil {
+			// Lost a race against another writer creating it.
+			var exists bool
+			if r.client.GetContext(ctx, &exists,
+				"SELECT to_regclass($1) IS NOT NULL", name) == nil && exists {
+				err = nil
+			}
+		}
+	}
+	if err != nil {
+		return eh.RepoError{
+			Err:       eh.ErrCouldNotSaveEntity,
+			BaseErr:   fmt.Errorf("creating partition %s: %w", name, err),
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	}
+	if tx == nil {
+		r.partitions.Store(name, struct{}{})
+	}
+
+	return nil
+}
@@ -0,0 +1,104 @@
+package repo
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jmoiron/sqlx"
+
+	"github.com/eendLabs/eh-pg/pkg/mocks"
+)
+
+func TestPartitionConfig(t *testing.T) {
+	db, err := sqlx.Open("postgres", "")
+	if err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+
+	config := &Config{TableName: "models", Partition: &PartitionConfig{Column: "content"}}
+	r, err := NewRepoWithClient(config, db)
+	if err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	if c := config.Partition; c.Strategy != PartitionHash || c.Partitions != 16 ||
+		c.Interval != 30*24*time.Hour {
+		t.Error("the config should have the defaults:", c)
+	}
+	if key := r.upsertSpec().key; !reflect.DeepEqual(key, []string{"id", "content"}) {
+		t.Error("the conflict target should include the partition key:", key)
+	}
+
+	for _, c := range []*Config{
+		{TableName: "models", Partition: &PartitionConfig{Column: "content;"}},
+		{TableName: "models", Partition: &PartitionConfig{Column: "content", Strategy: "LIST"}},
+		{TableName: "models", KeyColumns: []string{"id"}, Partition: &PartitionConfig{Column: "content"}},
+	} {
+		if _, err := NewRepoWithClient(c, db); !errors.Is(err, ErrInvalidPartition) {
+			t.Error("there should be a ErrInvalidPartition error:", c.Partition, err)
+		}
+	}
+}
+
+func TestCreateTableQueryPartitioned(t *testing.T) {
+	db, err := sqlx.Open("postgres", "")
+	if err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	r, err := NewRepoWithClient(&Config{
+		TableName: "models",
+		Partition: &PartitionConfig{Column: "content", Partitions: 2},
+	}, db)
+	if err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+
+	expected := `CREATE TABLE IF NOT EXISTS models (
+    content text,
+    created_at timestamptz,
+    id uuid,
+    version bigint,
+    PRIMARY KEY (id, content)
+) PARTITION BY HASH (content);
+CREATE TABLE IF NOT EXISTS models_p0 PARTITION OF models FOR VALUES WITH (MODULUS 2, REMAINDER 0);
+CREATE TABLE IF NOT EXISTS models_p1 PARTITION OF models FOR VALUES WITH (MODULUS 2, REMAINDER 1)`
+	if query, err := r.createTableQuery(&mocks.Model{}); err != nil || query != expected {
+		t.Error("the query should be correct:", query, err)
+	}
+}
+
+func TestRangePartitionQuery(t *testing.T) {
+	c := &PartitionConfig{Column: "created_at", Strategy: PartitionRange}
+	c.provideDefaults()
+	created := time.Date(2021, 3, 14, 15, 9, 26, 0, time.FixedZone("", 3600))
+
+	start := c.rangeStart(created)
+	if start.After(created) || !start.Add(c.Interval).After(created) {
+		t.Error("the partition should contain the time:", start)
+	}
+	name, query := c.rangePartitionQuery("models", start)
+	if name != "models_"+start.Format("20060102") {
+		t.Error("the name should be correct:", name)
+	}
+	expected := "CREATE TABLE IF NOT EXISTS " + name + " PARTITION OF models " +
+		"FOR VALUES FROM ('" + start.Format(time.RFC3339) + "') " +
+		"TO ('" + start.Add(c.Interval).Format(time.RFC3339) + "')"
+	if query != expected {
+		t.Error("the query should be correct:", query)
+	}
+
+	c.Interval = time.Hour
+	if name, _ := c.rangePartitionQuery("models", c.rangeStart(created)); name != "models_20210314_140000" {
+		t.Error("the name should include the time:", name)
+	}
+
+	if tm, err := c.partitionTime(defaultMapper, &mocks.Model{ID: uuid.New(), CreatedAt: created}); err != nil || !tm.Equal(created) {
+		t.Error("the partition time should be correct:", tm, err)
+	}
+	c.Column = "content"
+	if _, err := c.partitionTime(defaultMapper, &mocks.Model{ID: uuid.New()}); !errors.Is(err, ErrInvalidPartition) {
+		t.Error("there should be a ErrInvalidPartition error:", err)
+	}
+}
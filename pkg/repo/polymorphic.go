@@ -0,0 +1,143 @@
+package repo
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/jmoiron/sqlx/reflectx"
+	eh "github.com/looplab/eventhorizon"
+)
+
+// ErrUnknownEntityType is when an entity type is not registered.
+var ErrUnknownEntityType = errors.New("unknown entity type")
+
+// RegisterEntityType registers the factory of the entities of a type, for
+// repos storing several entity types in one table. The name is stored in
+// Config.TypeColumn on Save and selects the factory of each row read by Find,
+// FindAll, the filter queries and FindAllIter. The first registered type is
+// also the entity factory of the repo, used when no row is read, like for the
+// column validation of query options. Columns mapped by several types must
+// have the same Go type. All types must be registered before the repo is
+// used.
+func (r *Repo) RegisterEntityType(name string, f func() eh.Entity) {
+	if r.types == nil {
+		r.types = map[string]func() eh.Entity{}
+		r.typeNames = map[reflect.Type]string{}
+	}
+	r.types[name] = f
+	r.typeNames[reflect.TypeOf(f())] = name
+	if r.factoryFn == nil {
+		r.factoryFn = f
+	}
+}
+
+// typeColumn returns the type column as a computed column.
+func (r *Repo) typeColumn() ComputedColumn {
+	return ComputedColumn{Name: r.config.TypeColumn, Func: func(entity eh.Entity) (interface{}, error) {
+		name, ok := r.typeNames[reflect.TypeOf(entity)]
+		if !ok {
+			return nil, fmt.Errorf("%w: %T", ErrUnknownEntityType, entity)
+		}
+		return name, nil
+	}}
+}
+
+// get runs a query for one row and scans it with scanRow. It returns
+// sql.ErrNoRows if there is no row.
+func (r *Repo) get(ctx context.Context, q sqlx.QueryerContext, query string,
+	args ...interface{}) (eh.Entity, error) {
+	rows, err := q.QueryxContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	if !rows.Next() {
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+		return nil, sql.ErrNoRows
+	}
+	return r.scanRow(rows)
+}
+
+// scanRow scans the current row into an entity, created by the factory of its
+// type for repos with several entity types.
+func (r *Repo) scanRow(rows *sqlx.Rows) (eh.Entity, error) {
+	// The rows of a transaction of the context use the mapper of its client.
+	rows.Mapper = r.mapper
+	if len(r.types) == 0 {
+		entity := r.factoryFn()
+		return entity, rows.StructScan(entity)
+	}
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+
+	// The type is only known after the scan, scan each column into the first
+	// type mapping it and copy the values to the entity of the row's type.
+	names := make([]string, 0, len(r.types))
+	for name := range r.types {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	candidates := make([]reflect.Value, len(names))
+	traversals := make([][][]int, len(names))
+	for i, name := range names {
+		candidates[i] = reflect.Indirect(reflect.ValueOf(r.types[name]()))
+		traversals[i] = r.mapper.TraversalsByName(candidates[i].Type(), columns)
+	}
+
+	var typ sql.NullString
+	targets := make([]interface{}, len(columns))
+	for i, column := range columns {
+		if column == r.config.TypeColumn {
+			targets[i] = &typ
+			continue
+		}
+		for j := range candidates {
+			if len(traversals[j][i]) > 0 {
+				targets[i] = reflectx.FieldByIndexes(candidates[j], traversals[j][i]).
+					Addr().Interface()
+				break
+			}
+		}
+		if targets[i] == nil {
+			targets[i] = new(interface{})
+		}
+	}
+	if err := rows.Scan(targets...); err != nil {
+		return nil, err
+	}
+
+	f, ok := r.types[typ.String]
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", ErrUnknownEntityType, typ.String)
+	}
+	entity := f()
+	v := reflect.Indirect(reflect.ValueOf(entity))
+	for i, traversal := range r.mapper.TraversalsByName(v.Type(), columns) {
+		if len(traversal) == 0 {
+			continue
+		}
+		src := reflect.ValueOf(targets[i]).Elem()
+		if columns[i] == r.config.TypeColumn {
+			src = reflect.ValueOf(typ.String)
+		}
+		dst := reflectx.FieldByIndexes(v, traversal)
+		if !src.Type().AssignableTo(dst.Type()) {
+			return nil, fmt.Errorf("column %s is a %s in %T but a %s in another type",
+				columns[i], dst.Type(), entity, src.Type())
+		}
+		dst.Set(src)
+	}
+
+	return entity, nil
+}
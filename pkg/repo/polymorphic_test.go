@@ -0,0 +1,68 @@
+package repo
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/jmoiron/sqlx"
+	eh "github.com/looplab/eventhorizon"
+
+	"github.com/eendLabs/eh-pg/pkg/mocks"
+)
+
+type noteModel struct {
+	ID      uuid.UUID `db:"id"`
+	Content string    `db:"content"`
+	Pinned  bool      `db:"pinned"`
+}
+
+func (m *noteModel) EntityID() uuid.UUID {
+	return m.ID
+}
+
+func TestRegisterEntityType(t *testing.T) {
+	db, err := sqlx.Open("postgres", "")
+	if err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+
+	if _, err := NewRepoWithClient(&Config{
+		TableName:  "models",
+		TypeColumn: "entity type",
+	}, db); !errors.Is(err, ErrInvalidColumn) {
+		t.Error("there should be a ErrInvalidColumn error:", err)
+	}
+
+	r, err := NewRepoWithClient(&Config{TableName: "models", TypeColumn: "kind"}, db)
+	if err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	r.RegisterEntityType("model", func() eh.Entity {
+		return &mocks.Model{}
+	})
+	r.RegisterEntityType("note", func() eh.Entity {
+		return &noteModel{}
+	})
+	if _, ok := r.factoryFn().(*mocks.Model); !ok {
+		t.Error("the first type should be the entity factory")
+	}
+
+	column := r.typeColumn()
+	if name, err := column.Func(&noteModel{}); err != nil || name != "note" {
+		t.Error("the type name should be correct:", name, err)
+	}
+	if _, err := column.Func(&versionedModel{}); !errors.Is(err, ErrUnknownEntityType) {
+		t.Error("there should be a ErrUnknownEntityType error:", err)
+	}
+
+	query, _, err := r.upsertSpec().query(entityColumns(defaultMapper, &noteModel{}), []eh.Entity{&noteModel{ID: uuid.New()}})
+	if err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	if query != "INSERT INTO models (content, id, pinned, kind) VALUES ($1, $2, $3, $4) "+
+		"ON CONFLICT (id) DO UPDATE SET content = EXCLUDED.content, id = EXCLUDED.id, "+
+		"pinned = EXCLUDED.pinned, kind = EXCLUDED.kind" {
+		t.Error("the query should write the type:", query)
+	}
+}
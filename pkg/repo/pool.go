@@ -0,0 +1,168 @@
+package repo
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	eh "github.com/looplab/eventhorizon"
+)
+
+// ErrPoolExhausted is when no connection could be acquired within the
+// configured acquire timeout.
+var ErrPoolExhausted = errors.New("connection pool exhausted")
+
+// ErrInvalidPool is when the pool config is not valid.
+var ErrInvalidPool = errors.New("invalid pool config")
+
+// PoolConfig configures the connection pool of the repo.
+type PoolConfig struct {
+	// MaxOpenConns is the max number of open connections, the setting of
+	// the client (unlimited by default) if 0.
+	MaxOpenConns int
+	// MaxIdleConns is the max number of idle connections, the setting of the
+	// client if 0.
+	MaxIdleConns int
+	// ConnMaxLifetime is the max time a connection may be reused, the
+	// setting of the client if 0.
+	ConnMaxLifetime time.Duration
+	// AcquireTimeout is the max time an operation waits for a connection
+	// before failing with ErrPoolExhausted. It requires MaxOpenConns.
+	AcquireTimeout time.Duration
+	// OnAcquire is called with the time each operation waited for a
+	// connection, useful to feed a metrics histogram.
+	OnAcquire func(wait time.Duration)
+	// ReadLane and WriteLane optionally split the pool into separate limits
+	// for reads and writes, so that bulk projector writes cannot exhaust the
+	// connections needed by latency sensitive Finds. MaxOpenConns is set to
+	// their sum. They require AcquireTimeout.
+	ReadLane  int
+	WriteLane int
+}
+
+func (c *PoolConfig) provideDefaults() {
+	if c.ReadLane > 0 && c.WriteLane > 0 {
+		c.MaxOpenConns = c.ReadLane + c.WriteLane
+	}
+}
+
+func (c *PoolConfig) validate() error {
+	switch {
+	case c.MaxOpenConns < 0 || c.MaxIdleConns < 0 || c.ConnMaxLifetime < 0 ||
+		c.AcquireTimeout < 0 || c.ReadLane < 0 || c.WriteLane < 0:
+		return fmt.Errorf("%w: negative limit", ErrInvalidPool)
+	case (c.ReadLane > 0) != (c.WriteLane > 0):
+		return fmt.Errorf("%w: both ReadLane and WriteLane are required", ErrInvalidPool)
+	case c.ReadLane > 0 && c.AcquireTimeout == 0:
+		// The lanes would be disabled, with the pool still capped at their sum.
+		return fmt.Errorf("%w: the lanes require AcquireTimeout", ErrInvalidPool)
+	case c.AcquireTimeout > 0 && c.MaxOpenConns == 0:
+		return fmt.Errorf("%w: AcquireTimeout requires MaxOpenConns", ErrInvalidPool)
+	}
+	return nil
+}
+
+// PoolStats are the statistics of the connection pool.
+type PoolStats struct {
+	sql.DBStats
+	// Waiting is the number of operations currently waiting for a connection.
+	Waiting int64
+	// AcquireTimeouts is the number of operations that failed with
+	// ErrPoolExhausted.
+	AcquireTimeouts int64
+	// AcquireWait is the total time operations waited for a connection.
+	AcquireWait time.Duration
+}
+
+type pool struct {
+	config *PoolConfig
+	// reads and writes are the semaphores of the lanes, the same one when
+	// the pool is not split.
+	reads  chan struct{}
+	writes chan struct{}
+
+	waiting  int64
+	timeouts int64
+	wait     int64
+}
+
+func newPool(config *PoolConfig) *pool {
+	p := &pool{config: config}
+	switch {
+	case config.AcquireTimeout <= 0:
+	case config.ReadLane > 0 && config.WriteLane > 0:
+		p.reads = make(chan struct{}, config.ReadLane)
+		p.writes = make(chan struct{}, config.WriteLane)
+	case config.MaxOpenConns > 0:
+		p.reads = make(chan struct{}, config.MaxOpenConns)
+		p.writes = p.reads
+	}
+	return p
+}
+
+// acquire waits for a free connection slot in the read lane and returns a
+// func releasing it.
+func (r *Repo) acquire(ctx context.Context) (func(), error) {
+	if r.pool == nil {
+		return func() {}, nil
+	}
+	return r.pool.acquire(ctx, r.pool.reads)
+}
+
+// acquireWrite waits for a free connection slot in the write lane and returns
+// a func releasing it.
+func (r *Repo) acquireWrite(ctx context.Context) (func(), error) {
+	if r.pool == nil {
+		return func() {}, nil
+	}
+	return r.pool.acquire(ctx, r.pool.writes)
+}
+
+func (p *pool) acquire(ctx context.Context, sem chan struct{}) (func(), error) {
+	if sem == nil {
+		return func() {}, nil
+	}
+
+	start := time.Now()
+	atomic.AddInt64(&p.waiting, 1)
+	defer atomic.AddInt64(&p.waiting, -1)
+
+	timer := time.NewTimer(p.config.AcquireTimeout)
+	defer timer.Stop()
+
+	select {
+	case sem <- struct{}{}:
+		wait := time.Since(start)
+		atomic.AddInt64(&p.wait, int64(wait))
+		if p.config.OnAcquire != nil {
+			p.config.OnAcquire(wait)
+		}
+		return func() { <-sem }, nil
+	case <-timer.C:
+		atomic.AddInt64(&p.timeouts, 1)
+		return nil, eh.RepoError{
+			Err:       ErrPoolExhausted,
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	case <-ctx.Done():
+		return nil, eh.RepoError{
+			Err:       ErrPoolExhausted,
+			BaseErr:   ctx.Err(),
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	}
+}
+
+// PoolStats returns the statistics of the connection pool.
+func (r *Repo) PoolStats() PoolStats {
+	s := PoolStats{DBStats: r.client.Stats()}
+	if p := r.pool; p != nil {
+		s.Waiting = atomic.LoadInt64(&p.waiting)
+		s.AcquireTimeouts = atomic.LoadInt64(&p.timeouts)
+		s.AcquireWait = time.Duration(atomic.LoadInt64(&p.wait))
+	}
+	return s
+}
@@ -0,0 +1,145 @@
+package repo
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+func TestPoolAcquireTimeout(t *testing.T) {
+	client, err := sqlx.Open("postgres", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var waits int
+	r, err := NewRepoWithClient(&Config{
+		TableName: "models",
+		Pool: &PoolConfig{
+			MaxOpenConns:   1,
+			AcquireTimeout: 10 * time.Millisecond,
+			OnAcquire: func(time.Duration) {
+				waits++
+			},
+		},
+	}, client)
+	if err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	defer r.Close(context.Background())
+
+	ctx := context.Background()
+	release, err := r.acquire(ctx)
+	if err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+
+	if _, err := r.acquire(ctx); !errors.Is(err, ErrPoolExhausted) {
+		t.Error("there should be a ErrPoolExhausted error:", err)
+	}
+	if s := r.PoolStats(); s.AcquireTimeouts != 1 || s.Waiting != 0 {
+		t.Error("the stats should be correct:", s)
+	}
+
+	release()
+	release, err = r.acquire(ctx)
+	if err != nil {
+		t.Error("there should be no error:", err)
+	}
+	release()
+	if waits != 2 {
+		t.Error("the acquire hook should be called:", waits)
+	}
+}
+
+func TestPoolLanes(t *testing.T) {
+	client, err := sqlx.Open("postgres", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := &Config{
+		TableName: "models",
+		Pool: &PoolConfig{
+			ReadLane:       1,
+			WriteLane:      1,
+			AcquireTimeout: 10 * time.Millisecond,
+		},
+	}
+	r, err := NewRepoWithClient(config, client)
+	if err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	defer r.Close(context.Background())
+	if config.Pool.MaxOpenConns != 2 {
+		t.Error("the max open conns should be the sum of the lanes:", config.Pool.MaxOpenConns)
+	}
+
+	// Exhausted writes don't block reads.
+	ctx := context.Background()
+	releaseWrite, err := r.acquireWrite(ctx)
+	if err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	if _, err := r.acquireWrite(ctx); !errors.Is(err, ErrPoolExhausted) {
+		t.Error("there should be a ErrPoolExhausted error:", err)
+	}
+	releaseRead, err := r.acquire(ctx)
+	if err != nil {
+		t.Error("there should be no error:", err)
+	}
+	if _, err := r.acquire(ctx); !errors.Is(err, ErrPoolExhausted) {
+		t.Error("there should be a ErrPoolExhausted error:", err)
+	}
+
+	// The bulk and maintenance operations wait for the lanes too.
+	if err := r.Clear(ctx); !errors.Is(err, ErrPoolExhausted) {
+		t.Error("there should be a ErrPoolExhausted error:", err)
+	}
+	if err := r.EnsureIndex(ctx, IndexInput{PartitionKey: "content"}); !errors.Is(err, ErrPoolExhausted) {
+		t.Error("there should be a ErrPoolExhausted error:", err)
+	}
+	if err := r.EnsureIndex(ctx, IndexInput{PartitionKey: "content"},
+		Concurrently()); !errors.Is(err, ErrPoolExhausted) {
+		t.Error("there should be a ErrPoolExhausted error:", err)
+	}
+	if _, err := r.EstimateCount(ctx); !errors.Is(err, ErrPoolExhausted) {
+		t.Error("there should be a ErrPoolExhausted error:", err)
+	}
+	releaseRead()
+	releaseWrite()
+}
+
+func TestPoolConfigValidate(t *testing.T) {
+	client, err := sqlx.Open("postgres", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, p := range []*PoolConfig{
+		{MaxOpenConns: -1},
+		{MaxIdleConns: -1},
+		{ReadLane: 1},
+		{ReadLane: 1, WriteLane: 1},
+		{AcquireTimeout: time.Second},
+	} {
+		if _, err := NewRepoWithClient(&Config{TableName: "models", Pool: p}, client); !errors.Is(err, ErrInvalidPool) {
+			t.Error("there should be a ErrInvalidPool error:", p, err)
+		}
+	}
+
+	// Unset limits keep the settings of the client.
+	client.SetMaxOpenConns(3)
+	if _, err := NewRepoWithClient(&Config{
+		TableName: "models",
+		Pool:      &PoolConfig{MaxIdleConns: 1},
+	}, client); err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	if s := client.Stats(); s.MaxOpenConnections != 3 {
+		t.Error("the max open conns should not change:", s.MaxOpenConnections)
+	}
+}
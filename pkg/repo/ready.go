@@ -0,0 +1,215 @@
+package repo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// ErrNotReady is when the read model is not ready to serve traffic.
+var ErrNotReady = errors.New("read model not ready")
+
+// ReadyOption is an option for Ready and WaitReady.
+type ReadyOption func(*readyOptions)
+
+type readyOptions struct {
+	pollInterval time.Duration
+	maxLag       time.Duration
+	lag          func(context.Context) (time.Duration, error)
+}
+
+// WithPollInterval sets the time between two checks of WaitReady, 1 second
+// by default.
+func WithPollInterval(d time.Duration) ReadyOption {
+	return func(o *readyOptions) {
+		o.pollInterval = d
+	}
+}
+
+// WithMaxLag also requires the projection lag, as reported by lag, to be at
+// most max. The lag is typically the time since the oldest unprojected event.
+func WithMaxLag(max time.Duration, lag func(context.Context) (time.Duration, error)) ReadyOption {
+	return func(o *readyOptions) {
+		o.maxLag = max
+		o.lag = lag
+	}
+}
+
+// Ready checks once if the read model is ready: the table must exist with all
+// the columns mapped by the entity and the configured extra columns, with the
+// type, NOT NULL constraint and collation of the pg struct tags (see
+// EnsureTable), with the valid indexes of Config.Indexes and with the foreign
+// keys of Config.ForeignKeys, i.e. the schema migrations must be applied, and
+// the projection lag must be under the threshold given with WithMaxLag. The
+// returned error is a ErrNotReady explaining why the read model is not ready.
+func (r *Repo) Ready(ctx context.Context, opts ...ReadyOption) error {
+	var o readyOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return r.ready(ctx, o)
+}
+
+// WaitReady blocks until the read model is ready, as checked by Ready, or the
+// context is done. It can be used to gate traffic on read model readiness in
+// deployments.
+func (r *Repo) WaitReady(ctx context.Context, opts ...ReadyOption) error {
+	o := readyOptions{pollInterval: time.Second}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	ticker := time.NewTicker(o.pollInterval)
+	defer ticker.Stop()
+
+	for {
+		err := r.ready(ctx, o)
+		if err == nil {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%w (%v)", err, ctx.Err())
+		case <-ticker.C:
+		}
+	}
+}
+
+func (r *Repo) ready(ctx context.Context, o readyOptions) error {
+	var columns []tableColumn
+	if err := r.client.SelectContext(ctx, &columns,
+		"SELECT attname AS name, format_type(atttypid, atttypmod) AS type, "+
+			"attnotnull AS not_null, COALESCE((SELECT collname FROM pg_collation "+
+			"WHERE oid = attcollation), '') AS collation FROM pg_attribute "+
+			"WHERE attrelid = to_regclass($1) AND attnum > 0 AND NOT attisdropped",
+		r.config.TableName); err != nil {
+		return fmt.Errorf("%w: %v", ErrNotReady, err)
+	}
+	if len(columns) == 0 {
+		return fmt.Errorf("%w: table %s does not exist", ErrNotReady, r.config.TableName)
+	}
+	names := make([]string, len(columns))
+	for i, c := range columns {
+		names[i] = c.Name
+	}
+	if missing := missingColumns(names, r.requiredColumns()); len(missing) > 0 {
+		return fmt.Errorf("%w: table %s is missing columns %v",
+			ErrNotReady, r.config.TableName, missing)
+	}
+	if r.factoryFn != nil {
+		tags, err := columnTags(r.mapper, r.factoryFn())
+		if err != nil {
+			return fmt.Errorf("%w: %v", ErrNotReady, err)
+		}
+		if mismatched := mismatchedColumns(columns, tags); len(mismatched) > 0 {
+			return fmt.Errorf("%w: table %s has mismatched columns %v",
+				ErrNotReady, r.config.TableName, mismatched)
+		}
+	}
+
+	if len(r.indexes()) > 0 {
+		// Invalid indexes, left by failed concurrent builds, aren't used.
+		var indexes []string
+		if err := r.client.SelectContext(ctx, &indexes,
+			"SELECT c.relname FROM pg_index i JOIN pg_class c ON c.oid = i.indexrelid "+
+				"WHERE i.indrelid = to_regclass($1) AND i.indisvalid",
+			r.config.TableName); err != nil {
+			return fmt.Errorf("%w: %v", ErrNotReady, err)
+		}
+		if missing := missingColumns(indexes, r.requiredIndexes()); len(missing) > 0 {
+			return fmt.Errorf("%w: table %s is missing indexes %v",
+				ErrNotReady, r.config.TableName, missing)
+		}
+	}
+
+	if len(r.config.ForeignKeys) > 0 {
+		foreignKeys, err := r.foreignKeys(ctx, r.client)
+		if err != nil {
+			return fmt.Errorf("%w: %v", ErrNotReady, err)
+		}
+		if missing := missingColumns(foreignKeys, r.requiredForeignKeys()); len(missing) > 0 {
+			return fmt.Errorf("%w: table %s is missing foreign keys %v",
+				ErrNotReady, r.config.TableName, missing)
+		}
+	}
+
+	if o.lag != nil {
+		lag, err := o.lag(ctx)
+		if err != nil {
+			return fmt.Errorf("%w: %v", ErrNotReady, err)
+		}
+		if lag > o.maxLag {
+			return fmt.Errorf("%w: projection lag %s is over %s", ErrNotReady, lag, o.maxLag)
+		}
+	}
+
+	return nil
+}
+
+// requiredColumns returns the columns the repo reads and writes.
+func (r *Repo) requiredColumns() []string {
+	var required []string
+	if r.factoryFn != nil {
+		required = entityColumns(r.mapper, r.factoryFn())
+	}
+	for _, c := range r.upsertSpec().computed {
+		required = append(required, c.Name)
+	}
+	if c := r.config.Search; c != nil {
+		required = append(required, c.Column)
+	}
+	required = append(required, r.generatedColumns()...)
+	return required
+}
+
+// missingColumns returns the required columns that are not in columns, sorted.
+func missingColumns(columns, required []string) []string {
+	exists := make(map[string]bool, len(columns))
+	for _, c := range columns {
+		exists[c] = true
+	}
+	var missing []string
+	for _, c := range required {
+		if !exists[c] {
+			missing = append(missing, c)
+		}
+	}
+	sort.Strings(missing)
+	return missing
+}
+
+// tableColumn is a column of the table, as defined in the database.
+type tableColumn struct {
+	Name      string `db:"name"`
+	Type      string `db:"type"`
+	NotNull   bool   `db:"not_null"`
+	Collation string `db:"collation"`
+}
+
+// mismatchedColumns describes the columns that don't have the type, the NOT
+// NULL constraint or the collation of their pg tag, sorted.
+func mismatchedColumns(columns []tableColumn, tags map[string]columnTag) []string {
+	var mismatched []string
+	for _, c := range columns {
+		tag, ok := tags[c.Name]
+		if !ok {
+			continue
+		}
+		if tag.Type != "" && normalizeType(tag.Type) != normalizeType(c.Type) {
+			mismatched = append(mismatched,
+				fmt.Sprintf("%s: %s is not %s", c.Name, c.Type, tag.Type))
+		}
+		if tag.NotNull && !c.NotNull {
+			mismatched = append(mismatched, c.Name+": nullable")
+		}
+		if tag.Collation != "" && tag.Collation != c.Collation {
+			mismatched = append(mismatched,
+				fmt.Sprintf("%s: collation %s is not %s", c.Name, c.Collation, tag.Collation))
+		}
+	}
+	sort.Strings(mismatched)
+	return mismatched
+}
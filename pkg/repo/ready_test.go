@@ -0,0 +1,82 @@
+package repo
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	eh "github.com/looplab/eventhorizon"
+
+	"github.com/eendLabs/eh-pg/pkg/mocks"
+)
+
+func TestRequiredColumns(t *testing.T) {
+	db, err := sqlx.Open("postgres", "")
+	if err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	r, err := NewRepoWithClient(&Config{
+		TableName:      "models",
+		ChecksumColumn: "checksum",
+	}, db)
+	if err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	r.SetEntityFactory(func() eh.Entity { return &mocks.Model{} })
+
+	missing := missingColumns(
+		[]string{"id", "version", "content", "created_at", "extra"},
+		r.requiredColumns())
+	if len(missing) != 1 || missing[0] != "checksum" {
+		t.Error("the missing columns should be correct:", missing)
+	}
+}
+
+func TestMismatchedColumns(t *testing.T) {
+	tags, err := columnTags(defaultMapper, &pricedModel{})
+	if err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+
+	columns := []tableColumn{
+		{Name: "id", Type: "uuid", NotNull: true},
+		{Name: "price", Type: "numeric(12,2)", NotNull: true},
+		{Name: "name", Type: "text", NotNull: true},
+		{Name: "comment", Type: "character varying(20)"},
+	}
+	if mismatched := mismatchedColumns(columns, tags); len(mismatched) != 0 {
+		t.Error("there should be no mismatched columns:", mismatched)
+	}
+
+	columns[1] = tableColumn{Name: "price", Type: "numeric(10,2)"}
+	columns[2] = tableColumn{Name: "name", Type: "text"}
+	expected := []string{
+		"name: nullable",
+		"price: nullable",
+		"price: numeric(10,2) is not numeric(12,2)",
+	}
+	if mismatched := mismatchedColumns(columns, tags); !reflect.DeepEqual(mismatched, expected) {
+		t.Error("the mismatched columns should be correct:", mismatched)
+	}
+}
+
+func TestWaitReadyTimeout(t *testing.T) {
+	db, err := sqlx.Open("postgres", "host=127.0.0.1 port=1 connect_timeout=1")
+	if err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	r, err := NewRepoWithClient(&Config{TableName: "models"}, db)
+	if err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err = r.WaitReady(ctx, WithPollInterval(10*time.Millisecond))
+	if !errors.Is(err, ErrNotReady) {
+		t.Error("there should be a ErrNotReady error:", err)
+	}
+}
@@ -0,0 +1,72 @@
+package repo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	eh "github.com/looplab/eventhorizon"
+)
+
+// RemoveWithFilter removes the entities matching the filter and returns the
+// number of removed entities, using the same expression and positional args as
+// FindWithFilter:
+//
+//	r.RemoveWithFilter(ctx, "tenant_id = $1", tenantID)
+//
+// An empty expression is not allowed, use Clear to remove all entities. With
+// soft delete the entities are only marked as deleted, unless the context is
+// from WithHardDelete. Entities in the cold table of Tiering are not removed.
+func (r *Repo) RemoveWithFilter(ctx context.Context, expr string,
+	args ...interface{}) (int64, error) {
+	if expr == "" {
+		return 0, eh.RepoError{
+			Err:       eh.ErrCouldNotRemoveEntity,
+			BaseErr:   errors.New("empty filter"),
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	}
+
+	query := fmt.Sprintf("DELETE FROM %s WHERE %s", r.config.TableName, expr)
+	if c := r.config.SoftDelete; c != nil && !hardDeleteFromContext(ctx) {
+		query = fmt.Sprintf("UPDATE %[1]s SET %[2]s = now() WHERE %[2]s IS NULL AND (%[3]s)",
+			r.config.TableName, c.Column, expr)
+	}
+
+	affected, err := r.execAffected(ctx, eh.ErrCouldNotRemoveEntity, query, args...)
+	if err != nil {
+		return 0, err
+	}
+	r.autoAnalyze(ctx, r.config.TableName)
+
+	return affected, nil
+}
+
+// execAffected runs a write query with the settings of the context, see
+// inSettings, and returns the number of affected rows. Errors of the query are
+// returned as a eh.RepoError of errKind, or as is if errKind is nil.
+func (r *Repo) execAffected(ctx context.Context, errKind error, query string,
+	args ...interface{}) (int64, error) {
+	var affected int64
+	err := r.inSettings(ctx, func(ctx context.Context) error {
+		ex, release, err := r.conn(ctx, true)
+		if err != nil {
+			return err
+		}
+		defer release()
+
+		res, err := ex.ExecContext(ctx, query, args...)
+		if err == nil {
+			affected, err = res.RowsAffected()
+		}
+		if err != nil && errKind != nil {
+			return eh.RepoError{
+				Err:       errKind,
+				BaseErr:   err,
+				Namespace: eh.NamespaceFromContext(ctx),
+			}
+		}
+		return err
+	})
+	return affected, err
+}
@@ -0,0 +1,25 @@
+package repo
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/jmoiron/sqlx"
+	eh "github.com/looplab/eventhorizon"
+)
+
+func TestRemoveWithFilterEmpty(t *testing.T) {
+	db, err := sqlx.Open("postgres", "")
+	if err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	r, err := NewRepoWithClient(&Config{TableName: "models"}, db)
+	if err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+
+	if _, err := r.RemoveWithFilter(context.Background(), ""); !errors.Is(err, eh.ErrCouldNotRemoveEntity) {
+		t.Error("there should be a ErrCouldNotRemoveEntity error:", err)
+	}
+}
@@ -3,20 +3,22 @@ package repo
 import (
 	"context"
 	"database/sql"
-	"encoding/json"
 	"errors"
 	"fmt"
 	"log"
 	"os"
 	"reflect"
+	"regexp"
 	"strconv"
-	"strings"
+	"sync"
 
 	"github.com/google/uuid"
 	"github.com/jmoiron/sqlx"
 	"github.com/jmoiron/sqlx/reflectx"
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 	eh "github.com/looplab/eventhorizon"
+
+	"github.com/eendLabs/eh-pg/pkg/worker"
 )
 
 var ErrCouldNotDialDB = errors.New("could not dial database")
@@ -24,11 +26,27 @@ var ErrCouldNotDialDB = errors.New("could not dial database")
 // ErrCouldNotClearDB is when the database could not be cleared.
 var ErrCouldNotClearDB = errors.New("could not clear database")
 
+// ErrClearNotConfirmed is when a guarded Clear was not confirmed.
+var ErrClearNotConfirmed = errors.New("clear not confirmed")
+
 var ErrNoDBClient = errors.New("no database client")
 
 // ErrModelNotSet is when an model factory is not set on the Repo.
 var ErrModelNotSet = errors.New("model not set")
 
+// ErrInvalidColumn is when a column name is not valid.
+var ErrInvalidColumn = errors.New("invalid column")
+
+// ErrInvalidTable is when a table name is not valid.
+var ErrInvalidTable = errors.New("invalid table")
+
+var identifierRe = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// validIdentifier reports if s can safely be used as an unquoted identifier.
+func validIdentifier(s string) bool {
+	return identifierRe.MatchString(s)
+}
+
 type DBConfig struct {
 	Host     string `json:"POSTGRES_HOST,omitempty"`
 	Port     int    `json:"POSTGRES_PORT,omitempty"`
@@ -50,11 +68,119 @@ func (d DBConfig) GetConnString() string {
 
 type Config struct {
 	TableName string
-	dbName    func(ctx context.Context) string
-	DbConfig  *DBConfig
+	// ReadFrom is optionally a view or table the entities are read from
+	// instead of TableName, which is still written to. It allows serving
+	// projections composed from several tables. Locked finds and the columns
+	// maintained by the repo, like the search, heartbeat and checksum
+	// columns, still use TableName.
+	ReadFrom string
+	// MaterializedView optionally makes the entities read from a materialized
+	// view, refreshed with Refresh. It excludes ReadFrom.
+	MaterializedView *MaterializedView
+	dbName           func(ctx context.Context) string
+	DbConfig         *DBConfig
+	// Driver is the driver NewRepo connects with, DriverPQ by default.
+	Driver Driver
+	// Context is the root context of the background workers, cancelling it
+	// stops them. context.Background() by default.
+	Context context.Context
+	// Retention optionally deletes old rows in the background.
+	Retention *RetentionPolicy
+	// ClearGuard optionally requires Clear to be confirmed.
+	ClearGuard *ClearGuard
+	// Tiering optionally moves rarely read entities to a cold table.
+	Tiering *TieringPolicy
+	// Pool optionally configures the connection pool.
+	Pool *PoolConfig
+	// KeyColumns are optionally the columns of the logical identity of the
+	// entities, with a unique constraint, used as the conflict target of Save
+	// and by FindByKey. "id" by default.
+	KeyColumns []string
+	// NameMapper maps the entity fields without a db tag to columns, for
+	// Save, EnsureTable, the filters and the scanning of rows. SnakeCase by
+	// default.
+	NameMapper NameMapper
+	// Partition optionally partitions the table by a column.
+	Partition *PartitionConfig
+	// NamespaceSchemas optionally maps the namespaces to schemas.
+	NamespaceSchemas *NamespaceSchemaConfig
+	// RowSecurity optionally isolates the tenants with row-level security.
+	RowSecurity *RowSecurityConfig
+	// Indexes are the indexes the queries of the projection need, created by
+	// EnsureTable and checked by Ready.
+	Indexes []IndexConfig
+	// ForeignKeys are the references to the tables of other read models,
+	// created by EnsureTable and checked by Ready.
+	ForeignKeys []ForeignKey
+	// JSONFields are the fields in JSONB columns to create expression indexes
+	// for with EnsureJSONIndexes.
+	JSONFields []JSONField
+	// Expiration optionally makes the entities expire.
+	Expiration *ExpirationConfig
+	// SoftDelete optionally makes Remove mark the entities as deleted.
+	SoftDelete *SoftDeleteConfig
+	// InsertOnlyColumns are optionally columns written when an entity is
+	// inserted but never overwritten by Save, like created_at.
+	InsertOnlyColumns []string
+	// VersionColumn is the column of the version of entities implementing
+	// eh.Versionable, used for optimistic concurrency by Save. "version" by
+	// default.
+	VersionColumn string
+	// Returning makes Save write the saved row back into the entity, so
+	// defaults, sequences, triggers and generated columns populated by
+	// Postgres are reflected in memory.
+	Returning bool
+	// Templates optionally overrides the SQL used by Find, Save and Remove.
+	Templates *Templates
+	// ComputedColumns are derived columns written on every Save.
+	ComputedColumns []ComputedColumn
+	// GeneratedColumns are columns Postgres extracts from the fields of JSONB
+	// columns.
+	GeneratedColumns []GeneratedColumn
+	// Heartbeat optionally stamps rows with the writing projector.
+	Heartbeat *HeartbeatConfig
+	// ChecksumColumn optionally stores the Checksum of the entity on Save,
+	// for cheap change detection with Checksums.
+	ChecksumColumn string
+	// SkipUnchanged makes Save skip the update of rows with the same
+	// checksum, avoiding dead tuples and trigger firing when projectors
+	// replay idempotent events. It requires ChecksumColumn.
+	SkipUnchanged bool
+	// Audit optionally sets audit timestamps on Save.
+	Audit *AuditConfig
+	// History optionally keeps every version of the entities.
+	History *HistoryConfig
+	// Idempotency optionally makes Save a no-op for reprocessed events, see
+	// WithIdempotencyKey.
+	Idempotency *IdempotencyConfig
+	// TypeColumn is the type discriminator column of repos storing several
+	// entity types, see RegisterEntityType.
+	TypeColumn string
+	// OnConflict is how Save handles entities that already exist,
+	// ConflictUpsert by default.
+	OnConflict ConflictStrategy
+	// Search optionally enables full-text search.
+	Search *SearchConfig
+	// LastWrite optionally records the last successful Save.
+	LastWrite *LastWriteConfig
+	// Explain optionally receives the query plans of all find queries, see
+	// WithExplain.
+	Explain PlanFunc
+	// IterFetchSize is the number of rows fetched at a time by FindAllIter,
+	// 1000 by default.
+	IterFetchSize int
+	// Middleware optionally intercepts Find, FindAll, Save, Remove, SaveAll,
+	// SaveIfVersion and Clear, the first one being the outermost.
+	Middleware []Middleware
+	// AutoAnalyze runs ANALYZE on the table after bulk operations like
+	// SaveMixed, Clear, MoveCold and SwapTo.
+	AutoAnalyze bool
 }
 
 func (c *Config) provideDefaults() {
+	if c.Driver == "" {
+		c.Driver = DriverPQ
+	}
 	c.DbConfig = &DBConfig{}
 	if c.DbConfig.Host == "" {
 		if host := os.Getenv("POSTGRES_HOST"); host == "" {
@@ -100,16 +226,34 @@ func (c *Config) provideDefaults() {
 	}
 }
 
+// Repo implements an eventhorizon.ReadWriteRepo backed by a Postgres table.
+// All statements run with the context of the call, cancelling it cancels the
+// running statement on the server and not only the client call.
 type Repo struct {
-	client    *sqlx.DB
+	client *sqlx.DB
+	// unsafe is set when the client ignores the columns not mapped by the
+	// entity, see NewRepoWithClient.
+	unsafe    bool
 	config    *Config
 	factoryFn func() eh.Entity
+	mapper    *reflectx.Mapper
+	pool      *pool
+	named     namedQueries
+	exec      QueryFunc
+	types     map[string]func() eh.Entity
+	typeNames map[reflect.Type]string
+	// partitions are the names of the range partitions known to exist.
+	partitions sync.Map
+
+	retention *worker.Worker
+	refresh   *worker.Worker
+	janitor   *worker.Worker
 }
 
 func NewRepo(config *Config) (*Repo, error) {
 	config.provideDefaults()
 
-	client, err := sqlx.Connect("postgres",
+	client, err := sqlx.Connect(string(config.Driver),
 		config.DbConfig.GetConnString())
 	if err != nil {
 		return nil, eh.RepoError{
@@ -126,25 +270,292 @@ func NewRepoWithClient(config *Config, client *sqlx.DB) (*Repo, error) {
 		return nil, ErrNoDBClient
 	}
 
+	if config.NameMapper == nil {
+		config.NameMapper = SnakeCase
+	}
 	r := &Repo{
-		client: client,
 		config: config,
+		mapper: newMapper(config.NameMapper),
 	}
+	// A handle of its own, to scan the rows with the mapper of the repo
+	// without changing the one of the client.
+	r.client = sqlx.NewDb(client.DB, client.DriverName())
+	r.client.Mapper = r.mapper
+	r.exec = chain(config.Middleware, r.do)
 
 	r.config.dbName = func(ctx context.Context) string {
 		ns := eh.NamespaceFromContext(ctx)
 		return r.config.TableName + "_" + ns
 	}
 
+	if config.Templates == nil {
+		config.Templates = &Templates{}
+	}
+	config.Templates.provideDefaults()
+	if err := config.Templates.validate(); err != nil {
+		return nil, err
+	}
+
+	for _, c := range config.ComputedColumns {
+		if err := c.validate(); err != nil {
+			return nil, err
+		}
+	}
+
+	if c := config.Heartbeat; c != nil {
+		c.provideDefaults()
+		if err := c.validate(); err != nil {
+			return nil, err
+		}
+	}
+
+	if c := config.Search; c != nil {
+		c.provideDefaults()
+		if err := c.validate(); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, c := range config.KeyColumns {
+		if !validIdentifier(c) {
+			return nil, fmt.Errorf("%w: key column %q", ErrInvalidColumn, c)
+		}
+	}
+
+	if c := config.NamespaceSchemas; c != nil {
+		c.provideDefaults()
+		if err := c.validate(config.TableName); err != nil {
+			return nil, err
+		}
+	}
+
+	if c := config.RowSecurity; c != nil {
+		c.provideDefaults()
+		if err := c.validate(); err != nil {
+			return nil, err
+		}
+	}
+
+	if c := config.Partition; c != nil {
+		c.provideDefaults()
+		if err := c.validate(config.KeyColumns); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, c := range config.GeneratedColumns {
+		if err := c.validate(); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, c := range r.indexes() {
+		if err := c.validate(config.TableName); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, c := range config.ForeignKeys {
+		if err := c.validate(config.TableName); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, f := range config.JSONFields {
+		if err := f.validate(); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, c := range config.InsertOnlyColumns {
+		if !validIdentifier(c) {
+			return nil, fmt.Errorf("%w: insert only column %q", ErrInvalidColumn, c)
+		}
+	}
+
+	if c := config.Expiration; c != nil {
+		c.provideDefaults()
+		if err := c.validate(); err != nil {
+			return nil, err
+		}
+	}
+
+	if c := config.SoftDelete; c != nil {
+		c.provideDefaults()
+		if err := c.validate(); err != nil {
+			return nil, err
+		}
+	}
+
+	if c := config.VersionColumn; c != "" && !validIdentifier(c) {
+		return nil, fmt.Errorf("%w: version column %q", ErrInvalidColumn, c)
+	}
+
+	if t := config.ReadFrom; t != "" && !validTableName(t) {
+		return nil, fmt.Errorf("%w: read from %q", ErrInvalidTable, t)
+	}
+
+	if v := config.MaterializedView; v != nil {
+		if err := v.validate(); err != nil {
+			return nil, err
+		}
+		if config.ReadFrom != "" {
+			return nil, fmt.Errorf("%w: excludes ReadFrom", ErrInvalidMaterializedView)
+		}
+	}
+
+	if c := config.LastWrite; c != nil {
+		c.provideDefaults()
+		if err := c.validate(); err != nil {
+			return nil, err
+		}
+	}
+
+	if c := config.Idempotency; c != nil {
+		c.provideDefaults()
+		if err := c.validate(); err != nil {
+			return nil, err
+		}
+	}
+
+	if c := config.History; c != nil {
+		c.provideDefaults(config.TableName)
+		if err := c.validate(); err != nil {
+			return nil, err
+		}
+	}
+
+	if c := config.Audit; c != nil {
+		c.provideDefaults()
+		if err := c.validate(); err != nil {
+			return nil, err
+		}
+	}
+
+	if c := config.ChecksumColumn; c != "" && !validIdentifier(c) {
+		return nil, fmt.Errorf("%w: checksum column %q", ErrInvalidColumn, c)
+	}
+	if config.SkipUnchanged && config.ChecksumColumn == "" {
+		return nil, fmt.Errorf("%w: skip unchanged requires a checksum column",
+			ErrInvalidColumn)
+	}
+	if c := config.TypeColumn; c != "" && !validIdentifier(c) {
+		return nil, fmt.Errorf("%w: type column %q", ErrInvalidColumn, c)
+	}
+	if err := config.OnConflict.validate(); err != nil {
+		return nil, err
+	}
+
+	// Computed, generated, heartbeat, checksum, search, soft delete and
+	// expiration columns are not mapped by the entity, ignore them when
+	// scanning rows, also for the whole rows returned by Save and the history
+	// rows.
+	if len(r.upsertSpec().computed) > 0 || len(config.GeneratedColumns) > 0 ||
+		config.Search != nil ||
+		config.SoftDelete != nil || config.Expiration != nil ||
+		config.Returning || config.History != nil {
+		r.client = r.client.Unsafe()
+		r.unsafe = true
+	}
+
+	if p := config.Tiering; p != nil {
+		p.provideDefaults(config.TableName)
+	}
+
+	if p := config.Pool; p != nil {
+		p.provideDefaults()
+		if err := p.validate(); err != nil {
+			return nil, err
+		}
+		if p.MaxOpenConns > 0 {
+			client.SetMaxOpenConns(p.MaxOpenConns)
+		}
+		if p.MaxIdleConns > 0 {
+			client.SetMaxIdleConns(p.MaxIdleConns)
+		}
+		if p.ConnMaxLifetime > 0 {
+			client.SetConnMaxLifetime(p.ConnMaxLifetime)
+		}
+		r.pool = newPool(p)
+	}
+
+	if p := config.Retention; p != nil {
+		p.provideDefaults()
+		if err := p.validate(); err != nil {
+			return nil, err
+		}
+		ctx := config.Context
+		if ctx == nil {
+			ctx = context.Background()
+		}
+		r.retention = worker.Start(ctx, "retention on "+config.TableName,
+			p.Interval, func(ctx context.Context) error {
+				_, err := r.EnforceRetention(ctx)
+				return err
+			})
+	}
+
+	if c := config.Expiration; c != nil && c.Interval > 0 {
+		ctx := config.Context
+		if ctx == nil {
+			ctx = context.Background()
+		}
+		r.janitor = worker.Start(ctx, "expiration on "+config.TableName,
+			c.Interval, func(ctx context.Context) error {
+				_, err := r.DeleteExpired(ctx)
+				return err
+			})
+	}
+
+	if v := config.MaterializedView; v != nil && v.RefreshInterval > 0 {
+		ctx := config.Context
+		if ctx == nil {
+			ctx = context.Background()
+		}
+		r.refresh = worker.Start(ctx, "refresh of "+v.Name,
+			v.RefreshInterval, func(ctx context.Context) error {
+				return r.Refresh(ctx, v.Concurrently)
+			})
+	}
+
 	return r, nil
 }
 
+// versionColumn returns the version column of versioned entities.
+func (r *Repo) versionColumn() string {
+	if r.config.VersionColumn != "" {
+		return r.config.VersionColumn
+	}
+	return "version"
+}
+
+// readTable returns the table or view the entities are read from.
+// Soft-deleted rows are excluded.
+func (r *Repo) readTable() string {
+	if v := r.config.MaterializedView; v != nil {
+		return r.liveRows(v.Name)
+	}
+	if r.config.ReadFrom != "" {
+		return r.liveRows(r.config.ReadFrom)
+	}
+	return r.liveRows(r.config.TableName)
+}
+
 // Parent implements the Parent method of the eventhorizon.ReadRepo interface.
 func (r *Repo) Parent() eh.ReadRepo {
 	return nil
 }
 
+// Find implements the Find method of the eventhorizon.ReadRepo interface.
 func (r *Repo) Find(ctx context.Context, id uuid.UUID) (eh.Entity, error) {
+	op := &Operation{Kind: OpFind, Table: r.config.TableName, ID: id}
+	if err := r.exec(ctx, op); err != nil {
+		return nil, err
+	}
+	return op.Entity, nil
+}
+
+func (r *Repo) find(ctx context.Context, id uuid.UUID) (eh.Entity, error) {
 	ns := eh.NamespaceFromContext(ctx)
 
 	if r.factoryFn == nil {
@@ -153,13 +564,43 @@ func (r *Repo) Find(ctx context.Context, id uuid.UUID) (eh.Entity, error) {
 			Namespace: ns,
 		}
 	}
-	entity := r.factoryFn()
-	query := fmt.Sprintf("SELECT * FROM %s WHERE id=$1",
-		r.config.TableName)
-	fmt.Println(query)
-	fmt.Println("id", id.String())
-	err := r.client.GetContext(ctx, entity,
-		query, id.String())
+
+	table := r.readTable()
+	mode := lockFromContext(ctx)
+	if mode != "" {
+		table = r.liveRows(r.config.TableName)
+	}
+	query := render(r.config.Templates.Find, map[string]string{
+		"table": table,
+	})
+	if mode != "" {
+		if r.txFromContext(ctx) == nil {
+			return nil, eh.RepoError{
+				Err:       ErrNoTransaction,
+				Namespace: ns,
+			}
+		}
+		var err error
+		if query, err = lockQuery(query, mode); err != nil {
+			return nil, eh.RepoError{
+				Err:       eh.ErrCouldNotLoadEntity,
+				BaseErr:   err,
+				Namespace: ns,
+			}
+		}
+	}
+	q, release, err := r.conn(ctx, false)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	entity, err := r.get(ctx, q, query, id.String())
+	if errors.Is(err, sql.ErrNoRows) && r.config.Tiering != nil {
+		entity, err = r.findCold(ctx, q, id)
+	}
+	if errors.Is(err, sql.ErrNoRows) {
+		err = &NotFoundError{ID: id, Table: r.config.TableName}
+	}
 	if err != nil {
 		return nil, eh.RepoError{
 			Err:       eh.ErrEntityNotFound,
@@ -167,62 +608,149 @@ func (r *Repo) Find(ctx context.Context, id uuid.UUID) (eh.Entity, error) {
 			Namespace: eh.NamespaceFromContext(ctx),
 		}
 	}
+	if r.config.Tiering != nil {
+		r.sampleAccess(ctx, id)
+	}
 
 	return entity, nil
 }
 
+// FindByIDs returns the entities with the given IDs in one query. Missing IDs
+// are skipped, the order of the result is not defined.
+func (r *Repo) FindByIDs(ctx context.Context, ids []uuid.UUID) ([]eh.Entity, error) {
+	if r.factoryFn == nil {
+		return nil, eh.RepoError{
+			Err:       ErrModelNotSet,
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	}
+
+	strs := make([]string, len(ids))
+	for i, id := range ids {
+		strs[i] = id.String()
+	}
+
+	return r.query(ctx,
+		fmt.Sprintf("SELECT * FROM %s WHERE id = ANY($1::uuid[])",
+			r.readTable()), pq.Array(strs))
+}
+
 // FindAll implements the FindAll method of the eventhorizon.ReadRepo interface.
+// Use FindWithFilter with an empty expression to page through all entities.
 func (r *Repo) FindAll(ctx context.Context) ([]eh.Entity, error) {
-	ns := eh.NamespaceFromContext(ctx)
+	op := &Operation{Kind: OpFindAll, Table: r.config.TableName}
+	if err := r.exec(ctx, op); err != nil {
+		return nil, err
+	}
+	return op.Entities, nil
+}
 
+func (r *Repo) findAll(ctx context.Context) ([]eh.Entity, error) {
 	if r.factoryFn == nil {
 		return nil, eh.RepoError{
 			Err:       ErrModelNotSet,
-			Namespace: ns,
+			Namespace: eh.NamespaceFromContext(ctx),
 		}
 	}
-	var result []eh.Entity
-	entity := r.factoryFn()
 
-	rows, err := r.client.
-		QueryxContext(ctx,
-			fmt.Sprintf("SELECT * FROM %s", r.config.TableName))
+	return r.query(ctx,
+		fmt.Sprintf("SELECT * FROM %s", r.readTable()))
+}
 
-	if rows != nil {
-		for rows.Next() {
-			if err := rows.StructScan(entity); err != nil {
-				return nil, err
-			}
-			result = append(result, entity)
-			entity = r.factoryFn()
+// FindWithFilter allows to find entities with a filter. The expression is
+// used as the WHERE clause of the query and may use positional parameters
+// ($1, $2, ...) bound to args, e.g:
+//
+//	r.FindWithFilter(ctx, "content = $1 AND version > $2", "foo", 2)
+//
+// An empty expression matches all entities. QueryOptions can be passed among
+// the args, e.g. to paginate the result:
+//
+//	r.FindWithFilter(ctx, "", WithLimit(10), WithOffset(20))
+func (r *Repo) FindWithFilter(ctx context.Context, expr string,
+	args ...interface{}) ([]eh.Entity, error) {
+	if r.factoryFn == nil {
+		return nil, eh.RepoError{
+			Err:       ErrModelNotSet,
+			Namespace: eh.NamespaceFromContext(ctx),
 		}
 	}
 
-	if err != nil {
+	args, opts := splitQueryOptions(args)
+	if err := opts.validate(r.mapper, r.factoryFn()); err != nil {
 		return nil, eh.RepoError{
-			Err:       eh.ErrEntityNotFound,
+			Err:       eh.ErrCouldNotLoadEntity,
 			BaseErr:   err,
-			Namespace: ns,
+			Namespace: eh.NamespaceFromContext(ctx),
 		}
 	}
+	query := opts.selectFrom(r.readTable())
+	if expr != "" {
+		query += " WHERE " + expr
+	}
+	query, args = opts.apply(query, args)
 
-	return result, nil
+	return r.query(ctx, query, args...)
 }
 
-// FindWithFilter allows to find entities with a filter
-func (r *Repo) FindWithFilter(ctx context.Context, expr string,
+// query runs a query and scans all rows into entities created by the factory.
+func (r *Repo) query(ctx context.Context, query string,
 	args ...interface{}) ([]eh.Entity, error) {
-	if r.factoryFn == nil {
+	q, release, err := r.conn(ctx, false)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	r.explain(ctx, q, query, args...)
+	rows, err := q.QueryxContext(ctx, query, args...)
+	if err != nil {
 		return nil, eh.RepoError{
-			Err:       ErrModelNotSet,
+			Err:       eh.ErrCouldNotLoadEntity,
+			BaseErr:   err,
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	}
+
+	return r.scan(ctx, rows)
+}
+
+// scan scans all rows into entities created by the factory and closes them.
+func (r *Repo) scan(ctx context.Context, rows *sqlx.Rows) ([]eh.Entity, error) {
+	defer rows.Close()
+
+	var result []eh.Entity
+	for rows.Next() {
+		entity, err := r.scanRow(rows)
+		if err != nil {
+			return nil, eh.RepoError{
+				Err:       eh.ErrCouldNotLoadEntity,
+				BaseErr:   err,
+				Namespace: eh.NamespaceFromContext(ctx),
+			}
+		}
+		result = append(result, entity)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, eh.RepoError{
+			Err:       eh.ErrCouldNotLoadEntity,
+			BaseErr:   err,
 			Namespace: eh.NamespaceFromContext(ctx),
 		}
 	}
 
-	return nil, nil
+	return result, nil
 }
 
-// FindWithFilterUsingIndex allows to find entities with a filter using an index
+// FindWithFilterUsingIndex allows to find entities with a filter using an
+// index. The partition key is matched by equality and, when a sort key value
+// is given, so is the sort key; results are ordered by the sort key unless
+// WithOrderBy is given. The optional filter query is AND:ed to the index
+// condition and uses its own positional parameters ($1, $2, ...) bound to
+// filterArgs, which may also contain QueryOptions.
+//
+// It expects a btree index on the partition and sort key columns to exist,
+// see EnsureIndex.
 func (r *Repo) FindWithFilterUsingIndex(ctx context.Context,
 	indexInput IndexInput, filterQuery string,
 	filterArgs ...interface{}) ([]eh.Entity, error) {
@@ -233,11 +761,45 @@ func (r *Repo) FindWithFilterUsingIndex(ctx context.Context,
 		}
 	}
 
-	return nil, nil
+	filterArgs, opts := splitQueryOptions(filterArgs)
+	if len(opts.orderBy) == 0 && indexInput.SortKey != "" {
+		opts.orderBy = []orderBy{{column: indexInput.SortKey, direction: Asc}}
+	}
+	where, args, err := indexInput.where(len(filterArgs))
+	if err == nil {
+		err = opts.validate(r.mapper, r.factoryFn())
+	}
+	if err != nil {
+		return nil, eh.RepoError{
+			Err:       eh.ErrCouldNotLoadEntity,
+			BaseErr:   err,
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	}
+	if filterQuery != "" {
+		where += " AND (" + filterQuery + ")"
+	}
+	query := opts.selectFrom(r.readTable()) + " WHERE " + where
+	query, args = opts.apply(query, append(filterArgs, args...))
+
+	return r.query(ctx, query, args...)
 }
 
 // Save implements the Save method of the eventhorizon.WriteRepo interface.
+// Entities implementing eh.Versionable are only saved if the stored version is
+// not newer, otherwise an eh.ErrIncorrectEntityVersion error is returned with a
+// VersionConflictError, preventing lost updates between concurrent writers.
+// With Config.Returning the saved row is scanned back into the entity.
 func (r *Repo) Save(ctx context.Context, entity eh.Entity) error {
+	return r.exec(ctx, &Operation{
+		Kind:   OpSave,
+		Table:  r.config.TableName,
+		ID:     entity.EntityID(),
+		Entity: entity,
+	})
+}
+
+func (r *Repo) save(ctx context.Context, entity eh.Entity) error {
 	if entity.EntityID() == uuid.Nil {
 		return eh.RepoError{
 			Err:       eh.ErrCouldNotSaveEntity,
@@ -246,66 +808,116 @@ func (r *Repo) Save(ctx context.Context, entity eh.Entity) error {
 		}
 	}
 
-	mapper := reflectx.NewMapper("db")
-	fields := mapper.FieldMap(reflect.Indirect(reflect.ValueOf(entity)))
-	var mapFields, excludedFields []string
-	mapValues := make(map[string]interface{})
+	if err := r.ensureRangePartitions(ctx, entity); err != nil {
+		return err
+	}
 
-	for field, v := range fields {
-		mapFields = append(mapFields, field)
+	if key := idempotencyKeyFromContext(ctx); key != "" && r.config.Idempotency != nil {
+		return r.saveOnce(ctx, key, entity)
+	}
 
-		// getting type from reflect.Value
-		vi := v.Interface()
-		switch x := vi.(type) {
-		default:
-			mapValues[field] = x
+	return r.saveEntity(ctx, entity)
+}
+
+// saveEntity saves the entity with the conflict strategy of the repo.
+func (r *Repo) saveEntity(ctx context.Context, entity eh.Entity) error {
+	spec := r.upsertSpec()
+	switch r.config.OnConflict {
+	case ConflictError, ConflictIgnore:
+		spec.absent = true
+	case ConflictUpdateOnly:
+		if err := r.updateOnly(ctx, spec, entity); err != nil {
+			return err
 		}
-		excludedFields = append(excludedFields,
-			fmt.Sprintf("%s = EXCLUDED.%s", field, field))
+		r.recordLastWrite(ctx, entity)
+		return nil
+	}
 
+	ex, release, err := r.conn(ctx, true)
+	if err != nil {
+		return err
 	}
+	defer release()
 
-	joinedFields := strings.Join(mapFields, ", ")
-	joinedFieldsBindVar := ":" + strings.Join(mapFields, ", :")
-	joinedFieldsExcluded := strings.Join(excludedFields, ", ")
-	query := fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s) "+
-		"ON CONFLICT (id) DO UPDATE SET %s;",
-		r.config.TableName, joinedFields, joinedFieldsBindVar,
-		joinedFieldsExcluded)
-	log.Println(query)
-	marshal, _ := json.Marshal(mapValues)
-	log.Println("marshalledValues: %w", string(marshal))
-	fmt.Printf("conn: %s", r.config.DbConfig.GetConnString())
+	if err := r.saveIn(ctx, ex, spec, entity); err != nil {
+		return err
+	}
+	r.recordLastWrite(ctx, entity)
 
-	w, err := r.client.NamedExecContext(ctx, query, mapValues)
-	if err != nil {
-		fmt.Printf("error: %v", err)
+	return nil
+}
+
+// saveIn upserts the entity and checks the result.
+func (r *Repo) saveIn(ctx context.Context, ex sqlx.ExtContext, spec upsertSpec,
+	entity eh.Entity) error {
+	var affected int64
+	var err error
+	if r.config.Returning {
+		affected, err = upsertReturning(ctx, ex, spec, entity)
+	} else {
+		affected, err = upsert(ctx, ex, spec, []eh.Entity{entity})
+	}
+	if err == nil && affected == 0 && spec.absent {
+		if r.config.OnConflict == ConflictIgnore {
+			return nil
+		}
 		return eh.RepoError{
 			Err:       eh.ErrCouldNotSaveEntity,
-			BaseErr:   err,
+			BaseErr:   fmt.Errorf("%w: %s", ErrEntityExists, entity.EntityID()),
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	}
+	if err == nil && affected == 0 && spec.unchanged != "" {
+		// Skipped, either unchanged or older than the stored version.
+		var same bool
+		if same, err = spec.storedUnchanged(ctx, ex, entity); same {
+			return nil
+		}
+	}
+	if err == nil && affected == 0 && spec.versionCheck(entity) {
+		return eh.RepoError{
+			Err: eh.ErrIncorrectEntityVersion,
+			BaseErr: &VersionConflictError{
+				ID:      entity.EntityID(),
+				Version: entity.(eh.Versionable).AggregateVersion(),
+				Table:   r.config.TableName,
+			},
 			Namespace: eh.NamespaceFromContext(ctx),
 		}
 	}
-
-	affected, err := w.RowsAffected()
 	if err != nil || affected != 1 {
-		fmt.Printf("error: %v", err)
 		return eh.RepoError{
 			Err:       eh.ErrCouldNotSaveEntity,
 			BaseErr:   err,
 			Namespace: eh.NamespaceFromContext(ctx),
 		}
 	}
-	fmt.Printf("affected rows: %d", affected)
 
 	return nil
 }
 
 // Remove implements the Remove method of the eventhorizon.WriteRepo interface.
+// With soft delete the entity is only marked as deleted, unless the context
+// is from WithHardDelete.
 func (r *Repo) Remove(ctx context.Context, id uuid.UUID) error {
-	w, err := r.client.ExecContext(ctx,
-		fmt.Sprintf("DELETE FROM %s WHERE id = $1",
-			r.config.TableName), id)
+	return r.exec(ctx, &Operation{Kind: OpRemove, Table: r.config.TableName, ID: id})
+}
+
+func (r *Repo) remove(ctx context.Context, id uuid.UUID) error {
+	if r.config.SoftDelete != nil && !hardDeleteFromContext(ctx) {
+		return r.softRemove(ctx, id)
+	}
+
+	ex, release, err := r.conn(ctx, true)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	w, err := ex.ExecContext(ctx,
+		render(r.config.Templates.Remove, map[string]string{
+			"table": r.config.TableName,
+		}), id)
 	if err != nil {
 		return eh.RepoError{
 			Err:       eh.ErrCouldNotRemoveEntity,
@@ -314,7 +926,21 @@ func (r *Repo) Remove(ctx context.Context, id uuid.UUID) error {
 		}
 	}
 	affected, err := w.RowsAffected()
-	if w != nil && affected != 1 {
+	if err == nil && r.config.Tiering != nil {
+		var cold int64
+		if cold, err = r.removeCold(ctx, ex, id); err != nil {
+			return eh.RepoError{
+				Err:       eh.ErrCouldNotRemoveEntity,
+				BaseErr:   err,
+				Namespace: eh.NamespaceFromContext(ctx),
+			}
+		}
+		affected += cold
+	}
+	if w != nil && affected < 1 {
+		if err == nil {
+			err = &NotFoundError{ID: id, Table: r.config.TableName}
+		}
 		return eh.RepoError{
 			Err:       eh.ErrEntityNotFound,
 			BaseErr:   err,
@@ -339,22 +965,211 @@ type IndexInput struct {
 	SortKeyValue      interface{}
 }
 
-// Clear clears the read model database.
-func (r *Repo) Clear(ctx context.Context) error {
-	tx := r.client.MustBeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelDefault})
-	tx.MustExec(fmt.Sprintf("delete from %s", r.config.TableName))
-	if err := tx.Commit(); err != nil {
+// where builds the index condition, with parameters numbered after offset.
+func (i IndexInput) where(offset int) (string, []interface{}, error) {
+	if !validIdentifier(i.PartitionKey) {
+		return "", nil, fmt.Errorf("%w: partition key %q",
+			ErrInvalidColumn, i.PartitionKey)
+	}
+	if i.SortKey != "" && !validIdentifier(i.SortKey) {
+		return "", nil, fmt.Errorf("%w: sort key %q",
+			ErrInvalidColumn, i.SortKey)
+	}
+
+	where := fmt.Sprintf("%s = $%d", i.PartitionKey, offset+1)
+	args := []interface{}{i.PartitionKeyValue}
+	if i.SortKey != "" && i.SortKeyValue != nil {
+		where += fmt.Sprintf(" AND %s = $%d", i.SortKey, offset+2)
+		args = append(args, i.SortKeyValue)
+	}
+
+	return where, args, nil
+}
+
+// Clear clears the read model database. When the Config has a ClearGuard the
+// call must be confirmed with WithConfirmToken or WithExpectedRowCount. The
+// rows are deleted, unless WithTruncate is given, in the WithTx transaction of
+// the context if any.
+func (r *Repo) Clear(ctx context.Context, opts ...ClearOption) error {
+	op := &Operation{Kind: OpClear, Table: r.config.TableName}
+	return r.run(ctx, op, func(ctx context.Context) error {
+		return r.clear(ctx, opts...)
+	})
+}
+
+func (r *Repo) clear(ctx context.Context, opts ...ClearOption) error {
+	o := clearOptions{expectedRows: -1}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	if g := r.config.ClearGuard; g != nil && o.expectedRows < 0 &&
+		(g.Token == "" || o.token != g.Token) {
 		return eh.RepoError{
 			Err:       ErrCouldNotClearDB,
-			BaseErr:   err,
+			BaseErr:   ErrClearNotConfirmed,
 			Namespace: eh.NamespaceFromContext(ctx),
 		}
 	}
+
+	err := r.writeTx(ctx, func(tx *sqlx.Tx) error {
+		affected, err := r.clearRows(ctx, tx, o)
+		if err != nil {
+			return eh.RepoError{
+				Err:       ErrCouldNotClearDB,
+				BaseErr:   err,
+				Namespace: eh.NamespaceFromContext(ctx),
+			}
+		}
+		if o.expectedRows >= 0 && affected != o.expectedRows {
+			return eh.RepoError{
+				Err: ErrCouldNotClearDB,
+				BaseErr: fmt.Errorf("%w: expected %d rows, found %d",
+					ErrClearNotConfirmed, o.expectedRows, affected),
+				Namespace: eh.NamespaceFromContext(ctx),
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	r.autoAnalyze(ctx, r.config.TableName)
+
 	return nil
 }
 
+// clearRows truncates the table or deletes its rows and returns the number of
+// cleared rows, which is only counted for WithExpectedRowCount.
+func (r *Repo) clearRows(ctx context.Context, tx *sqlx.Tx, o clearOptions) (int64, error) {
+	table := r.config.TableName
+	if o.truncate {
+		var count int64
+		if o.expectedRows >= 0 {
+			// TRUNCATE doesn't report the rows, count them with the table
+			// locked like by TRUNCATE.
+			if _, err := tx.ExecContext(ctx,
+				"LOCK TABLE "+table+" IN ACCESS EXCLUSIVE MODE"); err != nil {
+				return 0, err
+			}
+			if err := tx.GetContext(ctx, &count, "SELECT count(*) FROM "+table); err != nil {
+				return 0, err
+			}
+		}
+
+		if _, err := tx.ExecContext(ctx, "SAVEPOINT eh_truncate"); err != nil {
+			return 0, err
+		}
+		_, err := tx.ExecContext(ctx, o.truncateQuery(table))
+		if err == nil {
+			return count, nil
+		}
+		if errorCode(err) != codeInsufficientPrivilege {
+			return 0, err
+		}
+		log.Printf("eh-pg: could not truncate %s, deleting the rows: %v", table, err)
+		if _, err := tx.ExecContext(ctx, "ROLLBACK TO SAVEPOINT eh_truncate"); err != nil {
+			return 0, err
+		}
+	}
+
+	res, err := tx.ExecContext(ctx, fmt.Sprintf("delete from %s", table))
+	if err != nil {
+		return 0, err
+	}
+	if o.expectedRows < 0 {
+		return 0, nil
+	}
+	return res.RowsAffected()
+}
+
+// ClearGuard is a safety interlock for Clear, preventing accidental wipes of
+// production tables from misconfigured namespaces.
+type ClearGuard struct {
+	// Token is the token to pass with WithConfirmToken. If empty, Clear can
+	// only be confirmed with WithExpectedRowCount.
+	Token string
+}
+
+// ClearOption is an option for Clear.
+type ClearOption func(*clearOptions)
+
+type clearOptions struct {
+	token           string
+	expectedRows    int64
+	truncate        bool
+	cascade         bool
+	restartIdentity bool
+}
+
+// truncateQuery returns the TRUNCATE statement of the table.
+func (o clearOptions) truncateQuery(table string) string {
+	query := "TRUNCATE " + table
+	if o.restartIdentity {
+		query += " RESTART IDENTITY"
+	}
+	if o.cascade {
+		query += " CASCADE"
+	}
+	return query
+}
+
+// WithConfirmToken confirms a guarded Clear with the configured token.
+func WithConfirmToken(token string) ClearOption {
+	return func(o *clearOptions) {
+		o.token = token
+	}
+}
+
+// WithExpectedRowCount confirms a guarded Clear with the number of rows that
+// are expected to be deleted. If the count differs nothing is deleted.
+func WithExpectedRowCount(n int64) ClearOption {
+	return func(o *clearOptions) {
+		o.expectedRows = n
+	}
+}
+
+// WithTruncate clears the table with TRUNCATE instead of deleting the rows,
+// which is much faster for large tables and leaves no dead rows behind, but
+// locks the table against reads until the Clear is done. The rows are still
+// deleted when the role lacks the TRUNCATE privilege.
+func WithTruncate() ClearOption {
+	return func(o *clearOptions) {
+		o.truncate = true
+	}
+}
+
+// WithCascade truncates the tables referencing the table with foreign keys
+// too. It implies WithTruncate and is ignored when the rows are deleted.
+func WithCascade() ClearOption {
+	return func(o *clearOptions) {
+		o.truncate = true
+		o.cascade = true
+	}
+}
+
+// WithRestartIdentity restarts the sequences of the identity and serial
+// columns of the table. It implies WithTruncate and is ignored when the rows
+// are deleted.
+func WithRestartIdentity() ClearOption {
+	return func(o *clearOptions) {
+		o.truncate = true
+		o.restartIdentity = true
+	}
+}
+
 // Close closes a database session.
 func (r *Repo) Close(_ context.Context) {
+	if r.retention != nil {
+		r.retention.Stop()
+	}
+	if r.refresh != nil {
+		r.refresh.Stop()
+	}
+	if r.janitor != nil {
+		r.janitor.Stop()
+	}
+	r.closeNamed()
 	if err := r.client.Close(); err != nil {
 		log.Fatalf("cannot close db %v", err)
 	}
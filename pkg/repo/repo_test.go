@@ -2,11 +2,18 @@ package repo
 
 import (
 	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
 	"github.com/eendLabs/eh-pg/pkg/mocks"
+	"github.com/google/uuid"
 	"github.com/jmoiron/sqlx"
 	eh "github.com/looplab/eventhorizon"
 	ehmocks "github.com/looplab/eventhorizon/mocks"
+	"github.com/shopspring/decimal"
+	"reflect"
 	"testing"
+	"time"
 )
 
 func TestReadRepoIntegration(t *testing.T) {
@@ -17,6 +24,8 @@ func TestReadRepoIntegration(t *testing.T) {
 	config := &Config{}
 	config.provideDefaults()
 	config.TableName = "models"
+	config.LastWrite = &LastWriteConfig{}
+	config.IterFetchSize = 1
 	client, err := sqlx.Connect("postgres",
 		config.DbConfig.GetConnString())
 	if err != nil {
@@ -43,6 +52,10 @@ func TestReadRepoIntegration(t *testing.T) {
 	if r == nil {
 		t.Error("there should be a repository")
 	}
+	client.MustExecContext(ctx, "DROP TABLE IF EXISTS eh_last_writes")
+	if err := r.EnsureLastWrite(ctx); err != nil {
+		t.Fatal("there should be no error:", err)
+	}
 
 	r.SetEntityFactory(func() eh.Entity {
 		return &mocks.Model{} //&mocks.Model{}
@@ -64,13 +77,54 @@ func TestReadRepoIntegration(t *testing.T) {
 	}()
 
 	AcceptanceTest(t, context.Background(), r)
-	//extraRepoTests(t, context.Background(), r)
+	extraRepoTests(t, context.Background(), r)
 	//AcceptanceTest(t, customNamespaceCtx, r)
 	//extraRepoTests(t, customNamespaceCtx, r)
 
+	writes, err := r.LastWrites(ctx)
+	if err != nil {
+		t.Error("there should be no error:", err)
+	}
+	if len(writes) != 1 || writes[0].Table != "models" || writes[0].Time.IsZero() {
+		t.Error("the last write should be recorded:", writes)
+	}
+
+	// In a transaction the last write is only recorded on commit, for Save
+	// and SaveAll alike.
+	for _, save := range []func(context.Context, eh.Entity) error{
+		r.Save,
+		func(ctx context.Context, m eh.Entity) error {
+			return r.SaveAll(ctx, []eh.Entity{m})
+		},
+	} {
+		m := &versionedModel{mocks.Model{ID: uuid.New(), Version: 7, CreatedAt: time.Now().UTC()}}
+		errRollback := errors.New("rollback")
+		if err := WithTx(ctx, client, func(ctx context.Context) error {
+			if err := save(ctx, m); err != nil {
+				return err
+			}
+			return errRollback
+		}); !errors.Is(err, errRollback) {
+			t.Error("there should be a rollback error:", err)
+		}
+		if writes, err := r.LastWrites(ctx); err != nil || len(writes) != 1 || writes[0].Version == 7 {
+			t.Error("the rolled back write should not be recorded:", writes, err)
+		}
+		if err := WithTx(ctx, client, func(ctx context.Context) error {
+			return save(ctx, m)
+		}); err != nil {
+			t.Error("there should be no error:", err)
+		}
+		if writes, err := r.LastWrites(ctx); err != nil || len(writes) != 1 || writes[0].Version != 7 {
+			t.Error("the committed write should be recorded:", writes, err)
+		}
+		if err := r.Remove(ctx, m.ID); err != nil {
+			t.Error("there should be no error:", err)
+		}
+		client.MustExecContext(ctx, "UPDATE eh_last_writes SET version = 0")
+	}
 }
 
-/*
 func extraRepoTests(t *testing.T, ctx context.Context, r *Repo) {
 	// Insert a custom item.
 	modelCustom := &mocks.Model{
@@ -82,106 +136,2690 @@ func extraRepoTests(t *testing.T, ctx context.Context, r *Repo) {
 		t.Error("there should be no error:", err)
 	}
 
+	// FindWithFilter by content.
+	result, err := r.FindWithFilter(ctx, "content = $1", "modelCustom")
+	if err != nil {
+		t.Error("there should be no error:", err)
+	}
+	if len(result) != 1 {
+		t.Error("there should be one item:", len(result))
+	}
+	if len(result) > 0 && result[0].EntityID() != modelCustom.ID {
+		t.Error("the item should be correct:", result[0])
+	}
+
 	// FindCustom by content.
-	result, err := r.FindCustom(ctx, func(ctx context.Context, c *mongo.Collection) (*mongo.Cursor, error) {
-		return c.Find(ctx, bson.M{"content": "modelCustom"})
+	result, err = r.FindCustom(ctx, func(ctx context.Context, db *sqlx.DB) (*sqlx.Rows, error) {
+		return db.QueryxContext(ctx, "SELECT * FROM models WHERE content = $1", "modelCustom")
 	})
+	if err != nil {
+		t.Error("there should be no error:", err)
+	}
 	if len(result) != 1 {
 		t.Error("there should be one item:", len(result))
 	}
-	if !reflect.DeepEqual(result[0], modelCustom) {
-		t.Error("the item should be correct:", modelCustom)
-	}
 
 	// FindCustom with no query.
-	result, err = r.FindCustom(ctx, func(ctx context.Context, c *mongo.Collection) (*mongo.Cursor, error) {
+	_, err = r.FindCustom(ctx, func(ctx context.Context, db *sqlx.DB) (*sqlx.Rows, error) {
 		return nil, nil
 	})
-	var repoErr eh.RepoError
-	if !errors.As(err, &repoErr) || !errors.Is(err, ErrInvalidQuery) {
+	if !errors.Is(err, ErrInvalidQuery) {
 		t.Error("there should be a invalid query error:", err)
 	}
 
-	var count int64
-	// FindCustom with query execution in the callback.
-	_, err = r.FindCustom(ctx, func(ctx context.Context, c *mongo.Collection) (*mongo.Cursor, error) {
-		if count, err = c.CountDocuments(ctx, bson.M{}); err != nil {
-			t.Error("there should be no error:", err)
+	// FindWithFilter paginated, without expression.
+	result, err = r.FindWithFilter(ctx, "", WithLimit(1), WithOffset(1))
+	if err != nil {
+		t.Error("there should be no error:", err)
+	}
+	if len(result) != 1 {
+		t.Error("there should be one item:", len(result))
+	}
+
+	// FindPage through all items, one at a time.
+	var cursor Cursor
+	pages := 0
+	for {
+		page, next, err := r.FindPage(ctx, cursor, 1, WithKeyset("created_at"))
+		if err != nil {
+			t.Fatal("there should be no error:", err)
+		}
+		pages += len(page)
+		if next == "" {
+			break
 		}
+		cursor = next
+	}
+	if pages != 2 {
+		t.Error("there should be two items:", pages)
+	}
 
-		// Be sure to return nil to not execute the query again in FindCustom.
-		return nil, nil
-	})
-	if !errors.As(err, &repoErr) || !errors.Is(err, ErrInvalidQuery) {
-		t.Error("there should be a invalid query error:", err)
+	// FindAllIter over all items.
+	iter, err := r.FindAllIter(ctx)
+	if err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	count := 0
+	for iter.Next(ctx) {
+		if _, ok := iter.Value().(*mocks.Model); !ok {
+			t.Error("the item should be a model:", iter.Value())
+		}
+		count++
+	}
+	if err := iter.Close(ctx); err != nil {
+		t.Error("there should be no error:", err)
 	}
 	if count != 2 {
-		t.Error("the count should be correct:", count)
+		t.Error("there should be two items:", count)
+	}
+
+	// SaveMixed into the same table, in one transaction.
+	mixed1 := &mocks.Model{ID: uuid.New(), Content: "mixed1", CreatedAt: time.Now().UTC()}
+	mixed2 := &mocks.Model{ID: uuid.New(), Content: "mixed2", CreatedAt: time.Now().UTC()}
+	if err := r.SaveMixed(ctx, map[string][]eh.Entity{
+		"models": {mixed1, mixed2},
+	}); err != nil {
+		t.Error("there should be no error:", err)
+	}
+	for _, id := range []uuid.UUID{mixed1.ID, mixed2.ID} {
+		if _, err := r.Find(ctx, id); err != nil {
+			t.Error("there should be no error:", err)
+		}
+		if err := r.Remove(ctx, id); err != nil {
+			t.Error("there should be no error:", err)
+		}
+	}
+
+	// FindByIDs with one missing ID.
+	result, err = r.FindByIDs(ctx, []uuid.UUID{modelCustom.ID, uuid.New()})
+	if err != nil {
+		t.Error("there should be no error:", err)
+	}
+	if len(result) != 1 {
+		t.Error("there should be one item:", len(result))
+	}
+
+	// FindWithFilter with projected columns.
+	result, err = r.FindWithFilter(ctx, "content = $1", "modelCustom",
+		WithColumns("id", "content"))
+	if err != nil {
+		t.Error("there should be no error:", err)
+	}
+	if len(result) != 1 || !result[0].(*mocks.Model).CreatedAt.IsZero() {
+		t.Error("only the projected columns should be set:", result)
+	}
+
+	// FindWhere with the filter builder.
+	result, err = r.FindWhere(ctx, And(Eq("content", "modelCustom"), Gte("version", 0)),
+		WithLimit(10))
+	if err != nil {
+		t.Error("there should be no error:", err)
+	}
+	if len(result) != 1 {
+		t.Error("there should be one item:", len(result))
+	}
+
+	// FindWithFilter with no matches.
+	result, err = r.FindWithFilter(ctx, "content = $1", "missing")
+	if err != nil {
+		t.Error("there should be no error:", err)
+	}
+	if len(result) != 0 {
+		t.Error("there should be no items:", len(result))
+	}
+
+	// FindWithFilterUsingIndex by content, with an extra filter.
+	result, err = r.FindWithFilterUsingIndex(ctx, IndexInput{
+		PartitionKey:      "content",
+		PartitionKeyValue: "modelCustom",
+		SortKey:           "created_at",
+	}, "version >= $1", 0)
+	if err != nil {
+		t.Error("there should be no error:", err)
+	}
+	if len(result) != 1 {
+		t.Error("there should be one item:", len(result))
 	}
 
-	modelCustom2 := &mocks.Model{
-		ID:      uuid.New(),
-		Content: "modelCustom2",
+	// Count all items and with a filter.
+	if n, err := r.Count(ctx); err != nil || n != 2 {
+		t.Error("there should be two items:", n, err)
 	}
-	if err := r.Collection(ctx, func(ctx context.Context, c *mongo.Collection) error {
-		_, err := c.InsertOne(ctx, modelCustom2)
+	if n, err := r.CountWithFilter(ctx, "content = $1", "modelCustom"); err != nil || n != 1 {
+		t.Error("there should be one item:", n, err)
+	}
+
+	// WithTriggersDisabled runs the callback in a transaction.
+	if err := r.WithTriggersDisabled(ctx, func(ctx context.Context, tx *sqlx.Tx) error {
+		_, err := tx.ExecContext(ctx, "UPDATE models SET version = version + 1")
 		return err
 	}); err != nil {
 		t.Error("there should be no error:", err)
 	}
-	model, err := r.Find(ctx, modelCustom2.ID)
-	if err != nil {
+	if err := r.DisableTriggers(ctx, nil); !errors.Is(err, ErrNoTransaction) {
+		t.Error("there should be a ErrNoTransaction error:", err)
+	}
+
+	// Find with a lock in a repo-managed transaction.
+	if err := r.WithTriggersDisabled(ctx, func(ctx context.Context, tx *sqlx.Tx) error {
+		_, err := r.Find(WithLock(ctx, LockForUpdate), modelCustom.ID)
+		return err
+	}); err != nil {
 		t.Error("there should be no error:", err)
 	}
-	if !reflect.DeepEqual(model, modelCustom2) {
-		t.Error("the item should be correct:", model)
+
+	// Read your own writes in a repo-managed transaction.
+	errRollback := errors.New("rollback")
+	if err := r.WithTriggersDisabled(ctx, func(ctx context.Context, tx *sqlx.Tx) error {
+		entity, err := r.Find(WithLock(ctx, LockForUpdate), modelCustom.ID)
+		if err != nil {
+			return err
+		}
+		m := *entity.(*mocks.Model)
+		m.Content = "uncommitted"
+		if err := r.Save(ctx, &m); err != nil {
+			return err
+		}
+		if entity, err = r.Find(ctx, modelCustom.ID); err != nil {
+			return err
+		}
+		if entity.(*mocks.Model).Content != "uncommitted" {
+			t.Error("the uncommitted write should be read:", entity)
+		}
+		return errRollback
+	}); !errors.Is(err, errRollback) {
+		t.Error("there should be a rollback error:", err)
+	}
+	if entity, err := r.Find(ctx, modelCustom.ID); err != nil ||
+		entity.(*mocks.Model).Content != "modelCustom" {
+		t.Error("the write should be rolled back:", entity, err)
+	}
+
+	// EstimateCount never fails on an existing table.
+	if _, err := r.EstimateCount(ctx); err != nil {
+		t.Error("there should be no error:", err)
 	}
 
-	// FindCustomIter by content.
-	iter, err := r.FindCustomIter(ctx, func(ctx context.Context, c *mongo.Collection) (*mongo.Cursor, error) {
-		return c.Find(ctx, bson.M{"content": "modelCustom"})
+	// Aggregate grouped by content.
+	rows, err := r.Aggregate(ctx, AggregateQuery{
+		GroupBy:    []string{"content"},
+		Aggregates: []Aggregation{{Func: Count, Column: "*"}},
+		Where:      Eq("content", "modelCustom"),
 	})
 	if err != nil {
 		t.Error("there should be no error:", err)
 	}
+	if len(rows) != 1 || rows[0]["content"] != "modelCustom" || rows[0]["count"] != int64(1) {
+		t.Error("the rows should be correct:", rows)
+	}
+
+	// FindRaw with a join.
+	result, err = r.FindRaw(ctx, "SELECT m.* FROM models m "+
+		"JOIN models o ON o.id = m.id WHERE o.content = $1", "modelCustom")
+	if err != nil {
+		t.Error("there should be no error:", err)
+	}
+	if len(result) != 1 {
+		t.Error("there should be one item:", len(result))
+	}
+
+	// Find by a natural key.
+	entity, err := r.FindByFieldFold(ctx, "content", "MODELCUSTOM")
+	if err != nil {
+		t.Error("there should be no error:", err)
+	}
+	if entity, ok := entity.(*mocks.Model); !ok || entity.Content != "modelCustom" {
+		t.Error("the entity should be correct:", entity)
+	}
+	if _, err := r.FindByField(ctx, "content", "MODELCUSTOM"); !errors.Is(err, eh.ErrEntityNotFound) {
+		t.Error("there should be a ErrEntityNotFound error:", err)
+	}
+
+	// All entities in batches.
+	var batches, batched int
+	if err := r.FindAllInBatches(ctx, 1, func(batch []eh.Entity) error {
+		batches++
+		batched += len(batch)
+		return nil
+	}); err != nil {
+		t.Error("there should be no error:", err)
+	}
+	if all, _ := r.FindAll(ctx); batches != len(all) || batched != len(all) {
+		t.Error("all entities should be in batches:", batches, batched, len(all))
+	}
+
+	// Optimistic concurrency for versioned entities.
+	versioned := &versionedModel{mocks.Model{ID: uuid.New(), Version: 2, CreatedAt: time.Now().UTC()}}
+	if err := r.Save(ctx, versioned); err != nil {
+		t.Error("there should be no error:", err)
+	}
+	versioned.Version = 1
+	err = r.Save(ctx, versioned)
+	if rrErr, ok := err.(eh.RepoError); !ok || rrErr.Err != eh.ErrIncorrectEntityVersion {
+		t.Error("there should be a ErrIncorrectEntityVersion error:", err)
+	} else if vc, ok := rrErr.BaseErr.(*VersionConflictError); !ok || vc.Version != 1 {
+		t.Error("there should be a VersionConflictError:", rrErr.BaseErr)
+	}
+	versioned.Version = 3
+	if err := r.Save(ctx, versioned); err != nil {
+		t.Error("there should be no error:", err)
+	}
+
+	// Compare-and-swap of the version.
+	versioned.Version = 4
+	if err := r.SaveIfVersion(ctx, versioned, 2); !errors.Is(err, eh.ErrIncorrectEntityVersion) {
+		t.Error("there should be a ErrIncorrectEntityVersion error:", err)
+	}
+	if err := r.SaveIfVersion(ctx, versioned, 3); err != nil {
+		t.Error("there should be no error:", err)
+	}
+	cas := &mocks.Model{ID: uuid.New(), Version: 1, CreatedAt: time.Now().UTC()}
+	if err := r.SaveIfVersion(ctx, cas, 1); !errors.Is(err, eh.ErrIncorrectEntityVersion) {
+		t.Error("there should be a ErrIncorrectEntityVersion error:", err)
+	}
+	if err := r.SaveIfVersion(ctx, cas, 0); err != nil {
+		t.Error("there should be no error:", err)
+	}
+	if err := r.SaveIfVersion(ctx, cas, 0); !errors.Is(err, eh.ErrIncorrectEntityVersion) {
+		t.Error("there should be a ErrIncorrectEntityVersion error:", err)
+	}
+	if err := r.Remove(ctx, cas.ID); err != nil {
+		t.Error("there should be no error:", err)
+	}
+	if err := r.Remove(ctx, versioned.ID); err != nil {
+		t.Error("there should be no error:", err)
+	}
+
+	// SaveAll in one transaction.
+	all1 := &mocks.Model{ID: uuid.New(), Content: "all", CreatedAt: time.Now().UTC()}
+	all2 := &mocks.Model{ID: uuid.New(), Content: "all", CreatedAt: time.Now().UTC()}
+	if err := r.SaveAll(ctx, []eh.Entity{all1, all2}); err != nil {
+		t.Error("there should be no error:", err)
+	}
+	if n, err := r.CountWhere(ctx, Eq("content", "all")); err != nil || n != 2 {
+		t.Error("the entities should be saved:", n, err)
+	}
+	all, err := r.FindAll(ctx)
+	if err != nil {
+		t.Error("there should be no error:", err)
+	}
+	if result, err := r.FindWhere(ctx, nil); err != nil || len(result) != len(all) {
+		t.Error("a nil filter should match all entities:", len(result), err)
+	}
+	if n, err := r.CountWhere(ctx, nil); err != nil || n != int64(len(all)) {
+		t.Error("a nil filter should count all entities:", n, err)
+	}
+	if err := r.SaveAll(ctx, []eh.Entity{all1, &mocks.Model{}}); err == nil {
+		t.Error("there should be an error")
+	}
+	for _, id := range []uuid.UUID{all1.ID, all2.ID} {
+		if err := r.Remove(ctx, id); err != nil {
+			t.Error("there should be no error:", err)
+		}
+	}
+
+	// The latest entity per content.
+	result, err = r.FindLatest(ctx, []string{"content"}, "created_at", Eq("content", "modelCustom"))
+	if err != nil {
+		t.Error("there should be no error:", err)
+	}
+	if len(result) != 1 {
+		t.Error("there should be one item:", len(result))
+	}
+
+	// A page with the total count.
+	result, total, err := r.FindPageWithTotal(ctx, Eq("content", "modelCustom"), 1, 10)
+	if err != nil {
+		t.Error("there should be no error:", err)
+	}
+	if len(result) != 1 || total != 1 {
+		t.Error("the page should be correct:", len(result), total)
+	}
+	result, total, err = r.FindPageWithTotal(ctx, Eq("content", "modelCustom"), 2, 10)
+	if err != nil {
+		t.Error("there should be no error:", err)
+	}
+	if len(result) != 0 || total != 1 {
+		t.Error("the page should be empty with the total:", len(result), total)
+	}
+	n, err := r.CountWhere(ctx, nil)
+	if err != nil {
+		t.Error("there should be no error:", err)
+	}
+	result, total, err = r.FindPageWithTotal(ctx, nil, 1, 1)
+	if err != nil {
+		t.Error("there should be no error:", err)
+	}
+	if len(result) != 1 || total != n {
+		t.Error("a nil filter should page through all entities:", len(result), total, n)
+	}
+
+	// Explain the query plan.
+	var plan json.RawMessage
+	result, err = r.FindWhere(WithExplain(ctx,
+		func(_ context.Context, _ string, p json.RawMessage) {
+			plan = p
+		}), Eq("content", "modelCustom"))
+	if err != nil {
+		t.Error("there should be no error:", err)
+	}
+	if len(result) != 1 || !json.Valid(plan) {
+		t.Error("the plan should be explained:", len(result), string(plan))
+	}
 
-	if iter.Next(ctx) != true {
-		t.Error("the iterator should have results")
+	// FindNamed with a registered query.
+	if err := r.RegisterQuery("by_content",
+		"SELECT * FROM {table} WHERE content = $1"); err != nil {
+		t.Error("there should be no error:", err)
 	}
-	if !reflect.DeepEqual(iter.Value(), modelCustom) {
-		t.Error("the item should be correct:", modelCustom)
+	if err := r.RegisterQuery("by_content", "SELECT 1"); !errors.Is(err, ErrQueryAlreadyRegistered) {
+		t.Error("there should be a ErrQueryAlreadyRegistered error:", err)
 	}
-	if iter.Next(ctx) == true {
-		t.Error("the iterator should have no results")
+	if err := r.RegisterQuery("invalid", "SELECT * FROM {table} WHERE no_such_column = $1"); !errors.Is(err, ErrInvalidQuery) {
+		t.Error("there should be a ErrInvalidQuery error:", err)
 	}
-	err = iter.Close(ctx)
+	result, err = r.FindNamed(ctx, "by_content", "modelCustom")
 	if err != nil {
 		t.Error("there should be no error:", err)
 	}
+	if len(result) != 1 {
+		t.Error("there should be one item:", len(result))
+	}
 
+	// Selftest passes on the test database.
+	if report := r.Selftest(ctx); !report.OK() {
+		t.Error("the selftest should pass:", report.Checks)
+	}
+
+	// FindWithFilter with an invalid expression.
+	_, err = r.FindWithFilter(ctx, "no_such_column = $1", 1)
+	if !errors.Is(err, eh.ErrCouldNotLoadEntity) {
+		t.Error("there should be a ErrCouldNotLoadEntity error:", err)
+	}
 }
-*/
 
-func TestRepository(t *testing.T) {
-	if r := Repository(nil); r != nil {
-		t.Error("the parent repository should be nil:", r)
+func TestCancelIntegration(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integration test")
 	}
 
-	inner := &ehmocks.Repo{}
-	if r := Repository(inner); r != nil {
-		t.Error("the parent repository should be nil:", r)
+	config := &Config{}
+	config.provideDefaults()
+	config.TableName = "models_cancel"
+	client, err := sqlx.Connect("postgres",
+		config.DbConfig.GetConnString())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	ctx := context.Background()
+	client.MustExecContext(ctx, `
+	DROP TABLE IF EXISTS models_cancel;
+	CREATE TABLE models_cancel (
+	    id uuid primary key,
+	    version integer,
+	    content text,
+	    created_at timestamp
+	)`)
+	defer client.MustExecContext(ctx, "DROP TABLE models_cancel")
+
+	r, err := NewRepoWithClient(config, client)
+	if err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	r.SetEntityFactory(func() eh.Entity {
+		return &mocks.Model{}
+	})
+
+	// Lock the table so that FindAll blocks on the server.
+	lock, err := client.BeginTxx(ctx, nil)
+	if err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	lock.MustExecContext(ctx, "LOCK TABLE models_cancel IN ACCESS EXCLUSIVE MODE")
+	defer lock.Rollback()
+
+	cancelCtx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancel()
+	if _, err := r.FindAll(cancelCtx); err == nil {
+		t.Fatal("there should be an error")
+	}
+
+	// The statement must have been cancelled on the server, not abandoned
+	// while still waiting for the lock.
+	var running int
+	for i := 0; i < 20; i++ {
+		if err := client.GetContext(ctx, &running,
+			"SELECT count(*) FROM pg_stat_activity "+
+				"WHERE query = 'SELECT * FROM models_cancel' AND state = 'active'"); err != nil {
+			t.Fatal("there should be no error:", err)
+		}
+		if running == 0 {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if running != 0 {
+		t.Error("the statement should be cancelled on the server")
+	}
+}
+
+func TestReadFromIntegration(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integration test")
 	}
 
-	// Local Mongo testing with Docker
 	config := &Config{}
-	r, err := NewRepo(config)
+	config.provideDefaults()
+	config.TableName = "models_written"
+	config.ReadFrom = "models_read"
+	client, err := sqlx.Connect("postgres",
+		config.DbConfig.GetConnString())
 	if err != nil {
-		t.Error("there should be no error:", err)
+		t.Fatal(err)
 	}
-	defer r.Close(context.Background())
+	defer client.Close()
 
-	outer := &ehmocks.Repo{ParentRepo: r}
-	if r := Repository(outer); r != r {
-		t.Error("the parent repository should be correct:", r)
+	ctx := context.Background()
+	client.MustExecContext(ctx, `
+	DROP VIEW IF EXISTS models_read;
+	DROP TABLE IF EXISTS models_written;
+	CREATE TABLE models_written (
+	    id uuid primary key,
+	    version integer,
+	    content text,
+	    created_at timestamp
+	);
+	CREATE VIEW models_read AS
+	    SELECT id, version, upper(content) AS content, created_at
+	    FROM models_written`)
+	defer client.MustExecContext(ctx, "DROP VIEW models_read; DROP TABLE models_written")
+
+	r, err := NewRepoWithClient(config, client)
+	if err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	r.SetEntityFactory(func() eh.Entity {
+		return &mocks.Model{}
+	})
+
+	m := &mocks.Model{ID: uuid.New(), Content: "model", CreatedAt: time.Now().UTC()}
+	if err := r.Save(ctx, m); err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	entity, err := r.Find(ctx, m.ID)
+	if err != nil {
+		t.Error("there should be no error:", err)
+	}
+	if entity, ok := entity.(*mocks.Model); !ok || entity.Content != "MODEL" {
+		t.Error("the entity should be read from the view:", entity)
+	}
+	result, err := r.FindWhere(ctx, Eq("content", "MODEL"))
+	if err != nil {
+		t.Error("there should be no error:", err)
+	}
+	if len(result) != 1 {
+		t.Error("there should be one item:", len(result))
+	}
+}
+
+func TestReturningIntegration(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integration test")
+	}
+
+	config := &Config{}
+	config.provideDefaults()
+	client, err := sqlx.Connect("postgres",
+		config.DbConfig.GetConnString())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	ctx := context.Background()
+	client.MustExecContext(ctx, `
+	DROP TABLE IF EXISTS models_returning;
+	CREATE TABLE models_returning (
+	    id uuid primary key,
+	    version integer,
+	    content text,
+	    created_at timestamp,
+	    saved_at timestamp default now()
+	);
+	CREATE OR REPLACE FUNCTION models_returning_upper() RETURNS trigger AS $$
+	BEGIN
+	    NEW.content := upper(NEW.content);
+	    RETURN NEW;
+	END $$ LANGUAGE plpgsql;
+	CREATE TRIGGER models_returning_upper BEFORE INSERT OR UPDATE
+	    ON models_returning FOR EACH ROW EXECUTE PROCEDURE models_returning_upper()`)
+	defer client.MustExecContext(ctx, `DROP TABLE models_returning;
+	DROP FUNCTION models_returning_upper()`)
+
+	r, err := NewRepoWithClient(&Config{
+		TableName: "models_returning",
+		Returning: true,
+	}, client)
+	if err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+
+	m := &mocks.Model{ID: uuid.New(), Content: "returned", CreatedAt: time.Now().UTC()}
+	if err := r.Save(ctx, m); err != nil {
+		t.Error("there should be no error:", err)
+	}
+	if m.Content != "RETURNED" {
+		t.Error("the entity should be hydrated from the row:", m.Content)
+	}
+}
+
+func TestSkipUnchangedIntegration(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integration test")
+	}
+
+	config := &Config{}
+	config.provideDefaults()
+	client, err := sqlx.Connect("postgres",
+		config.DbConfig.GetConnString())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	ctx := context.Background()
+	client.MustExecContext(ctx, `
+	DROP TABLE IF EXISTS models_unchanged;
+	CREATE TABLE models_unchanged (
+	    id uuid primary key,
+	    version integer,
+	    content text,
+	    created_at timestamp,
+	    checksum text
+	)`)
+	defer client.MustExecContext(ctx, "DROP TABLE models_unchanged")
+
+	r, err := NewRepoWithClient(&Config{
+		TableName:      "models_unchanged",
+		ChecksumColumn: "checksum",
+		SkipUnchanged:  true,
+	}, client)
+	if err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+
+	m := &versionedModel{mocks.Model{ID: uuid.New(), Version: 1, CreatedAt: time.Now().UTC()}}
+	var xmin1, xmin2 string
+	if err := r.Save(ctx, m); err != nil {
+		t.Error("there should be no error:", err)
+	}
+	client.GetContext(ctx, &xmin1, "SELECT xmin::text FROM models_unchanged")
+	if err := r.Save(ctx, m); err != nil {
+		t.Error("there should be no error:", err)
+	}
+	client.GetContext(ctx, &xmin2, "SELECT xmin::text FROM models_unchanged")
+	if xmin1 != xmin2 {
+		t.Error("the unchanged row should not be updated:", xmin1, xmin2)
+	}
+
+	old := &versionedModel{mocks.Model{ID: m.ID, Content: "old", CreatedAt: m.CreatedAt}}
+	if err := r.Save(ctx, old); !errors.Is(err, eh.ErrIncorrectEntityVersion) {
+		t.Error("there should be a ErrIncorrectEntityVersion error:", err)
+	}
+}
+
+func TestConflictStrategyIntegration(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integration test")
+	}
+
+	config := &Config{}
+	config.provideDefaults()
+	client, err := sqlx.Connect("postgres",
+		config.DbConfig.GetConnString())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	ctx := context.Background()
+	client.MustExecContext(ctx, `
+	DROP TABLE IF EXISTS models_conflict;
+	CREATE TABLE models_conflict (
+	    id uuid primary key,
+	    version integer,
+	    content text,
+	    created_at timestamp
+	)`)
+	defer client.MustExecContext(ctx, "DROP TABLE models_conflict")
+
+	repos := map[ConflictStrategy]*Repo{}
+	for _, s := range []ConflictStrategy{ConflictError, ConflictIgnore, ConflictUpdateOnly} {
+		r, err := NewRepoWithClient(&Config{
+			TableName:  "models_conflict",
+			OnConflict: s,
+		}, client)
+		if err != nil {
+			t.Fatal("there should be no error:", err)
+		}
+		r.SetEntityFactory(func() eh.Entity {
+			return &mocks.Model{}
+		})
+		repos[s] = r
+	}
+
+	m := &mocks.Model{ID: uuid.New(), Content: "first", CreatedAt: time.Now().UTC()}
+	if err := repos[ConflictUpdateOnly].Save(ctx, m); !errors.Is(err, eh.ErrEntityNotFound) {
+		t.Error("there should be a ErrEntityNotFound error:", err)
+	}
+	if err := repos[ConflictError].Save(ctx, m); err != nil {
+		t.Error("there should be no error:", err)
+	}
+
+	m.Content = "second"
+	err = repos[ConflictError].Save(ctx, m)
+	if rrErr, ok := err.(eh.RepoError); !ok || !errors.Is(rrErr.BaseErr, ErrEntityExists) {
+		t.Error("there should be a ErrEntityExists error:", err)
+	}
+	if err := repos[ConflictIgnore].Save(ctx, m); err != nil {
+		t.Error("there should be no error:", err)
+	}
+	if e, _ := repos[ConflictIgnore].Find(ctx, m.ID); e.(*mocks.Model).Content != "first" {
+		t.Error("the entity should not be updated:", e)
+	}
+	if err := repos[ConflictUpdateOnly].Save(ctx, m); err != nil {
+		t.Error("there should be no error:", err)
+	}
+	if e, _ := repos[ConflictIgnore].Find(ctx, m.ID); e.(*mocks.Model).Content != "second" {
+		t.Error("the entity should be updated:", e)
+	}
+}
+
+func TestAuditIntegration(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integration test")
+	}
+
+	config := &Config{}
+	config.provideDefaults()
+	client, err := sqlx.Connect("postgres",
+		config.DbConfig.GetConnString())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	ctx := context.Background()
+	client.MustExecContext(ctx, `
+	DROP TABLE IF EXISTS models_audit;
+	CREATE TABLE models_audit (
+	    id uuid primary key,
+	    version integer,
+	    content text,
+	    created_at timestamp,
+	    updated_at timestamp
+	)`)
+	defer client.MustExecContext(ctx, "DROP TABLE models_audit")
+
+	r, err := NewRepoWithClient(&Config{
+		TableName: "models_audit",
+		Audit:     &AuditConfig{},
+	}, client)
+	if err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+
+	m := &mocks.Model{ID: uuid.New(), Content: "audited"}
+	if err := r.Save(ctx, m); err != nil {
+		t.Error("there should be no error:", err)
+	}
+	var created, updated time.Time
+	row := client.QueryRowxContext(ctx, "SELECT created_at, updated_at FROM models_audit")
+	if err := row.Scan(&created, &updated); err != nil || !created.Equal(updated) {
+		t.Error("the audit columns should be set on insert:", created, updated, err)
+	}
+
+	if err := r.Save(ctx, m); err != nil {
+		t.Error("there should be no error:", err)
+	}
+	var created2, updated2 time.Time
+	row = client.QueryRowxContext(ctx, "SELECT created_at, updated_at FROM models_audit")
+	if err := row.Scan(&created2, &updated2); err != nil ||
+		!created2.Equal(created) || !updated2.After(updated) {
+		t.Error("only the updated column should change:", created2, updated2, err)
+	}
+}
+
+func TestHistoryIntegration(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integration test")
+	}
+
+	config := &Config{}
+	config.provideDefaults()
+	client, err := sqlx.Connect("postgres",
+		config.DbConfig.GetConnString())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	ctx := context.Background()
+	client.MustExecContext(ctx, `
+	DROP TABLE IF EXISTS models_versions, models_versions_history;
+	CREATE TABLE models_versions (
+	    id uuid primary key,
+	    version integer,
+	    content text,
+	    created_at timestamp
+	)`)
+	defer client.MustExecContext(ctx, `DROP TABLE models_versions, models_versions_history;
+	DROP FUNCTION models_versions_history_record()`)
+
+	r, err := NewRepoWithClient(&Config{
+		TableName: "models_versions",
+		History:   &HistoryConfig{},
+	}, client)
+	if err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	r.SetEntityFactory(func() eh.Entity {
+		return &mocks.Model{}
+	})
+	if err := r.EnsureHistory(ctx); err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+
+	m := &mocks.Model{ID: uuid.New(), Version: 1, Content: "v1", CreatedAt: time.Now().UTC()}
+	if err := r.Save(ctx, m); err != nil {
+		t.Error("there should be no error:", err)
+	}
+	time.Sleep(10 * time.Millisecond)
+	t1 := time.Now()
+	time.Sleep(10 * time.Millisecond)
+	m.Version, m.Content = 2, "v2"
+	if err := r.Save(ctx, m); err != nil {
+		t.Error("there should be no error:", err)
+	}
+	time.Sleep(10 * time.Millisecond)
+	t2 := time.Now()
+	time.Sleep(10 * time.Millisecond)
+	if err := r.Remove(ctx, m.ID); err != nil {
+		t.Error("there should be no error:", err)
+	}
+
+	if e, err := r.FindAsOf(ctx, m.ID, t1); err != nil || e.(*mocks.Model).Content != "v1" {
+		t.Error("the first version should be found:", e, err)
+	}
+	if e, err := r.FindAsOf(ctx, m.ID, t2); err != nil || e.(*mocks.Model).Content != "v2" {
+		t.Error("the second version should be found:", e, err)
+	}
+	if _, err := r.FindAsOf(ctx, m.ID, time.Now()); !errors.Is(err, eh.ErrEntityNotFound) {
+		t.Error("there should be a ErrEntityNotFound error:", err)
+	}
+}
+
+func TestPolymorphicIntegration(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integration test")
+	}
+
+	config := &Config{}
+	config.provideDefaults()
+	client, err := sqlx.Connect("postgres",
+		config.DbConfig.GetConnString())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	ctx := context.Background()
+	client.MustExecContext(ctx, `
+	DROP TABLE IF EXISTS models_mixed;
+	CREATE TABLE models_mixed (
+	    id uuid primary key,
+	    kind text NOT NULL,
+	    version integer,
+	    content text,
+	    created_at timestamp,
+	    pinned boolean
+	)`)
+	defer client.MustExecContext(ctx, "DROP TABLE models_mixed")
+
+	r, err := NewRepoWithClient(&Config{
+		TableName:  "models_mixed",
+		TypeColumn: "kind",
+	}, client)
+	if err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	r.RegisterEntityType("model", func() eh.Entity {
+		return &mocks.Model{}
+	})
+	r.RegisterEntityType("note", func() eh.Entity {
+		return &noteModel{}
+	})
+
+	m := &mocks.Model{ID: uuid.New(), Content: "model", CreatedAt: time.Now().UTC()}
+	n := &noteModel{ID: uuid.New(), Content: "note", Pinned: true}
+	for _, e := range []eh.Entity{m, n} {
+		if err := r.Save(ctx, e); err != nil {
+			t.Error("there should be no error:", err)
+		}
+	}
+
+	if e, err := r.Find(ctx, n.ID); err != nil || *e.(*noteModel) != *n {
+		t.Error("the note should be found:", e, err)
+	}
+	if e, err := r.Find(ctx, m.ID); err != nil || e.(*mocks.Model).Content != "model" {
+		t.Error("the model should be found:", e, err)
+	}
+	all, err := r.FindWithFilter(ctx, "", WithOrderBy("content", Asc))
+	if err != nil || len(all) != 2 {
+		t.Fatal("there should be two items:", all, err)
+	}
+	if _, ok := all[0].(*mocks.Model); !ok {
+		t.Error("the first item should be a model:", all[0])
+	}
+	if _, ok := all[1].(*noteModel); !ok {
+		t.Error("the second item should be a note:", all[1])
+	}
+}
+
+func TestIdempotencyIntegration(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integration test")
+	}
+
+	config := &Config{}
+	config.provideDefaults()
+	client, err := sqlx.Connect("postgres",
+		config.DbConfig.GetConnString())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	ctx := context.Background()
+	client.MustExecContext(ctx, `
+	DROP TABLE IF EXISTS models_once, eh_idempotency_keys_test;
+	CREATE TABLE models_once (
+	    id uuid primary key,
+	    version integer,
+	    content text,
+	    created_at timestamp
+	)`)
+	defer client.MustExecContext(ctx, "DROP TABLE models_once, eh_idempotency_keys_test")
+
+	r, err := NewRepoWithClient(&Config{
+		TableName:   "models_once",
+		Idempotency: &IdempotencyConfig{TableName: "eh_idempotency_keys_test"},
+	}, client)
+	if err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	r.SetEntityFactory(func() eh.Entity {
+		return &mocks.Model{}
+	})
+	if err := r.EnsureIdempotency(ctx); err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+
+	keyCtx := WithIdempotencyKey(ctx, "event-1/handler")
+	m := &mocks.Model{ID: uuid.New(), Content: "first", CreatedAt: time.Now().UTC()}
+	if err := r.Save(keyCtx, m); err != nil {
+		t.Error("there should be no error:", err)
+	}
+	m.Content = "reprocessed"
+	if err := r.Save(keyCtx, m); err != nil {
+		t.Error("there should be no error:", err)
+	}
+	if e, _ := r.Find(ctx, m.ID); e.(*mocks.Model).Content != "first" {
+		t.Error("the reprocessed save should be a no-op:", e)
+	}
+
+	// The key is not recorded when the save fails.
+	failing := &mocks.Model{Content: "no id"}
+	if err := r.Save(WithIdempotencyKey(ctx, "event-2/handler"), failing); err == nil {
+		t.Error("there should be an error")
+	}
+	if n, err := r.DeleteIdempotencyKeys(ctx, 0); err != nil || n != 1 {
+		t.Error("there should be one key:", n, err)
+	}
+}
+
+func TestEnsureTableIntegration(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integration test")
+	}
+
+	config := &Config{}
+	config.provideDefaults()
+	client, err := sqlx.Connect("postgres",
+		config.DbConfig.GetConnString())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	ctx := context.Background()
+	client.MustExecContext(ctx, "DROP TABLE IF EXISTS models_ensured")
+	defer client.MustExecContext(ctx, "DROP TABLE models_ensured")
+
+	r, err := NewRepoWithClient(&Config{
+		TableName:  "models_ensured",
+		SoftDelete: &SoftDeleteConfig{},
+	}, client)
+	if err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	r.SetEntityFactory(func() eh.Entity {
+		return &mocks.Model{}
+	})
+	for i := 0; i < 2; i++ {
+		if err := r.EnsureTable(ctx); err != nil {
+			t.Fatal("there should be no error:", err)
+		}
+	}
+
+	m := &mocks.Model{ID: uuid.New(), Version: 1, Content: "ensured", CreatedAt: time.Now().UTC().Truncate(time.Millisecond)}
+	if err := r.Save(ctx, m); err != nil {
+		t.Error("there should be no error:", err)
+	}
+	if e, err := r.Find(ctx, m.ID); err != nil || !e.(*mocks.Model).CreatedAt.Equal(m.CreatedAt) {
+		t.Error("the entity should be found:", e, err)
+	}
+	if err := r.Remove(ctx, m.ID); err != nil {
+		t.Error("there should be no error:", err)
+	}
+}
+
+func TestEnsureTableNumericIntegration(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integration test")
+	}
+
+	config := &Config{}
+	config.provideDefaults()
+	client, err := sqlx.Connect("postgres",
+		config.DbConfig.GetConnString())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	ctx := context.Background()
+	client.MustExecContext(ctx, "DROP TABLE IF EXISTS models_numeric")
+	defer client.MustExecContext(ctx, "DROP TABLE models_numeric")
+
+	r, err := NewRepoWithClient(&Config{TableName: "models_numeric"}, client)
+	if err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	r.SetEntityFactory(func() eh.Entity {
+		return &moneyModel{}
+	})
+	if err := r.EnsureTable(ctx); err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+
+	var dataType string
+	if err := client.GetContext(ctx, &dataType,
+		"SELECT data_type FROM information_schema.columns "+
+			"WHERE table_name = 'models_numeric' AND column_name = 'amount'"); err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	if dataType != "numeric" {
+		t.Error("the column should be numeric:", dataType)
+	}
+
+	m := &moneyModel{ID: uuid.New(), Amount: decimal.RequireFromString("1234567890.123456789")}
+	if err := r.Save(ctx, m); err != nil {
+		t.Error("there should be no error:", err)
+	}
+	if e, err := r.Find(ctx, m.ID); err != nil || !e.(*moneyModel).Amount.Equal(m.Amount) {
+		t.Error("the entity should be found:", e, err)
+	}
+}
+
+func TestEnsureTableTagsIntegration(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integration test")
+	}
+
+	config := &Config{}
+	config.provideDefaults()
+	client, err := sqlx.Connect("postgres",
+		config.DbConfig.GetConnString())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	ctx := context.Background()
+	client.MustExecContext(ctx, "DROP TABLE IF EXISTS models_priced")
+	defer client.MustExecContext(ctx, "DROP TABLE models_priced")
+
+	r, err := NewRepoWithClient(&Config{TableName: "models_priced"}, client)
+	if err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	r.SetEntityFactory(func() eh.Entity {
+		return &pricedModel{}
+	})
+	if err := r.EnsureTable(ctx); err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	if err := r.Ready(ctx); err != nil {
+		t.Error("the read model should be ready:", err)
+	}
+
+	client.MustExecContext(ctx, "INSERT INTO models_priced (id) VALUES ($1)", uuid.New())
+	var price string
+	if err := client.GetContext(ctx, &price, "SELECT price FROM models_priced"); err != nil || price != "0.00" {
+		t.Error("the default should be used:", price, err)
+	}
+
+	client.MustExecContext(ctx, "ALTER TABLE models_priced ALTER COLUMN price TYPE numeric(10,2)")
+	if err := r.Ready(ctx); !errors.Is(err, ErrNotReady) {
+		t.Error("the read model should not be ready:", err)
+	}
+}
+
+func TestNameMapperIntegration(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integration test")
+	}
+
+	config := &Config{}
+	config.provideDefaults()
+	client, err := sqlx.Connect("postgres",
+		config.DbConfig.GetConnString())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	ctx := context.Background()
+	client.MustExecContext(ctx, "DROP TABLE IF EXISTS models_camel")
+	defer client.MustExecContext(ctx, "DROP TABLE models_camel")
+
+	r, err := NewRepoWithClient(&Config{
+		TableName:  "models_camel",
+		NameMapper: CamelCase,
+	}, client)
+	if err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	r.SetEntityFactory(func() eh.Entity {
+		return &untaggedModel{}
+	})
+	if err := r.EnsureTable(ctx); err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	if err := r.Ready(ctx); err != nil {
+		t.Error("the read model should be ready:", err)
+	}
+
+	m := &untaggedModel{ID: uuid.New(), CreatedAt: "now", Note: "note"}
+	if err := r.Save(ctx, m); err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	var createdAt string
+	if err := client.GetContext(ctx, &createdAt,
+		`SELECT "createdAt" FROM models_camel`); err != nil || createdAt != "now" {
+		t.Error("the column should be camel case:", createdAt, err)
+	}
+	entity, err := r.Find(ctx, m.ID)
+	if err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	if !reflect.DeepEqual(entity, m) {
+		t.Error("the entity should be correct:", entity)
+	}
+	result, err := r.FindWhere(ctx, Eq("createdAt", "now"))
+	if err != nil || len(result) != 1 {
+		t.Error("the entity should be found by the column:", result, err)
+	}
+
+	other := &untaggedModel{ID: uuid.New(), CreatedAt: "then", Note: "note"}
+	if err := r.Save(ctx, other); err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	page, cursor, err := r.FindPage(ctx, "", 1, WithKeyset("createdAt"))
+	if err != nil || len(page) != 1 || !reflect.DeepEqual(page[0], m) {
+		t.Error("the first page should be correct:", page, err)
+	}
+	page, _, err = r.FindPage(ctx, cursor, 1, WithKeyset("createdAt"))
+	if err != nil || len(page) != 1 || !reflect.DeepEqual(page[0], other) {
+		t.Error("the next page should be correct:", page, err)
+	}
+}
+
+type collatedModel struct {
+	ID   uuid.UUID `db:"id"`
+	Name string    `db:"name" pg:"collate:C"`
+}
+
+func (m *collatedModel) EntityID() uuid.UUID {
+	return m.ID
+}
+
+func TestCollationIntegration(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integration test")
+	}
+
+	config := &Config{}
+	config.provideDefaults()
+	client, err := sqlx.Connect("postgres",
+		config.DbConfig.GetConnString())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	ctx := context.Background()
+	client.MustExecContext(ctx, "DROP TABLE IF EXISTS models_collated")
+	defer client.MustExecContext(ctx, "DROP TABLE models_collated")
+
+	r, err := NewRepoWithClient(&Config{TableName: "models_collated"}, client)
+	if err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	r.SetEntityFactory(func() eh.Entity {
+		return &collatedModel{}
+	})
+	if err := r.EnsureTable(ctx); err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	if err := r.Ready(ctx); err != nil {
+		t.Error("the read model should be ready:", err)
+	}
+	for _, name := range []string{"b", "a", "B"} {
+		if err := r.Save(ctx, &collatedModel{ID: uuid.New(), Name: name}); err != nil {
+			t.Fatal("there should be no error:", err)
+		}
+	}
+
+	names := func(entities []eh.Entity) []string {
+		var names []string
+		for _, e := range entities {
+			names = append(names, e.(*collatedModel).Name)
+		}
+		return names
+	}
+	entities, err := r.FindWhere(ctx, Ne("name", ""), WithOrderBy("name", Asc))
+	if err != nil || !reflect.DeepEqual(names(entities), []string{"B", "a", "b"}) {
+		t.Error("the entities should be sorted by the collation of the column:", names(entities), err)
+	}
+	entities, err = r.FindWhere(ctx, Ne("name", ""), WithOrderByCollate("name", Desc, "C"))
+	if err != nil || !reflect.DeepEqual(names(entities), []string{"b", "a", "B"}) {
+		t.Error("the entities should be sorted by the collation:", names(entities), err)
+	}
+
+	client.MustExecContext(ctx, `ALTER TABLE models_collated ALTER COLUMN name TYPE text COLLATE "POSIX"`)
+	if err := r.Ready(ctx); !errors.Is(err, ErrNotReady) {
+		t.Error("the read model should not be ready:", err)
+	}
+}
+
+func TestGeneratedColumnsIntegration(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integration test")
+	}
+
+	config := &Config{}
+	config.provideDefaults()
+	client, err := sqlx.Connect("postgres",
+		config.DbConfig.GetConnString())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	ctx := context.Background()
+	client.MustExecContext(ctx, "DROP TABLE IF EXISTS models_generated")
+	defer client.MustExecContext(ctx, "DROP TABLE models_generated")
+
+	r, err := NewRepoWithClient(&Config{
+		TableName: "models_generated",
+		GeneratedColumns: []GeneratedColumn{
+			{Name: "status", Field: JSONField{Column: "data", Keys: []string{"status"}}, Index: true},
+			{Name: "total", Field: JSONField{Column: "data", Keys: []string{"total"}}, Type: "numeric"},
+		},
+		Returning: true,
+	}, client)
+	if err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	r.SetEntityFactory(func() eh.Entity {
+		return &orderDocument{}
+	})
+	if err := r.EnsureTable(ctx); err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	if err := r.Ready(ctx); err != nil {
+		t.Error("the read model should be ready:", err)
+	}
+
+	m := &orderDocument{ID: uuid.New(), Data: json.RawMessage(`{"status": "open", "total": 12.5}`)}
+	if err := r.Save(ctx, m); err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	if m.Status != "open" {
+		t.Error("the generated column should be returned:", m.Status)
+	}
+	m.Data = json.RawMessage(`{"status": "closed", "total": 10}`)
+	if err := r.Save(ctx, m); err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	entities, err := r.FindWhere(ctx, Eq("status", "closed"))
+	if err != nil || len(entities) != 1 || entities[0].(*orderDocument).Status != "closed" {
+		t.Error("the entity should be found by the generated column:", entities, err)
+	}
+	var total float64
+	if err := client.GetContext(ctx, &total, "SELECT total FROM models_generated"); err != nil || total != 10 {
+		t.Error("the generated column should be cast:", total, err)
+	}
+}
+
+func TestPartitionIntegration(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integration test")
+	}
+
+	config := &Config{}
+	config.provideDefaults()
+	client, err := sqlx.Connect("postgres",
+		config.DbConfig.GetConnString())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	ctx := context.Background()
+	for _, p := range []*PartitionConfig{
+		{Column: "content", Partitions: 4},
+		{Column: "created_at", Strategy: PartitionRange, Interval: 24 * time.Hour},
+	} {
+		client.MustExecContext(ctx, "DROP TABLE IF EXISTS models_partitioned CASCADE")
+
+		r, err := NewRepoWithClient(&Config{
+			TableName: "models_partitioned",
+			Partition: p,
+		}, client)
+		if err != nil {
+			t.Fatal("there should be no error:", err)
+		}
+		r.SetEntityFactory(func() eh.Entity {
+			return &mocks.Model{}
+		})
+		if err := r.EnsureTable(ctx); err != nil {
+			t.Fatal("there should be no error:", err)
+		}
+
+		now := time.Now().UTC().Truncate(time.Millisecond)
+		m1 := &mocks.Model{ID: uuid.New(), Version: 1, Content: "a", CreatedAt: now}
+		m2 := &mocks.Model{ID: uuid.New(), Version: 1, Content: "b", CreatedAt: now.Add(-72 * time.Hour)}
+		if err := r.Save(ctx, m1); err != nil {
+			t.Error("there should be no error:", err)
+		}
+		if err := r.SaveAll(ctx, []eh.Entity{m2}); err != nil {
+			t.Error("there should be no error:", err)
+		}
+		m1.Version = 2
+		if err := r.Save(ctx, m1); err != nil {
+			t.Error("there should be no error:", err)
+		}
+
+		var partitions int
+		if err := client.GetContext(ctx, &partitions, `
+		SELECT count(*) FROM pg_inherits
+		WHERE inhparent = 'models_partitioned'::regclass`); err != nil {
+			t.Fatal(err)
+		}
+		if (p.Strategy == PartitionHash && partitions != 4) ||
+			(p.Strategy == PartitionRange && partitions != 2) {
+			t.Error("the partitions should be created:", p.Strategy, partitions)
+		}
+
+		entities, err := r.FindAll(ctx)
+		if err != nil || len(entities) != 2 {
+			t.Error("the entities should be found:", entities, err)
+		}
+		if e, err := r.Find(ctx, m1.ID); err != nil || e.(*mocks.Model).Version != 2 {
+			t.Error("the entity should be updated:", e, err)
+		}
+	}
+	client.MustExecContext(ctx, "DROP TABLE models_partitioned CASCADE")
+}
+
+func TestNamespaceSchemaIntegration(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integration test")
+	}
+
+	config := &Config{}
+	config.provideDefaults()
+	client, err := sqlx.Connect("postgres",
+		config.DbConfig.GetConnString())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	ctx := context.Background()
+	client.MustExecContext(ctx, "DROP SCHEMA IF EXISTS ns_a, ns_b CASCADE")
+	defer client.MustExecContext(ctx, "DROP SCHEMA IF EXISTS ns_a, ns_b CASCADE")
+
+	r, err := NewRepoWithClient(&Config{
+		TableName:        "models_ns",
+		NamespaceSchemas: &NamespaceSchemaConfig{Prefix: "ns_"},
+	}, client)
+	if err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	r.SetEntityFactory(func() eh.Entity {
+		return &mocks.Model{}
+	})
+
+	ctxA := eh.NewContextWithNamespace(ctx, "a")
+	ctxB := eh.NewContextWithNamespace(ctx, "b")
+	for _, ctx := range []context.Context{ctxA, ctxB} {
+		if err := r.EnsureNamespaceSchema(ctx); err != nil {
+			t.Fatal("there should be no error:", err)
+		}
+	}
+
+	m := &mocks.Model{ID: uuid.New(), Version: 1, Content: "a", CreatedAt: time.Now().UTC()}
+	if err := r.Save(ctxA, m); err != nil {
+		t.Error("there should be no error:", err)
+	}
+	if _, err := r.Find(ctxA, m.ID); err != nil {
+		t.Error("the entity should be found in its namespace:", err)
+	}
+	if _, err := r.Find(ctxB, m.ID); !errors.Is(err, eh.ErrEntityNotFound) {
+		t.Error("the entity should not be found in another namespace:", err)
+	}
+	var count int
+	if err := client.GetContext(ctx, &count, "SELECT count(*) FROM ns_a.models_ns"); err != nil || count != 1 {
+		t.Error("the entity should be in the schema of the namespace:", count, err)
+	}
+
+	// Joined transactions keep their search_path.
+	if err := WithTx(ctxB, client, func(ctx context.Context) error {
+		if err := r.Save(ctx, m); err != nil {
+			return err
+		}
+		var path string
+		if err := TxFromContext(ctx, client).GetContext(ctx, &path, "SHOW search_path"); err != nil {
+			return err
+		}
+		if path == "ns_b" {
+			t.Error("the search_path should be restored:", path)
+		}
+		return nil
+	}); err != nil {
+		t.Error("there should be no error:", err)
+	}
+	if entities, err := r.FindAll(ctxB); err != nil || len(entities) != 1 {
+		t.Error("the entity should be saved in the namespace:", entities, err)
+	}
+	if diff, err := r.DiffNamespaces(ctx, "a", "b"); err != nil || !diff.Equal() {
+		t.Error("the namespaces should be equal:", diff, err)
+	}
+	changed := &mocks.Model{ID: m.ID, Version: 2, Content: "b", CreatedAt: m.CreatedAt}
+	if err := r.Save(ctxB, changed); err != nil {
+		t.Error("there should be no error:", err)
+	}
+	onlyB := &mocks.Model{ID: uuid.New(), Version: 1, Content: "b", CreatedAt: time.Now().UTC()}
+	if err := r.Save(ctxB, onlyB); err != nil {
+		t.Error("there should be no error:", err)
+	}
+	diff, err := r.DiffNamespaces(ctx, "a", "b")
+	if err != nil {
+		t.Error("there should be no error:", err)
+	}
+	if !reflect.DeepEqual(diff, DiffReport{OnlyInB: []uuid.UUID{onlyB.ID}, Changed: []uuid.UUID{m.ID}}) {
+		t.Error("the diff should be correct:", diff)
+	}
+
+	// The other methods on the table run in the schema of the namespace too.
+	if count, err := r.Count(ctxB); err != nil || count != 2 {
+		t.Error("the entities of the namespace should be counted:", count, err)
+	}
+	if entities, err := r.FindWithFilter(ctxA, "content = $1", "a"); err != nil || len(entities) != 1 {
+		t.Error("the entity should be found in its namespace:", entities, err)
+	}
+	if removed, err := r.RemoveWithFilter(ctxB, "id = $1", onlyB.ID); err != nil || removed != 1 {
+		t.Error("the entity should be removed from its namespace:", removed, err)
+	}
+	if err := r.Clear(ctxB); err != nil {
+		t.Error("there should be no error:", err)
+	}
+	if count, err := r.Count(ctxA); err != nil || count != 1 {
+		t.Error("the other namespaces should be kept:", count, err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := r.DropNamespace(ctx, "b"); err != nil {
+			t.Error("there should be no error:", err)
+		}
+	}
+	var exists bool
+	if err := client.GetContext(ctx, &exists, "SELECT to_regnamespace('ns_b') IS NOT NULL"); err != nil || exists {
+		t.Error("the schema should be dropped:", exists, err)
+	}
+	if _, err := r.Find(ctxA, m.ID); err != nil {
+		t.Error("the other namespaces should be kept:", err)
+	}
+}
+
+func TestEnsureIndexIntegration(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integration test")
+	}
+
+	config := &Config{}
+	config.provideDefaults()
+	client, err := sqlx.Connect("postgres",
+		config.DbConfig.GetConnString())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	ctx := context.Background()
+	client.MustExecContext(ctx, `
+	DROP TABLE IF EXISTS models_indexed;
+	CREATE TABLE models_indexed (
+	    id uuid primary key,
+	    version integer,
+	    content text,
+	    created_at timestamptz
+	);`)
+	defer client.MustExecContext(ctx, "DROP TABLE models_indexed")
+
+	r, err := NewRepoWithClient(&Config{TableName: "models_indexed"}, client)
+	if err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	r.SetEntityFactory(func() eh.Entity {
+		return &mocks.Model{}
+	})
+
+	indexes := []IndexInput{
+		{IndexName: "models_indexed_by_content", PartitionKey: "content", SortKey: "created_at"},
+		{PartitionKey: "version"},
+	}
+	for i := 0; i < 2; i++ {
+		if err := r.EnsureIndexes(ctx, indexes); err != nil {
+			t.Fatal("there should be no error:", err)
+		}
+	}
+	if err := r.EnsureIndex(ctx, IndexInput{PartitionKey: "created_at"},
+		Concurrently()); err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+
+	// The indexes wait for the schema lock of other instances.
+	tx, err := client.BeginTxx(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := lockSchema(ctx, tx, "models_indexed"); err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	for _, opts := range [][]IndexOption{nil, {Concurrently()}} {
+		lockedCtx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+		if err := r.EnsureIndex(lockedCtx, IndexInput{PartitionKey: "content"},
+			opts...); err == nil {
+			t.Error("the index should wait for the lock:", opts)
+		}
+		cancel()
+	}
+	tx.Rollback()
+
+	var names []string
+	if err := client.SelectContext(ctx, &names, `
+	SELECT indexname FROM pg_indexes
+	WHERE tablename = 'models_indexed' AND indexname <> 'models_indexed_pkey'
+	ORDER BY indexname`); err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		"models_indexed_by_content",
+		"models_indexed_created_at_idx",
+		"models_indexed_version_idx",
+	}
+	if !reflect.DeepEqual(names, expected) {
+		t.Error("the indexes should be created:", names)
+	}
+
+	m := &mocks.Model{ID: uuid.New(), Version: 1, Content: "indexed", CreatedAt: time.Now().UTC()}
+	if err := r.Save(ctx, m); err != nil {
+		t.Error("there should be no error:", err)
+	}
+	if entities, err := r.FindWithFilterUsingIndex(ctx, indexes[0], ""); err != nil || len(entities) != 0 {
+		t.Error("no entity should be found:", entities, err)
+	}
+	indexes[0].PartitionKeyValue = "indexed"
+	if entities, err := r.FindWithFilterUsingIndex(ctx, indexes[0], ""); err != nil || len(entities) != 1 {
+		t.Error("the entity should be found:", entities, err)
+	}
+}
+
+func TestConfigIndexesIntegration(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integration test")
+	}
+
+	config := &Config{}
+	config.provideDefaults()
+	client, err := sqlx.Connect("postgres",
+		config.DbConfig.GetConnString())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	ctx := context.Background()
+	client.MustExecContext(ctx, "DROP TABLE IF EXISTS models_config_indexed")
+	defer client.MustExecContext(ctx, "DROP TABLE models_config_indexed")
+
+	r, err := NewRepoWithClient(&Config{
+		TableName: "models_config_indexed",
+		Indexes: []IndexConfig{
+			{Columns: []string{"content", "created_at"}},
+			{Columns: []string{"content"}, Unique: true, Where: "version > 1"},
+		},
+	}, client)
+	if err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	r.SetEntityFactory(func() eh.Entity {
+		return &mocks.Model{}
+	})
+	if err := r.EnsureTable(ctx); err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	if err := r.Ready(ctx); err != nil {
+		t.Error("the read model should be ready:", err)
+	}
+
+	for i := 0; i < 2; i++ {
+		m := &mocks.Model{ID: uuid.New(), Version: 2, Content: "unique", CreatedAt: time.Now().UTC()}
+		err := r.Save(ctx, m)
+		if i == 0 && err != nil {
+			t.Error("there should be no error:", err)
+		}
+		if i == 1 && err == nil {
+			t.Error("the unique index should be used")
+		}
+	}
+
+	client.MustExecContext(ctx, "DROP INDEX models_config_indexed_content_key")
+	if err := r.Ready(ctx); !errors.Is(err, ErrNotReady) {
+		t.Error("the read model should not be ready:", err)
+	}
+	if err := r.EnsureConfigIndexes(ctx, Concurrently()); err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	if err := r.Ready(ctx); err != nil {
+		t.Error("the read model should be ready:", err)
+	}
+}
+
+func TestSwapToIntegration(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integration test")
+	}
+
+	config := &Config{}
+	config.provideDefaults()
+	client, err := sqlx.Connect("postgres",
+		config.DbConfig.GetConnString())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	ctx := context.Background()
+	client.MustExecContext(ctx, "DROP TABLE IF EXISTS models_swapped, models_swapped_v1, models_swapped_v2")
+	defer client.MustExecContext(ctx, "DROP TABLE IF EXISTS models_swapped, models_swapped_v1, models_swapped_v2")
+
+	r, err := NewRepoWithClient(&Config{
+		TableName: "models_swapped",
+		Indexes:   []IndexConfig{{Columns: []string{"content"}}},
+	}, client)
+	if err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	r.SetEntityFactory(func() eh.Entity {
+		return &mocks.Model{}
+	})
+	if err := r.EnsureTable(ctx); err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	m1 := &mocks.Model{ID: uuid.New(), Content: "v1", CreatedAt: time.Now().UTC()}
+	if err := r.Save(ctx, m1); err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+
+	v2, err := r.Versioned(2)
+	if err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	if err := v2.EnsureTable(ctx); err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	m2 := &mocks.Model{ID: uuid.New(), Content: "v2", CreatedAt: time.Now().UTC()}
+	if err := v2.Save(ctx, m2); err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	if _, err := r.Find(ctx, m2.ID); err == nil {
+		t.Error("the rebuilt entity should not be read before the swap")
+	}
+
+	if err := r.SwapTo(ctx, 2); err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	if version, err := r.TableVersion(ctx); err != nil || version != 2 {
+		t.Error("the table should be at version 2:", version, err)
+	}
+	if _, err := r.Find(ctx, m2.ID); err != nil {
+		t.Error("the rebuilt entity should be read after the swap:", err)
+	}
+	if err := r.Ready(ctx); err != nil {
+		t.Error("the read model should be ready:", err)
+	}
+	if err := r.SwapTo(ctx, 2); !errors.Is(err, ErrInvalidTableVersion) {
+		t.Error("the swap should be invalid:", err)
+	}
+
+	if err := r.SwapTo(ctx, 1); err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	if _, err := r.Find(ctx, m1.ID); err != nil {
+		t.Error("the entity should be read after the roll back:", err)
+	}
+	if err := r.Ready(ctx); err != nil {
+		t.Error("the read model should be ready:", err)
+	}
+}
+
+func TestAnalyzeIntegration(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integration test")
+	}
+
+	config := &Config{}
+	config.provideDefaults()
+	client, err := sqlx.Connect("postgres",
+		config.DbConfig.GetConnString())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	ctx := context.Background()
+	client.MustExecContext(ctx, "DROP TABLE IF EXISTS models_analyzed, models_analyzed_v1, models_analyzed_v2")
+	defer client.MustExecContext(ctx, "DROP TABLE IF EXISTS models_analyzed, models_analyzed_v1, models_analyzed_v2")
+
+	r, err := NewRepoWithClient(&Config{
+		TableName:   "models_analyzed",
+		AutoAnalyze: true,
+	}, client)
+	if err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	r.SetEntityFactory(func() eh.Entity {
+		return &mocks.Model{}
+	})
+	if err := r.EnsureTable(ctx); err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+
+	// ANALYZE updates the row estimate of the table.
+	estimate := func(table string) float64 {
+		var tuples float64
+		if err := client.GetContext(ctx, &tuples,
+			"SELECT reltuples FROM pg_class WHERE oid = to_regclass($1)", table); err != nil {
+			t.Fatal("there should be no error:", err)
+		}
+		return tuples
+	}
+
+	if err := r.SaveAll(ctx, []eh.Entity{
+		&mocks.Model{ID: uuid.New(), Content: "a"},
+		&mocks.Model{ID: uuid.New(), Content: "b"},
+	}); err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	if tuples := estimate("models_analyzed"); tuples != 2 {
+		t.Error("the table should be analyzed after SaveAll:", tuples)
+	}
+
+	if err := r.Save(ctx, &mocks.Model{ID: uuid.New(), Content: "c"}); err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	if err := r.Analyze(ctx); err != nil {
+		t.Error("there should be no error:", err)
+	}
+	if tuples := estimate("models_analyzed"); tuples != 3 {
+		t.Error("the table should be analyzed:", tuples)
+	}
+
+	v2, err := r.Versioned(2)
+	if err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	if err := v2.EnsureTable(ctx); err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	if err := v2.Save(ctx, &mocks.Model{ID: uuid.New(), Content: "d"}); err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	if err := r.SwapTo(ctx, 2); err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	if tuples := estimate("models_analyzed"); tuples != 1 {
+		t.Error("the table should be analyzed after SwapTo:", tuples)
+	}
+}
+
+func TestTieringIntegration(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integration test")
+	}
+
+	config := &Config{}
+	config.provideDefaults()
+	client, err := sqlx.Connect("postgres",
+		config.DbConfig.GetConnString())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	ctx := context.Background()
+	client.MustExecContext(ctx, "DROP TABLE IF EXISTS models_tiered, models_tiered_cold, models_tiered_access")
+	defer client.MustExecContext(ctx, "DROP TABLE IF EXISTS models_tiered, models_tiered_cold, models_tiered_access")
+
+	r, err := NewRepoWithClient(&Config{
+		TableName: "models_tiered",
+		Tiering:   &TieringPolicy{},
+	}, client)
+	if err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	r.SetEntityFactory(func() eh.Entity {
+		return &mocks.Model{}
+	})
+	if err := r.EnsureTable(ctx); err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	if err := r.EnsureTiering(ctx); err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+
+	m := &mocks.Model{ID: uuid.New(), Version: 1, Content: "v1", CreatedAt: time.Now().UTC().Truncate(time.Millisecond)}
+	if err := r.Save(ctx, m); err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	if moved, err := r.MoveCold(ctx, 0); err != nil || moved != 1 {
+		t.Error("the entity should be moved:", moved, err)
+	}
+	entity, err := r.Find(ctx, m.ID)
+	if err != nil {
+		t.Error("there should be no error:", err)
+	}
+	if !reflect.DeepEqual(entity, m) {
+		t.Error("the cold entity should be found:", entity)
+	}
+
+	// A newer version saved to the hot table replaces the cold copy.
+	m.Version, m.Content = 2, "v2"
+	if err := r.Save(ctx, m); err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	if moved, err := r.MoveCold(ctx, 0); err != nil || moved != 1 {
+		t.Error("the entity should be moved:", moved, err)
+	}
+	var content string
+	if err := client.GetContext(ctx, &content,
+		"SELECT content FROM models_tiered_cold WHERE id = $1", m.ID); err != nil || content != "v2" {
+		t.Error("the cold copy should be the newer version:", content, err)
+	}
+	entity, err = r.Find(ctx, m.ID)
+	if err != nil {
+		t.Error("there should be no error:", err)
+	}
+	if !reflect.DeepEqual(entity, m) {
+		t.Error("the newer version should be found:", entity)
+	}
+
+	if err := r.MoveHot(ctx, m.ID); err != nil {
+		t.Error("there should be no error:", err)
+	}
+	var count int
+	if err := client.GetContext(ctx, &count,
+		"SELECT count(*) FROM models_tiered WHERE id = $1", m.ID); err != nil || count != 1 {
+		t.Error("the entity should be hot:", count, err)
+	}
+	if err := client.GetContext(ctx, &count,
+		"SELECT count(*) FROM models_tiered_cold"); err != nil || count != 0 {
+		t.Error("the cold table should be empty:", count, err)
+	}
+	if _, err := r.findCold(ctx, r.client, m.ID); !errors.Is(err, sql.ErrNoRows) {
+		t.Error("the entity should not be cold:", err)
+	}
+	entity, err = r.Find(ctx, m.ID)
+	if err != nil {
+		t.Error("there should be no error:", err)
+	}
+	if !reflect.DeepEqual(entity, m) {
+		t.Error("the hot entity should be found:", entity)
+	}
+}
+
+func TestClearTruncateIntegration(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integration test")
+	}
+
+	config := &Config{}
+	config.provideDefaults()
+	client, err := sqlx.Connect("postgres",
+		config.DbConfig.GetConnString())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	ctx := context.Background()
+	client.MustExecContext(ctx, `
+	DROP TABLE IF EXISTS models_truncated;
+	CREATE TABLE models_truncated (
+	    id uuid primary key,
+	    version integer,
+	    content text,
+	    created_at timestamptz,
+	    seq bigint GENERATED BY DEFAULT AS IDENTITY
+	);
+	DROP ROLE IF EXISTS eh_no_truncate;
+	CREATE ROLE eh_no_truncate;
+	GRANT SELECT, INSERT, UPDATE, DELETE ON models_truncated TO eh_no_truncate;`)
+	defer client.MustExecContext(ctx, "DROP TABLE models_truncated; DROP ROLE eh_no_truncate")
+
+	r, err := NewRepoWithClient(&Config{
+		TableName:  "models_truncated",
+		ClearGuard: &ClearGuard{},
+	}, client)
+	if err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	r.SetEntityFactory(func() eh.Entity {
+		return &mocks.Model{}
+	})
+
+	save := func() {
+		for i := 0; i < 2; i++ {
+			m := &mocks.Model{ID: uuid.New(), Content: "truncated", CreatedAt: time.Now().UTC()}
+			if err := r.Save(ctx, m); err != nil {
+				t.Fatal("there should be no error:", err)
+			}
+		}
+	}
+	count := func() int {
+		var n int
+		if err := client.GetContext(ctx, &n, "SELECT count(*) FROM models_truncated"); err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+
+	save()
+	if err := r.Clear(ctx, WithTruncate(), WithExpectedRowCount(3)); !errors.Is(err, ErrCouldNotClearDB) {
+		t.Error("the clear should not be confirmed:", err)
+	}
+	if n := count(); n != 2 {
+		t.Error("the rows should be kept:", n)
+	}
+	if err := r.Clear(ctx, WithRestartIdentity(), WithExpectedRowCount(2)); err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	if n := count(); n != 0 {
+		t.Error("the rows should be truncated:", n)
+	}
+	save()
+	var seq int
+	if err := client.GetContext(ctx, &seq, "SELECT min(seq) FROM models_truncated"); err != nil || seq != 1 {
+		t.Error("the identity should be restarted:", seq, err)
+	}
+
+	// Without the TRUNCATE privilege the rows are deleted.
+	tx, err := client.BeginTxx(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+	tx.MustExecContext(ctx, "SET LOCAL ROLE eh_no_truncate")
+	if n, err := r.clearRows(ctx, tx, clearOptions{truncate: true, expectedRows: 2}); err != nil || n != 2 {
+		t.Error("the rows should be deleted:", n, err)
+	}
+}
+
+func TestWithTxIntegration(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integration test")
+	}
+
+	config := &Config{}
+	config.provideDefaults()
+	client, err := sqlx.Connect("postgres",
+		config.DbConfig.GetConnString())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	ctx := context.Background()
+	client.MustExecContext(ctx, `
+	DROP TABLE IF EXISTS models_tx1, models_tx2;
+	CREATE TABLE models_tx1 (
+	    id uuid primary key,
+	    version integer,
+	    content text,
+	    created_at timestamp
+	);
+	CREATE TABLE models_tx2 (LIKE models_tx1 INCLUDING ALL)`)
+	defer client.MustExecContext(ctx, "DROP TABLE models_tx1, models_tx2")
+
+	var repos []*Repo
+	for _, table := range []string{"models_tx1", "models_tx2"} {
+		r, err := NewRepoWithClient(&Config{TableName: table}, client)
+		if err != nil {
+			t.Fatal("there should be no error:", err)
+		}
+		r.SetEntityFactory(func() eh.Entity {
+			return &mocks.Model{}
+		})
+		repos = append(repos, r)
+	}
+
+	m := &mocks.Model{ID: uuid.New(), Content: "tx", CreatedAt: time.Now().UTC()}
+	errRollback := errors.New("rollback")
+	if err := WithTx(ctx, client, func(ctx context.Context) error {
+		for _, r := range repos {
+			if err := r.Save(ctx, m); err != nil {
+				return err
+			}
+		}
+
+		// The plan is explained in the transaction, seeing its writes.
+		var plan []struct {
+			Plan struct {
+				ActualRows int `json:"Actual Rows"`
+			}
+		}
+		if _, err := repos[0].FindAll(WithExplain(ctx,
+			func(_ context.Context, _ string, p json.RawMessage) {
+				if err := json.Unmarshal(p, &plan); err != nil {
+					t.Error("there should be no error:", err)
+				}
+			})); err != nil {
+			return err
+		}
+		if len(plan) != 1 || plan[0].Plan.ActualRows != 1 {
+			t.Error("the plan should be explained in the transaction:", plan)
+		}
+		return errRollback
+	}); !errors.Is(err, errRollback) {
+		t.Error("there should be a rollback error:", err)
+	}
+	for _, r := range repos {
+		if _, err := r.Find(ctx, m.ID); !errors.Is(err, eh.ErrEntityNotFound) {
+			t.Error("the write should be rolled back:", err)
+		}
+	}
+
+	// SaveMixed joins the transaction.
+	if err := WithTx(ctx, client, func(ctx context.Context) error {
+		if err := repos[0].SaveMixed(ctx, map[string][]eh.Entity{
+			"models_tx1": {m},
+			"models_tx2": {m},
+		}); err != nil {
+			return err
+		}
+		return errRollback
+	}); !errors.Is(err, errRollback) {
+		t.Error("there should be a rollback error:", err)
+	}
+	for _, r := range repos {
+		if _, err := r.Find(ctx, m.ID); !errors.Is(err, eh.ErrEntityNotFound) {
+			t.Error("the write should be rolled back:", err)
+		}
+	}
+
+	if err := WithTx(ctx, client, func(ctx context.Context) error {
+		for _, r := range repos {
+			if err := r.Save(ctx, m); err != nil {
+				return err
+			}
+		}
+		_, err := TxFromContext(ctx, client).ExecContext(ctx,
+			"UPDATE models_tx2 SET version = 2")
+		return err
+	}); err != nil {
+		t.Error("there should be no error:", err)
+	}
+	for _, r := range repos {
+		if _, err := r.Find(ctx, m.ID); err != nil {
+			t.Error("the write should be committed:", err)
+		}
+	}
+}
+
+func TestWithTxUnmappedColumnsIntegration(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integration test")
+	}
+
+	config := &Config{}
+	config.provideDefaults()
+	config.TableName = "models_tx_soft"
+	config.SoftDelete = &SoftDeleteConfig{}
+	config.Returning = true
+	client, err := sqlx.Connect("postgres",
+		config.DbConfig.GetConnString())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	ctx := context.Background()
+	client.MustExecContext(ctx, `
+	DROP TABLE IF EXISTS models_tx_soft;
+	CREATE TABLE models_tx_soft (
+	    id uuid primary key,
+	    version integer,
+	    content text,
+	    created_at timestamp,
+	    deleted_at timestamptz
+	)`)
+	defer client.MustExecContext(ctx, "DROP TABLE models_tx_soft")
+
+	r, err := NewRepoWithClient(config, client)
+	if err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	r.SetEntityFactory(func() eh.Entity {
+		return &mocks.Model{}
+	})
+
+	// The transaction of WithTx is begun on the client as passed, which
+	// doesn't ignore the deleted_at column.
+	m := &mocks.Model{ID: uuid.New(), Content: "tx", CreatedAt: time.Now().UTC()}
+	if err := WithTx(ctx, client, func(ctx context.Context) error {
+		if err := r.Save(ctx, m); err != nil {
+			return err
+		}
+		if _, err := r.Find(ctx, m.ID); err != nil {
+			return err
+		}
+		if _, err := r.Find(WithLock(ctx, LockForUpdate), m.ID); err != nil {
+			return err
+		}
+		entities, err := r.FindAll(ctx)
+		if err != nil {
+			return err
+		}
+		if len(entities) != 1 {
+			t.Error("there should be one item:", len(entities))
+		}
+		return nil
+	}); err != nil {
+		t.Error("there should be no error:", err)
+	}
+	if _, err := r.Find(ctx, m.ID); err != nil {
+		t.Error("the write should be committed:", err)
+	}
+}
+
+func TestSoftDeleteIntegration(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integration test")
+	}
+
+	config := &Config{}
+	config.provideDefaults()
+	config.TableName = "models_soft"
+	config.SoftDelete = &SoftDeleteConfig{}
+	client, err := sqlx.Connect("postgres",
+		config.DbConfig.GetConnString())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	ctx := context.Background()
+	client.MustExecContext(ctx, `
+	DROP TABLE IF EXISTS models_soft;
+	CREATE TABLE models_soft (
+	    id uuid primary key,
+	    version integer,
+	    content text,
+	    created_at timestamp,
+	    deleted_at timestamptz
+	)`)
+	defer client.MustExecContext(ctx, "DROP TABLE models_soft")
+
+	r, err := NewRepoWithClient(config, client)
+	if err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	r.SetEntityFactory(func() eh.Entity {
+		return &mocks.Model{}
+	})
+
+	m := &mocks.Model{ID: uuid.New(), Content: "soft", CreatedAt: time.Now().UTC()}
+	if err := r.Save(ctx, m); err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	if err := r.Remove(ctx, m.ID); err != nil {
+		t.Error("there should be no error:", err)
+	}
+	if _, err := r.Find(ctx, m.ID); !errors.Is(err, eh.ErrEntityNotFound) {
+		t.Error("there should be a ErrEntityNotFound error:", err)
+	}
+	if result, _ := r.FindAll(ctx); len(result) != 0 {
+		t.Error("there should be no items:", len(result))
+	}
+	if err := r.Remove(ctx, m.ID); !errors.Is(err, eh.ErrEntityNotFound) {
+		t.Error("there should be a ErrEntityNotFound error:", err)
+	}
+	deleted, err := r.FindDeleted(ctx)
+	if err != nil {
+		t.Error("there should be no error:", err)
+	}
+	if len(deleted) != 1 {
+		t.Error("there should be one deleted item:", len(deleted))
+	}
+
+	if err := r.Restore(ctx, m.ID); err != nil {
+		t.Error("there should be no error:", err)
+	}
+	if _, err := r.Find(ctx, m.ID); err != nil {
+		t.Error("there should be no error:", err)
+	}
+
+	if err := r.Remove(WithHardDelete(ctx), m.ID); err != nil {
+		t.Error("there should be no error:", err)
+	}
+	if deleted, _ := r.FindDeleted(ctx); len(deleted) != 0 {
+		t.Error("the item should be deleted:", len(deleted))
+	}
+
+	m2 := &mocks.Model{ID: uuid.New(), Content: "purged", CreatedAt: time.Now().UTC()}
+	if err := r.Save(ctx, m2); err != nil {
+		t.Error("there should be no error:", err)
+	}
+	if err := r.Remove(ctx, m2.ID); err != nil {
+		t.Error("there should be no error:", err)
+	}
+	if n, err := r.Purge(ctx, time.Hour); err != nil || n != 0 {
+		t.Error("recent tombstones should be kept:", n, err)
+	}
+	if n, err := r.Purge(ctx, 0); err != nil || n != 1 {
+		t.Error("the tombstone should be purged:", n, err)
+	}
+
+	m3 := &mocks.Model{ID: uuid.New(), Content: "filtered", CreatedAt: time.Now().UTC()}
+	if err := r.Save(ctx, m3); err != nil {
+		t.Error("there should be no error:", err)
+	}
+	if n, err := r.RemoveWithFilter(ctx, "content = $1", "filtered"); err != nil || n != 1 {
+		t.Error("the item should be removed:", n, err)
+	}
+	if deleted, _ := r.FindDeleted(ctx); len(deleted) != 1 {
+		t.Error("the item should be soft-deleted:", len(deleted))
+	}
+	if n, err := r.RemoveWithFilter(WithHardDelete(ctx), "content = $1", "filtered"); err != nil || n != 1 {
+		t.Error("the item should be deleted:", n, err)
+	}
+}
+
+func TestReadFrom(t *testing.T) {
+	client, err := sqlx.Open("postgres", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := NewRepoWithClient(&Config{TableName: "models"}, client)
+	if err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	if table := r.readTable(); table != "models" {
+		t.Error("the entities should be read from the table:", table)
+	}
+
+	r, err = NewRepoWithClient(&Config{TableName: "models", ReadFrom: "views.models"}, client)
+	if err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	if table := r.readTable(); table != "views.models" {
+		t.Error("the entities should be read from the view:", table)
+	}
+
+	if _, err := NewRepoWithClient(&Config{
+		TableName: "models",
+		ReadFrom:  "models; DROP TABLE models",
+	}, client); !errors.Is(err, ErrInvalidTable) {
+		t.Error("there should be a ErrInvalidTable error:", err)
+	}
+}
+
+func TestRepository(t *testing.T) {
+	if r := Repository(nil); r != nil {
+		t.Error("the parent repository should be nil:", r)
+	}
+
+	inner := &ehmocks.Repo{}
+	if r := Repository(inner); r != nil {
+		t.Error("the parent repository should be nil:", r)
+	}
+
+	// Local Mongo testing with Docker
+	config := &Config{}
+	r, err := NewRepo(config)
+	if err != nil {
+		t.Error("there should be no error:", err)
+	}
+	defer r.Close(context.Background())
+
+	outer := &ehmocks.Repo{ParentRepo: r}
+	if r := Repository(outer); r != r {
+		t.Error("the parent repository should be correct:", r)
+	}
+}
+
+func TestClearGuard(t *testing.T) {
+	client, err := sqlx.Open("postgres", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &Config{
+		TableName:  "models",
+		ClearGuard: &ClearGuard{Token: "wipe-models"},
+	}
+	r, err := NewRepoWithClient(config, client)
+	if err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	defer r.Close(context.Background())
+
+	ctx := context.Background()
+	if err := r.Clear(ctx); !errors.Is(err, ErrCouldNotClearDB) ||
+		!errors.Is(err.(eh.RepoError).BaseErr, ErrClearNotConfirmed) {
+		t.Error("there should be a ErrClearNotConfirmed error:", err)
+	}
+	if err := r.Clear(ctx, WithConfirmToken("wrong")); !errors.Is(err, ErrCouldNotClearDB) ||
+		!errors.Is(err.(eh.RepoError).BaseErr, ErrClearNotConfirmed) {
+		t.Error("there should be a ErrClearNotConfirmed error:", err)
+	}
+}
+
+func TestClearTruncateQuery(t *testing.T) {
+	for _, c := range []struct {
+		opts     []ClearOption
+		expected string
+	}{
+		{[]ClearOption{WithTruncate()}, "TRUNCATE models"},
+		{[]ClearOption{WithCascade()}, "TRUNCATE models CASCADE"},
+		{[]ClearOption{WithRestartIdentity(), WithCascade()}, "TRUNCATE models RESTART IDENTITY CASCADE"},
+	} {
+		var o clearOptions
+		for _, opt := range c.opts {
+			opt(&o)
+		}
+		if !o.truncate {
+			t.Error("the table should be truncated")
+		}
+		if query := o.truncateQuery("models"); query != c.expected {
+			t.Error("the query should be correct:", query)
+		}
+	}
+}
+
+func TestIndexInputWhere(t *testing.T) {
+	i := IndexInput{
+		IndexName:         "models_content_created_at_idx",
+		PartitionKey:      "content",
+		PartitionKeyValue: "foo",
+		SortKey:           "created_at",
+	}
+	where, args, err := i.where(1)
+	if err != nil {
+		t.Error("there should be no error:", err)
+	}
+	if where != "content = $2" || len(args) != 1 {
+		t.Error("the condition should be correct:", where, args)
+	}
+
+	i.SortKeyValue = time.Date(2009, time.November, 10, 23, 0, 0, 0, time.UTC)
+	where, args, err = i.where(0)
+	if err != nil {
+		t.Error("there should be no error:", err)
+	}
+	if where != "content = $1 AND created_at = $2" || len(args) != 2 {
+		t.Error("the condition should be correct:", where, args)
+	}
+
+	i.PartitionKey = "content; DROP TABLE models"
+	if _, _, err := i.where(0); !errors.Is(err, ErrInvalidColumn) {
+		t.Error("there should be a ErrInvalidColumn error:", err)
+	}
+}
+
+func TestRowSecurityIntegration(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integration test")
+	}
+
+	config := &Config{}
+	config.provideDefaults()
+	client, err := sqlx.Connect("postgres",
+		config.DbConfig.GetConnString())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	ctx := context.Background()
+	client.MustExecContext(ctx, "DROP TABLE IF EXISTS models_rls")
+	defer client.MustExecContext(ctx, "DROP TABLE IF EXISTS models_rls")
+	client.MustExecContext(ctx, "DROP ROLE IF EXISTS eh_rls_tenant")
+	client.MustExecContext(ctx, "CREATE ROLE eh_rls_tenant NOLOGIN")
+	defer client.MustExecContext(ctx, "DROP ROLE IF EXISTS eh_rls_tenant")
+
+	rowSecurity := &RowSecurityConfig{Force: true}
+	owner, err := NewRepoWithClient(&Config{
+		TableName:   "models_rls",
+		RowSecurity: rowSecurity,
+	}, client)
+	if err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	owner.SetEntityFactory(func() eh.Entity {
+		return &mocks.Model{}
+	})
+	if err := owner.EnsureTable(ctx); err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	if err := owner.EnsureRowSecurity(ctx); err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	if err := owner.EnsureRowSecurity(ctx); err != nil {
+		t.Error("ensuring the policy again should succeed:", err)
+	}
+	client.MustExecContext(ctx, "GRANT ALL ON models_rls TO eh_rls_tenant")
+	defer client.MustExecContext(ctx, "REVOKE ALL ON models_rls FROM eh_rls_tenant")
+
+	// The policies don't apply to superusers, use a single connection with
+	// another role.
+	tenantClient, err := sqlx.Connect("postgres",
+		config.DbConfig.GetConnString())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tenantClient.Close()
+	tenantClient.SetMaxOpenConns(1)
+	tenantClient.MustExecContext(ctx, "SET ROLE eh_rls_tenant")
+
+	r, err := NewRepoWithClient(&Config{
+		TableName:   "models_rls",
+		RowSecurity: rowSecurity,
+	}, tenantClient)
+	if err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	r.SetEntityFactory(func() eh.Entity {
+		return &mocks.Model{}
+	})
+
+	ctxA := eh.NewContextWithNamespace(ctx, "a")
+	ctxB := eh.NewContextWithNamespace(ctx, "b")
+	m := &mocks.Model{ID: uuid.New(), Version: 1, Content: "a", CreatedAt: time.Now().UTC()}
+	if err := r.Save(ctxA, m); err != nil {
+		t.Error("there should be no error:", err)
+	}
+	if _, err := r.Find(ctxA, m.ID); err != nil {
+		t.Error("the entity should be found by its tenant:", err)
+	}
+	if _, err := r.Find(ctxB, m.ID); !errors.Is(err, eh.ErrEntityNotFound) {
+		t.Error("the entity should not be found by another tenant:", err)
+	}
+	if entities, err := r.FindAll(ctxB); err != nil || len(entities) != 0 {
+		t.Error("another tenant should see no entities:", entities, err)
+	}
+	if err := r.Save(ctxB, m); err == nil {
+		t.Error("another tenant should not overwrite the entity")
+	}
+	var tenant string
+	if err := client.GetContext(ctx, &tenant, "SELECT tenant_id FROM models_rls WHERE id = $1", m.ID); err != nil || tenant != "a" {
+		t.Error("the entity should have its tenant:", tenant, err)
+	}
+
+	if err := r.InTenant(ctxB, func(ctx context.Context) error {
+		var count int
+		if err := TxFromContext(ctx, tenantClient).GetContext(ctx, &count, "SELECT count(*) FROM models_rls"); err != nil {
+			return err
+		}
+		if count != 0 {
+			t.Error("the tenant should only count its entities:", count)
+		}
+		return nil
+	}); err != nil {
+		t.Error("there should be no error:", err)
+	}
+	var count int
+	if err := tenantClient.GetContext(ctx, &count, "SELECT count(*) FROM models_rls"); err != nil || count != 0 {
+		t.Error("no rows should be visible without a tenant:", count, err)
+	}
+}
+
+func TestForeignKeysIntegration(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integration test")
+	}
+
+	config := &Config{}
+	config.provideDefaults()
+	client, err := sqlx.Connect("postgres",
+		config.DbConfig.GetConnString())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	ctx := context.Background()
+	client.MustExecContext(ctx, "DROP TABLE IF EXISTS models_lines, models_orders")
+	defer client.MustExecContext(ctx, "DROP TABLE IF EXISTS models_lines, models_orders")
+
+	orders, err := NewRepoWithClient(&Config{TableName: "models_orders"}, client)
+	if err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	orders.SetEntityFactory(func() eh.Entity {
+		return &mocks.Model{}
+	})
+	if err := orders.EnsureTable(ctx); err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+
+	lines, err := NewRepoWithClient(&Config{
+		TableName: "models_lines",
+		ForeignKeys: []ForeignKey{
+			{Columns: []string{"order_id"}, References: "models_orders", OnDelete: Cascade},
+		},
+	}, client)
+	if err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	lines.SetEntityFactory(func() eh.Entity {
+		return &orderLine{}
+	})
+	if err := lines.EnsureTable(ctx); err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	if err := lines.Ready(ctx); err != nil {
+		t.Error("the read model should be ready:", err)
+	}
+
+	o1 := &mocks.Model{ID: uuid.New(), Version: 1, Content: "open", CreatedAt: time.Now().UTC()}
+	o2 := &mocks.Model{ID: uuid.New(), Version: 1, Content: "closed", CreatedAt: time.Now().UTC()}
+	for _, o := range []*mocks.Model{o1, o2} {
+		if err := orders.Save(ctx, o); err != nil {
+			t.Fatal("there should be no error:", err)
+		}
+	}
+	l1 := &orderLine{ID: uuid.New(), OrderID: o1.ID, SKU: "a"}
+	l2 := &orderLine{ID: uuid.New(), OrderID: o1.ID, SKU: "b"}
+	l3 := &orderLine{ID: uuid.New(), OrderID: o2.ID, SKU: "c"}
+	for _, l := range []*orderLine{l1, l2, l3} {
+		if err := lines.Save(ctx, l); err != nil {
+			t.Fatal("there should be no error:", err)
+		}
+	}
+	if err := lines.Save(ctx, &orderLine{ID: uuid.New(), OrderID: uuid.New()}); err == nil {
+		t.Error("a line of a missing order should not be saved")
+	}
+
+	entities, err := lines.FindWithJoin(ctx, "models_orders", "content = $1", "open",
+		WithOrderBy("sku", Asc), WithLimit(1))
+	if err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	if len(entities) != 1 || entities[0].EntityID() != l1.ID {
+		t.Error("the lines of the open order should be found:", entities)
+	}
+	if entities, err := lines.FindWithJoin(ctx, "models_lines_order_id_fkey", ""); err != nil || len(entities) != 3 {
+		t.Error("the lines should be found by the foreign key name:", entities, err)
+	}
+
+	if err := orders.Remove(ctx, o1.ID); err != nil {
+		t.Error("there should be no error:", err)
+	}
+	if entities, err := lines.FindAll(ctx); err != nil || len(entities) != 1 {
+		t.Error("the lines of the removed order should be deleted:", entities, err)
+	}
+
+	client.MustExecContext(ctx, "ALTER TABLE models_lines DROP CONSTRAINT models_lines_order_id_fkey")
+	if err := lines.Ready(ctx); !errors.Is(err, ErrNotReady) {
+		t.Error("the read model should not be ready without the foreign key:", err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := lines.EnsureForeignKeys(ctx); err != nil {
+			t.Error("there should be no error:", err)
+		}
+	}
+	if err := lines.Ready(ctx); err != nil {
+		t.Error("the read model should be ready:", err)
+	}
+}
+
+func TestEnsureTableConcurrentIntegration(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integration test")
+	}
+
+	config := &Config{}
+	config.provideDefaults()
+	client, err := sqlx.Connect("postgres",
+		config.DbConfig.GetConnString())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	ctx := context.Background()
+	client.MustExecContext(ctx, "DROP TABLE IF EXISTS models_concurrent")
+	defer client.MustExecContext(ctx, "DROP TABLE IF EXISTS models_concurrent")
+
+	// Without the lock, concurrent CREATE TABLE IF NOT EXISTS fail on the
+	// type of the table created by the other instances.
+	errs := make(chan error, 8)
+	for i := 0; i < cap(errs); i++ {
+		go func() {
+			r, err := NewRepoWithClient(&Config{
+				TableName: "models_concurrent",
+				Indexes:   []IndexConfig{{Columns: []string{"content"}}},
+			}, client)
+			if err != nil {
+				errs <- err
+				return
+			}
+			r.SetEntityFactory(func() eh.Entity {
+				return &mocks.Model{}
+			})
+			errs <- r.EnsureTable(ctx)
+		}()
+	}
+	for i := 0; i < cap(errs); i++ {
+		if err := <-errs; err != nil {
+			t.Error("there should be no error:", err)
+		}
+	}
+}
+
+func TestPgxIntegration(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integration test")
+	}
+
+	r, err := NewRepo(&Config{
+		TableName: "models_pgx",
+		Driver:    DriverPgx,
+	})
+	if err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	defer r.Close(context.Background())
+	r.SetEntityFactory(func() eh.Entity {
+		return &mocks.Model{}
+	})
+
+	ctx := context.Background()
+	r.client.MustExecContext(ctx, "DROP TABLE IF EXISTS models_pgx")
+	defer r.client.MustExecContext(ctx, "DROP TABLE IF EXISTS models_pgx")
+	if err := r.EnsureTable(ctx); err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+
+	m1 := &mocks.Model{ID: uuid.New(), Version: 1, Content: "a", CreatedAt: time.Now().UTC()}
+	m2 := &mocks.Model{ID: uuid.New(), Version: 1, Content: "b", CreatedAt: time.Now().UTC()}
+	for _, m := range []*mocks.Model{m1, m2} {
+		if err := r.Save(ctx, m); err != nil {
+			t.Fatal("there should be no error:", err)
+		}
+	}
+	if entity, err := r.Find(ctx, m1.ID); err != nil || entity.(*mocks.Model).Content != "a" {
+		t.Error("the entity should be found:", entity, err)
+	}
+	if entities, err := r.FindByIDs(ctx, []uuid.UUID{m1.ID, m2.ID}); err != nil || len(entities) != 2 {
+		t.Error("the entities should be found with an array parameter:", entities, err)
+	}
+	if entities, err := r.FindWhere(ctx, In("content", "b")); err != nil || len(entities) != 1 {
+		t.Error("the entities should be filtered:", entities, err)
+	}
+	if err := r.Clear(ctx, WithTruncate()); err != nil {
+		t.Error("there should be no error:", err)
+	}
+	if entities, err := r.FindAll(ctx); err != nil || len(entities) != 0 {
+		t.Error("the table should be cleared:", entities, err)
 	}
 }
@@ -0,0 +1,103 @@
+package repo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/eendLabs/eh-pg/pkg/worker"
+)
+
+// ErrInvalidRetention is when a retention policy is not valid.
+var ErrInvalidRetention = errors.New("invalid retention policy")
+
+// RetentionPolicy declares how long rows are kept in the read model table.
+// Rows where Column is older than MaxAge are deleted by a background worker.
+type RetentionPolicy struct {
+	// Column is the timestamp column compared against the retention age.
+	Column string
+	// MaxAge is how long a row is kept after the time in Column.
+	MaxAge time.Duration
+	// BatchSize is the max number of rows deleted per statement, 1000 by default.
+	BatchSize int
+	// BatchPause is the pause between two delete batches, 100ms by default.
+	BatchPause time.Duration
+	// Interval is the time between two retention runs, 1 minute by default.
+	Interval time.Duration
+}
+
+func (p *RetentionPolicy) provideDefaults() {
+	if p.BatchSize <= 0 {
+		p.BatchSize = 1000
+	}
+	if p.BatchPause <= 0 {
+		p.BatchPause = 100 * time.Millisecond
+	}
+	if p.Interval <= 0 {
+		p.Interval = time.Minute
+	}
+}
+
+func (p *RetentionPolicy) validate() error {
+	if p.Column == "" {
+		return fmt.Errorf("%w: missing column", ErrInvalidRetention)
+	}
+	if !validIdentifier(p.Column) {
+		return fmt.Errorf("%w: invalid column %q", ErrInvalidRetention, p.Column)
+	}
+	if p.MaxAge <= 0 {
+		return fmt.Errorf("%w: max age must be positive", ErrInvalidRetention)
+	}
+	return nil
+}
+
+// RetentionWorker returns the background retention worker, or nil if no
+// retention policy is configured. It can be used to wait for the worker to
+// stop when the root context is cancelled, or to receive its errors.
+func (r *Repo) RetentionWorker() *worker.Worker {
+	return r.retention
+}
+
+// EnforceRetention deletes all rows that are older than the configured
+// retention policy, in batches, and returns the number of deleted rows.
+// It is called periodically by the retention worker but can also be called
+// manually, for example after a bulk import.
+func (r *Repo) EnforceRetention(ctx context.Context) (int64, error) {
+	p := r.config.Retention
+	if p == nil {
+		return 0, nil
+	}
+
+	// Delete the oldest rows first, walking the column index batch by batch.
+	query := fmt.Sprintf("DELETE FROM %[1]s WHERE id IN ("+
+		"SELECT id FROM %[1]s WHERE %[2]s < $1 "+
+		"ORDER BY %[2]s, id LIMIT $2 FOR UPDATE SKIP LOCKED)",
+		r.config.TableName, p.Column)
+
+	var total int64
+	for {
+		affected, err := r.deleteExpiredBatch(ctx, query, p)
+		if err != nil {
+			return total, err
+		}
+		total += affected
+
+		if affected < int64(p.BatchSize) {
+			return total, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return total, ctx.Err()
+		case <-time.After(p.BatchPause):
+		}
+	}
+}
+
+// deleteExpiredBatch deletes one batch of the rows older than the retention
+// policy, with a slot of the write lane held for the batch only.
+func (r *Repo) deleteExpiredBatch(ctx context.Context, query string,
+	p *RetentionPolicy) (int64, error) {
+	return r.execAffected(ctx, nil, query, time.Now().Add(-p.MaxAge), p.BatchSize)
+}
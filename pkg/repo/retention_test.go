@@ -0,0 +1,40 @@
+package repo
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestRetentionPolicy(t *testing.T) {
+	p := &RetentionPolicy{}
+	if err := p.validate(); !errors.Is(err, ErrInvalidRetention) {
+		t.Error("there should be a ErrInvalidRetention error:", err)
+	}
+
+	p = &RetentionPolicy{Column: "created_at"}
+	if err := p.validate(); !errors.Is(err, ErrInvalidRetention) {
+		t.Error("there should be a ErrInvalidRetention error:", err)
+	}
+
+	p = &RetentionPolicy{Column: "created_at < now(); DROP TABLE models; --", MaxAge: time.Hour}
+	if err := p.validate(); !errors.Is(err, ErrInvalidRetention) {
+		t.Error("there should be a ErrInvalidRetention error:", err)
+	}
+
+	p = &RetentionPolicy{Column: "created_at", MaxAge: time.Hour}
+	if err := p.validate(); err != nil {
+		t.Error("there should be no error:", err)
+	}
+
+	p.provideDefaults()
+	if p.BatchSize != 1000 {
+		t.Error("the batch size should be correct:", p.BatchSize)
+	}
+	if p.BatchPause != 100*time.Millisecond {
+		t.Error("the batch pause should be correct:", p.BatchPause)
+	}
+	if p.Interval != time.Minute {
+		t.Error("the interval should be correct:", p.Interval)
+	}
+}
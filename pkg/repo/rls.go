@@ -0,0 +1,174 @@
+package repo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+	eh "github.com/looplab/eventhorizon"
+)
+
+// ErrInvalidRowSecurity is when the row security config is not valid.
+var ErrInvalidRowSecurity = errors.New("invalid row security")
+
+// rowSecurityPolicy is the name of the policy on each table.
+const rowSecurityPolicy = "eh_tenant_isolation"
+
+var settingRe = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*\.[A-Za-z_][A-Za-z0-9_]*$`)
+
+// RowSecurityConfig isolates the tenants sharing the table with row-level
+// security policies, created by EnsureRowSecurity, so that the database only
+// lets a session read and write the rows of its tenant instead of relying on
+// the WHERE clauses of every query. The tenant is set in a session variable
+// for the operations, see InTenant, and written to the tenant column by Save.
+//
+// The policies don't apply to superusers and roles with BYPASSRLS, the
+// repo must connect as another role.
+type RowSecurityConfig struct {
+	// Column is the tenant column, "tenant_id" by default.
+	Column string
+	// Type is the type of the column, "text" by default.
+	Type string
+	// Setting is the session variable holding the tenant, "app.tenant_id" by
+	// default. It must have a prefix, like "app.".
+	Setting string
+	// Tenant returns the tenant of the context, the namespace by default.
+	Tenant func(context.Context) string
+	// Force applies the policies to the owner of the tables too, which
+	// bypasses them otherwise.
+	Force bool
+}
+
+func (c *RowSecurityConfig) provideDefaults() {
+	if c.Column == "" {
+		c.Column = "tenant_id"
+	}
+	if c.Type == "" {
+		c.Type = "text"
+	}
+	if c.Setting == "" {
+		c.Setting = "app.tenant_id"
+	}
+	if c.Tenant == nil {
+		c.Tenant = eh.NamespaceFromContext
+	}
+}
+
+func (c *RowSecurityConfig) validate() error {
+	if !validIdentifier(c.Column) {
+		return fmt.Errorf("%w: invalid column %q", ErrInvalidRowSecurity, c.Column)
+	}
+	if strings.Contains(c.Type, ";") {
+		return fmt.Errorf("%w: invalid type %q", ErrInvalidRowSecurity, c.Type)
+	}
+	if !settingRe.MatchString(c.Setting) {
+		return fmt.Errorf("%w: invalid setting %q", ErrInvalidRowSecurity, c.Setting)
+	}
+	return nil
+}
+
+// tenant returns the tenant of the session, NULL if not set.
+func (c *RowSecurityConfig) tenant() string {
+	expr := fmt.Sprintf("current_setting('%s', true)", c.Setting)
+	if c.Type != "text" {
+		expr += "::" + c.Type
+	}
+	return expr
+}
+
+// column returns the computed tenant column written by Save.
+func (c *RowSecurityConfig) column() ComputedColumn {
+	return ComputedColumn{Name: c.Column, Expr: c.tenant()}
+}
+
+// policyQueries returns the statements enabling the policy on the table.
+func (c *RowSecurityConfig) policyQueries(table string) []string {
+	force := "NO FORCE"
+	if c.Force {
+		force = "FORCE"
+	}
+	check := fmt.Sprintf("%s = %s", c.Column, c.tenant())
+	return []string{
+		fmt.Sprintf("ALTER TABLE %s ENABLE ROW LEVEL SECURITY", table),
+		fmt.Sprintf("ALTER TABLE %s %s ROW LEVEL SECURITY", table, force),
+		fmt.Sprintf("DROP POLICY IF EXISTS %s ON %s", rowSecurityPolicy, table),
+		fmt.Sprintf("CREATE POLICY %s ON %s USING (%s) WITH CHECK (%s)",
+			rowSecurityPolicy, table, check, check),
+	}
+}
+
+// InTenant runs f with the session variable of Config.RowSecurity set to the
+// tenant of the context, so that the methods called with the context passed
+// to f only see the rows of the tenant. f runs in the repo-managed
+// transaction of the context, or in a new one committed when f succeeds.
+// The methods on the table do so by themselves, InTenant groups them in one
+// transaction. Without RowSecurity f is called with the context as is.
+func (r *Repo) InTenant(ctx context.Context, f func(context.Context) error) error {
+	c := r.config.RowSecurity
+	if c == nil {
+		return f(ctx)
+	}
+	return r.withSettings(ctx, []setting{{c.Setting, c.Tenant(ctx)}}, f)
+}
+
+// EnsureRowSecurity enables row-level security on the table and the given
+// tables, which must have the tenant column, and creates or replaces their
+// tenant isolation policy, see Config.RowSecurity. It must be run by the
+// owner of the tables.
+func (r *Repo) EnsureRowSecurity(ctx context.Context, tables ...string) error {
+	c := r.config.RowSecurity
+	if c == nil {
+		return nil
+	}
+
+	tables = append([]string{r.config.TableName}, tables...)
+	for _, table := range tables {
+		if !validTableName(table) {
+			return eh.RepoError{
+				Err:       fmt.Errorf("%w: %q", ErrInvalidTable, table),
+				Namespace: eh.NamespaceFromContext(ctx),
+			}
+		}
+	}
+
+	return r.writeTx(ctx, func(tx *sqlx.Tx) error {
+		for _, table := range tables {
+			if err := lockSchema(ctx, tx, table); err != nil {
+				return err
+			}
+			for _, query := range c.policyQueries(table) {
+				if _, err := tx.ExecContext(ctx, query); err != nil {
+					return eh.RepoError{
+						Err:       err,
+						Namespace: eh.NamespaceFromContext(ctx),
+					}
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// settings returns the session settings of the operations for the context:
+// the search_path of the namespace schema and the tenant of the row security.
+func (r *Repo) settings(ctx context.Context) ([]setting, error) {
+	var settings []setting
+	if c := r.config.NamespaceSchemas; c != nil {
+		schema, err := c.schema(eh.NamespaceFromContext(ctx))
+		if err != nil {
+			return nil, eh.RepoError{
+				Err:       err,
+				Namespace: eh.NamespaceFromContext(ctx),
+			}
+		}
+		settings = append(settings, setting{"search_path", pq.QuoteIdentifier(schema)})
+	}
+	if c := r.config.RowSecurity; c != nil {
+		settings = append(settings, setting{c.Setting, c.Tenant(ctx)})
+	}
+	return settings, nil
+}
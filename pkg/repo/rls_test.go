@@ -0,0 +1,88 @@
+package repo
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/jmoiron/sqlx"
+	eh "github.com/looplab/eventhorizon"
+	"github.com/looplab/eventhorizon/mocks"
+)
+
+func TestRowSecurityConfig(t *testing.T) {
+	db, err := sqlx.Open("postgres", "")
+	if err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+
+	config := &Config{
+		TableName:   "models",
+		RowSecurity: &RowSecurityConfig{},
+	}
+	r, err := NewRepoWithClient(config, db)
+	if err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	c := config.RowSecurity
+	if c.Column != "tenant_id" || c.Type != "text" || c.Setting != "app.tenant_id" {
+		t.Error("the config should have the defaults:", c)
+	}
+	ctx := eh.NewContextWithNamespace(context.Background(), "acme")
+	if tenant := c.Tenant(ctx); tenant != "acme" {
+		t.Error("the tenant should be the namespace:", tenant)
+	}
+	if settings, err := r.settings(ctx); err != nil ||
+		!reflect.DeepEqual(settings, []setting{{"app.tenant_id", "acme"}}) {
+		t.Error("the settings should set the tenant:", settings, err)
+	}
+
+	m := &mocks.Model{ID: uuid.New()}
+	query, _, err := r.upsertSpec().query(entityColumns(r.mapper, m), []eh.Entity{m})
+	if err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	if !strings.Contains(query, "current_setting('app.tenant_id', true)") {
+		t.Error("the tenant column should be written by Save:", query)
+	}
+	if table, err := r.createTableQuery(m); err != nil ||
+		!strings.Contains(table, "tenant_id text NOT NULL") {
+		t.Error("the table should have the tenant column:", table, err)
+	}
+
+	for _, c := range []*RowSecurityConfig{
+		{Column: "tenant id"},
+		{Type: "uuid; DROP TABLE models"},
+		{Setting: "tenant_id"},
+		{Setting: "app.tenant_id'"},
+	} {
+		if _, err := NewRepoWithClient(&Config{TableName: "models", RowSecurity: c}, db); !errors.Is(err, ErrInvalidRowSecurity) {
+			t.Error("there should be a ErrInvalidRowSecurity error:", c, err)
+		}
+	}
+}
+
+func TestRowSecurityPolicyQueries(t *testing.T) {
+	c := &RowSecurityConfig{Type: "uuid", Force: true}
+	c.provideDefaults()
+
+	expected := []string{
+		"ALTER TABLE app.models ENABLE ROW LEVEL SECURITY",
+		"ALTER TABLE app.models FORCE ROW LEVEL SECURITY",
+		"DROP POLICY IF EXISTS eh_tenant_isolation ON app.models",
+		"CREATE POLICY eh_tenant_isolation ON app.models " +
+			"USING (tenant_id = current_setting('app.tenant_id', true)::uuid) " +
+			"WITH CHECK (tenant_id = current_setting('app.tenant_id', true)::uuid)",
+	}
+	if queries := c.policyQueries("app.models"); !reflect.DeepEqual(queries, expected) {
+		t.Error("the queries should be correct:", queries)
+	}
+
+	c.Force = false
+	if queries := c.policyQueries("models"); queries[1] != "ALTER TABLE models NO FORCE ROW LEVEL SECURITY" {
+		t.Error("the owner should bypass the policy:", queries[1])
+	}
+}
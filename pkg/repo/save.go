@@ -0,0 +1,582 @@
+package repo
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/jmoiron/sqlx"
+	"github.com/jmoiron/sqlx/reflectx"
+	eh "github.com/looplab/eventhorizon"
+)
+
+// maxParams is the max number of parameters Postgres accepts in a statement.
+const maxParams = 65535
+
+// SaveMixed saves entities of different types into several tables in a single
+// transaction, with one batch upsert per table. It is useful for event
+// handlers updating several read models atomically. The tables are written in
+// name order to avoid deadlocks between concurrent calls. In a repo-managed
+// transaction it is run in that transaction.
+func (r *Repo) SaveMixed(ctx context.Context, entities map[string][]eh.Entity) error {
+	tables := make([]string, 0, len(entities))
+	for table := range entities {
+		if !validTableName(table) {
+			return eh.RepoError{
+				Err:       eh.ErrCouldNotSaveEntity,
+				BaseErr:   fmt.Errorf("invalid table name: %q", table),
+				Namespace: eh.NamespaceFromContext(ctx),
+			}
+		}
+		tables = append(tables, table)
+	}
+	sort.Strings(tables)
+
+	if err := r.ensureRangePartitions(ctx, entities[r.config.TableName]...); err != nil {
+		return err
+	}
+
+	if err := r.writeTx(ctx, func(tx *sqlx.Tx) error {
+		for _, table := range tables {
+			spec := upsertSpec{template: DefaultTemplates.Save, table: table, mapper: r.mapper}
+			if table == r.config.TableName {
+				spec = r.upsertSpec()
+			}
+			if _, err := upsert(ctx, tx, spec, entities[table]); err != nil {
+				return eh.RepoError{
+					Err:       eh.ErrCouldNotSaveEntity,
+					BaseErr:   fmt.Errorf("%s: %w", table, err),
+					Namespace: eh.NamespaceFromContext(ctx),
+				}
+			}
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+	r.autoAnalyze(ctx, tables...)
+
+	return nil
+}
+
+// SaveAll saves the entities in a single transaction, with multi-row upserts
+// of as many entities as the parameter limit allows, instead of a round trip
+// per entity. All entities must be of the same type. If an entity occurs
+// several times the last one is saved. Versioned entities older than the
+// stored ones are skipped, see Save. Of the conflict strategies only
+// ConflictUpsert and ConflictIgnore are supported. In a repo-managed
+// transaction it is run in that transaction.
+func (r *Repo) SaveAll(ctx context.Context, entities []eh.Entity) error {
+	op := &Operation{Kind: OpSaveAll, Table: r.config.TableName, Entities: entities}
+	return r.run(ctx, op, func(ctx context.Context) error {
+		return r.saveAll(ctx, entities)
+	})
+}
+
+func (r *Repo) saveAll(ctx context.Context, entities []eh.Entity) error {
+	if len(entities) == 0 {
+		return nil
+	}
+
+	spec := r.upsertSpec()
+	switch r.config.OnConflict {
+	case ConflictIgnore:
+		spec.absent = true
+	case ConflictError, ConflictUpdateOnly:
+		return eh.RepoError{
+			Err: eh.ErrCouldNotSaveEntity,
+			BaseErr: fmt.Errorf("%w: %d not supported by SaveAll",
+				ErrInvalidConflictStrategy, r.config.OnConflict),
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	}
+
+	if err := r.ensureRangePartitions(ctx, entities...); err != nil {
+		return err
+	}
+
+	if tx := r.txFromContext(ctx); tx != nil {
+		if _, err := upsert(ctx, tx, spec, entities); err != nil {
+			return eh.RepoError{
+				Err:       eh.ErrCouldNotSaveEntity,
+				BaseErr:   err,
+				Namespace: eh.NamespaceFromContext(ctx),
+			}
+		}
+		r.recordLastWrite(ctx, entities[len(entities)-1])
+		return nil
+	}
+
+	release, err := r.acquireWrite(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	tx, err := r.client.BeginTxx(ctx, &sql.TxOptions{})
+	if err != nil {
+		return eh.RepoError{
+			Err:       eh.ErrCouldNotSaveEntity,
+			BaseErr:   err,
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	}
+	defer tx.Rollback()
+
+	if _, err := upsert(ctx, tx, spec, entities); err != nil {
+		return eh.RepoError{
+			Err:       eh.ErrCouldNotSaveEntity,
+			BaseErr:   err,
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return eh.RepoError{
+			Err:       eh.ErrCouldNotSaveEntity,
+			BaseErr:   err,
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	}
+	r.recordLastWrite(ctx, entities[len(entities)-1])
+	r.autoAnalyze(ctx, r.config.TableName)
+
+	return nil
+}
+
+// SaveIfVersion saves the entity only if the stored version is
+// expectedVersion, as an atomic compare-and-swap on the version column, see
+// Config.VersionColumn. An expectedVersion of 0 requires that the entity does
+// not exist yet. On a mismatch an eh.ErrIncorrectEntityVersion error is
+// returned with a VersionConflictError. In a repo-managed transaction it is
+// run in that transaction.
+func (r *Repo) SaveIfVersion(ctx context.Context, entity eh.Entity,
+	expectedVersion int) error {
+	op := &Operation{
+		Kind:   OpSave,
+		Table:  r.config.TableName,
+		ID:     entity.EntityID(),
+		Entity: entity,
+	}
+	return r.run(ctx, op, func(ctx context.Context) error {
+		return r.saveIfVersion(ctx, entity, expectedVersion)
+	})
+}
+
+func (r *Repo) saveIfVersion(ctx context.Context, entity eh.Entity,
+	expectedVersion int) error {
+	if entity.EntityID() == uuid.Nil {
+		return eh.RepoError{
+			Err:       eh.ErrCouldNotSaveEntity,
+			BaseErr:   eh.ErrMissingEntityID,
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	}
+
+	if err := r.ensureRangePartitions(ctx, entity); err != nil {
+		return err
+	}
+
+	if err := r.writeTx(ctx, func(tx *sqlx.Tx) error {
+		return r.compareAndSwap(ctx, tx, entity, expectedVersion)
+	}); err != nil {
+		return err
+	}
+	r.recordLastWrite(ctx, entity)
+
+	return nil
+}
+
+// compareAndSwap locks the stored row, checks its version and saves the
+// entity in the transaction.
+func (r *Repo) compareAndSwap(ctx context.Context, tx *sqlx.Tx, entity eh.Entity,
+	expectedVersion int) error {
+	conflict := eh.RepoError{
+		Err: eh.ErrIncorrectEntityVersion,
+		BaseErr: &VersionConflictError{
+			ID:      entity.EntityID(),
+			Version: expectedVersion,
+			Table:   r.config.TableName,
+		},
+		Namespace: eh.NamespaceFromContext(ctx),
+	}
+
+	// An explicit write, also if unchanged.
+	spec := r.upsertSpec()
+	spec.unchanged = ""
+	var stored int
+	err := tx.GetContext(ctx, &stored, fmt.Sprintf(
+		"SELECT %s FROM %s WHERE id = $1 FOR UPDATE",
+		spec.version, r.config.TableName), entity.EntityID())
+	if errors.Is(err, sql.ErrNoRows) {
+		// Rows can't be locked before they exist, insert only to detect a
+		// concurrent insert.
+		spec.absent = true
+	} else if err != nil {
+		return eh.RepoError{
+			Err:       eh.ErrCouldNotSaveEntity,
+			BaseErr:   err,
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	}
+	if stored != expectedVersion {
+		return conflict
+	}
+
+	var affected int64
+	if r.config.Returning {
+		affected, err = upsertReturning(ctx, tx, spec, entity)
+	} else {
+		affected, err = upsert(ctx, tx, spec, []eh.Entity{entity})
+	}
+	if err != nil {
+		return eh.RepoError{
+			Err:       eh.ErrCouldNotSaveEntity,
+			BaseErr:   err,
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	}
+	if affected != 1 {
+		return conflict
+	}
+
+	return nil
+}
+
+// upsertSpec describes how entities are upserted into a table.
+type upsertSpec struct {
+	template string
+	table    string
+	// mapper maps the fields of the entities to columns.
+	mapper   *reflectx.Mapper
+	computed []ComputedColumn
+	// key are the conflict target columns, "id" if empty.
+	key []string
+	// insertOnly are the columns not updated on conflict.
+	insertOnly []string
+	// version is the version column of versioned entities, which are only
+	// updated if the stored version is not newer. No check if empty.
+	version string
+	// absent makes the upsert only insert, never update, existing rows.
+	absent bool
+	// unchanged is the checksum column of rows not updated if the checksum
+	// is the same. No check if empty.
+	unchanged string
+	// generated are the columns generated by Postgres, never written.
+	generated []string
+}
+
+// versionCheck reports if the version of the entities is checked.
+func (s upsertSpec) versionCheck(entity eh.Entity) bool {
+	if s.version == "" {
+		return false
+	}
+	_, ok := entity.(eh.Versionable)
+	return ok && hasColumn(s.mapper, entity, s.version)
+}
+
+// storedUnchanged reports if the stored row of the entity has the checksum of
+// the entity.
+func (s upsertSpec) storedUnchanged(ctx context.Context, q sqlx.QueryerContext,
+	entity eh.Entity) (bool, error) {
+	sum, err := Checksum(entity)
+	if err != nil {
+		return false, err
+	}
+	var same bool
+	err = sqlx.GetContext(ctx, q, &same, fmt.Sprintf(
+		"SELECT %s = $1 FROM %s WHERE id = $2", s.unchanged, s.table),
+		sum, entity.EntityID())
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	return same, err
+}
+
+// keyColumns returns the conflict target columns.
+func (s upsertSpec) keyColumns() []string {
+	if len(s.key) == 0 {
+		return []string{"id"}
+	}
+	return s.key
+}
+
+// keyOf returns the values of the key columns of the entity as a string.
+func (s upsertSpec) keyOf(entity eh.Entity) (string, error) {
+	if len(s.key) == 0 {
+		return entity.EntityID().String(), nil
+	}
+
+	fields := columnFields(s.mapper, reflect.ValueOf(entity))
+	values := make([]string, len(s.key))
+	for i, column := range s.key {
+		v, ok := fields[column]
+		if !ok {
+			return "", fmt.Errorf("entity %s does not map key column %s",
+				entity.EntityID(), column)
+		}
+		values[i] = fmt.Sprint(v.Interface())
+	}
+	return strings.Join(values, "\x00"), nil
+}
+
+// upsertSpec returns the upsert spec for the table of the repo.
+func (r *Repo) upsertSpec() upsertSpec {
+	computed := append([]ComputedColumn{}, r.config.ComputedColumns...)
+	if c := r.config.Heartbeat; c != nil {
+		computed = append(computed, c.columns()...)
+	}
+	if c := r.config.ChecksumColumn; c != "" {
+		computed = append(computed, checksumColumn(c))
+	}
+	if c := r.config.Expiration; c != nil {
+		computed = append(computed, c.columns()...)
+	}
+	if r.config.TypeColumn != "" {
+		computed = append(computed, r.typeColumn())
+	}
+	if c := r.config.RowSecurity; c != nil {
+		computed = append(computed, c.column())
+	}
+	key := r.config.KeyColumns
+	if c := r.config.Partition; c != nil && len(key) == 0 {
+		key = c.key()
+	}
+	insertOnly := r.config.InsertOnlyColumns
+	if c := r.config.Audit; c != nil {
+		computed = append(computed, c.columns()...)
+		if c.CreatedColumn != "" {
+			insertOnly = append(append([]string{}, insertOnly...), c.CreatedColumn)
+		}
+	}
+
+	spec := upsertSpec{
+		template:   r.config.Templates.Save,
+		table:      r.config.TableName,
+		mapper:     r.mapper,
+		computed:   computed,
+		key:        key,
+		insertOnly: insertOnly,
+		version:    r.versionColumn(),
+		generated:  r.generatedColumns(),
+	}
+	if r.config.SkipUnchanged {
+		spec.unchanged = r.config.ChecksumColumn
+	}
+
+	return spec
+}
+
+// upsert inserts or updates the entities in the table, in as few statements as
+// the parameter limit allows, and returns the number of affected rows. All
+// entities must map to the same columns. If an ID occurs several times the
+// last entity is used.
+func upsert(ctx context.Context, ex sqlx.ExecerContext, spec upsertSpec,
+	entities []eh.Entity) (int64, error) {
+	if len(entities) == 0 {
+		return 0, nil
+	}
+
+	// Keep the last entity per key, Postgres can't update a row twice in the
+	// same statement.
+	seen := make(map[string]int, len(entities))
+	unique := make([]eh.Entity, 0, len(entities))
+	for _, entity := range entities {
+		if entity.EntityID() == uuid.Nil {
+			return 0, eh.ErrMissingEntityID
+		}
+		key, err := spec.keyOf(entity)
+		if err != nil {
+			return 0, err
+		}
+		if i, ok := seen[key]; ok {
+			unique[i] = entity
+			continue
+		}
+		seen[key] = len(unique)
+		unique = append(unique, entity)
+	}
+
+	columns := entityColumns(spec.mapper, unique[0])
+	rowsPerStatement := maxParams / (len(columns) + len(spec.computed))
+
+	var affected int64
+	for start := 0; start < len(unique); start += rowsPerStatement {
+		end := start + rowsPerStatement
+		if end > len(unique) {
+			end = len(unique)
+		}
+
+		query, args, err := spec.query(columns, unique[start:end])
+		if err != nil {
+			return affected, err
+		}
+		res, err := ex.ExecContext(ctx, query, args...)
+		if err != nil {
+			return affected, err
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return affected, err
+		}
+		affected += n
+	}
+
+	return affected, nil
+}
+
+// upsertReturning upserts the entity and scans the saved row back into it. It
+// returns 0 if no row was saved, because of a newer stored version.
+func upsertReturning(ctx context.Context, q sqlx.QueryerContext, spec upsertSpec,
+	entity eh.Entity) (int64, error) {
+	query, args, err := spec.query(entityColumns(spec.mapper, entity), []eh.Entity{entity})
+	if err != nil {
+		return 0, err
+	}
+	row := q.QueryRowxContext(ctx, query+" RETURNING *", args...)
+	row.Mapper = spec.mapper
+	err = row.StructScan(entity)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+
+	return 1, nil
+}
+
+// query builds a multi-row upsert statement from the save template.
+func (s upsertSpec) query(columns []string,
+	entities []eh.Entity) (string, []interface{}, error) {
+	// Computed columns also mapped by the entity replace its values, the
+	// generated columns are left to Postgres.
+	overridden := make(map[string]bool, len(s.computed)+len(s.generated))
+	for _, c := range s.computed {
+		overridden[c.Name] = true
+	}
+	for _, c := range s.generated {
+		overridden[c] = true
+	}
+
+	args := make([]interface{}, 0, (len(columns)+len(s.computed))*len(entities))
+	rows := make([]string, len(entities))
+	for i, entity := range entities {
+		fields := columnFields(s.mapper, reflect.ValueOf(entity))
+		if len(fields) != len(columns) {
+			return "", nil, fmt.Errorf("entity %s does not map to the columns %v",
+				entity.EntityID(), columns)
+		}
+
+		params := make([]string, 0, len(columns)+len(s.computed))
+		paramOf := make(map[string]string, len(columns))
+		for _, column := range columns {
+			if overridden[column] {
+				continue
+			}
+			v, ok := fields[column]
+			if !ok {
+				return "", nil, fmt.Errorf("entity %s does not map column %s",
+					entity.EntityID(), column)
+			}
+			args = append(args, v.Interface())
+			paramOf[column] = fmt.Sprintf("$%d", len(args))
+			params = append(params, paramOf[column])
+		}
+		for _, c := range s.computed {
+			if c.Func != nil {
+				v, err := c.Func(entity)
+				if err != nil {
+					return "", nil, fmt.Errorf("computed column %s: %w", c.Name, err)
+				}
+				args = append(args, v)
+				params = append(params, fmt.Sprintf("$%d", len(args)))
+				continue
+			}
+			expr, err := c.render(paramOf)
+			if err != nil {
+				return "", nil, err
+			}
+			params = append(params, expr)
+		}
+		rows[i] = "(" + strings.Join(params, ", ") + ")"
+	}
+
+	insertOnly := make(map[string]bool, len(s.insertOnly))
+	for _, column := range s.insertOnly {
+		insertOnly[column] = true
+	}
+	allColumns := make([]string, 0, len(columns)+len(s.computed))
+	excluded := make([]string, 0, len(columns)+len(s.computed))
+	add := func(column, name string) {
+		allColumns = append(allColumns, name)
+		if !insertOnly[column] {
+			excluded = append(excluded, fmt.Sprintf("%s = EXCLUDED.%s", name, name))
+		}
+	}
+	for _, column := range columns {
+		if !overridden[column] {
+			add(column, quoteColumn(column))
+		}
+	}
+	for _, c := range s.computed {
+		add(c.Name, c.Name)
+	}
+
+	var conds []string
+	if s.versionCheck(entities[0]) {
+		conds = append(conds, fmt.Sprintf("%s.%s <= EXCLUDED.%s", s.table, s.version, s.version))
+	}
+	if s.unchanged != "" {
+		conds = append(conds, fmt.Sprintf("%s.%s IS DISTINCT FROM EXCLUDED.%s",
+			s.table, s.unchanged, s.unchanged))
+	}
+	if s.absent {
+		conds = []string{"false"}
+	}
+	var condition string
+	if len(conds) > 0 {
+		condition = " WHERE " + strings.Join(conds, " AND ")
+	}
+
+	query := render(s.template, map[string]string{
+		"table":     s.table,
+		"key":       strings.Join(s.keyColumns(), ", "),
+		"columns":   strings.Join(allColumns, ", "),
+		"values":    strings.Join(rows, ", "),
+		"updates":   strings.Join(excluded, ", "),
+		"condition": condition,
+	})
+
+	return query, args, nil
+}
+
+// entityColumns returns the columns mapped by the entity, in name order.
+func entityColumns(m *reflectx.Mapper, entity eh.Entity) []string {
+	fields := columnFields(m, reflect.ValueOf(entity))
+	columns := make([]string, 0, len(fields))
+	for column := range fields {
+		columns = append(columns, column)
+	}
+	sort.Strings(columns)
+
+	return columns
+}
+
+// validTableName reports if s is a valid, optionally schema qualified, table
+// name.
+func validTableName(s string) bool {
+	parts := strings.Split(s, ".")
+	if len(parts) > 2 {
+		return false
+	}
+	for _, part := range parts {
+		if !validIdentifier(part) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,206 @@
+package repo
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	eh "github.com/looplab/eventhorizon"
+
+	"github.com/eendLabs/eh-pg/pkg/mocks"
+)
+
+func TestUpsertQuery(t *testing.T) {
+	m1 := &mocks.Model{ID: uuid.New(), Content: "m1", CreatedAt: time.Now()}
+	m2 := &mocks.Model{ID: uuid.New(), Content: "m2", CreatedAt: time.Now()}
+
+	columns := entityColumns(defaultMapper, m1)
+	if len(columns) != 4 || columns[0] != "content" || columns[3] != "version" {
+		t.Error("the columns should be correct:", columns)
+	}
+
+	query, args, err := upsertSpec{
+		mapper:   defaultMapper,
+		template: DefaultTemplates.Save,
+		table:    "models",
+	}.query(columns, []eh.Entity{m1, m2})
+	if err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	expected := "INSERT INTO models (content, created_at, id, version) " +
+		"VALUES ($1, $2, $3, $4), ($5, $6, $7, $8) " +
+		"ON CONFLICT (id) DO UPDATE SET content = EXCLUDED.content, " +
+		"created_at = EXCLUDED.created_at, id = EXCLUDED.id, " +
+		"version = EXCLUDED.version"
+	if query != expected {
+		t.Error("the query should be correct:", query)
+	}
+	if len(args) != 8 || args[0] != "m1" || args[6] != m2.ID {
+		t.Error("the args should be correct:", args)
+	}
+}
+
+func TestValidTableName(t *testing.T) {
+	for name, valid := range map[string]bool{
+		"models":           true,
+		"public.models":    true,
+		"a.b.c":            false,
+		"models; DROP ALL": false,
+		"":                 false,
+	} {
+		if validTableName(name) != valid {
+			t.Error("the table name validity should be correct:", name)
+		}
+	}
+}
+
+func TestUpsertQueryComputed(t *testing.T) {
+	m := &mocks.Model{ID: uuid.New(), Content: "Model", Version: 2}
+	spec := upsertSpec{
+		mapper:   defaultMapper,
+		template: DefaultTemplates.Save,
+		table:    "models",
+		computed: []ComputedColumn{
+			{Name: "search_text", Expr: "lower({content})"},
+			{Name: "double_version", Func: func(e eh.Entity) (interface{}, error) {
+				return e.(*mocks.Model).Version * 2, nil
+			}},
+		},
+	}
+
+	query, args, err := spec.query(entityColumns(defaultMapper, m), []eh.Entity{m})
+	if err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	expected := "INSERT INTO models (content, created_at, id, version, " +
+		"search_text, double_version) " +
+		"VALUES ($1, $2, $3, $4, (lower($1)), $5) " +
+		"ON CONFLICT (id) DO UPDATE SET content = EXCLUDED.content, " +
+		"created_at = EXCLUDED.created_at, id = EXCLUDED.id, " +
+		"version = EXCLUDED.version, search_text = EXCLUDED.search_text, " +
+		"double_version = EXCLUDED.double_version"
+	if query != expected {
+		t.Error("the query should be correct:", query)
+	}
+	if len(args) != 5 || args[4] != 4 {
+		t.Error("the args should be correct:", args)
+	}
+
+	spec.computed = []ComputedColumn{{Name: "search_text", Expr: "lower({title})"}}
+	if _, _, err := spec.query(entityColumns(defaultMapper, m), []eh.Entity{m}); !errors.Is(err, ErrInvalidComputedColumn) {
+		t.Error("there should be a ErrInvalidComputedColumn error:", err)
+	}
+
+	if err := (ComputedColumn{Name: "x"}).validate(); !errors.Is(err, ErrInvalidComputedColumn) {
+		t.Error("there should be a ErrInvalidComputedColumn error:", err)
+	}
+}
+
+func TestUpsertQueryKey(t *testing.T) {
+	m1 := &mocks.Model{ID: uuid.New(), Content: "m", Version: 1}
+	m2 := &mocks.Model{ID: uuid.New(), Content: "m", Version: 2}
+	spec := upsertSpec{
+		mapper:   defaultMapper,
+		template: DefaultTemplates.Save,
+		table:    "models",
+		key:      []string{"content", "version"},
+	}
+
+	query, _, err := spec.query(entityColumns(defaultMapper, m1), []eh.Entity{m1})
+	if err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	if !strings.Contains(query, "ON CONFLICT (content, version) DO UPDATE") {
+		t.Error("the conflict target should be the key:", query)
+	}
+
+	k1, err := spec.keyOf(m1)
+	if err != nil {
+		t.Error("there should be no error:", err)
+	}
+	k2, _ := spec.keyOf(m2)
+	k3, _ := spec.keyOf(&mocks.Model{ID: uuid.New(), Content: "m", Version: 1})
+	if k1 == k2 || k1 != k3 {
+		t.Error("the keys should be correct:", k1, k2, k3)
+	}
+
+	spec.key = []string{"sku"}
+	if _, err := spec.keyOf(m1); err == nil {
+		t.Error("there should be an error")
+	}
+}
+
+type versionedModel struct {
+	mocks.Model
+}
+
+func (m *versionedModel) AggregateVersion() int {
+	return m.Version
+}
+
+func TestUpsertQueryVersion(t *testing.T) {
+	spec := upsertSpec{
+		mapper:   defaultMapper,
+		template: DefaultTemplates.Save,
+		table:    "models",
+		version:  "version",
+	}
+
+	m := &versionedModel{mocks.Model{ID: uuid.New(), Version: 2}}
+	query, _, err := spec.query(entityColumns(defaultMapper, m), []eh.Entity{m})
+	if err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	if !strings.HasSuffix(query, "version = EXCLUDED.version WHERE models.version <= EXCLUDED.version") {
+		t.Error("the query should check the version:", query)
+	}
+
+	// Not versioned.
+	query, _, _ = spec.query(entityColumns(defaultMapper, &m.Model), []eh.Entity{&m.Model})
+	if strings.Contains(query, "WHERE") {
+		t.Error("the query should not check the version:", query)
+	}
+
+	// Versioned but the version column is not mapped.
+	spec.version = "revision"
+	query, _, _ = spec.query(entityColumns(defaultMapper, m), []eh.Entity{m})
+	if strings.Contains(query, "WHERE") {
+		t.Error("the query should not check the version:", query)
+	}
+}
+
+func TestUpsertQueryInsertOnly(t *testing.T) {
+	m := &mocks.Model{ID: uuid.New()}
+	query, _, err := upsertSpec{
+		mapper:     defaultMapper,
+		template:   DefaultTemplates.Save,
+		table:      "models",
+		insertOnly: []string{"created_at", "id"},
+	}.query(entityColumns(defaultMapper, m), []eh.Entity{m})
+	if err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	if !strings.HasSuffix(query, "ON CONFLICT (id) DO UPDATE SET "+
+		"content = EXCLUDED.content, version = EXCLUDED.version") {
+		t.Error("the insert only columns should not be updated:", query)
+	}
+}
+
+func TestUpsertQueryAbsent(t *testing.T) {
+	m := &versionedModel{mocks.Model{ID: uuid.New(), Version: 2}}
+	query, _, err := upsertSpec{
+		mapper:   defaultMapper,
+		template: DefaultTemplates.Save,
+		table:    "models",
+		version:  "version",
+		absent:   true,
+	}.query(entityColumns(defaultMapper, m), []eh.Entity{m})
+	if err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	if !strings.HasSuffix(query, "version = EXCLUDED.version WHERE false") {
+		t.Error("the query should never update:", query)
+	}
+}
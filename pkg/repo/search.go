@@ -0,0 +1,132 @@
+package repo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+	eh "github.com/looplab/eventhorizon"
+)
+
+// ErrInvalidSearch is when the full-text search config is not valid.
+var ErrInvalidSearch = errors.New("invalid search config")
+
+// SearchConfig enables full-text search over text columns of the entity. The
+// columns feed a generated tsvector column with a GIN index, created by
+// EnsureSearch, which is queried by Search. Generated columns require
+// Postgres 12.
+type SearchConfig struct {
+	// Column is the generated tsvector column, "search" by default.
+	Column string
+	// Fields are the text columns feeding the search column.
+	Fields []string
+	// Language is the text search configuration, "english" by default.
+	Language string
+}
+
+func (c *SearchConfig) provideDefaults() {
+	if c.Column == "" {
+		c.Column = "search"
+	}
+	if c.Language == "" {
+		c.Language = "english"
+	}
+}
+
+func (c *SearchConfig) validate() error {
+	if !validIdentifier(c.Column) {
+		return fmt.Errorf("%w: invalid column %q", ErrInvalidSearch, c.Column)
+	}
+	if !validIdentifier(c.Language) {
+		return fmt.Errorf("%w: invalid language %q", ErrInvalidSearch, c.Language)
+	}
+	if len(c.Fields) == 0 {
+		return fmt.Errorf("%w: no fields", ErrInvalidSearch)
+	}
+	for _, f := range c.Fields {
+		if !validIdentifier(f) {
+			return fmt.Errorf("%w: invalid field %q", ErrInvalidSearch, f)
+		}
+	}
+	return nil
+}
+
+// tsquery returns the tsquery expression for the search text at $n.
+func (c *SearchConfig) tsquery(n int) string {
+	return fmt.Sprintf("websearch_to_tsquery('%s', $%d)", c.Language, n)
+}
+
+// EnsureSearch adds the generated search column and its GIN index to the
+// table if they don't exist.
+func (r *Repo) EnsureSearch(ctx context.Context) error {
+	c := r.config.Search
+	if c == nil {
+		return nil
+	}
+
+	fields := make([]string, len(c.Fields))
+	for i, f := range c.Fields {
+		fields[i] = fmt.Sprintf("coalesce(%s, '')", f)
+	}
+	query := fmt.Sprintf(`
+	ALTER TABLE %[1]s ADD COLUMN IF NOT EXISTS %[2]s tsvector
+	    GENERATED ALWAYS AS (to_tsvector('%[3]s', %[4]s)) STORED;
+	CREATE INDEX IF NOT EXISTS %[1]s_%[2]s_idx ON %[1]s USING GIN (%[2]s);`,
+		r.config.TableName, c.Column, c.Language, strings.Join(fields, " || ' ' || "))
+
+	return r.writeTx(ctx, func(tx *sqlx.Tx) error {
+		if err := lockSchema(ctx, tx, r.config.TableName); err != nil {
+			return err
+		}
+		_, err := tx.ExecContext(ctx, query)
+		return err
+	})
+}
+
+// Search returns the entities matching the search text, best matches first
+// unless ordered by WithOrderBy. The text is parsed with websearch_to_tsquery,
+// so quoted phrases, "or" and "-" are supported.
+func (r *Repo) Search(ctx context.Context, text string,
+	opts ...QueryOption) ([]eh.Entity, error) {
+	if r.factoryFn == nil {
+		return nil, eh.RepoError{
+			Err:       ErrModelNotSet,
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	}
+	if r.config.Search == nil {
+		return nil, eh.RepoError{
+			Err:       eh.ErrCouldNotLoadEntity,
+			BaseErr:   fmt.Errorf("%w: search not configured", ErrInvalidSearch),
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	}
+
+	var o queryOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if err := o.validate(r.mapper, r.factoryFn()); err != nil {
+		return nil, eh.RepoError{
+			Err:       eh.ErrCouldNotLoadEntity,
+			BaseErr:   err,
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	}
+
+	query, args := r.searchQuery(text, o)
+	return r.query(ctx, query, args...)
+}
+
+func (r *Repo) searchQuery(text string, o queryOptions) (string, []interface{}) {
+	c := r.config.Search
+	query := o.selectFrom(r.liveRows(r.config.TableName)) +
+		fmt.Sprintf(" WHERE %s @@ %s", c.Column, c.tsquery(1))
+	if len(o.orderBy) == 0 {
+		query += fmt.Sprintf(" ORDER BY ts_rank(%s, %s) DESC, id", c.Column, c.tsquery(1))
+	}
+
+	return o.apply(query, []interface{}{text})
+}
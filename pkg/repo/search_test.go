@@ -0,0 +1,54 @@
+package repo
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/jmoiron/sqlx"
+)
+
+func TestSearchQuery(t *testing.T) {
+	db, err := sqlx.Open("postgres", "")
+	if err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	r, err := NewRepoWithClient(&Config{
+		TableName: "models",
+		Search:    &SearchConfig{Fields: []string{"content"}},
+	}, db)
+	if err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+
+	query, args := r.searchQuery("foo bar", queryOptions{limit: 10})
+	expected := "SELECT * FROM models " +
+		"WHERE search @@ websearch_to_tsquery('english', $1) " +
+		"ORDER BY ts_rank(search, websearch_to_tsquery('english', $1)) DESC, id " +
+		"LIMIT $2"
+	if query != expected {
+		t.Error("the query should be correct:", query)
+	}
+	if len(args) != 2 || args[0] != "foo bar" || args[1] != 10 {
+		t.Error("the args should be correct:", args)
+	}
+
+	// Explicit ordering replaces the ranking.
+	query, _ = r.searchQuery("foo", queryOptions{
+		orderBy: []orderBy{{column: "version", direction: Desc}},
+	})
+	if query != "SELECT * FROM models "+
+		"WHERE search @@ websearch_to_tsquery('english', $1) ORDER BY version DESC, id DESC" {
+		t.Error("the query should be correct:", query)
+	}
+
+	for _, c := range []*SearchConfig{
+		{},
+		{Fields: []string{"content; --"}},
+		{Fields: []string{"content"}, Language: "english'"},
+	} {
+		_, err := NewRepoWithClient(&Config{TableName: "models", Search: c}, db)
+		if !errors.Is(err, ErrInvalidSearch) {
+			t.Error("there should be a ErrInvalidSearch error:", err)
+		}
+	}
+}
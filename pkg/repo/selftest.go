@@ -0,0 +1,128 @@
+package repo
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"reflect"
+	"time"
+
+	"github.com/google/uuid"
+	eh "github.com/looplab/eventhorizon"
+)
+
+// SelftestCheck is the result of one check of Selftest.
+type SelftestCheck struct {
+	Name     string
+	Err      error
+	Duration time.Duration
+}
+
+// SelftestReport is the result of Selftest.
+type SelftestReport struct {
+	Checks []SelftestCheck
+}
+
+// OK reports if all checks passed.
+func (r SelftestReport) OK() bool {
+	for _, c := range r.Checks {
+		if c.Err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// Selftest exercises the database features used by the repo and returns a
+// report of the checks: connecting, the schema (see Ready), a round-trip
+// write, read and delete of a scratch entity, LISTEN/NOTIFY and advisory
+// locks. The round-trip runs in a transaction that is rolled back, leaving no
+// trace. It is handy to verify new environments and their permissions.
+func (r *Repo) Selftest(ctx context.Context) SelftestReport {
+	var report SelftestReport
+	run := func(name string, check func(context.Context) error) {
+		start := time.Now()
+		err := check(ctx)
+		report.Checks = append(report.Checks, SelftestCheck{
+			Name:     name,
+			Err:      err,
+			Duration: time.Since(start),
+		})
+	}
+
+	run("connect", func(ctx context.Context) error {
+		return r.client.PingContext(ctx)
+	})
+	run("schema", func(ctx context.Context) error {
+		return r.Ready(ctx)
+	})
+	run("round-trip", r.selftestRoundTrip)
+	run("listen/notify", func(ctx context.Context) error {
+		conn, err := r.client.Connx(ctx)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		_, err = conn.ExecContext(ctx,
+			"LISTEN eh_selftest; NOTIFY eh_selftest; UNLISTEN eh_selftest")
+		return err
+	})
+	run("advisory lock", func(ctx context.Context) error {
+		conn, err := r.client.Connx(ctx)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		var locked bool
+		if err := conn.GetContext(ctx, &locked,
+			"SELECT pg_try_advisory_lock(hashtext('eh_selftest'))"); err != nil {
+			return err
+		}
+		if !locked {
+			return errors.New("lock held by another session")
+		}
+		_, err = conn.ExecContext(ctx, "SELECT pg_advisory_unlock(hashtext('eh_selftest'))")
+		return err
+	})
+
+	return report
+}
+
+// selftestRoundTrip saves, finds and removes a scratch entity in a rolled back
+// transaction.
+func (r *Repo) selftestRoundTrip(ctx context.Context) error {
+	if r.factoryFn == nil {
+		return ErrModelNotSet
+	}
+	entity := r.factoryFn()
+	id := uuid.New()
+	v := reflect.Indirect(reflect.ValueOf(entity))
+	field, ok := columnFields(r.mapper, v)["id"]
+	if !ok || !field.CanSet() || field.Type() != reflect.TypeOf(id) {
+		return errors.New("the entity has no settable uuid.UUID id field")
+	}
+	field.Set(reflect.ValueOf(id))
+
+	tx, err := r.client.BeginTxx(ctx, &sql.TxOptions{})
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if n, err := upsert(ctx, tx, r.upsertSpec(), []eh.Entity{entity}); err != nil {
+		return fmt.Errorf("write: %w", err)
+	} else if n != 1 {
+		return fmt.Errorf("write: %d rows affected", n)
+	}
+	if err := tx.GetContext(ctx, r.factoryFn(), render(r.config.Templates.Find,
+		map[string]string{"table": r.config.TableName}), id.String()); err != nil {
+		return fmt.Errorf("read: %w", err)
+	}
+	if _, err := tx.ExecContext(ctx, render(r.config.Templates.Remove,
+		map[string]string{"table": r.config.TableName}), id); err != nil {
+		return fmt.Errorf("delete: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,38 @@
+package repo
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/jmoiron/sqlx"
+	eh "github.com/looplab/eventhorizon"
+
+	"github.com/eendLabs/eh-pg/pkg/mocks"
+)
+
+func TestSelftestUnreachable(t *testing.T) {
+	db, err := sqlx.Open("postgres", "host=127.0.0.1 port=1 connect_timeout=1")
+	if err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	r, err := NewRepoWithClient(&Config{TableName: "models"}, db)
+	if err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	r.SetEntityFactory(func() eh.Entity { return &mocks.Model{} })
+
+	report := r.Selftest(context.Background())
+	if report.OK() {
+		t.Error("the report should not be ok")
+	}
+	if len(report.Checks) != 5 || report.Checks[0].Name != "connect" ||
+		report.Checks[0].Err == nil {
+		t.Error("the checks should be reported:", report.Checks)
+	}
+
+	r.SetEntityFactory(nil)
+	if err := r.selftestRoundTrip(context.Background()); !errors.Is(err, ErrModelNotSet) {
+		t.Error("there should be a ErrModelNotSet error:", err)
+	}
+}
@@ -0,0 +1,156 @@
+package repo
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	eh "github.com/looplab/eventhorizon"
+)
+
+// SoftDeleteConfig makes Remove mark the rows as deleted instead of deleting
+// them. Soft-deleted entities are excluded from all finds and can be listed
+// with FindDeleted, brought back with Restore and deleted with Purge. The
+// column must exist in the table but not be mapped by the entity.
+type SoftDeleteConfig struct {
+	// Column is the timestamp column set when removed, "deleted_at" by
+	// default.
+	Column string
+}
+
+func (c *SoftDeleteConfig) provideDefaults() {
+	if c.Column == "" {
+		c.Column = "deleted_at"
+	}
+}
+
+func (c *SoftDeleteConfig) validate() error {
+	if !validIdentifier(c.Column) {
+		return fmt.Errorf("%w: soft delete column %q", ErrInvalidColumn, c.Column)
+	}
+	return nil
+}
+
+// WithHardDelete returns a context making Remove delete the row even if soft
+// delete is configured.
+func WithHardDelete(ctx context.Context) context.Context {
+	return context.WithValue(ctx, hardDeleteKey, true)
+}
+
+func hardDeleteFromContext(ctx context.Context) bool {
+	hard, _ := ctx.Value(hardDeleteKey).(bool)
+	return hard
+}
+
+// liveRows returns the table as a source without the soft-deleted and
+// expired rows, or the table itself without soft delete and expiration. The
+// source is a subquery aliased as the table, which Postgres inlines so the
+// indexes of the table are used.
+func (r *Repo) liveRows(table string) string {
+	var conds []string
+	if c := r.config.SoftDelete; c != nil {
+		conds = append(conds, c.Column+" IS NULL")
+	}
+	if c := r.config.Expiration; c != nil {
+		conds = append(conds, fmt.Sprintf("(%[1]s IS NULL OR %[1]s > now())", c.Column))
+	}
+	if len(conds) == 0 {
+		return table
+	}
+	alias := table[strings.LastIndex(table, ".")+1:]
+	return fmt.Sprintf("(SELECT * FROM %s WHERE %s) AS %s",
+		table, strings.Join(conds, " AND "), alias)
+}
+
+// softRemove marks the entity as deleted.
+func (r *Repo) softRemove(ctx context.Context, id uuid.UUID) error {
+	return r.setDeleted(ctx, id, eh.ErrCouldNotRemoveEntity,
+		fmt.Sprintf("UPDATE %[1]s SET %[2]s = now() WHERE id = $1 AND %[2]s IS NULL",
+			r.config.TableName, r.config.SoftDelete.Column))
+}
+
+// Restore brings back a soft-deleted entity. It returns an
+// eh.ErrEntityNotFound error if there is no soft-deleted entity with the ID.
+func (r *Repo) Restore(ctx context.Context, id uuid.UUID) error {
+	c := r.config.SoftDelete
+	if c == nil {
+		return eh.RepoError{
+			Err:       eh.ErrCouldNotSaveEntity,
+			BaseErr:   fmt.Errorf("soft delete not configured"),
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	}
+
+	return r.setDeleted(ctx, id, eh.ErrCouldNotSaveEntity,
+		fmt.Sprintf("UPDATE %[1]s SET %[2]s = NULL WHERE id = $1 AND %[2]s IS NOT NULL",
+			r.config.TableName, c.Column))
+}
+
+// Purge deletes the entities soft-deleted longer than olderThan ago and
+// returns the number of deleted rows, for periodically dropping old
+// tombstones.
+func (r *Repo) Purge(ctx context.Context, olderThan time.Duration) (int64, error) {
+	c := r.config.SoftDelete
+	if c == nil || olderThan < 0 {
+		err := fmt.Errorf("soft delete not configured")
+		if c != nil {
+			err = fmt.Errorf("negative age: %s", olderThan)
+		}
+		return 0, eh.RepoError{
+			Err:       eh.ErrCouldNotRemoveEntity,
+			BaseErr:   err,
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	}
+
+	affected, err := r.execAffected(ctx, eh.ErrCouldNotRemoveEntity, fmt.Sprintf(
+		"DELETE FROM %[1]s WHERE %[2]s < now() - $1 * interval '1 millisecond'",
+		r.config.TableName, c.Column), olderThan.Milliseconds())
+	if err != nil {
+		return 0, err
+	}
+	r.autoAnalyze(ctx, r.config.TableName)
+
+	return affected, nil
+}
+
+// setDeleted runs the update of the deleted column for the ID.
+func (r *Repo) setDeleted(ctx context.Context, id uuid.UUID, errKind error,
+	query string) error {
+	n, err := r.execAffected(ctx, errKind, query, id)
+	if err != nil {
+		return err
+	}
+	if n < 1 {
+		return eh.RepoError{
+			Err:       eh.ErrEntityNotFound,
+			BaseErr:   &NotFoundError{ID: id, Table: r.config.TableName},
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	}
+
+	return nil
+}
+
+// FindDeleted returns the soft-deleted entities, the most recently deleted
+// first.
+func (r *Repo) FindDeleted(ctx context.Context) ([]eh.Entity, error) {
+	c := r.config.SoftDelete
+	if c == nil || r.factoryFn == nil {
+		err := ErrModelNotSet
+		if c == nil {
+			err = fmt.Errorf("soft delete not configured")
+		}
+		return nil, eh.RepoError{
+			Err:       eh.ErrCouldNotLoadEntity,
+			BaseErr:   err,
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	}
+
+	return r.query(ctx, fmt.Sprintf(
+		"SELECT * FROM %[1]s WHERE %[2]s IS NOT NULL ORDER BY %[2]s DESC, id",
+		r.config.TableName, c.Column))
+}
@@ -0,0 +1,53 @@
+package repo
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+func TestSoftDelete(t *testing.T) {
+	db, err := sqlx.Open("postgres", "")
+	if err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+
+	config := &Config{TableName: "public.models", SoftDelete: &SoftDeleteConfig{}}
+	r, err := NewRepoWithClient(config, db)
+	if err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	if config.SoftDelete.Column != "deleted_at" {
+		t.Error("the column should be the default:", config.SoftDelete.Column)
+	}
+	if table := r.readTable(); table != "(SELECT * FROM public.models WHERE deleted_at IS NULL) AS models" {
+		t.Error("the soft-deleted rows should be excluded:", table)
+	}
+
+	r, err = NewRepoWithClient(&Config{TableName: "models"}, db)
+	if err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	if table := r.readTable(); table != "models" {
+		t.Error("the table should be read directly:", table)
+	}
+
+	if _, err := NewRepoWithClient(&Config{
+		TableName:  "models",
+		SoftDelete: &SoftDeleteConfig{Column: "deleted at"},
+	}, db); !errors.Is(err, ErrInvalidColumn) {
+		t.Error("there should be a ErrInvalidColumn error:", err)
+	}
+
+	ctx := context.Background()
+	if _, err := r.Purge(ctx, time.Hour); err == nil {
+		t.Error("there should be an error without soft delete")
+	}
+
+	if hardDeleteFromContext(ctx) || !hardDeleteFromContext(WithHardDelete(ctx)) {
+		t.Error("the hard delete should be set by the context")
+	}
+}
@@ -0,0 +1,492 @@
+package repo
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5/pgtype"
+	"github.com/jmoiron/sqlx"
+	"github.com/jmoiron/sqlx/reflectx"
+	eh "github.com/looplab/eventhorizon"
+	"github.com/shopspring/decimal"
+)
+
+// ErrInvalidTag is when a pg struct tag is not valid.
+var ErrInvalidTag = errors.New("invalid pg tag")
+
+// ErrCouldNotEnsureSchema is when a table, an index or another schema object
+// could not be created.
+var ErrCouldNotEnsureSchema = errors.New("could not ensure schema")
+
+var (
+	timeType     = reflect.TypeOf(time.Time{})
+	durationType = reflect.TypeOf(time.Duration(0))
+	uuidType     = reflect.TypeOf(uuid.UUID{})
+	pointType    = reflect.TypeOf(Point{})
+	rawJSONType  = reflect.TypeOf(json.RawMessage{})
+)
+
+// numericTypes are the arbitrary precision number types, stored as numeric
+// instead of text like the other value types.
+var numericTypes = map[reflect.Type]bool{
+	reflect.TypeOf(decimal.Decimal{}):     true,
+	reflect.TypeOf(decimal.NullDecimal{}): true,
+	reflect.TypeOf(pgtype.Numeric{}):      true,
+}
+
+// sqlNullTypes are the column types of the sql.Null types.
+var sqlNullTypes = map[reflect.Type]string{
+	reflect.TypeOf(sql.NullString{}):  "text",
+	reflect.TypeOf(sql.NullBool{}):    "boolean",
+	reflect.TypeOf(sql.NullInt16{}):   "smallint",
+	reflect.TypeOf(sql.NullInt32{}):   "integer",
+	reflect.TypeOf(sql.NullInt64{}):   "bigint",
+	reflect.TypeOf(sql.NullFloat64{}): "double precision",
+	reflect.TypeOf(sql.NullTime{}):    "timestamptz",
+}
+
+// EnsureTable creates the table of the entities if it doesn't exist, with a
+// column for each field mapped by the entity and the columns written by the
+// repo itself, like the soft delete and audit columns, and the
+// GeneratedColumns. The columns of ComputedColumns are not created, as their
+// type is not known. It is meant for tests and new deployments, the table is
+// not altered if it exists.
+//
+// The column types are inferred from the field types, a pg struct tag
+// overrides the type and adds constraints:
+//
+//	Price decimal.Decimal `db:"price" pg:"type:numeric(12,2),notnull,default:0"`
+//
+// The collate option sets the collation of a text column, used to compare and
+// sort it, like a case-insensitive ICU collation:
+//
+//	Name string `db:"name" pg:"collate:und-u-ks-level2"`
+//
+// The collation must exist, see CREATE COLLATION. Note that LIKE, and so
+// filters like HasPrefixFold, don't support nondeterministic collations.
+//
+// Ready checks the types, NOT NULL constraints and collations of the tagged
+// columns. With Config.Partition the table is partitioned, see
+// PartitionConfig. The indexes of Config.Indexes and the foreign keys of
+// Config.ForeignKeys are created with the table.
+//
+// It is safe to call from several instances starting at the same time: the
+// DDL is run in a transaction holding an advisory lock keyed by the table, so
+// the other instances wait for it.
+func (r *Repo) EnsureTable(ctx context.Context) error {
+	if r.factoryFn == nil {
+		return eh.RepoError{
+			Err:       ErrModelNotSet,
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	}
+
+	query, err := r.createTableQuery(r.factoryFn())
+	if err != nil {
+		return eh.RepoError{
+			Err:       err,
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	}
+
+	return r.writeTx(ctx, func(tx *sqlx.Tx) error {
+		if err := lockSchema(ctx, tx, r.config.TableName); err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, query); err != nil {
+			return eh.RepoError{
+				Err:       ErrCouldNotEnsureSchema,
+				BaseErr:   err,
+				Namespace: eh.NamespaceFromContext(ctx),
+			}
+		}
+		return r.ensureConfigIndexes(ctx, tx, r.config.TableName, indexOptions{})
+	})
+}
+
+// lockSchema takes the advisory lock of the DDL of the table until the end of
+// the transaction, so that instances starting at the same time create it one
+// after the other instead of failing on the objects created concurrently,
+// which IF NOT EXISTS doesn't prevent.
+func lockSchema(ctx context.Context, tx *sqlx.Tx, table string) error {
+	if _, err := tx.ExecContext(ctx,
+		"SELECT pg_advisory_xact_lock(hashtext($1))", "eh_schema:"+table); err != nil {
+		return eh.RepoError{
+			Err:       ErrCouldNotEnsureSchema,
+			BaseErr:   err,
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	}
+	return nil
+}
+
+// ensureSchema runs the DDL of f on the table with the advisory lock of
+// lockSchema, in the transaction of writeTx. With concurrently it runs on a
+// dedicated connection holding the lock for the session instead, as CREATE
+// INDEX CONCURRENTLY can't run in a transaction, and the table passed to f is
+// qualified by the schema of the namespace of Config.NamespaceSchemas, as the
+// search_path is not set on the connection.
+func (r *Repo) ensureSchema(ctx context.Context, concurrently bool,
+	f func(ex sqlx.ExecerContext, table string) error) error {
+	if !concurrently {
+		return r.writeTx(ctx, func(tx *sqlx.Tx) error {
+			if err := lockSchema(ctx, tx, r.config.TableName); err != nil {
+				return err
+			}
+			return f(tx, r.config.TableName)
+		})
+	}
+
+	table := r.config.TableName
+	if r.config.NamespaceSchemas != nil {
+		var err error
+		if table, err = r.namespaceTable(eh.NamespaceFromContext(ctx)); err != nil {
+			return eh.RepoError{
+				Err:       err,
+				Namespace: eh.NamespaceFromContext(ctx),
+			}
+		}
+	}
+
+	release, err := r.acquireWrite(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	conn, err := r.client.Connx(ctx)
+	if err != nil {
+		return eh.RepoError{
+			Err:       ErrCouldNotEnsureSchema,
+			BaseErr:   err,
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	}
+	defer conn.Close()
+
+	key := "eh_schema:" + r.config.TableName
+	if _, err := conn.ExecContext(ctx,
+		"SELECT pg_advisory_lock(hashtext($1))", key); err != nil {
+		return eh.RepoError{
+			Err:       ErrCouldNotEnsureSchema,
+			BaseErr:   err,
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	}
+	defer func() {
+		// Unlock even if the context is done, the connection returns to the
+		// pool still holding the session lock otherwise. If that fails,
+		// discard the connection, closing the session releases the lock.
+		if _, err := conn.ExecContext(context.Background(),
+			"SELECT pg_advisory_unlock(hashtext($1))", key); err != nil {
+			conn.Raw(func(interface{}) error {
+				return driver.ErrBadConn
+			})
+		}
+	}()
+
+	return f(conn, table)
+}
+
+// createTableQuery returns the CREATE TABLE statement for the entity.
+func (r *Repo) createTableQuery(entity eh.Entity) (string, error) {
+	tags, err := columnTags(r.mapper, entity)
+	if err != nil {
+		return "", err
+	}
+
+	fields := columnFields(r.mapper, reflect.ValueOf(entity))
+	columns := make([]string, 0, len(fields))
+	for column := range fields {
+		columns = append(columns, column)
+	}
+	sort.Strings(columns)
+
+	generated := make(map[string]GeneratedColumn, len(r.config.GeneratedColumns))
+	for _, g := range r.config.GeneratedColumns {
+		generated[g.Name] = g
+	}
+
+	defs := make([]string, 0, len(columns))
+	for _, column := range columns {
+		if g, ok := generated[column]; ok {
+			defs = append(defs, quoteColumn(column)+" "+g.definition())
+			continue
+		}
+		tag := tags[column]
+		typ := tag.Type
+		if typ == "" {
+			typ = columnType(fields[column].Type())
+		}
+		def := quoteColumn(column) + " " + typ + collate(tag.Collation)
+		if tag.NotNull {
+			def += " NOT NULL"
+		}
+		if tag.Default != "" {
+			def += " DEFAULT " + tag.Default
+		}
+		if column == "id" && r.config.Partition == nil {
+			def += " PRIMARY KEY"
+		}
+		defs = append(defs, def)
+	}
+
+	for _, c := range r.repoColumns() {
+		if _, ok := fields[c[0]]; !ok {
+			defs = append(defs, c[0]+" "+c[1])
+		}
+	}
+	for _, g := range r.config.GeneratedColumns {
+		if _, ok := fields[g.Name]; !ok {
+			defs = append(defs, g.Name+" "+g.definition())
+		}
+	}
+	if c := r.config.Partition; c != nil {
+		// The primary key of a partitioned table must include the column.
+		defs = append(defs, fmt.Sprintf("PRIMARY KEY (%s)", strings.Join(c.key(), ", ")))
+	}
+	if len(r.config.KeyColumns) > 0 {
+		defs = append(defs, fmt.Sprintf("UNIQUE (%s)", strings.Join(r.config.KeyColumns, ", ")))
+	}
+	for _, fk := range r.config.ForeignKeys {
+		defs = append(defs, fk.constraint(r.config.TableName))
+	}
+
+	query := fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (\n    %s\n)",
+		r.config.TableName, strings.Join(defs, ",\n    "))
+	if c := r.config.Partition; c != nil {
+		query += " " + c.partitionedBy()
+		if c.Strategy == PartitionHash {
+			query += ";\n" + c.hashPartitionsQuery(r.config.TableName)
+		}
+	}
+
+	return query, nil
+}
+
+// columnTag are the DDL options of a column given by the pg struct tag of its
+// field.
+type columnTag struct {
+	Type      string
+	NotNull   bool
+	Default   string
+	Collation string
+}
+
+// columnTags returns the parsed pg tags of the columns of the entity.
+func columnTags(m *reflectx.Mapper, entity interface{}) (map[string]columnTag, error) {
+	t := reflectx.Deref(reflect.TypeOf(entity))
+	tags := map[string]columnTag{}
+	for column, fi := range m.TypeMap(t).Names {
+		tag, ok := fi.Field.Tag.Lookup("pg")
+		if !ok || !isColumn(fi) {
+			continue
+		}
+		c, err := parseColumnTag(tag)
+		if err != nil {
+			return nil, fmt.Errorf("%w of column %s", err, column)
+		}
+		tags[column] = c
+	}
+	return tags, nil
+}
+
+// parseColumnTag parses a pg struct tag of type, notnull, default and collate
+// options separated by commas. Commas in parentheses and quotes don't separate
+// options, so that the type and the default can contain them.
+func parseColumnTag(tag string) (columnTag, error) {
+	var c columnTag
+	for _, opt := range splitTag(tag) {
+		key, value := opt, ""
+		if i := strings.IndexByte(opt, ':'); i >= 0 {
+			key, value = opt[:i], strings.TrimSpace(opt[i+1:])
+		}
+		switch strings.TrimSpace(key) {
+		case "type":
+			if value == "" {
+				return c, fmt.Errorf("%w: empty type", ErrInvalidTag)
+			}
+			c.Type = value
+		case "notnull":
+			c.NotNull = true
+		case "default":
+			if value == "" {
+				return c, fmt.Errorf("%w: empty default", ErrInvalidTag)
+			}
+			c.Default = value
+		case "collate":
+			if value == "" {
+				return c, fmt.Errorf("%w: empty collation", ErrInvalidTag)
+			}
+			c.Collation = value
+		case "":
+		default:
+			return c, fmt.Errorf("%w: unknown option %q", ErrInvalidTag, key)
+		}
+	}
+	if strings.ContainsRune(c.Type+c.Default, ';') {
+		return c, fmt.Errorf("%w: %q", ErrInvalidTag, tag)
+	}
+	return c, nil
+}
+
+// splitTag splits the options of a tag on the commas outside of parentheses
+// and single quotes.
+func splitTag(tag string) []string {
+	var opts []string
+	var depth int
+	var quoted bool
+	start := 0
+	for i, c := range tag {
+		switch {
+		case c == '\'':
+			quoted = !quoted
+		case quoted:
+		case c == '(':
+			depth++
+		case c == ')':
+			depth--
+		case c == ',' && depth == 0:
+			opts = append(opts, tag[start:i])
+			start = i + 1
+		}
+	}
+	return append(opts, tag[start:])
+}
+
+// typeAliases are the names Postgres formats the aliases of types as.
+var typeAliases = map[string]string{
+	"int":         "integer",
+	"int2":        "smallint",
+	"int4":        "integer",
+	"int8":        "bigint",
+	"float4":      "real",
+	"float8":      "double precision",
+	"bool":        "boolean",
+	"decimal":     "numeric",
+	"varchar":     "character varying",
+	"char":        "character",
+	"timestamptz": "timestamp with time zone",
+	"timestamp":   "timestamp without time zone",
+	"timetz":      "time with time zone",
+	"time":        "time without time zone",
+}
+
+// normalizeType returns the type the way Postgres formats it, so that a tag
+// type can be compared to the type of a column, e.g. int4 is integer and
+// numeric(12, 2) is numeric(12,2).
+func normalizeType(typ string) string {
+	typ = strings.ToLower(strings.TrimSpace(typ))
+	typ = strings.ReplaceAll(typ, ", ", ",")
+	base, rest := typ, ""
+	if i := strings.IndexAny(typ, "(["); i >= 0 {
+		base, rest = strings.TrimSpace(typ[:i]), typ[i:]
+	}
+	if alias, ok := typeAliases[base]; ok {
+		base = alias
+	}
+	return base + rest
+}
+
+// repoColumns returns the names and types of the columns written by the repo
+// itself.
+func (r *Repo) repoColumns() [][2]string {
+	var columns [][2]string
+	if c := r.config.TypeColumn; c != "" {
+		columns = append(columns, [2]string{c, "text NOT NULL"})
+	}
+	if c := r.config.Heartbeat; c != nil {
+		columns = append(columns,
+			[2]string{c.ProjectorColumn, "text"},
+			[2]string{c.TimeColumn, "timestamptz"})
+	}
+	if c := r.config.ChecksumColumn; c != "" {
+		columns = append(columns, [2]string{c, "text"})
+	}
+	if c := r.config.Audit; c != nil {
+		for _, column := range []string{c.CreatedColumn, c.UpdatedColumn} {
+			if column != "" {
+				columns = append(columns, [2]string{column, "timestamptz"})
+			}
+		}
+	}
+	if c := r.config.Expiration; c != nil {
+		columns = append(columns, [2]string{c.Column, "timestamptz"})
+	}
+	if c := r.config.SoftDelete; c != nil {
+		columns = append(columns, [2]string{c.Column, "timestamptz"})
+	}
+	if c := r.config.RowSecurity; c != nil {
+		columns = append(columns, [2]string{c.Column, c.Type + " NOT NULL"})
+	}
+	return columns
+}
+
+// columnType returns the Postgres type of a column for a field type. Structs,
+// maps and slices without a better type are stored as jsonb, other value
+// types as text.
+func columnType(t reflect.Type) string {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if typ, ok := sqlNullTypes[t]; ok {
+		return typ
+	}
+
+	switch t {
+	case timeType:
+		return "timestamptz"
+	case durationType:
+		return "bigint"
+	case uuidType:
+		return "uuid"
+	case pointType:
+		return "geometry(Point, 4326)"
+	case rawJSONType:
+		return "jsonb"
+	}
+
+	switch t.Kind() {
+	case reflect.String:
+		return "text"
+	case reflect.Bool:
+		return "boolean"
+	case reflect.Int8, reflect.Int16, reflect.Uint8:
+		return "smallint"
+	case reflect.Int32, reflect.Uint16:
+		return "integer"
+	case reflect.Int, reflect.Int64, reflect.Uint, reflect.Uint32, reflect.Uint64:
+		return "bigint"
+	case reflect.Float32:
+		return "real"
+	case reflect.Float64:
+		return "double precision"
+	case reflect.Slice:
+		switch t.Elem().Kind() {
+		case reflect.Uint8:
+			return "bytea"
+		case reflect.String, reflect.Bool, reflect.Int8, reflect.Int16,
+			reflect.Int32, reflect.Int, reflect.Int64, reflect.Float32, reflect.Float64:
+			// Arrays, see pq.Array.
+			return columnType(t.Elem()) + "[]"
+		}
+		return "jsonb"
+	}
+
+	if numericTypes[t] {
+		return "numeric"
+	}
+	if isValueType(t) {
+		return "text"
+	}
+	return "jsonb"
+}
@@ -0,0 +1,194 @@
+package repo
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5/pgtype"
+	"github.com/jmoiron/sqlx"
+	"github.com/shopspring/decimal"
+
+	"github.com/eendLabs/eh-pg/pkg/mocks"
+)
+
+func TestColumnType(t *testing.T) {
+	type nested struct {
+		A int
+	}
+	for _, c := range []struct {
+		v        interface{}
+		expected string
+	}{
+		{"", "text"},
+		{true, "boolean"},
+		{int16(0), "smallint"},
+		{int32(0), "integer"},
+		{0, "bigint"},
+		{0.5, "double precision"},
+		{time.Time{}, "timestamptz"},
+		{time.Second, "bigint"},
+		{Point{}, "geometry(Point, 4326)"},
+		{sql.NullString{}, "text"},
+		{&time.Time{}, "timestamptz"},
+		{nested{}, "jsonb"},
+		{[]string{}, "text[]"},
+		{[]int64{}, "bigint[]"},
+		{[]byte{}, "bytea"},
+		{[]nested{}, "jsonb"},
+		{map[string]string{}, "jsonb"},
+		{json.RawMessage(nil), "jsonb"},
+		{decimal.Decimal{}, "numeric"},
+		{decimal.NullDecimal{}, "numeric"},
+		{pgtype.Numeric{}, "numeric"},
+	} {
+		if typ := columnType(reflect.TypeOf(c.v)); typ != c.expected {
+			t.Errorf("the type of %T should be %s: %s", c.v, c.expected, typ)
+		}
+	}
+}
+
+func TestCreateTableQuery(t *testing.T) {
+	db, err := sqlx.Open("postgres", "")
+	if err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	r, err := NewRepoWithClient(&Config{
+		TableName:  "models",
+		SoftDelete: &SoftDeleteConfig{},
+		Audit:      &AuditConfig{},
+	}, db)
+	if err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+
+	expected := `CREATE TABLE IF NOT EXISTS models (
+    content text,
+    created_at timestamptz,
+    id uuid PRIMARY KEY,
+    version bigint,
+    updated_at timestamptz,
+    deleted_at timestamptz
+)`
+	if query, err := r.createTableQuery(&mocks.Model{}); err != nil || query != expected {
+		t.Error("the query should be correct:", query, err)
+	}
+}
+
+type pricedModel struct {
+	ID      uuid.UUID `db:"id"`
+	Price   float64   `db:"price" pg:"type:numeric(12,2),notnull,default:0"`
+	Name    string    `db:"name" pg:"notnull,default:'a,b'"`
+	Comment string    `db:"comment"`
+}
+
+func (m *pricedModel) EntityID() uuid.UUID {
+	return m.ID
+}
+
+func TestCreateTableQueryTags(t *testing.T) {
+	db, err := sqlx.Open("postgres", "")
+	if err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	r, err := NewRepoWithClient(&Config{TableName: "models"}, db)
+	if err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+
+	expected := `CREATE TABLE IF NOT EXISTS models (
+    comment text,
+    id uuid PRIMARY KEY,
+    name text NOT NULL DEFAULT 'a,b',
+    price numeric(12,2) NOT NULL DEFAULT 0
+)`
+	if query, err := r.createTableQuery(&pricedModel{}); err != nil || query != expected {
+		t.Error("the query should be correct:", query, err)
+	}
+}
+
+func TestParseColumnTag(t *testing.T) {
+	for tag, expected := range map[string]columnTag{
+		"type:numeric(12,2),notnull,default:0": {Type: "numeric(12,2)", NotNull: true, Default: "0"},
+		"notnull":                              {NotNull: true},
+		"default:'x,y',type:text":              {Type: "text", Default: "'x,y'"},
+		"default:now()":                        {Default: "now()"},
+		"collate:und-x-icu,notnull":            {NotNull: true, Collation: "und-x-icu"},
+	} {
+		if c, err := parseColumnTag(tag); err != nil || c != expected {
+			t.Errorf("the tag %q should be parsed: %+v %v", tag, c, err)
+		}
+	}
+
+	for _, tag := range []string{
+		"type:",
+		"collate:",
+		"unique",
+		"type:text; DROP TABLE models",
+	} {
+		if _, err := parseColumnTag(tag); !errors.Is(err, ErrInvalidTag) {
+			t.Errorf("the tag %q should be invalid: %v", tag, err)
+		}
+	}
+}
+
+func TestNormalizeType(t *testing.T) {
+	for typ, expected := range map[string]string{
+		"numeric(12, 2)": "numeric(12,2)",
+		"INT4":           "integer",
+		"int8[]":         "bigint[]",
+		"varchar(20)":    "character varying(20)",
+		"timestamptz":    "timestamp with time zone",
+		"text":           "text",
+	} {
+		if n := normalizeType(typ); n != expected {
+			t.Errorf("the type %q should be normalized to %q: %q", typ, expected, n)
+		}
+	}
+}
+
+type localizedModel struct {
+	ID   uuid.UUID `db:"id"`
+	Name string    `db:"name" pg:"collate:und-u-ks-level2"`
+}
+
+func (m *localizedModel) EntityID() uuid.UUID {
+	return m.ID
+}
+
+func TestCollation(t *testing.T) {
+	db, err := sqlx.Open("postgres", "")
+	if err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	r, err := NewRepoWithClient(&Config{TableName: "models"}, db)
+	if err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+
+	expected := `CREATE TABLE IF NOT EXISTS models (
+    id uuid PRIMARY KEY,
+    name text COLLATE "und-u-ks-level2"
+)`
+	if query, err := r.createTableQuery(&localizedModel{}); err != nil || query != expected {
+		t.Error("the query should be correct:", query, err)
+	}
+
+	tags, err := columnTags(defaultMapper, &localizedModel{})
+	if err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	columns := []tableColumn{{Name: "name", Type: "text", Collation: "und-u-ks-level2"}}
+	if mismatched := mismatchedColumns(columns, tags); len(mismatched) != 0 {
+		t.Error("there should be no mismatched columns:", mismatched)
+	}
+	columns[0].Collation = "default"
+	if mismatched := mismatchedColumns(columns, tags); len(mismatched) != 1 ||
+		mismatched[0] != "name: collation default is not und-u-ks-level2" {
+		t.Error("the collation should be mismatched:", mismatched)
+	}
+}
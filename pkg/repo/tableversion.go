@@ -0,0 +1,225 @@
+package repo
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+	eh "github.com/looplab/eventhorizon"
+)
+
+// ErrInvalidTableVersion is when a table version can't be swapped to.
+var ErrInvalidTableVersion = errors.New("invalid table version")
+
+// tableVersionComment prefixes the version in the comment of the table.
+const tableVersionComment = "eh-pg table version "
+
+// versionedTable returns the table of the version, <table>_v<version>.
+func versionedTable(table string, version int) string {
+	return table + "_v" + strconv.Itoa(version)
+}
+
+// splitTable splits the table into its schema prefix, like "app.", and its
+// name.
+func splitTable(table string) (string, string) {
+	i := strings.LastIndex(table, ".") + 1
+	return table[:i], table[i:]
+}
+
+// Versioned returns a repo writing to and reading from the version of the
+// table, <table>_v<version>, for blue/green rebuilds of a projection: the
+// rebuilt projection is written to the new version while the entities are
+// still read from the table, then SwapTo makes it the table.
+//
+//	v2, err := r.Versioned(2)
+//	v2.EnsureTable(ctx)
+//	// Replay the events into v2.
+//	r.SwapTo(ctx, 2)
+//
+// The repo shares the client, the entity factory and the entity types, so it
+// must not be closed. It has no background workers and doesn't use the
+// ReadFrom, MaterializedView, Tiering and History tables of the table.
+func (r *Repo) Versioned(version int) (*Repo, error) {
+	if version < 1 {
+		return nil, fmt.Errorf("%w: %d", ErrInvalidTableVersion, version)
+	}
+
+	config := *r.config
+	config.TableName = versionedTable(r.config.TableName, version)
+	config.ReadFrom = ""
+	config.MaterializedView = nil
+	config.Retention = nil
+	config.Tiering = nil
+	config.History = nil
+	if c := r.config.Expiration; c != nil {
+		expiration := *c
+		expiration.Interval = 0
+		config.Expiration = &expiration
+	}
+
+	v, err := NewRepoWithClient(&config, r.client)
+	if err != nil {
+		return nil, err
+	}
+	v.factoryFn = r.factoryFn
+	v.types = r.types
+	v.typeNames = r.typeNames
+	return v, nil
+}
+
+// TableVersion returns the version of the table, as set by SwapTo, 1 for
+// tables that were never swapped.
+func (r *Repo) TableVersion(ctx context.Context) (int, error) {
+	var version int
+	err := r.InNamespaceSchema(ctx, func(ctx context.Context) error {
+		ex, release, err := r.conn(ctx, false)
+		if err != nil {
+			return err
+		}
+		defer release()
+
+		version, err = r.tableVersion(ctx, ex)
+		return err
+	})
+	return version, err
+}
+
+func (r *Repo) tableVersion(ctx context.Context, q sqlx.QueryerContext) (int, error) {
+	var comment sql.NullString
+	if err := sqlx.GetContext(ctx, q, &comment,
+		"SELECT obj_description(to_regclass($1), 'pg_class')",
+		r.config.TableName); err != nil {
+		return 0, eh.RepoError{
+			Err:       err,
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	}
+	if v, err := strconv.Atoi(strings.TrimPrefix(comment.String,
+		tableVersionComment)); err == nil && v > 0 {
+		return v, nil
+	}
+	return 1, nil
+}
+
+// SwapTo atomically makes the version of the table, written with Versioned,
+// the table, and keeps the previous table as its version, so that swapping
+// back to it rolls back. The tables, and the indexes of Config.Indexes and the
+// foreign keys of Config.ForeignKeys named after them, are renamed in a
+// transaction, which waits for the running queries on the tables and blocks
+// the new ones until it commits. With AutoAnalyze, the table is analyzed
+// after the swap.
+//
+// Views and foreign keys referencing the table follow the renamed previous
+// table and must be recreated. Partitioned tables can't be swapped, as the
+// partitions are named after the table.
+func (r *Repo) SwapTo(ctx context.Context, version int) error {
+	if r.config.Partition != nil {
+		return eh.RepoError{
+			Err:       fmt.Errorf("%w: the table is partitioned", ErrInvalidTableVersion),
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	}
+
+	return r.InNamespaceSchema(ctx, func(ctx context.Context) error {
+		if err := r.writeTx(ctx, func(tx *sqlx.Tx) error {
+			current, err := r.tableVersion(ctx, tx)
+			if err != nil {
+				return err
+			}
+
+			var exists, occupied bool
+			if err := tx.GetContext(ctx, &exists, "SELECT to_regclass($1) IS NOT NULL",
+				versionedTable(r.config.TableName, version)); err != nil {
+				return eh.RepoError{
+					Err:       err,
+					Namespace: eh.NamespaceFromContext(ctx),
+				}
+			}
+			if err := tx.GetContext(ctx, &occupied, "SELECT to_regclass($1) IS NOT NULL",
+				versionedTable(r.config.TableName, current)); err != nil {
+				return eh.RepoError{
+					Err:       err,
+					Namespace: eh.NamespaceFromContext(ctx),
+				}
+			}
+			switch {
+			case version == current:
+				err = fmt.Errorf("%w: the table is at version %d", ErrInvalidTableVersion, version)
+			case !exists:
+				err = fmt.Errorf("%w: %s does not exist", ErrInvalidTableVersion,
+					versionedTable(r.config.TableName, version))
+			case occupied:
+				err = fmt.Errorf("%w: %s already exists", ErrInvalidTableVersion,
+					versionedTable(r.config.TableName, current))
+			}
+			if err != nil {
+				return eh.RepoError{
+					Err:       err,
+					Namespace: eh.NamespaceFromContext(ctx),
+				}
+			}
+
+			for _, query := range swapQueries(r.config.TableName, current, version,
+				r.indexes(), r.config.ForeignKeys) {
+				if _, err := tx.ExecContext(ctx, query); err != nil {
+					return eh.RepoError{
+						Err:       err,
+						Namespace: eh.NamespaceFromContext(ctx),
+					}
+				}
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+		r.autoAnalyze(ctx, r.config.TableName)
+		return nil
+	})
+}
+
+// swapQueries returns the statements swapping the table from the current
+// version to the version.
+func swapQueries(table string, current, version int, indexes []IndexConfig,
+	foreignKeys []ForeignKey) []string {
+	schema, name := splitTable(table)
+	from := versionedTable(table, version)
+	_, to := splitTable(versionedTable(table, current))
+
+	queries := []string{
+		fmt.Sprintf("ALTER TABLE %s RENAME TO %s", table, to),
+		fmt.Sprintf("ALTER TABLE %s RENAME TO %s", from, name),
+	}
+	for _, index := range indexes {
+		if index.Name != "" {
+			continue
+		}
+		queries = append(queries,
+			fmt.Sprintf("ALTER INDEX IF EXISTS %s%s RENAME TO %s",
+				schema, index.name(table), index.name(to)))
+	}
+	for _, index := range indexes {
+		if index.Name != "" {
+			continue
+		}
+		queries = append(queries,
+			fmt.Sprintf("ALTER INDEX IF EXISTS %s%s RENAME TO %s",
+				schema, index.name(from), index.name(table)))
+	}
+	for _, fk := range foreignKeys {
+		if fk.Name != "" {
+			continue
+		}
+		queries = append(queries,
+			fmt.Sprintf("ALTER TABLE %s%s RENAME CONSTRAINT %s TO %s",
+				schema, to, fk.name(table), fk.name(to)),
+			fmt.Sprintf("ALTER TABLE %s RENAME CONSTRAINT %s TO %s",
+				table, fk.name(from), fk.name(table)))
+	}
+	return append(queries, fmt.Sprintf("COMMENT ON TABLE %s IS %s",
+		table, pq.QuoteLiteral(tableVersionComment+strconv.Itoa(version))))
+}
@@ -0,0 +1,75 @@
+package repo
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	eh "github.com/looplab/eventhorizon"
+	"github.com/looplab/eventhorizon/mocks"
+)
+
+func TestSwapQueries(t *testing.T) {
+	indexes := []IndexConfig{
+		{Columns: []string{"content"}},
+		{Name: "by_version", Columns: []string{"version"}},
+	}
+	expected := []string{
+		"ALTER TABLE app.models RENAME TO models_v1",
+		"ALTER TABLE app.models_v2 RENAME TO models",
+		"ALTER INDEX IF EXISTS app.models_content_idx RENAME TO models_v1_content_idx",
+		"ALTER INDEX IF EXISTS app.models_v2_content_idx RENAME TO models_content_idx",
+		"ALTER TABLE app.models_v1 RENAME CONSTRAINT models_customer_id_fkey TO models_v1_customer_id_fkey",
+		"ALTER TABLE app.models RENAME CONSTRAINT models_v2_customer_id_fkey TO models_customer_id_fkey",
+		"COMMENT ON TABLE app.models IS 'eh-pg table version 2'",
+	}
+	foreignKeys := []ForeignKey{
+		{Columns: []string{"customer_id"}, References: "app.customers"},
+		{Name: "by_parent", Columns: []string{"parent_id"}, References: "app.models"},
+	}
+	if queries := swapQueries("app.models", 1, 2, indexes, foreignKeys); !reflect.DeepEqual(queries, expected) {
+		t.Error("the queries should be correct:", queries)
+	}
+}
+
+func TestVersioned(t *testing.T) {
+	db, err := sqlx.Open("postgres", "host=127.0.0.1 port=1 connect_timeout=1")
+	if err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	r, err := NewRepoWithClient(&Config{
+		TableName:  "models",
+		ReadFrom:   "models_view",
+		Expiration: &ExpirationConfig{Interval: time.Minute},
+	}, db)
+	if err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	defer r.ExpirationWorker().Stop()
+	r.SetEntityFactory(func() eh.Entity {
+		return &mocks.Model{}
+	})
+
+	v, err := r.Versioned(2)
+	if err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	if v.config.TableName != "models_v2" || v.config.ReadFrom != "" {
+		t.Error("the table should be versioned:", v.config.TableName, v.config.ReadFrom)
+	}
+	if v.janitor != nil || v.config.Expiration.Column != "expires_at" {
+		t.Error("the expiration should be kept without a worker")
+	}
+	if v.factoryFn == nil {
+		t.Error("the entity factory should be shared")
+	}
+	if r.config.TableName != "models" || r.config.ReadFrom != "models_view" {
+		t.Error("the config of the repo should not change")
+	}
+
+	if _, err := r.Versioned(0); !errors.Is(err, ErrInvalidTableVersion) {
+		t.Error("the version should be invalid:", err)
+	}
+}
@@ -0,0 +1,118 @@
+package repo
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// ErrInvalidTemplate is when a SQL template is not valid.
+var ErrInvalidTemplate = errors.New("invalid SQL template")
+
+// Templates are the SQL templates used by Find, Save and Remove. They can be
+// overridden to accommodate exotic schemas, like views with INSTEAD OF
+// triggers or inherited tables. Named placeholders in braces are replaced
+// when the statement is built, and are validated when the repo is created.
+type Templates struct {
+	// Find is run with the ID as $1.
+	// Placeholders: {table}.
+	Find string
+	// Save is run with the values of all mapped columns as parameters.
+	// Placeholders: {table}, {key}, {columns}, {values}, {updates} and
+	// {condition}, where {key} is the list of conflict target columns, see
+	// Config.KeyColumns, {values} is the parenthesized list of parameters for
+	// each row, {updates} is the "column = EXCLUDED.column" list for all
+	// columns and {condition} is the WHERE clause of the optimistic
+	// concurrency check for versioned entities and of Config.SkipUnchanged,
+	// empty otherwise.
+	Save string
+	// Remove is run with the ID as $1.
+	// Placeholders: {table}.
+	Remove string
+}
+
+// DefaultTemplates are the templates used when not overridden.
+var DefaultTemplates = Templates{
+	Find: "SELECT * FROM {table} WHERE id = $1",
+	Save: "INSERT INTO {table} ({columns}) VALUES {values} " +
+		"ON CONFLICT ({key}) DO UPDATE SET {updates}{condition}",
+	Remove: "DELETE FROM {table} WHERE id = $1",
+}
+
+var placeholderRe = regexp.MustCompile(`\{(\w+)\}`)
+
+func (t *Templates) provideDefaults() {
+	if t.Find == "" {
+		t.Find = DefaultTemplates.Find
+	}
+	if t.Save == "" {
+		t.Save = DefaultTemplates.Save
+	}
+	if t.Remove == "" {
+		t.Remove = DefaultTemplates.Remove
+	}
+}
+
+func (t *Templates) validate() error {
+	if err := validateTemplate("find", t.Find,
+		[]string{"table"}, nil); err != nil {
+		return err
+	}
+	if err := validateTemplate("save", t.Save,
+		[]string{"table", "key", "columns", "values", "updates", "condition"},
+		[]string{"columns", "values"}); err != nil {
+		return err
+	}
+	if err := validateTemplate("remove", t.Remove,
+		[]string{"table"}, nil); err != nil {
+		return err
+	}
+	if !strings.Contains(t.Find, "$1") {
+		return fmt.Errorf("%w: find: missing $1 for the ID", ErrInvalidTemplate)
+	}
+	if !strings.Contains(t.Remove, "$1") {
+		return fmt.Errorf("%w: remove: missing $1 for the ID", ErrInvalidTemplate)
+	}
+	return nil
+}
+
+// validateTemplate checks that the template only uses the allowed
+// placeholders and contains all the required ones.
+func validateTemplate(name, tmpl string, allowed, required []string) error {
+	used := map[string]bool{}
+	for _, m := range placeholderRe.FindAllStringSubmatch(tmpl, -1) {
+		used[m[1]] = true
+	}
+
+	for p := range used {
+		ok := false
+		for _, a := range allowed {
+			if p == a {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return fmt.Errorf("%w: %s: unknown placeholder {%s}",
+				ErrInvalidTemplate, name, p)
+		}
+	}
+	for _, p := range required {
+		if !used[p] {
+			return fmt.Errorf("%w: %s: missing placeholder {%s}",
+				ErrInvalidTemplate, name, p)
+		}
+	}
+
+	return nil
+}
+
+// render replaces the placeholders in the template.
+func render(tmpl string, values map[string]string) string {
+	pairs := make([]string, 0, 2*len(values))
+	for k, v := range values {
+		pairs = append(pairs, "{"+k+"}", v)
+	}
+	return strings.NewReplacer(pairs...).Replace(tmpl)
+}
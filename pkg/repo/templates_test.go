@@ -0,0 +1,35 @@
+package repo
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestTemplates(t *testing.T) {
+	tmpl := &Templates{}
+	tmpl.provideDefaults()
+	if err := tmpl.validate(); err != nil {
+		t.Error("the default templates should be valid:", err)
+	}
+
+	tmpl = &Templates{Find: "SELECT * FROM {table}_view WHERE id = $1"}
+	tmpl.provideDefaults()
+	if err := tmpl.validate(); err != nil {
+		t.Error("there should be no error:", err)
+	}
+	if q := render(tmpl.Find, map[string]string{"table": "models"}); q != "SELECT * FROM models_view WHERE id = $1" {
+		t.Error("the query should be correct:", q)
+	}
+
+	for _, tmpl := range []*Templates{
+		{Find: "SELECT * FROM {tabel} WHERE id = $1"},
+		{Find: "SELECT * FROM {table}"},
+		{Save: "INSERT INTO {table} VALUES {values}"},
+		{Remove: "DELETE FROM {table} WHERE id = {id}"},
+	} {
+		tmpl.provideDefaults()
+		if err := tmpl.validate(); !errors.Is(err, ErrInvalidTemplate) {
+			t.Error("there should be a ErrInvalidTemplate error:", err)
+		}
+	}
+}
@@ -0,0 +1,214 @@
+package repo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+	eh "github.com/looplab/eventhorizon"
+)
+
+// ErrCouldNotMoveEntities is when entities could not be moved between tiers.
+var ErrCouldNotMoveEntities = errors.New("could not move entities")
+
+// TieringPolicy splits the read model into a hot table and a cold table.
+// Reads are tracked (sampled) in an access table and entities that have not
+// been read for a while can be moved to the cold table with MoveCold. Find
+// transparently falls back to the cold table when an entity is not hot.
+type TieringPolicy struct {
+	// ColdTableName is the table holding cold entities, "<table>_cold" by
+	// default. It must have the same columns as the hot table.
+	ColdTableName string
+	// AccessTableName is the table tracking the last access of entities,
+	// "<table>_access" by default.
+	AccessTableName string
+	// SampleRate is the fraction of Finds that record the access time,
+	// between 0 and 1, 0.1 by default.
+	SampleRate float64
+}
+
+func (p *TieringPolicy) provideDefaults(table string) {
+	if p.ColdTableName == "" {
+		p.ColdTableName = table + "_cold"
+	}
+	if p.AccessTableName == "" {
+		p.AccessTableName = table + "_access"
+	}
+	if p.SampleRate <= 0 {
+		p.SampleRate = 0.1
+	}
+}
+
+// EnsureTiering creates the cold table (with the same definition as the hot
+// table) and the access table if they don't exist.
+func (r *Repo) EnsureTiering(ctx context.Context) error {
+	p := r.config.Tiering
+	if p == nil {
+		return nil
+	}
+
+	return r.ensureSchema(ctx, false, func(ex sqlx.ExecerContext, table string) error {
+		if _, err := ex.ExecContext(ctx, fmt.Sprintf(`
+		CREATE TABLE IF NOT EXISTS %[2]s (LIKE %[1]s INCLUDING ALL);
+		CREATE TABLE IF NOT EXISTS %[3]s (
+		    id uuid primary key,
+		    accessed_at timestamptz not null
+		);
+		CREATE INDEX IF NOT EXISTS %[3]s_accessed_at_idx ON %[3]s (accessed_at);`,
+			table, p.ColdTableName, p.AccessTableName)); err != nil {
+			return eh.RepoError{
+				Err:       ErrCouldNotEnsureSchema,
+				BaseErr:   err,
+				Namespace: eh.NamespaceFromContext(ctx),
+			}
+		}
+		return nil
+	})
+}
+
+// MoveCold moves all entities that have not been accessed within the given
+// duration to the cold table and returns the number of moved entities.
+// Entities without a recorded access are considered cold. Entities saved to
+// the hot table after an earlier move replace their cold copy.
+func (r *Repo) MoveCold(ctx context.Context, notAccessedFor time.Duration) (int64, error) {
+	p := r.config.Tiering
+	if p == nil {
+		return 0, nil
+	}
+
+	var moved int64
+	if err := r.writeTx(ctx, func(tx *sqlx.Tx) error {
+		var columns []string
+		if err := tx.SelectContext(ctx, &columns,
+			"SELECT attname FROM pg_attribute WHERE attrelid = to_regclass($1) "+
+				"AND attnum > 0 AND NOT attisdropped AND attgenerated = '' "+
+				"AND attname <> 'id' ORDER BY attnum", p.ColdTableName); err != nil {
+			return err
+		}
+		if len(columns) == 0 {
+			return fmt.Errorf("table %s does not exist", p.ColdTableName)
+		}
+		set := make([]string, len(columns))
+		for i, c := range columns {
+			set[i] = fmt.Sprintf("%[1]s = EXCLUDED.%[1]s", pq.QuoteIdentifier(c))
+		}
+
+		res, err := tx.ExecContext(ctx, fmt.Sprintf(`
+		WITH moved AS (
+		    DELETE FROM %[1]s WHERE id IN (
+		        SELECT h.id FROM %[1]s h LEFT JOIN %[3]s a ON a.id = h.id
+		        WHERE a.accessed_at IS NULL OR a.accessed_at < $1
+		    ) RETURNING *
+		)
+		INSERT INTO %[2]s SELECT * FROM moved
+		ON CONFLICT (id) DO UPDATE SET %[4]s`,
+			r.config.TableName, p.ColdTableName, p.AccessTableName,
+			strings.Join(set, ", ")),
+			time.Now().Add(-notAccessedFor))
+		if err != nil {
+			return err
+		}
+		moved, err = res.RowsAffected()
+		return err
+	}); err != nil {
+		return 0, eh.RepoError{
+			Err:       ErrCouldNotMoveEntities,
+			BaseErr:   err,
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	}
+	r.autoAnalyze(ctx, r.config.TableName, p.ColdTableName)
+
+	return moved, nil
+}
+
+// MoveHot moves an entity from the cold table back to the hot table. A newer
+// copy already saved to the hot table is kept.
+func (r *Repo) MoveHot(ctx context.Context, id uuid.UUID) error {
+	p := r.config.Tiering
+	if p == nil {
+		return nil
+	}
+
+	return r.inSettings(ctx, func(ctx context.Context) error {
+		ex, release, err := r.conn(ctx, true)
+		if err != nil {
+			return err
+		}
+		_, err = ex.ExecContext(ctx, fmt.Sprintf(`
+		WITH moved AS (
+		    DELETE FROM %[2]s WHERE id = $1 RETURNING *
+		)
+		INSERT INTO %[1]s SELECT * FROM moved
+		ON CONFLICT (id) DO NOTHING`,
+			r.config.TableName, p.ColdTableName), id)
+		release()
+		if err != nil {
+			return eh.RepoError{
+				Err:       ErrCouldNotMoveEntities,
+				BaseErr:   err,
+				Namespace: eh.NamespaceFromContext(ctx),
+			}
+		}
+
+		return r.recordAccess(ctx, id)
+	})
+}
+
+// findCold finds an entity in the cold table, with the connection of the hot
+// table lookup.
+func (r *Repo) findCold(ctx context.Context, q sqlx.QueryerContext,
+	id uuid.UUID) (eh.Entity, error) {
+	entity := r.factoryFn()
+	if err := sqlx.GetContext(ctx, q, entity, fmt.Sprintf(
+		"SELECT * FROM %s WHERE id = $1", r.config.Tiering.ColdTableName),
+		id); err != nil {
+		return nil, err
+	}
+
+	return entity, nil
+}
+
+// removeCold removes an entity from the cold table, with the connection of
+// the hot table removal.
+func (r *Repo) removeCold(ctx context.Context, ex sqlx.ExecerContext,
+	id uuid.UUID) (int64, error) {
+	res, err := ex.ExecContext(ctx, fmt.Sprintf(
+		"DELETE FROM %s WHERE id = $1", r.config.Tiering.ColdTableName), id)
+	if err != nil {
+		return 0, err
+	}
+
+	return res.RowsAffected()
+}
+
+// sampleAccess records the access of an entity for a sample of the calls.
+func (r *Repo) sampleAccess(ctx context.Context, id uuid.UUID) {
+	if rand.Float64() >= r.config.Tiering.SampleRate {
+		return
+	}
+	if err := r.recordAccess(ctx, id); err != nil {
+		log.Printf("eh-pg: could not record access of %s: %v", id, err)
+	}
+}
+
+func (r *Repo) recordAccess(ctx context.Context, id uuid.UUID) error {
+	ex, release, err := r.conn(ctx, true)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	_, err = ex.ExecContext(ctx, fmt.Sprintf(
+		"INSERT INTO %s (id, accessed_at) VALUES ($1, now()) "+
+			"ON CONFLICT (id) DO UPDATE SET accessed_at = EXCLUDED.accessed_at",
+		r.config.Tiering.AccessTableName), id)
+	return err
+}
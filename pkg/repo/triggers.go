@@ -0,0 +1,100 @@
+package repo
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"github.com/jmoiron/sqlx"
+	eh "github.com/looplab/eventhorizon"
+)
+
+// ErrNoTransaction is when an operation requires a transaction.
+var ErrNoTransaction = errors.New("no transaction")
+
+// DisableTriggers disables the user triggers on the table within the
+// transaction. Disabling triggers outside of a transaction would leave them
+// disabled for all sessions if the caller fails before enabling them again,
+// therefore a transaction is required. The triggers stay disabled until
+// EnableTriggers is called or the transaction is rolled back.
+func (r *Repo) DisableTriggers(ctx context.Context, tx *sqlx.Tx) error {
+	return r.setTriggers(ctx, tx, "DISABLE")
+}
+
+// EnableTriggers enables the user triggers on the table within the transaction.
+func (r *Repo) EnableTriggers(ctx context.Context, tx *sqlx.Tx) error {
+	return r.setTriggers(ctx, tx, "ENABLE")
+}
+
+func (r *Repo) setTriggers(ctx context.Context, tx *sqlx.Tx, action string) error {
+	if tx == nil {
+		return eh.RepoError{
+			Err:       ErrNoTransaction,
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	}
+
+	if _, err := tx.ExecContext(ctx, fmt.Sprintf(
+		"ALTER TABLE %s %s TRIGGER USER", r.config.TableName, action)); err != nil {
+		return eh.RepoError{
+			Err:       err,
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	}
+
+	return nil
+}
+
+// WithTriggersDisabled runs f in a transaction with the user triggers on the
+// table disabled, for bulk rebuilds where triggers would amplify the writes.
+// The triggers are enabled again before the transaction commits. Note that the
+// table is locked for other sessions until the transaction ends. Finds, Saves
+// and Removes with the context passed to f run in the transaction, so they
+// see the uncommitted changes of f. The transaction has the settings of the
+// context, like the search_path of the namespace schema.
+func (r *Repo) WithTriggersDisabled(ctx context.Context,
+	f func(context.Context, *sqlx.Tx) error) error {
+	settings, err := r.settings(ctx)
+	if err != nil {
+		return err
+	}
+
+	release, err := r.acquireWrite(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	tx, err := r.client.BeginTxx(ctx, &sql.TxOptions{})
+	if err != nil {
+		return eh.RepoError{
+			Err:       err,
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	}
+	defer tx.Rollback()
+
+	if err := setConfig(ctx, tx, settings); err != nil {
+		return err
+	}
+	if err := r.DisableTriggers(ctx, tx); err != nil {
+		return err
+	}
+	ctx = contextWithSettings(contextWithTx(ctx, r.client.DB, tx), tx, settings)
+	if err := f(ctx, tx); err != nil {
+		return err
+	}
+	if err := r.EnableTriggers(ctx, tx); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return eh.RepoError{
+			Err:       err,
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	}
+
+	return nil
+}
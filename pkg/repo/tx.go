@@ -0,0 +1,46 @@
+package repo
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// WithTx runs f in a transaction on the database, committed if f returns nil
+// and rolled back otherwise. All repos created with the database as client
+// run their operations with the context passed to f in the transaction, so
+// that several read models, and other tables like an outbox written with
+// TxFromContext, are written atomically:
+//
+//	err := repo.WithTx(ctx, db, func(ctx context.Context) error {
+//		if err := orders.Save(ctx, order); err != nil {
+//			return err
+//		}
+//		return totals.Save(ctx, total)
+//	})
+//
+// If the context already carries a transaction on the database f joins it.
+func WithTx(ctx context.Context, db *sqlx.DB, f func(context.Context) error) error {
+	if txFromContext(ctx, db.DB) != nil {
+		return f(ctx)
+	}
+
+	tx, err := db.BeginTxx(ctx, &sql.TxOptions{})
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := f(contextWithTx(ctx, db.DB, tx)); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// TxFromContext returns the transaction on the database of a context passed
+// by WithTx, or nil, for writing other tables in the same transaction.
+func TxFromContext(ctx context.Context, db *sqlx.DB) *sqlx.Tx {
+	return txFromContext(ctx, db.DB)
+}
@@ -0,0 +1,35 @@
+package repo
+
+import (
+	"context"
+	"testing"
+
+	"github.com/jmoiron/sqlx"
+)
+
+func TestTxFromContext(t *testing.T) {
+	db1, err := sqlx.Open("postgres", "")
+	if err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	db2, err := sqlx.Open("postgres", "")
+	if err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+
+	tx := &sqlx.Tx{}
+	ctx := contextWithTx(context.Background(), db1.DB, tx)
+	if TxFromContext(ctx, db1) != tx {
+		t.Error("the transaction should be in the context")
+	}
+	// Also for a repo with an unsafe client.
+	if TxFromContext(ctx, db1.Unsafe()) != tx {
+		t.Error("the transaction should be in the context")
+	}
+	if TxFromContext(ctx, db2) != nil {
+		t.Error("the transaction should not be used for another database")
+	}
+	if TxFromContext(context.Background(), db1) != nil {
+		t.Error("there should be no transaction")
+	}
+}
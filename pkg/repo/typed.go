@@ -0,0 +1,132 @@
+package repo
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/google/uuid"
+	"github.com/jmoiron/sqlx"
+	eh "github.com/looplab/eventhorizon"
+)
+
+// TypedRepo is a repo returning entities of type *T instead of eh.Entity,
+// without type assertions or an entity factory:
+//
+//	r, err := NewTypedRepo[Model](config)
+//	m, err := r.Find(ctx, id) // m is a *Model
+//
+// The underlying repo, which satisfies the eventhorizon repo interfaces, is
+// returned by Untyped.
+type TypedRepo[T any, PT interface {
+	*T
+	eh.Entity
+}] struct {
+	repo *Repo
+}
+
+// NewTypedRepo creates a typed repo, see NewRepo.
+func NewTypedRepo[T any, PT interface {
+	*T
+	eh.Entity
+}](config *Config) (*TypedRepo[T, PT], error) {
+	r, err := NewRepo(config)
+	if err != nil {
+		return nil, err
+	}
+	return newTypedRepo[T, PT](r), nil
+}
+
+// NewTypedRepoWithClient creates a typed repo with a client, see
+// NewRepoWithClient.
+func NewTypedRepoWithClient[T any, PT interface {
+	*T
+	eh.Entity
+}](config *Config, client *sqlx.DB) (*TypedRepo[T, PT], error) {
+	r, err := NewRepoWithClient(config, client)
+	if err != nil {
+		return nil, err
+	}
+	return newTypedRepo[T, PT](r), nil
+}
+
+func newTypedRepo[T any, PT interface {
+	*T
+	eh.Entity
+}](r *Repo) *TypedRepo[T, PT] {
+	r.SetEntityFactory(func() eh.Entity {
+		return PT(new(T))
+	})
+	return &TypedRepo[T, PT]{repo: r}
+}
+
+// Untyped returns the underlying repo.
+func (r *TypedRepo[T, PT]) Untyped() *Repo {
+	return r.repo
+}
+
+// Find returns the entity with the ID, see Repo.Find.
+func (r *TypedRepo[T, PT]) Find(ctx context.Context, id uuid.UUID) (*T, error) {
+	entity, err := r.repo.Find(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	return r.typed(ctx, entity)
+}
+
+// FindAll returns all entities, see Repo.FindAll.
+func (r *TypedRepo[T, PT]) FindAll(ctx context.Context) ([]*T, error) {
+	return r.typedAll(ctx)(r.repo.FindAll(ctx))
+}
+
+// FindWhere returns the entities matching the filter, see Repo.FindWhere.
+func (r *TypedRepo[T, PT]) FindWhere(ctx context.Context, filter Filter,
+	opts ...QueryOption) ([]*T, error) {
+	return r.typedAll(ctx)(r.repo.FindWhere(ctx, filter, opts...))
+}
+
+// FindWithFilter returns the entities matching the expression, see
+// Repo.FindWithFilter.
+func (r *TypedRepo[T, PT]) FindWithFilter(ctx context.Context, expr string,
+	args ...interface{}) ([]*T, error) {
+	return r.typedAll(ctx)(r.repo.FindWithFilter(ctx, expr, args...))
+}
+
+// Save saves the entity, see Repo.Save.
+func (r *TypedRepo[T, PT]) Save(ctx context.Context, entity *T) error {
+	return r.repo.Save(ctx, PT(entity))
+}
+
+// Remove removes the entity with the ID, see Repo.Remove.
+func (r *TypedRepo[T, PT]) Remove(ctx context.Context, id uuid.UUID) error {
+	return r.repo.Remove(ctx, id)
+}
+
+// typed converts an entity, which may have been created by another factory
+// set on the underlying repo.
+func (r *TypedRepo[T, PT]) typed(ctx context.Context, entity eh.Entity) (*T, error) {
+	t, ok := entity.(PT)
+	if !ok {
+		return nil, eh.RepoError{
+			Err:       eh.ErrCouldNotLoadEntity,
+			BaseErr:   fmt.Errorf("unexpected entity type %T", entity),
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	}
+	return (*T)(t), nil
+}
+
+// typedAll returns a func converting the result of a find.
+func (r *TypedRepo[T, PT]) typedAll(ctx context.Context) func([]eh.Entity, error) ([]*T, error) {
+	return func(entities []eh.Entity, err error) ([]*T, error) {
+		if err != nil {
+			return nil, err
+		}
+		result := make([]*T, len(entities))
+		for i, entity := range entities {
+			if result[i], err = r.typed(ctx, entity); err != nil {
+				return nil, err
+			}
+		}
+		return result, nil
+	}
+}
@@ -0,0 +1,43 @@
+package repo
+
+import (
+	"context"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/jmoiron/sqlx"
+	eh "github.com/looplab/eventhorizon"
+	ehmocks "github.com/looplab/eventhorizon/mocks"
+
+	"github.com/eendLabs/eh-pg/pkg/mocks"
+)
+
+func TestTypedRepo(t *testing.T) {
+	db, err := sqlx.Open("postgres", "")
+	if err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	r, err := NewTypedRepoWithClient[mocks.Model](&Config{TableName: "models"}, db)
+	if err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+
+	var _ eh.ReadWriteRepo = r.Untyped()
+	if _, ok := r.Untyped().factoryFn().(*mocks.Model); !ok {
+		t.Error("the entity factory should be set")
+	}
+
+	ctx := context.Background()
+	m := &mocks.Model{ID: uuid.New()}
+	all, err := r.typedAll(ctx)([]eh.Entity{m}, nil)
+	if err != nil {
+		t.Error("there should be no error:", err)
+	}
+	if len(all) != 1 || all[0] != m {
+		t.Error("the entities should be typed:", all)
+	}
+
+	if _, err := r.typed(ctx, &ehmocks.SimpleModel{}); err == nil {
+		t.Error("there should be an error")
+	}
+}
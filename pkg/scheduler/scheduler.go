@@ -0,0 +1,345 @@
+package scheduler
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"regexp"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jmoiron/sqlx"
+	eh "github.com/looplab/eventhorizon"
+
+	"github.com/eendLabs/eh-pg/pkg/worker"
+)
+
+// ErrNoDBClient is when no database client is set.
+var ErrNoDBClient = errors.New("no database client")
+
+// ErrNoHandler is when no event handler is set.
+var ErrNoHandler = errors.New("no event handler")
+
+// ErrCouldNotSchedule is when an event could not be scheduled.
+var ErrCouldNotSchedule = errors.New("could not schedule event")
+
+// ErrCouldNotDeliver is when due events could not be delivered.
+var ErrCouldNotDeliver = errors.New("could not deliver events")
+
+// ErrInvalidConfig is when the table name is not a valid identifier.
+var ErrInvalidConfig = errors.New("invalid scheduler config")
+
+// identifierRe matches the table names that can be used unquoted in the
+// queries.
+var identifierRe = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// Config is the configuration of a Scheduler.
+type Config struct {
+	// TableName is the table holding scheduled events, "scheduled_events"
+	// by default.
+	TableName string
+	// PollInterval is the time between two polls for due events, 1 second
+	// by default.
+	PollInterval time.Duration
+	// BatchSize is the max number of due events delivered per poll, 100 by
+	// default.
+	BatchSize int
+	// RetryBackoff is the delay before the first retry of an event that
+	// could not be decoded or delivered, 1 second by default. It doubles
+	// with each attempt.
+	RetryBackoff time.Duration
+	// MaxRetryBackoff caps the delay between two retries, 1 hour by
+	// default.
+	MaxRetryBackoff time.Duration
+}
+
+func (c *Config) provideDefaults() {
+	if c.TableName == "" {
+		c.TableName = "scheduled_events"
+	}
+	if c.PollInterval <= 0 {
+		c.PollInterval = time.Second
+	}
+	if c.BatchSize <= 0 {
+		c.BatchSize = 100
+	}
+	if c.RetryBackoff <= 0 {
+		c.RetryBackoff = time.Second
+	}
+	if c.MaxRetryBackoff <= 0 {
+		c.MaxRetryBackoff = time.Hour
+	}
+}
+
+func (c *Config) validate() error {
+	if !identifierRe.MatchString(c.TableName) {
+		return fmt.Errorf("%w: table name %q", ErrInvalidConfig, c.TableName)
+	}
+	return nil
+}
+
+// retryDelay returns the delay before the next delivery of an event after
+// the failed attempts.
+func (c *Config) retryDelay(attempts int) time.Duration {
+	delay := c.RetryBackoff
+	for i := 1; i < attempts && delay < c.MaxRetryBackoff; i++ {
+		delay *= 2
+	}
+	if delay > c.MaxRetryBackoff {
+		delay = c.MaxRetryBackoff
+	}
+	return delay
+}
+
+// Scheduler stores events with a delivery time and hands them to an event
+// handler (typically an eh.EventBus) once they are due. Due events are
+// claimed with SKIP LOCKED, so several instances can poll the same table.
+type Scheduler struct {
+	client  *sqlx.DB
+	config  *Config
+	handler eh.EventHandler
+	worker  *worker.Worker
+}
+
+// NewScheduler creates a new Scheduler delivering due events to handler.
+func NewScheduler(client *sqlx.DB, config *Config,
+	handler eh.EventHandler) (*Scheduler, error) {
+	if client == nil {
+		return nil, ErrNoDBClient
+	}
+	if handler == nil {
+		return nil, ErrNoHandler
+	}
+	config.provideDefaults()
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+
+	return &Scheduler{
+		client:  client,
+		config:  config,
+		handler: handler,
+	}, nil
+}
+
+// CreateTable creates the scheduled events table if it does not exist, and
+// adds the attempts column to tables created by previous versions.
+func (s *Scheduler) CreateTable(ctx context.Context) error {
+	_, err := s.client.ExecContext(ctx, fmt.Sprintf(`
+	CREATE TABLE IF NOT EXISTS %[1]s (
+	    id uuid primary key,
+	    event_type text not null,
+	    aggregate_type text not null,
+	    aggregate_id uuid not null,
+	    version integer not null,
+	    data jsonb,
+	    metadata jsonb,
+	    context jsonb,
+	    timestamp timestamptz not null,
+	    deliver_at timestamptz not null,
+	    attempts integer not null default 0
+	);
+	ALTER TABLE %[1]s ADD COLUMN IF NOT EXISTS attempts integer not null default 0;
+	CREATE INDEX IF NOT EXISTS %[1]s_deliver_at_idx ON %[1]s (deliver_at);`,
+		s.config.TableName))
+	return err
+}
+
+type scheduledEvent struct {
+	ID            uuid.UUID       `db:"id"`
+	EventType     string          `db:"event_type"`
+	AggregateType string          `db:"aggregate_type"`
+	AggregateID   uuid.UUID       `db:"aggregate_id"`
+	Version       int             `db:"version"`
+	Data          json.RawMessage `db:"data"`
+	Metadata      json.RawMessage `db:"metadata"`
+	Context       json.RawMessage `db:"context"`
+	Timestamp     time.Time       `db:"timestamp"`
+	DeliverAt     time.Time       `db:"deliver_at"`
+	Attempts      int             `db:"attempts"`
+}
+
+// Schedule stores an event to be delivered at deliverAt. The context values
+// registered with eh.RegisterContextMarshaler (like the namespace) are stored
+// with the event and restored on delivery. The returned ID can be used to
+// cancel the delivery.
+func (s *Scheduler) Schedule(ctx context.Context, event eh.Event,
+	deliverAt time.Time) (uuid.UUID, error) {
+	data, err := json.Marshal(event.Data())
+	if err != nil {
+		return uuid.Nil, fmt.Errorf("%w: %v", ErrCouldNotSchedule, err)
+	}
+	metadata, err := json.Marshal(event.Metadata())
+	if err != nil {
+		return uuid.Nil, fmt.Errorf("%w: %v", ErrCouldNotSchedule, err)
+	}
+	values, err := json.Marshal(eh.MarshalContext(ctx))
+	if err != nil {
+		return uuid.Nil, fmt.Errorf("%w: %v", ErrCouldNotSchedule, err)
+	}
+
+	e := scheduledEvent{
+		ID:            uuid.New(),
+		EventType:     event.EventType().String(),
+		AggregateType: event.AggregateType().String(),
+		AggregateID:   event.AggregateID(),
+		Version:       event.Version(),
+		Data:          data,
+		Metadata:      metadata,
+		Context:       values,
+		Timestamp:     event.Timestamp(),
+		DeliverAt:     deliverAt,
+	}
+	if _, err := s.client.NamedExecContext(ctx, fmt.Sprintf(
+		"INSERT INTO %s (id, event_type, aggregate_type, aggregate_id, "+
+			"version, data, metadata, context, timestamp, deliver_at) "+
+			"VALUES (:id, :event_type, :aggregate_type, :aggregate_id, "+
+			":version, :data, :metadata, :context, :timestamp, :deliver_at)",
+		s.config.TableName), e); err != nil {
+		return uuid.Nil, fmt.Errorf("%w: %v", ErrCouldNotSchedule, err)
+	}
+
+	return e.ID, nil
+}
+
+// Cancel removes a scheduled event that has not been delivered yet.
+func (s *Scheduler) Cancel(ctx context.Context, id uuid.UUID) error {
+	_, err := s.client.ExecContext(ctx, fmt.Sprintf(
+		"DELETE FROM %s WHERE id = $1", s.config.TableName), id)
+	return err
+}
+
+// Start starts polling for due events in the background until the context is
+// cancelled or Close is called.
+func (s *Scheduler) Start(ctx context.Context) {
+	s.worker = worker.Start(ctx, "scheduler on "+s.config.TableName,
+		s.config.PollInterval, func(ctx context.Context) error {
+			_, err := s.DeliverDue(ctx)
+			return err
+		})
+}
+
+// Done returns a channel that is closed when the polling has stopped. It is
+// nil if the scheduler is not started.
+func (s *Scheduler) Done() <-chan struct{} {
+	if s.worker == nil {
+		return nil
+	}
+	return s.worker.Done()
+}
+
+// Errors returns a channel where polling errors are sent. It is nil if the
+// scheduler is not started.
+func (s *Scheduler) Errors() <-chan error {
+	if s.worker == nil {
+		return nil
+	}
+	return s.worker.Errors()
+}
+
+// Close stops the background polling started with Start.
+func (s *Scheduler) Close() {
+	if s.worker != nil {
+		s.worker.Stop()
+	}
+}
+
+// DeliverDue delivers one batch of due events to the handler and returns the
+// number of delivered events. Events that can't be decoded or fail in the
+// handler are kept and retried with an exponential backoff, see
+// Config.RetryBackoff, so that they don't hold back the other due events. On
+// errors the batch is rolled back and 0 is returned, the events of the batch
+// are delivered again by a later poll.
+func (s *Scheduler) DeliverDue(ctx context.Context) (int, error) {
+	tx, err := s.client.BeginTxx(ctx, &sql.TxOptions{})
+	if err != nil {
+		return 0, fmt.Errorf("%w: %v", ErrCouldNotDeliver, err)
+	}
+	defer tx.Rollback()
+
+	var due []scheduledEvent
+	if err := tx.SelectContext(ctx, &due, fmt.Sprintf(
+		"SELECT * FROM %s WHERE deliver_at <= now() "+
+			"ORDER BY deliver_at LIMIT $1 FOR UPDATE SKIP LOCKED",
+		s.config.TableName), s.config.BatchSize); err != nil {
+		return 0, fmt.Errorf("%w: %v", ErrCouldNotDeliver, err)
+	}
+
+	delivered := 0
+	for _, e := range due {
+		event, eventCtx, err := e.event(ctx)
+		if err != nil {
+			log.Printf("eh-pg: could not decode scheduled event %s: %v", e.ID, err)
+			if err := s.retryLater(ctx, tx, e); err != nil {
+				return 0, err
+			}
+			continue
+		}
+		if err := s.handler.HandleEvent(eventCtx, event); err != nil {
+			log.Printf("eh-pg: could not deliver scheduled event %s: %v", e.ID, err)
+			if err := s.retryLater(ctx, tx, e); err != nil {
+				return 0, err
+			}
+			continue
+		}
+		if _, err := tx.ExecContext(ctx, fmt.Sprintf(
+			"DELETE FROM %s WHERE id = $1", s.config.TableName), e.ID); err != nil {
+			return 0, fmt.Errorf("%w: %v", ErrCouldNotDeliver, err)
+		}
+		delivered++
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("%w: %v", ErrCouldNotDeliver, err)
+	}
+
+	return delivered, nil
+}
+
+// retryLater counts the failed attempt of the event and postpones it.
+func (s *Scheduler) retryLater(ctx context.Context, tx *sqlx.Tx, e scheduledEvent) error {
+	delay := s.config.retryDelay(e.Attempts + 1)
+	if _, err := tx.ExecContext(ctx, fmt.Sprintf(
+		"UPDATE %s SET attempts = attempts + 1, "+
+			"deliver_at = now() + make_interval(secs => $2) WHERE id = $1",
+		s.config.TableName), e.ID, delay.Seconds()); err != nil {
+		return fmt.Errorf("%w: %v", ErrCouldNotDeliver, err)
+	}
+	return nil
+}
+
+// event recreates the stored event and its context.
+func (e scheduledEvent) event(ctx context.Context) (eh.Event, context.Context, error) {
+	data, err := eh.CreateEventData(eh.EventType(e.EventType))
+	if err != nil && !errors.Is(err, eh.ErrEventDataNotRegistered) {
+		return nil, nil, err
+	}
+	if data != nil && len(e.Data) > 0 {
+		if err := json.Unmarshal(e.Data, data); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	var metadata map[string]interface{}
+	if len(e.Metadata) > 0 {
+		if err := json.Unmarshal(e.Metadata, &metadata); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	var values map[string]interface{}
+	if len(e.Context) > 0 {
+		if err := json.Unmarshal(e.Context, &values); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	event := eh.NewEvent(eh.EventType(e.EventType), data, e.Timestamp,
+		eh.ForAggregate(eh.AggregateType(e.AggregateType), e.AggregateID, e.Version),
+		eh.WithMetadata(metadata))
+
+	return event, eh.UnmarshalContext(ctx, values), nil
+}
@@ -0,0 +1,212 @@
+package scheduler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jmoiron/sqlx"
+	_ "github.com/lib/pq"
+	eh "github.com/looplab/eventhorizon"
+	ehmocks "github.com/looplab/eventhorizon/mocks"
+)
+
+func TestScheduledEventDecoding(t *testing.T) {
+	data, _ := json.Marshal(&ehmocks.EventData{Content: "reminder"})
+	values, _ := json.Marshal(eh.MarshalContext(
+		eh.NewContextWithNamespace(context.Background(), "ns")))
+	e := scheduledEvent{
+		ID:            uuid.New(),
+		EventType:     ehmocks.EventType.String(),
+		AggregateType: ehmocks.AggregateType.String(),
+		AggregateID:   uuid.New(),
+		Version:       3,
+		Data:          data,
+		Metadata:      json.RawMessage(`{"num":1}`),
+		Context:       values,
+		Timestamp:     time.Date(2009, time.November, 10, 23, 0, 0, 0, time.UTC),
+	}
+
+	event, ctx, err := e.event(context.Background())
+	if err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	if event.EventType() != ehmocks.EventType ||
+		event.AggregateID() != e.AggregateID ||
+		event.Version() != 3 ||
+		!event.Timestamp().Equal(e.Timestamp) {
+		t.Error("the event should be correct:", event)
+	}
+	if d, ok := event.Data().(*ehmocks.EventData); !ok || d.Content != "reminder" {
+		t.Error("the event data should be correct:", event.Data())
+	}
+	if event.Metadata()["num"] != float64(1) {
+		t.Error("the metadata should be correct:", event.Metadata())
+	}
+	if ns := eh.NamespaceFromContext(ctx); ns != "ns" {
+		t.Error("the namespace should be correct:", ns)
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	c := &Config{RetryBackoff: time.Second, MaxRetryBackoff: time.Minute}
+	for attempts, expected := range map[int]time.Duration{
+		1:   time.Second,
+		2:   2 * time.Second,
+		4:   8 * time.Second,
+		7:   time.Minute,
+		100: time.Minute,
+	} {
+		if delay := c.retryDelay(attempts); delay != expected {
+			t.Error("the delay should be correct:", attempts, delay)
+		}
+	}
+}
+
+func TestNewSchedulerTableName(t *testing.T) {
+	db, err := sqlx.Open("postgres", "")
+	if err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	handler := eh.EventHandlerFunc(func(context.Context, eh.Event) error { return nil })
+
+	if _, err := NewScheduler(db, &Config{TableName: "events; DROP TABLE x"}, handler); !errors.Is(err, ErrInvalidConfig) {
+		t.Error("there should be a ErrInvalidConfig error:", err)
+	}
+	if _, err := NewScheduler(db, &Config{}, handler); err != nil {
+		t.Error("there should be no error:", err)
+	}
+}
+
+func TestSchedulerIntegration(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integration test")
+	}
+
+	host := os.Getenv("POSTGRES_HOST")
+	if host == "" {
+		host = "localhost"
+	}
+	client, err := sqlx.Connect("postgres", "host="+host+
+		" port=5432 user=postgres password=postgres sslmode=disable")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	var mu sync.Mutex
+	var handled []eh.Event
+	handler := eh.EventHandlerFunc(func(ctx context.Context, e eh.Event) error {
+		mu.Lock()
+		defer mu.Unlock()
+		handled = append(handled, e)
+		return nil
+	})
+
+	s, err := NewScheduler(client, &Config{TableName: "scheduled_events_test"}, handler)
+	if err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	ctx := context.Background()
+	if err := s.CreateTable(ctx); err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	defer client.MustExec("DROP TABLE scheduled_events_test")
+
+	event := eh.NewEvent(ehmocks.EventType, &ehmocks.EventData{Content: "now"},
+		time.Now(), eh.ForAggregate(ehmocks.AggregateType, uuid.New(), 1))
+	if _, err := s.Schedule(ctx, event, time.Now().Add(-time.Second)); err != nil {
+		t.Error("there should be no error:", err)
+	}
+	later := eh.NewEvent(ehmocks.EventType, &ehmocks.EventData{Content: "later"},
+		time.Now(), eh.ForAggregate(ehmocks.AggregateType, uuid.New(), 1))
+	if _, err := s.Schedule(ctx, later, time.Now().Add(time.Hour)); err != nil {
+		t.Error("there should be no error:", err)
+	}
+
+	n, err := s.DeliverDue(ctx)
+	if err != nil {
+		t.Error("there should be no error:", err)
+	}
+	if n != 1 || len(handled) != 1 {
+		t.Error("there should be one delivered event:", n, len(handled))
+	}
+	if n, _ := s.DeliverDue(ctx); n != 0 {
+		t.Error("there should be no more due events:", n)
+	}
+}
+
+func TestSchedulerRetryIntegration(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integration test")
+	}
+
+	host := os.Getenv("POSTGRES_HOST")
+	if host == "" {
+		host = "localhost"
+	}
+	client, err := sqlx.Connect("postgres", "host="+host+
+		" port=5432 user=postgres password=postgres sslmode=disable")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	var mu sync.Mutex
+	var handled []eh.Event
+	handler := eh.EventHandlerFunc(func(ctx context.Context, e eh.Event) error {
+		if d, ok := e.Data().(*ehmocks.EventData); ok && d.Content == "poison" {
+			return errors.New("poison")
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		handled = append(handled, e)
+		return nil
+	})
+
+	s, err := NewScheduler(client, &Config{
+		TableName: "scheduled_events_retry",
+		BatchSize: 1,
+	}, handler)
+	if err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	ctx := context.Background()
+	client.MustExec("DROP TABLE IF EXISTS scheduled_events_retry")
+	if err := s.CreateTable(ctx); err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	defer client.MustExec("DROP TABLE scheduled_events_retry")
+
+	poison := eh.NewEvent(ehmocks.EventType, &ehmocks.EventData{Content: "poison"},
+		time.Now(), eh.ForAggregate(ehmocks.AggregateType, uuid.New(), 1))
+	id, err := s.Schedule(ctx, poison, time.Now().Add(-time.Minute))
+	if err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	event := eh.NewEvent(ehmocks.EventType, &ehmocks.EventData{Content: "ok"},
+		time.Now(), eh.ForAggregate(ehmocks.AggregateType, uuid.New(), 1))
+	if _, err := s.Schedule(ctx, event, time.Now().Add(-time.Second)); err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+
+	// The poison event fills the batch once, then is postponed.
+	if n, err := s.DeliverDue(ctx); err != nil || n != 0 {
+		t.Error("the poison event should not be delivered:", n, err)
+	}
+	var attempts int
+	var postponed bool
+	if err := client.QueryRowxContext(ctx,
+		"SELECT attempts, deliver_at > now() FROM scheduled_events_retry WHERE id = $1",
+		id).Scan(&attempts, &postponed); err != nil || attempts != 1 || !postponed {
+		t.Error("the poison event should be postponed:", attempts, postponed, err)
+	}
+	if n, err := s.DeliverDue(ctx); err != nil || n != 1 || len(handled) != 1 {
+		t.Error("the other event should be delivered:", n, len(handled), err)
+	}
+}
@@ -0,0 +1,352 @@
+package settings
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+)
+
+// ErrNoDBClient is when no database client is set.
+var ErrNoDBClient = errors.New("no database client")
+
+// ErrNoConnString is when no connection string is set for listening.
+var ErrNoConnString = errors.New("no connection string")
+
+// ErrInvalidConfig is when the table name or the channel is not a valid
+// identifier.
+var ErrInvalidConfig = errors.New("invalid settings config")
+
+// identifierRe matches the names that can be used unquoted in the DDL and the
+// notify trigger.
+var identifierRe = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// Config is the configuration of a Store.
+type Config struct {
+	// TableName is the table holding the settings, "eh_settings" by default.
+	// It names the notify trigger too, so it can't be schema qualified, use
+	// the search_path of the connection instead.
+	TableName string
+	// Channel is the NOTIFY channel used to signal changes, the table name
+	// by default.
+	Channel string
+	// ConnString is the connection string of the dedicated LISTEN
+	// connection, required by Start.
+	ConnString string
+}
+
+func (c *Config) provideDefaults() {
+	if c.TableName == "" {
+		c.TableName = "eh_settings"
+	}
+	if c.Channel == "" {
+		c.Channel = c.TableName
+	}
+}
+
+func (c *Config) validate() error {
+	if !identifierRe.MatchString(c.TableName) {
+		return fmt.Errorf("%w: table name %q", ErrInvalidConfig, c.TableName)
+	}
+	if !identifierRe.MatchString(c.Channel) {
+		return fmt.Errorf("%w: channel %q", ErrInvalidConfig, c.Channel)
+	}
+	return nil
+}
+
+// Store is a small key/value settings table for operational toggles, like
+// enabling a cache, a slow query threshold or batch sizes, that can be changed
+// at runtime without redeploys. Changes are signalled with NOTIFY by a trigger
+// on the table, and the values are cached in memory once started.
+//
+// Listening uses a pq.Listener connecting with Config.ConnString, so Start
+// requires the lib/pq driver to be available even if the client uses pgx.
+type Store struct {
+	client *sqlx.DB
+	config *Config
+
+	mu       sync.RWMutex
+	values   map[string]string
+	onChange []func(key string)
+	listener *pq.Listener
+	cancel   context.CancelFunc
+	done     chan struct{}
+	err      error
+}
+
+// NewStore creates a new Store.
+func NewStore(client *sqlx.DB, config *Config) (*Store, error) {
+	if client == nil {
+		return nil, ErrNoDBClient
+	}
+	config.provideDefaults()
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+
+	return &Store{
+		client: client,
+		config: config,
+		values: map[string]string{},
+	}, nil
+}
+
+// CreateTable creates the settings table and its notify trigger if they don't
+// exist.
+func (s *Store) CreateTable(ctx context.Context) error {
+	_, err := s.client.ExecContext(ctx, fmt.Sprintf(`
+	CREATE TABLE IF NOT EXISTS %[1]s (
+	    key text primary key,
+	    value text not null,
+	    updated_at timestamptz not null default now()
+	);
+	CREATE OR REPLACE FUNCTION %[1]s_notify() RETURNS trigger AS $$
+	BEGIN
+	    PERFORM pg_notify('%[2]s', COALESCE(NEW.key, OLD.key));
+	    RETURN NULL;
+	END;
+	$$ LANGUAGE plpgsql;
+	DROP TRIGGER IF EXISTS %[1]s_notify ON %[1]s;
+	CREATE TRIGGER %[1]s_notify AFTER INSERT OR UPDATE OR DELETE ON %[1]s
+	    FOR EACH ROW EXECUTE PROCEDURE %[1]s_notify();`,
+		s.config.TableName, s.config.Channel))
+	return err
+}
+
+// Set sets a setting.
+func (s *Store) Set(ctx context.Context, key, value string) error {
+	_, err := s.client.ExecContext(ctx, fmt.Sprintf(
+		"INSERT INTO %s (key, value) VALUES ($1, $2) "+
+			"ON CONFLICT (key) DO UPDATE SET value = EXCLUDED.value, updated_at = now()",
+		s.config.TableName), key, value)
+	return err
+}
+
+// Delete removes a setting, reverting it to its default.
+func (s *Store) Delete(ctx context.Context, key string) error {
+	_, err := s.client.ExecContext(ctx, fmt.Sprintf(
+		"DELETE FROM %s WHERE key = $1", s.config.TableName), key)
+	return err
+}
+
+// Start loads the settings and keeps them up to date by listening for changes
+// until the context is cancelled or Close is called.
+func (s *Store) Start(ctx context.Context) error {
+	if s.config.ConnString == "" {
+		return ErrNoConnString
+	}
+
+	listener := pq.NewListener(s.config.ConnString, time.Second, time.Minute,
+		func(ev pq.ListenerEventType, err error) {
+			if err != nil {
+				log.Printf("eh-pg: settings listener: %v", err)
+			}
+		})
+	if err := listener.Listen(s.config.Channel); err != nil {
+		listener.Close()
+		return err
+	}
+	if err := s.reload(ctx); err != nil {
+		listener.Close()
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	s.mu.Lock()
+	s.listener = listener
+	s.cancel = cancel
+	s.done = make(chan struct{})
+	s.mu.Unlock()
+
+	go s.listen(ctx, listener)
+
+	return nil
+}
+
+func (s *Store) listen(ctx context.Context, listener *pq.Listener) {
+	defer close(s.done)
+	defer listener.Close()
+
+	for {
+		select {
+		case <-ctx.Done():
+			s.mu.Lock()
+			s.err = ctx.Err()
+			s.mu.Unlock()
+			return
+		case n := <-listener.Notify:
+			// A nil notification is sent after a reconnect, changes may
+			// have been missed.
+			if n == nil {
+				if err := s.reload(ctx); err != nil && ctx.Err() == nil {
+					log.Printf("eh-pg: could not reload settings: %v", err)
+				}
+				continue
+			}
+			if err := s.refresh(ctx, n.Extra); err != nil && ctx.Err() == nil {
+				log.Printf("eh-pg: could not refresh setting %s: %v", n.Extra, err)
+			}
+		}
+	}
+}
+
+// reload loads all settings.
+func (s *Store) reload(ctx context.Context) error {
+	var rows []struct {
+		Key   string `db:"key"`
+		Value string `db:"value"`
+	}
+	if err := s.client.SelectContext(ctx, &rows, fmt.Sprintf(
+		"SELECT key, value FROM %s", s.config.TableName)); err != nil {
+		return err
+	}
+
+	values := make(map[string]string, len(rows))
+	for _, row := range rows {
+		values[row.Key] = row.Value
+	}
+
+	s.mu.Lock()
+	var changed []string
+	for k, v := range values {
+		if old, ok := s.values[k]; !ok || old != v {
+			changed = append(changed, k)
+		}
+	}
+	for k := range s.values {
+		if _, ok := values[k]; !ok {
+			changed = append(changed, k)
+		}
+	}
+	s.values = values
+	s.mu.Unlock()
+
+	for _, k := range changed {
+		s.notify(k)
+	}
+	return nil
+}
+
+// refresh loads one setting.
+func (s *Store) refresh(ctx context.Context, key string) error {
+	var value string
+	err := s.client.GetContext(ctx, &value, fmt.Sprintf(
+		"SELECT value FROM %s WHERE key = $1", s.config.TableName), key)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+
+	s.mu.Lock()
+	if errors.Is(err, sql.ErrNoRows) {
+		delete(s.values, key)
+	} else {
+		s.values[key] = value
+	}
+	s.mu.Unlock()
+
+	s.notify(key)
+	return nil
+}
+
+func (s *Store) notify(key string) {
+	s.mu.RLock()
+	onChange := s.onChange
+	s.mu.RUnlock()
+
+	for _, f := range onChange {
+		f(key)
+	}
+}
+
+// OnChange registers a function called with the key of each changed setting.
+func (s *Store) OnChange(f func(key string)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.onChange = append(s.onChange, f)
+}
+
+// Close stops listening for changes.
+func (s *Store) Close() {
+	s.mu.RLock()
+	cancel, done := s.cancel, s.done
+	s.mu.RUnlock()
+
+	if cancel != nil {
+		cancel()
+		<-done
+	}
+}
+
+// Done returns a channel that is closed when the Store has stopped listening
+// for changes, or nil if it has not been started.
+func (s *Store) Done() <-chan struct{} {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.done
+}
+
+// Err returns why the Store stopped listening for changes, nil if it is still
+// listening. It is context.Canceled after Close.
+func (s *Store) Err() error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.done == nil {
+		return nil
+	}
+	select {
+	case <-s.done:
+		return s.err
+	default:
+		return nil
+	}
+}
+
+// String returns the cached value of a setting, or def if not set.
+func (s *Store) String(key, def string) string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if v, ok := s.values[key]; ok {
+		return v
+	}
+	return def
+}
+
+// Bool returns the cached value of a boolean setting, or def if not set or
+// not a boolean.
+func (s *Store) Bool(key string, def bool) bool {
+	b, err := strconv.ParseBool(s.String(key, ""))
+	if err != nil {
+		return def
+	}
+	return b
+}
+
+// Int returns the cached value of an integer setting, or def if not set or
+// not an integer.
+func (s *Store) Int(key string, def int) int {
+	n, err := strconv.Atoi(s.String(key, ""))
+	if err != nil {
+		return def
+	}
+	return n
+}
+
+// Duration returns the cached value of a duration setting, like "250ms", or
+// def if not set or not a duration.
+func (s *Store) Duration(key string, def time.Duration) time.Duration {
+	d, err := time.ParseDuration(s.String(key, ""))
+	if err != nil {
+		return def
+	}
+	return d
+}
@@ -0,0 +1,136 @@
+package settings
+
+import (
+	"context"
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	_ "github.com/lib/pq"
+)
+
+func TestStoreValues(t *testing.T) {
+	db, err := sqlx.Open("postgres", "")
+	if err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	s, err := NewStore(db, &Config{})
+	if err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	if s.config.TableName != "eh_settings" || s.config.Channel != "eh_settings" {
+		t.Error("the defaults should be set:", s.config)
+	}
+
+	s.values = map[string]string{
+		"cache":      "true",
+		"batch_size": "500",
+		"slow_query": "250ms",
+		"broken":     "yes please",
+	}
+	if !s.Bool("cache", false) || s.Bool("broken", false) {
+		t.Error("the bools should be correct")
+	}
+	if s.Int("batch_size", 100) != 500 || s.Int("missing", 100) != 100 {
+		t.Error("the ints should be correct")
+	}
+	if s.Duration("slow_query", time.Second) != 250*time.Millisecond ||
+		s.Duration("broken", time.Second) != time.Second {
+		t.Error("the durations should be correct")
+	}
+
+	if err := s.Start(context.Background()); !errors.Is(err, ErrNoConnString) {
+		t.Error("there should be a ErrNoConnString error:", err)
+	}
+	if _, err := NewStore(nil, &Config{}); !errors.Is(err, ErrNoDBClient) {
+		t.Error("there should be a ErrNoDBClient error:", err)
+	}
+
+	for _, c := range []*Config{
+		{TableName: "eh_settings; DROP TABLE models"},
+		{TableName: "app.eh_settings"},
+		{Channel: "changes', 'x'); --"},
+	} {
+		if _, err := NewStore(db, c); !errors.Is(err, ErrInvalidConfig) {
+			t.Error("there should be a ErrInvalidConfig error:", c, err)
+		}
+	}
+}
+
+func TestStoreIntegration(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integration test")
+	}
+
+	host := os.Getenv("POSTGRES_HOST")
+	if host == "" {
+		host = "localhost"
+	}
+	connString := "host=" + host + " port=5432 user=postgres password=postgres sslmode=disable"
+	client, err := sqlx.Connect("postgres", connString)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	ctx := context.Background()
+	s, err := NewStore(client, &Config{TableName: "settings_test", ConnString: connString})
+	if err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	client.MustExecContext(ctx, "DROP TABLE IF EXISTS settings_test")
+	if err := s.CreateTable(ctx); err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	if err := s.Set(ctx, "batch_size", "10"); err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	if err := s.Start(ctx); err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	defer s.Close()
+	if s.Int("batch_size", 0) != 10 {
+		t.Error("the setting should be loaded")
+	}
+
+	changed := make(chan string, 10)
+	s.OnChange(func(key string) { changed <- key })
+	if err := s.Set(ctx, "batch_size", "20"); err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	select {
+	case key := <-changed:
+		if key != "batch_size" || s.Int("batch_size", 0) != 20 {
+			t.Error("the setting should be updated:", key)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the change should be notified")
+	}
+
+	if err := s.Delete(ctx, "batch_size"); err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	select {
+	case <-changed:
+		if s.Int("batch_size", 0) != 0 {
+			t.Error("the setting should be removed")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the change should be notified")
+	}
+
+	if err := s.Err(); err != nil {
+		t.Error("there should be no error while listening:", err)
+	}
+	s.Close()
+	select {
+	case <-s.Done():
+	default:
+		t.Error("the store should be done")
+	}
+	if err := s.Err(); !errors.Is(err, context.Canceled) {
+		t.Error("there should be a context.Canceled error:", err)
+	}
+}
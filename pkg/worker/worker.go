@@ -0,0 +1,89 @@
+package worker
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// Worker runs a function periodically in the background until its root
+// context is cancelled or it is stopped.
+type Worker struct {
+	name   string
+	cancel context.CancelFunc
+	done   chan struct{}
+	errCh  chan error
+	err    error
+}
+
+// Start starts a worker calling run immediately and then every interval. Run
+// errors are sent on the Errors channel (and logged if nobody is receiving).
+// The context passed to run is cancelled when the root context is cancelled
+// or Stop is called.
+func Start(ctx context.Context, name string, interval time.Duration,
+	run func(context.Context) error) *Worker {
+	ctx, cancel := context.WithCancel(ctx)
+	w := &Worker{
+		name:   name,
+		cancel: cancel,
+		done:   make(chan struct{}),
+		errCh:  make(chan error, 20),
+	}
+
+	go func() {
+		defer close(w.done)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			if err := run(ctx); err != nil && ctx.Err() == nil {
+				w.report(err)
+			}
+
+			select {
+			case <-ctx.Done():
+				w.err = ctx.Err()
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+
+	return w
+}
+
+func (w *Worker) report(err error) {
+	select {
+	case w.errCh <- err:
+	default:
+		log.Printf("eh-pg: %s failed: %v", w.name, err)
+	}
+}
+
+// Done returns a channel that is closed when the worker has stopped.
+func (w *Worker) Done() <-chan struct{} {
+	return w.done
+}
+
+// Errors returns a channel where errors from the runs are sent.
+func (w *Worker) Errors() <-chan error {
+	return w.errCh
+}
+
+// Err returns why the worker stopped, nil if it is still running. It is
+// context.Canceled after Stop.
+func (w *Worker) Err() error {
+	select {
+	case <-w.done:
+		return w.err
+	default:
+		return nil
+	}
+}
+
+// Stop stops the worker and waits for the current run to return.
+func (w *Worker) Stop() {
+	w.cancel()
+	<-w.done
+}
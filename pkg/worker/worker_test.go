@@ -0,0 +1,60 @@
+package worker
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestWorker(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	runErr := errors.New("run error")
+	w := Start(ctx, "test", time.Millisecond, func(ctx context.Context) error {
+		return runErr
+	})
+
+	select {
+	case err := <-w.Errors():
+		if !errors.Is(err, runErr) {
+			t.Error("the error should be correct:", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("there should be an error")
+	}
+	if err := w.Err(); err != nil {
+		t.Error("there should be no error while running:", err)
+	}
+
+	// Cancelling the root context stops the worker.
+	cancel()
+	select {
+	case <-w.Done():
+	case <-time.After(time.Second):
+		t.Fatal("the worker should be stopped")
+	}
+	if err := w.Err(); !errors.Is(err, context.Canceled) {
+		t.Error("there should be a context.Canceled error:", err)
+	}
+
+	// Stopping a stopped worker returns.
+	w.Stop()
+}
+
+func TestWorkerStop(t *testing.T) {
+	w := Start(context.Background(), "test", time.Hour, func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	})
+
+	w.Stop()
+	if err := w.Err(); !errors.Is(err, context.Canceled) {
+		t.Error("there should be a context.Canceled error:", err)
+	}
+	select {
+	case err := <-w.Errors():
+		t.Error("cancellation should not be reported as an error:", err)
+	default:
+	}
+}